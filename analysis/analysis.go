@@ -0,0 +1,86 @@
+// Package analysis derives insights about training jobs from the GPU metric history,
+// such as stragglers, hung jobs and memory leaks.
+package analysis
+
+import (
+	"time"
+
+	"github.com/xieydd/gpu-metric/utils"
+	"github.com/xieydd/gpu-metric/workload"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const METRIC_DUTY_CYCLE = "nvidia_gpu_duty_cycle"
+const METRIC_MEMORY_USED = "nvidia_gpu_memory_used_bytes"
+const METRIC_MEMORY_TOTAL = "nvidia_gpu_memory_total_bytes"
+
+// the most samples per series of the history of a job, the step of long histories is raised to stay below it
+const HISTORY_MAX_SAMPLES = 720
+
+// GpuKey identifies a GPU of a pod
+type GpuKey struct {
+	Pod string
+	Id  string
+}
+
+// workloadRange returns the GPU metric series of the running pods of w over the window before end
+func workloadRange(client kubernetes.Interface, w workload.Workload, end time.Time, window time.Duration, step time.Duration) ([]utils.GpuMetricSeries, error) {
+	pods := utils.RunningPods(w.AllPods())
+	if len(pods) == 0 {
+		return []utils.GpuMetricSeries{}, nil
+	}
+	prometheusServiceName, err := utils.RequirePrometheusServiceName(client)
+	if err != nil {
+		return nil, err
+	}
+	return utils.GetNamespacedPodsGpuRange(client, prometheusServiceName, pods, end.Add(-window), end, step)
+}
+
+// jobStart returns the earliest start time of the running pods
+func jobStart(pods []v1.Pod) (time.Time, bool) {
+	var start time.Time
+	for _, pod := range pods {
+		if pod.Status.Phase != v1.PodRunning || pod.Status.StartTime == nil {
+			continue
+		}
+		if start.IsZero() || pod.Status.StartTime.Time.Before(start) {
+			start = pod.Status.StartTime.Time
+		}
+	}
+	return start, !start.IsZero()
+}
+
+// jobHistory returns the GPU metric series of the running pods of w since they started, looking back
+// at most window, and the window of the series. The step is raised for long histories.
+func jobHistory(client kubernetes.Interface, w workload.Workload, window time.Duration, step time.Duration) ([]utils.GpuMetricSeries, time.Duration, error) {
+	now := time.Now()
+	if start, ok := jobStart(w.AllPods()); ok && now.Sub(start) < window {
+		window = now.Sub(start).Round(time.Second)
+	}
+	if s := window / HISTORY_MAX_SAMPLES; s > step {
+		step = s.Round(time.Second)
+	}
+	series, err := workloadRange(client, w, now, window, step)
+	return series, window, err
+}
+
+// seriesOf returns the series of metric by GPU
+func seriesOf(series []utils.GpuMetricSeries, metric string) map[GpuKey]utils.GpuMetricSeries {
+	result := map[GpuKey]utils.GpuMetricSeries{}
+	for _, s := range series {
+		if s.MetricName == metric {
+			result[GpuKey{Pod: s.PodName, Id: s.Id}] = s
+		}
+	}
+	return result
+}
+
+// podsByName indexes pods by name
+func podsByName(pods []v1.Pod) map[string]v1.Pod {
+	result := map[string]v1.Pod{}
+	for _, pod := range pods {
+		result[pod.Name] = pod
+	}
+	return result
+}
@@ -0,0 +1,344 @@
+package analysis
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xieydd/gpu-metric/utils"
+	"github.com/xieydd/gpu-metric/workload"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	BOTTLENECK_GPU     = "GPU-bound"
+	BOTTLENECK_CPU     = "CPU/input-bound"
+	BOTTLENECK_IO      = "IO-bound"
+	BOTTLENECK_NETWORK = "network-bound"
+	// the GPUs are not busy while no other resource is saturated, such as when the job waits on locks or other jobs
+	BOTTLENECK_UNKNOWN = "unknown"
+)
+
+const DEFAULT_BOTTLENECK_WINDOW = 10 * time.Minute
+
+// the mean duty cycle from which the GPUs of a pod are its bottleneck
+const DEFAULT_BOTTLENECK_GPU_DUTY_CYCLE = 70.0
+
+// the CPU usage, as a fraction of the CPU limit, of a saturated pod
+const DEFAULT_BOTTLENECK_CPU_SATURATION = 0.9
+
+// the fraction of the CFS periods throttled of a saturated pod
+const DEFAULT_BOTTLENECK_CPU_THROTTLED = 0.25
+
+// the fraction of time spent doing IO of a saturated pod, cAdvisor only reports it for block devices
+const DEFAULT_BOTTLENECK_IO_BUSY = 0.8
+
+// the filesystem throughput of a saturated pod in bytes per second
+const DEFAULT_BOTTLENECK_IO_THROUGHPUT = 200 * 1024 * 1024
+
+// the bandwidth of the network of the nodes in bytes per second, 10Gbit/s
+const DEFAULT_BOTTLENECK_NETWORK_BANDWIDTH = 10 * 1000 * 1000 * 1000 / 8
+
+// the network throughput, as a fraction of the bandwidth, of a saturated pod
+const DEFAULT_BOTTLENECK_NETWORK_UTILIZATION = 0.7
+
+// the cAdvisor metrics joined with the GPU metrics
+const (
+	METRIC_CPU_USAGE        = "container_cpu_usage_seconds_total"
+	METRIC_CPU_PERIODS      = "container_cpu_cfs_periods_total"
+	METRIC_CPU_THROTTLED    = "container_cpu_cfs_throttled_periods_total"
+	METRIC_FS_READS         = "container_fs_reads_bytes_total"
+	METRIC_FS_WRITES        = "container_fs_writes_bytes_total"
+	METRIC_FS_IO_TIME       = "container_fs_io_time_seconds_total"
+	METRIC_NETWORK_RECEIVE  = "container_network_receive_bytes_total"
+	METRIC_NETWORK_TRANSMIT = "container_network_transmit_bytes_total"
+)
+
+// BottleneckOptions of the bottleneck classifier
+type BottleneckOptions struct {
+	Window             time.Duration
+	GPUDutyCycle       float64
+	CPUSaturation      float64
+	CPUThrottled       float64
+	IOBusy             float64
+	IOThroughput       float64
+	NetworkBandwidth   float64
+	NetworkUtilization float64
+}
+
+func DefaultBottleneckOptions() BottleneckOptions {
+	return BottleneckOptions{
+		Window:             DEFAULT_BOTTLENECK_WINDOW,
+		GPUDutyCycle:       DEFAULT_BOTTLENECK_GPU_DUTY_CYCLE,
+		CPUSaturation:      DEFAULT_BOTTLENECK_CPU_SATURATION,
+		CPUThrottled:       DEFAULT_BOTTLENECK_CPU_THROTTLED,
+		IOBusy:             DEFAULT_BOTTLENECK_IO_BUSY,
+		IOThroughput:       DEFAULT_BOTTLENECK_IO_THROUGHPUT,
+		NetworkBandwidth:   DEFAULT_BOTTLENECK_NETWORK_BANDWIDTH,
+		NetworkUtilization: DEFAULT_BOTTLENECK_NETWORK_UTILIZATION,
+	}
+}
+
+// PodResources is the mean usage of the resources of a pod over the window.
+// The rates are per second, a nil field was not reported by cAdvisor.
+type PodResources struct {
+	DutyCycle float64 `json:"dutyCycle"`
+	// CPUUsage in cores, CPULimit is the sum of the limits of the containers, 0 if any is unlimited
+	CPUUsage        *float64 `json:"cpuUsage,omitempty"`
+	CPULimit        float64  `json:"cpuLimit,omitempty"`
+	CPUThrottled    *float64 `json:"cpuThrottled,omitempty"`
+	FsReadBytes     *float64 `json:"fsReadBytes,omitempty"`
+	FsWriteBytes    *float64 `json:"fsWriteBytes,omitempty"`
+	FsIOBusy        *float64 `json:"fsIOBusy,omitempty"`
+	NetworkReceive  *float64 `json:"networkReceiveBytes,omitempty"`
+	NetworkTransmit *float64 `json:"networkTransmitBytes,omitempty"`
+}
+
+// PodBottleneck is the resource limiting a pod and the evidence of the classification
+type PodBottleneck struct {
+	Role       string       `json:"role"`
+	Pod        string       `json:"pod"`
+	Node       string       `json:"node,omitempty"`
+	Bottleneck string       `json:"bottleneck"`
+	Evidence   []string     `json:"evidence"`
+	Resources  PodResources `json:"resources"`
+}
+
+// BottleneckReport classifies the pods of a job using GPUs
+type BottleneckReport struct {
+	Window string          `json:"window"`
+	Pods   []PodBottleneck `json:"pods"`
+}
+
+func mib(bytes float64) string {
+	return fmt.Sprintf("%.1fMiB/s", bytes/1024/1024)
+}
+
+func sumOf(values ...*float64) *float64 {
+	var sum *float64
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		if sum == nil {
+			sum = new(float64)
+		}
+		*sum += *v
+	}
+	return sum
+}
+
+// saturation is how close a resource is to its saturation threshold, 1 at the threshold
+type saturation struct {
+	bottleneck string
+	ratio      float64
+	evidence   string
+}
+
+// ClassifyBottleneck returns the bottleneck of a pod from the mean usage of its resources and the
+// evidence which led to it. The GPUs are the bottleneck if they are busy, otherwise the most saturated
+// of the CPU, the filesystem and the network starves them.
+func ClassifyBottleneck(r PodResources, o BottleneckOptions) (string, []string) {
+	if r.DutyCycle >= o.GPUDutyCycle {
+		return BOTTLENECK_GPU, []string{fmt.Sprintf("mean GPU duty cycle %.1f%% >= %.0f%%", r.DutyCycle, o.GPUDutyCycle)}
+	}
+	evidence := []string{fmt.Sprintf("mean GPU duty cycle %.1f%% < %.0f%%", r.DutyCycle, o.GPUDutyCycle)}
+	saturations := []saturation{}
+	if r.CPUUsage != nil && r.CPULimit > 0 {
+		ratio := *r.CPUUsage / r.CPULimit
+		saturations = append(saturations, saturation{BOTTLENECK_CPU, ratio / o.CPUSaturation,
+			fmt.Sprintf("CPU usage %.2f of %.2f cores limit (%.0f%%)", *r.CPUUsage, r.CPULimit, ratio*100)})
+	} else if r.CPUUsage != nil {
+		evidence = append(evidence, fmt.Sprintf("CPU usage %.2f cores without limit", *r.CPUUsage))
+	}
+	if r.CPUThrottled != nil {
+		saturations = append(saturations, saturation{BOTTLENECK_CPU, *r.CPUThrottled / o.CPUThrottled,
+			fmt.Sprintf("%.0f%% of the CPU periods throttled", *r.CPUThrottled*100)})
+	}
+	if r.FsIOBusy != nil {
+		saturations = append(saturations, saturation{BOTTLENECK_IO, *r.FsIOBusy / o.IOBusy,
+			fmt.Sprintf("filesystem busy %.0f%% of the time", *r.FsIOBusy*100)})
+	}
+	if fs := sumOf(r.FsReadBytes, r.FsWriteBytes); fs != nil {
+		saturations = append(saturations, saturation{BOTTLENECK_IO, *fs / o.IOThroughput,
+			fmt.Sprintf("filesystem throughput %s", mib(*fs))})
+	}
+	if network := sumOf(r.NetworkReceive, r.NetworkTransmit); network != nil {
+		ratio := *network / o.NetworkBandwidth
+		saturations = append(saturations, saturation{BOTTLENECK_NETWORK, ratio / o.NetworkUtilization,
+			fmt.Sprintf("network throughput %s, %.0f%% of %.1fGbit/s", mib(*network), ratio*100, o.NetworkBandwidth*8/1e9)})
+	}
+	sort.SliceStable(saturations, func(i, j int) bool { return saturations[i].ratio > saturations[j].ratio })
+	for _, s := range saturations {
+		evidence = append(evidence, s.evidence)
+	}
+	if len(saturations) == 0 || saturations[0].ratio < 1 {
+		return BOTTLENECK_UNKNOWN, append(evidence, "no resource is saturated")
+	}
+	return saturations[0].bottleneck, evidence
+}
+
+// cpuLimit returns the sum of the CPU limits of the containers of pod in cores, 0 if any is unlimited
+func cpuLimit(pod v1.Pod) float64 {
+	limit := 0.0
+	for _, container := range pod.Spec.Containers {
+		quantity, ok := container.Resources.Limits[v1.ResourceCPU]
+		if !ok || quantity.IsZero() {
+			return 0
+		}
+		limit += float64(quantity.MilliValue()) / 1000
+	}
+	return limit
+}
+
+// bottleneckQueries builds the queries of the mean usage of the pods over the window. cAdvisor labels the
+// containers with pod and container since Kubernetes 1.16, and with pod_name and container_name before.
+type bottleneckQueries struct {
+	namespace string
+	pods      string
+	window    string
+}
+
+// containers returns the per pod sum of the rate of metric of the containers, without the pause container
+func (q bottleneckQueries) containers(metric string) string {
+	return fmt.Sprintf(`sum by (pod, pod_name) (rate(%s{namespace=%q, pod=~%q, container!="", container!="POD"}[%s]) or `+
+		`rate(%s{namespace=%q, pod_name=~%q, container_name!="", container_name!="POD"}[%s]))`,
+		metric, q.namespace, q.pods, q.window, metric, q.namespace, q.pods, q.window)
+}
+
+// network returns the per pod rate of metric of all the interfaces, which cAdvisor reports for the
+// pause container or the pod cgroup, so only the cgroup with the most traffic is counted
+func (q bottleneckQueries) network(metric string) string {
+	return fmt.Sprintf(`max by (pod, pod_name) (sum by (pod, pod_name, id) (rate(%s{namespace=%q, pod=~%q}[%s]) or `+
+		`rate(%s{namespace=%q, pod_name=~%q}[%s])))`,
+		metric, q.namespace, q.pods, q.window, metric, q.namespace, q.pods, q.window)
+}
+
+func (q bottleneckQueries) dutyCycle() string {
+	return fmt.Sprintf(`avg by (pod_name) (avg_over_time(%s{namespace_name=%q, pod_name=~%q}[%s]))`,
+		METRIC_DUTY_CYCLE, q.namespace, q.pods, q.window)
+}
+
+// podValues runs query and returns its values by pod
+func podValues(client kubernetes.Interface, prometheusServiceName string, query string) (map[string]float64, error) {
+	results, err := utils.QueryPrometheus(client, prometheusServiceName, query)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]float64{}
+	for _, result := range results {
+		pod := result.Metric["pod"]
+		if pod == "" {
+			pod = result.Metric["pod_name"]
+		}
+		if v, ok := utils.SampleValue(result); ok && pod != "" {
+			values[pod] = v
+		}
+	}
+	return values, nil
+}
+
+// GetPodsResources returns the mean usage of the resources of the pods of a namespace over the window
+func GetPodsResources(client kubernetes.Interface, prometheusServiceName string, namespace string, pods []v1.Pod, window time.Duration) (map[string]PodResources, error) {
+	names := []string{}
+	for _, pod := range pods {
+		names = append(names, regexp.QuoteMeta(pod.Name))
+	}
+	q := bottleneckQueries{namespace: namespace, pods: strings.Join(names, "|"), window: fmt.Sprintf("%ds", int64(window/time.Second))}
+	queries := map[string]string{
+		METRIC_DUTY_CYCLE:       q.dutyCycle(),
+		METRIC_CPU_USAGE:        q.containers(METRIC_CPU_USAGE),
+		METRIC_CPU_THROTTLED:    q.containers(METRIC_CPU_THROTTLED) + " / " + q.containers(METRIC_CPU_PERIODS),
+		METRIC_FS_READS:         q.containers(METRIC_FS_READS),
+		METRIC_FS_WRITES:        q.containers(METRIC_FS_WRITES),
+		METRIC_FS_IO_TIME:       q.containers(METRIC_FS_IO_TIME),
+		METRIC_NETWORK_RECEIVE:  q.network(METRIC_NETWORK_RECEIVE),
+		METRIC_NETWORK_TRANSMIT: q.network(METRIC_NETWORK_TRANSMIT),
+	}
+	values := map[string]map[string]float64{}
+	for metric, query := range queries {
+		v, err := podValues(client, prometheusServiceName, query)
+		if err != nil {
+			return nil, err
+		}
+		values[metric] = v
+	}
+	valueOf := func(metric string, pod string) *float64 {
+		if v, ok := values[metric][pod]; ok {
+			return &v
+		}
+		return nil
+	}
+
+	result := map[string]PodResources{}
+	for _, pod := range pods {
+		result[pod.Name] = PodResources{
+			DutyCycle:       values[METRIC_DUTY_CYCLE][pod.Name],
+			CPUUsage:        valueOf(METRIC_CPU_USAGE, pod.Name),
+			CPULimit:        cpuLimit(pod),
+			CPUThrottled:    valueOf(METRIC_CPU_THROTTLED, pod.Name),
+			FsReadBytes:     valueOf(METRIC_FS_READS, pod.Name),
+			FsWriteBytes:    valueOf(METRIC_FS_WRITES, pod.Name),
+			FsIOBusy:        valueOf(METRIC_FS_IO_TIME, pod.Name),
+			NetworkReceive:  valueOf(METRIC_NETWORK_RECEIVE, pod.Name),
+			NetworkTransmit: valueOf(METRIC_NETWORK_TRANSMIT, pod.Name),
+		}
+	}
+	return result, nil
+}
+
+// ClassifyBottlenecks classifies the pods of a job by the mean usage of their resources
+func ClassifyBottlenecks(pods []v1.Pod, resources map[string]PodResources, o BottleneckOptions) *BottleneckReport {
+	report := &BottleneckReport{Window: o.Window.String(), Pods: []PodBottleneck{}}
+	for _, pod := range pods {
+		r, ok := resources[pod.Name]
+		if !ok {
+			continue
+		}
+		role, _ := workload.ReplicaOf(pod)
+		if role == "" {
+			role = "Pod"
+		}
+		bottleneck, evidence := ClassifyBottleneck(r, o)
+		report.Pods = append(report.Pods, PodBottleneck{
+			Role:       role,
+			Pod:        pod.Name,
+			Node:       pod.Spec.NodeName,
+			Bottleneck: bottleneck,
+			Evidence:   evidence,
+			Resources:  r,
+		})
+	}
+	sort.SliceStable(report.Pods, func(i, j int) bool {
+		if report.Pods[i].Role != report.Pods[j].Role {
+			return workload.ReplicaTypeLess(report.Pods[i].Role, report.Pods[j].Role)
+		}
+		return report.Pods[i].Pod < report.Pods[j].Pod
+	})
+	return report
+}
+
+// GetWorkloadBottlenecks classifies the running pods of w requesting GPUs over the window before now
+func GetWorkloadBottlenecks(client kubernetes.Interface, w workload.Workload, o BottleneckOptions) (*BottleneckReport, error) {
+	pods := []v1.Pod{}
+	for _, pod := range w.AllPods() {
+		if pod.Status.Phase == v1.PodRunning && utils.GpuInPod(pod) > 0 {
+			pods = append(pods, pod)
+		}
+	}
+	if len(pods) == 0 {
+		return &BottleneckReport{Window: o.Window.String(), Pods: []PodBottleneck{}}, nil
+	}
+	prometheusServiceName, err := utils.RequirePrometheusServiceName(client)
+	if err != nil {
+		return nil, err
+	}
+	resources, err := GetPodsResources(client, prometheusServiceName, w.Namespace(), pods, o.Window)
+	if err != nil {
+		return nil, err
+	}
+	return ClassifyBottlenecks(pods, resources, o), nil
+}
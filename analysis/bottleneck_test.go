@@ -0,0 +1,111 @@
+package analysis
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/xieydd/gpu-metric/utils"
+	"github.com/xieydd/gpu-metric/workload"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func value(v float64) *float64 {
+	return &v
+}
+
+func TestClassifyBottleneck(t *testing.T) {
+	cases := []struct {
+		name       string
+		resources  PodResources
+		bottleneck string
+		evidence   string
+	}{
+		{"busy GPUs", PodResources{DutyCycle: 95, CPUUsage: value(7.9), CPULimit: 8}, BOTTLENECK_GPU, "mean GPU duty cycle 95.0% >= 70%"},
+		{"data loading at the CPU limit", PodResources{DutyCycle: 35, CPUUsage: value(7.8), CPULimit: 8, CPUThrottled: value(0.1),
+			NetworkReceive: value(10 * MiB)}, BOTTLENECK_CPU, "CPU usage 7.80 of 8.00 cores limit (98%)"},
+		{"throttled CPU", PodResources{DutyCycle: 35, CPUUsage: value(3), CPULimit: 8, CPUThrottled: value(0.6)}, BOTTLENECK_CPU,
+			"60% of the CPU periods throttled"},
+		{"reading the dataset", PodResources{DutyCycle: 20, CPUUsage: value(2), CPULimit: 8, FsReadBytes: value(380 * MiB),
+			FsWriteBytes: value(1 * MiB)}, BOTTLENECK_IO, "filesystem throughput 381.0MiB/s"},
+		{"busy disk", PodResources{DutyCycle: 20, CPUUsage: value(1), FsIOBusy: value(0.95), FsReadBytes: value(30 * MiB)}, BOTTLENECK_IO,
+			"filesystem busy 95% of the time"},
+		{"PS traffic", PodResources{DutyCycle: 40, CPUUsage: value(2), NetworkReceive: value(700e6), NetworkTransmit: value(300e6)},
+			BOTTLENECK_NETWORK, "network throughput 953.7MiB/s, 80% of 10.0Gbit/s"},
+		{"nothing saturated", PodResources{DutyCycle: 10, CPUUsage: value(1), CPULimit: 8, NetworkReceive: value(1 * MiB)},
+			BOTTLENECK_UNKNOWN, "no resource is saturated"},
+		{"no cAdvisor metrics", PodResources{DutyCycle: 10}, BOTTLENECK_UNKNOWN, "no resource is saturated"},
+	}
+	for _, c := range cases {
+		bottleneck, evidence := ClassifyBottleneck(c.resources, DefaultBottleneckOptions())
+		if bottleneck != c.bottleneck {
+			t.Errorf("%s: expect %s, got %s because %v", c.name, c.bottleneck, bottleneck, evidence)
+		}
+		if !strings.Contains(strings.Join(evidence, "\n"), c.evidence) {
+			t.Errorf("%s: expect evidence %s, got %v", c.name, c.evidence, evidence)
+		}
+	}
+}
+
+func TestGetWorkloadBottlenecks(t *testing.T) {
+	// the duty cycle and the cAdvisor metrics of worker 0 labeled with pod, worker 1 with pod_name
+	responses := map[string]string{
+		METRIC_DUTY_CYCLE: `{"metric":{"pod_name":"job-worker-0"},"value":[1546300800,"92"]},` +
+			`{"metric":{"pod_name":"job-worker-1"},"value":[1546300800,"30"]}`,
+		METRIC_CPU_USAGE: `{"metric":{"pod":"job-worker-0"},"value":[1546300800,"3.5"]},` +
+			`{"metric":{"pod_name":"job-worker-1"},"value":[1546300800,"3.9"]}`,
+		METRIC_NETWORK_RECEIVE: `{"metric":{"pod":"job-worker-0"},"value":[1546300800,"1048576"]}`,
+	}
+	queries := []string{}
+	prometheus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		queries = append(queries, query)
+		result := ""
+		for metric, response := range responses {
+			if strings.Contains(query, metric+"{") {
+				result = response
+			}
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[%s]}}`, result)
+	}))
+	utils.PrometheusEndpoint = prometheus.URL + "/"
+	defer func() {
+		utils.PrometheusEndpoint = ""
+		prometheus.Close()
+	}()
+
+	pods := []v1.Pod{newWorkerPod("job-ps-0", "ps", 0, "cpu-node")}
+	for i := 0; i < 2; i++ {
+		pod := newWorkerPod(fmt.Sprintf("job-worker-%d", i), "worker", i, fmt.Sprintf("node%d", i))
+		pod.Spec.Containers = []v1.Container{{Name: "tensorflow", Resources: v1.ResourceRequirements{Limits: v1.ResourceList{
+			v1.ResourceCPU:                 resource.MustParse("4"),
+			utils.NVIDIA_GPU_RESOURCE_NAME: resource.MustParse("1"),
+		}}}}
+		pods = append(pods, pod)
+	}
+	w := workload.NewWorkload("TFJob", "job", "default", pods)
+	report, err := GetWorkloadBottlenecks(fake.NewSimpleClientset(), w, DefaultBottleneckOptions())
+	if err != nil {
+		t.Fatalf("failed to classify, %v", err)
+	}
+	if len(report.Pods) != 2 {
+		t.Fatalf("only the pods using GPUs should be classified, got %++v", report.Pods)
+	}
+	if report.Pods[0].Pod != "job-worker-0" || report.Pods[0].Bottleneck != BOTTLENECK_GPU {
+		t.Errorf("worker 0 should be GPU-bound, got %++v", report.Pods[0])
+	}
+	worker1 := report.Pods[1]
+	if worker1.Bottleneck != BOTTLENECK_CPU || worker1.Node != "node1" || worker1.Resources.CPULimit != 4 ||
+		worker1.Resources.NetworkReceive != nil || *worker1.Resources.CPUUsage != 3.9 {
+		t.Errorf("worker 1 should be CPU-bound, got %++v", worker1)
+	}
+	for _, query := range queries {
+		if !strings.Contains(query, `"job-worker-0|job-worker-1"`) || !strings.Contains(query, "[600s]") {
+			t.Errorf("unexpected query %s", query)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package analysis
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xieydd/gpu-metric/base"
+	"github.com/xieydd/gpu-metric/utils"
+	"github.com/xieydd/gpu-metric/workload"
+	v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// the power draw of the GPUs reported by the exporter, in milliwatts
+const METRIC_POWER_USAGE = "nvidia_gpu_power_usage_milliwatts"
+
+const DEFAULT_ENERGY_STEP = time.Minute
+
+// the power usage effectiveness of the data center, the energy of the facility per energy of the IT
+// equipment, about the average of the data centers
+const DEFAULT_PUE = 1.5
+
+// the carbon intensity of the electricity in grams of CO2 equivalent per kWh, about the world average
+const DEFAULT_CARBON_INTENSITY = 475.0
+
+// the job of the pods which no longer exist, their job can not be told
+const UNKNOWN_JOB = "<unknown>"
+
+// EnergyOptions of the energy accounting
+type EnergyOptions struct {
+	Step time.Duration
+	PUE  float64
+	// CarbonIntensity in gCO2e/kWh
+	CarbonIntensity float64
+}
+
+func DefaultEnergyOptions() EnergyOptions {
+	return EnergyOptions{
+		Step:            DEFAULT_ENERGY_STEP,
+		PUE:             DEFAULT_PUE,
+		CarbonIntensity: DEFAULT_CARBON_INTENSITY,
+	}
+}
+
+func (o EnergyOptions) Validate() error {
+	if o.PUE < 1 {
+		return fmt.Errorf("invalid PUE %v, must be at least 1", o.PUE)
+	}
+	if o.CarbonIntensity < 0 {
+		return fmt.Errorf("invalid carbon intensity %v, must not be negative", o.CarbonIntensity)
+	}
+	return nil
+}
+
+// Energy consumed by GPUs
+type Energy struct {
+	GPUHours     float64 `json:"gpuHours"`
+	GPUEnergyKWh float64 `json:"gpuEnergyKWh"`
+	// EnergyKWh is the energy of the facility, the energy of the GPUs by the PUE
+	EnergyKWh float64 `json:"energyKWh"`
+	CO2eKg    float64 `json:"co2eKg"`
+}
+
+func (e *Energy) add(other Energy) {
+	e.GPUHours += other.GPUHours
+	e.GPUEnergyKWh += other.GPUEnergyKWh
+	e.EnergyKWh += other.EnergyKWh
+	e.CO2eKg += other.CO2eKg
+}
+
+// PodEnergy is the energy of the GPUs of a pod
+type PodEnergy struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Job       string `json:"job"`
+	Node      string `json:"node,omitempty"`
+	GPUs      int    `json:"gpus"`
+	Energy
+}
+
+// JobEnergy is the energy of the GPUs of the pods of a job
+type JobEnergy struct {
+	Namespace string `json:"namespace"`
+	Job       string `json:"job"`
+	Pods      int    `json:"pods"`
+	Energy
+}
+
+// NamespaceEnergy is the energy of the GPUs of the pods of a namespace
+type NamespaceEnergy struct {
+	Namespace string `json:"namespace"`
+	Jobs      int    `json:"jobs"`
+	Pods      int    `json:"pods"`
+	Energy
+}
+
+// EnergyReport is the energy of the GPUs between start and end by pod, job and namespace
+type EnergyReport struct {
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	PUE             float64   `json:"pue"`
+	CarbonIntensity float64   `json:"carbonIntensity"`
+	// Available is false if the exporter does not report the power draw of the GPUs
+	Available  bool              `json:"available"`
+	Pods       []PodEnergy       `json:"pods"`
+	Jobs       []JobEnergy       `json:"jobs"`
+	Namespaces []NamespaceEnergy `json:"namespaces"`
+	Total      Energy            `json:"total"`
+}
+
+// energyOf integrates the series of the mean power draw of a GPU over each step. The power of a step is the
+// mean of the samples scraped during it, so a step is counted only if the GPU was scraped.
+func energyOf(s utils.GpuMetricSeries, step time.Duration, o EnergyOptions) Energy {
+	e := Energy{}
+	for _, sample := range s.Samples {
+		e.GPUHours += step.Hours()
+		// mW * h / 1000 / 1000 = kWh
+		e.GPUEnergyKWh += sample.Value * step.Hours() / 1e6
+	}
+	e.EnergyKWh = e.GPUEnergyKWh * o.PUE
+	e.CO2eKg = e.EnergyKWh * o.CarbonIntensity / 1000
+	return e
+}
+
+// NewEnergyReport integrates the mean power series of the GPUs by step between start and end, jobOf
+// returns the job of a pod
+func NewEnergyReport(series []utils.GpuMetricSeries, start time.Time, end time.Time, step time.Duration, jobOf func(namespace string, pod string) string, o EnergyOptions) *EnergyReport {
+	report := &EnergyReport{
+		Start:           start,
+		End:             end,
+		PUE:             o.PUE,
+		CarbonIntensity: o.CarbonIntensity,
+		Available:       len(series) > 0,
+		Pods:            []PodEnergy{},
+		Jobs:            []JobEnergy{},
+		Namespaces:      []NamespaceEnergy{},
+	}
+	pods := map[string]*PodEnergy{}
+	for _, s := range series {
+		if s.PodName == "" {
+			continue
+		}
+		key := s.PodNamespace + "/" + s.PodName
+		pod, ok := pods[key]
+		if !ok {
+			pod = &PodEnergy{Namespace: s.PodNamespace, Pod: s.PodName, Job: jobOf(s.PodNamespace, s.PodName), Node: s.NodeName}
+			pods[key] = pod
+		}
+		pod.GPUs++
+		pod.add(energyOf(s, step, o))
+	}
+
+	jobs := map[string]*JobEnergy{}
+	namespaces := map[string]*NamespaceEnergy{}
+	for _, pod := range pods {
+		report.Pods = append(report.Pods, *pod)
+		report.Total.add(pod.Energy)
+		key := pod.Namespace + "/" + pod.Job
+		job, ok := jobs[key]
+		if !ok {
+			job = &JobEnergy{Namespace: pod.Namespace, Job: pod.Job}
+			jobs[key] = job
+		}
+		job.Pods++
+		job.add(pod.Energy)
+		namespace, ok := namespaces[pod.Namespace]
+		if !ok {
+			namespace = &NamespaceEnergy{Namespace: pod.Namespace}
+			namespaces[pod.Namespace] = namespace
+		}
+		namespace.Pods++
+		namespace.add(pod.Energy)
+	}
+	for _, job := range jobs {
+		report.Jobs = append(report.Jobs, *job)
+		namespaces[job.Namespace].Jobs++
+	}
+	for _, namespace := range namespaces {
+		report.Namespaces = append(report.Namespaces, *namespace)
+	}
+	sort.Slice(report.Pods, func(i, j int) bool {
+		a, b := report.Pods[i], report.Pods[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Job != b.Job {
+			return a.Job < b.Job
+		}
+		return a.Pod < b.Pod
+	})
+	sort.Slice(report.Jobs, func(i, j int) bool {
+		if report.Jobs[i].Namespace != report.Jobs[j].Namespace {
+			return report.Jobs[i].Namespace < report.Jobs[j].Namespace
+		}
+		return report.Jobs[i].Job < report.Jobs[j].Job
+	})
+	sort.Slice(report.Namespaces, func(i, j int) bool { return report.Namespaces[i].Namespace < report.Namespaces[j].Namespace })
+	return report
+}
+
+// energyStep returns the step of a range, raised so that a series has at most HISTORY_MAX_SAMPLES samples
+func energyStep(start time.Time, end time.Time, step time.Duration) time.Duration {
+	if s := end.Sub(start) / HISTORY_MAX_SAMPLES; s > step {
+		step = s.Round(time.Minute)
+	}
+	return step
+}
+
+// powerRange returns the series of the mean power draw of the GPUs matching selector over each step
+func powerRange(client kubernetes.Interface, selector string, start time.Time, end time.Time, step time.Duration) ([]utils.GpuMetricSeries, error) {
+	prometheusServiceName, err := utils.RequirePrometheusServiceName(client)
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf("avg_over_time(%s{%s}[%ds])", METRIC_POWER_USAGE, selector, int64(step/time.Second))
+	// the first step ends a step after start, so that it covers the samples from start
+	return utils.QueryRangeMetricByPrometheus(client, prometheusServiceName, query, start.Add(step), end, step)
+}
+
+// jobOfPod returns the job of a pod: the release of an atlasctl job, or the top level controller
+func jobOfPod(resolver *workload.Resolver, pod *v1.Pod) (string, error) {
+	if release := pod.Labels[utils.JOB_RELEASE_LABEL]; release != "" {
+		return release, nil
+	}
+	chain, err := resolver.OwnerChain(pod)
+	if err != nil {
+		return "", err
+	}
+	if len(chain) == 0 {
+		return workload.KIND_POD + "/" + pod.Name, nil
+	}
+	top := chain[len(chain)-1]
+	return top.Kind + "/" + top.Name, nil
+}
+
+// GetNamespacesEnergy integrates the power of the GPUs of the pods of namespaces, or of all the
+// namespaces if none is given, between start and end
+func GetNamespacesEnergy(client kubernetes.Interface, namespaces []string, start time.Time, end time.Time, o EnergyOptions) (*EnergyReport, error) {
+	selector := `namespace_name!=""`
+	if len(namespaces) > 0 {
+		quoted := []string{}
+		for _, namespace := range namespaces {
+			quoted = append(quoted, regexp.QuoteMeta(namespace))
+		}
+		selector = fmt.Sprintf("namespace_name=~%q", strings.Join(quoted, "|"))
+	}
+	step := energyStep(start, end, o.Step)
+	series, err := powerRange(client, selector, start, end, step)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := map[string]string{}
+	listed := map[string]bool{}
+	resolver := workload.NewResolver(client)
+	for _, s := range series {
+		if s.PodName == "" || listed[s.PodNamespace] {
+			continue
+		}
+		listed[s.PodNamespace] = true
+		pods, err := base.ListAllPods(client, s.PodNamespace, meta_v1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for i := range pods {
+			job, err := jobOfPod(resolver, &pods[i])
+			if err != nil {
+				return nil, err
+			}
+			jobs[pods[i].Namespace+"/"+pods[i].Name] = job
+		}
+	}
+	jobOf := func(namespace string, pod string) string {
+		if job, ok := jobs[namespace+"/"+pod]; ok {
+			return job
+		}
+		return UNKNOWN_JOB
+	}
+	return NewEnergyReport(series, start, end, step, jobOf, o), nil
+}
+
+// lifetime returns when the first pod of w started and when the last one finished, now if any is not finished
+func lifetime(w workload.Workload, now time.Time) (time.Time, time.Time) {
+	var start, end time.Time
+	running := false
+	for _, pod := range w.AllPods() {
+		if pod.Status.StartTime != nil && (start.IsZero() || pod.Status.StartTime.Time.Before(start)) {
+			start = pod.Status.StartTime.Time
+		}
+		if pod.Status.Phase != v1.PodSucceeded && pod.Status.Phase != v1.PodFailed {
+			running = true
+			continue
+		}
+		for _, status := range pod.Status.ContainerStatuses {
+			if terminated := status.State.Terminated; terminated != nil && terminated.FinishedAt.Time.After(end) {
+				end = terminated.FinishedAt.Time
+			}
+		}
+	}
+	if running || end.IsZero() || end.After(now) {
+		end = now
+	}
+	if start.IsZero() || start.After(end) {
+		start = end
+	}
+	return start, end
+}
+
+// GetWorkloadEnergy integrates the power of the GPUs of the pods of w over its lifetime, from the start of its
+// first pod to the end of its last one
+func GetWorkloadEnergy(client kubernetes.Interface, w workload.Workload, o EnergyOptions) (*EnergyReport, error) {
+	start, end := lifetime(w, time.Now())
+	return GetWorkloadEnergyBetween(client, w, start, end, o)
+}
+
+// GetWorkloadEnergyBetween integrates the power of the GPUs of the pods of w between start and end
+func GetWorkloadEnergyBetween(client kubernetes.Interface, w workload.Workload, start time.Time, end time.Time, o EnergyOptions) (*EnergyReport, error) {
+	jobOf := func(namespace string, pod string) string { return w.Name() }
+	step := energyStep(start, end, o.Step)
+	names := []string{}
+	for _, pod := range w.AllPods() {
+		names = append(names, regexp.QuoteMeta(pod.Name))
+	}
+	if len(names) == 0 || end.Sub(start) < step {
+		return NewEnergyReport(nil, start, end, step, jobOf, o), nil
+	}
+	selector := fmt.Sprintf("namespace_name=%q, pod_name=~%q", w.Namespace(), strings.Join(names, "|"))
+	series, err := powerRange(client, selector, start, end, step)
+	if err != nil {
+		return nil, err
+	}
+	return NewEnergyReport(series, start, end, step, jobOf, o), nil
+}
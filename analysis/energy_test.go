@@ -0,0 +1,109 @@
+package analysis
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xieydd/gpu-metric/utils"
+	v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func near(a float64, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestNewEnergyReport(t *testing.T) {
+	// an hour of a 300W and a 100W GPU of worker 0, an hour of a 200W GPU of worker 1 and of another namespace
+	series := []utils.GpuMetricSeries{
+		newSeries(METRIC_POWER_USAGE, "job-worker-0", "node0", "0", repeat(300000, 60)...),
+		newSeries(METRIC_POWER_USAGE, "job-worker-0", "node0", "1", repeat(100000, 60)...),
+		newSeries(METRIC_POWER_USAGE, "job-worker-1", "node1", "0", repeat(200000, 60)...),
+	}
+	other := newSeries(METRIC_POWER_USAGE, "serving-0", "node1", "1", repeat(200000, 30)...)
+	other.PodNamespace = "serving"
+	series = append(series, other)
+	jobOf := func(namespace string, pod string) string {
+		if namespace == "serving" {
+			return "Deployment/serving"
+		}
+		return "job"
+	}
+	o := EnergyOptions{Step: time.Minute, PUE: 1.5, CarbonIntensity: 400}
+
+	report := NewEnergyReport(series, time.Unix(1546300800, 0), time.Unix(1546304400, 0), time.Minute, jobOf, o)
+	if !report.Available || len(report.Pods) != 3 || len(report.Jobs) != 2 || len(report.Namespaces) != 2 {
+		t.Fatalf("unexpected report %++v", report)
+	}
+	worker0 := report.Pods[0]
+	if worker0.Pod != "job-worker-0" || worker0.GPUs != 2 || !near(worker0.GPUHours, 2) || !near(worker0.GPUEnergyKWh, 0.4) ||
+		!near(worker0.EnergyKWh, 0.6) || !near(worker0.CO2eKg, 0.24) {
+		t.Errorf("unexpected energy of worker 0 %++v", worker0)
+	}
+	if job := report.Jobs[0]; job.Job != "job" || job.Pods != 2 || !near(job.GPUEnergyKWh, 0.6) || !near(job.CO2eKg, 0.36) {
+		t.Errorf("unexpected energy of the job %++v", job)
+	}
+	if namespace := report.Namespaces[1]; namespace.Namespace != "serving" || namespace.Jobs != 1 || !near(namespace.GPUEnergyKWh, 0.1) {
+		t.Errorf("unexpected energy of the serving namespace %++v", namespace)
+	}
+	if !near(report.Total.GPUHours, 3.5) || !near(report.Total.EnergyKWh, 1.05) || !near(report.Total.CO2eKg, 0.42) {
+		t.Errorf("unexpected total %++v", report.Total)
+	}
+
+	if empty := NewEnergyReport(nil, time.Unix(1546300800, 0), time.Unix(1546304400, 0), time.Minute, jobOf, o); empty.Available {
+		t.Errorf("report without power series should not be available, got %++v", empty)
+	}
+}
+
+func TestGetNamespacesEnergy(t *testing.T) {
+	queries := []string{}
+	prometheus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query().Get("query"))
+		result := ""
+		for i, pod := range []string{"job-worker-0", "serving-0", "deleted-0"} {
+			if i > 0 {
+				result += ","
+			}
+			result += fmt.Sprintf(`{"metric":{"__name__":"%s","namespace_name":"default","pod_name":"%s","uuid":"GPU-%d"},`+
+				`"values":[[1546300860,"250000"],[1546300920,"250000"]]}`, METRIC_POWER_USAGE, pod, i)
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":[%s]}}`, result)
+	}))
+	utils.PrometheusEndpoint = prometheus.URL + "/"
+	defer func() {
+		utils.PrometheusEndpoint = ""
+		prometheus.Close()
+	}()
+
+	worker := newWorkerPod("job-worker-0", "worker", 0, "node0")
+	worker.Labels[utils.JOB_RELEASE_LABEL] = "job"
+	controller := true
+	serving := v1.Pod{ObjectMeta: meta_v1.ObjectMeta{Name: "serving-0", Namespace: "default",
+		OwnerReferences: []meta_v1.OwnerReference{{Kind: "StatefulSet", Name: "serving", Controller: &controller}}}}
+	client := fake.NewSimpleClientset(&worker, &serving)
+
+	start := time.Unix(1546300800, 0)
+	report, err := GetNamespacesEnergy(client, []string{"default"}, start, start.Add(2*time.Minute), DefaultEnergyOptions())
+	if err != nil {
+		t.Fatalf("failed to get the energy, %v", err)
+	}
+	jobs := map[string]string{}
+	for _, pod := range report.Pods {
+		jobs[pod.Pod] = pod.Job
+	}
+	if jobs["job-worker-0"] != "job" || jobs["serving-0"] != "StatefulSet/serving" || jobs["deleted-0"] != UNKNOWN_JOB {
+		t.Errorf("unexpected jobs of the pods %v", jobs)
+	}
+	if len(report.Jobs) != 3 || !near(report.Total.GPUEnergyKWh, 0.025) {
+		t.Errorf("unexpected report %++v", report)
+	}
+	if len(queries) != 1 || !strings.Contains(queries[0], `namespace_name=~"default"`) || !strings.Contains(queries[0], "[60s]") {
+		t.Errorf("unexpected queries %v", queries)
+	}
+}
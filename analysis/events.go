@@ -0,0 +1,64 @@
+package analysis
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/xieydd/gpu-metric/base"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// the component of the events recorded by the analyses
+const EVENT_SOURCE_COMPONENT = "gpu-metric"
+
+// RecordPodEvent records an event on pod. The event is named after the pod, reason and message, so
+// recording the same finding again, such as on every refresh of top --watch, increments the count
+// of the existing event like the client-go recorder does instead of creating another one.
+func RecordPodEvent(client kubernetes.Interface, pod *v1.Pod, eventType string, reason string, message string) error {
+	now := meta_v1.NewTime(time.Now())
+	name := eventName(pod, reason, message)
+	event, err := client.CoreV1().Events(pod.Namespace).Get(name, meta_v1.GetOptions{})
+	if err == nil {
+		event.Count++
+		event.LastTimestamp = now
+		_, err = client.CoreV1().Events(pod.Namespace).Update(event)
+		return base.ToPermissionError(err, "update", "events", pod.Namespace)
+	}
+	if !errors.IsNotFound(err) {
+		return base.ToPermissionError(err, "get", "events", pod.Namespace)
+	}
+	event = &v1.Event{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:      name,
+			Namespace: pod.Namespace,
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind:            "Pod",
+			APIVersion:      "v1",
+			Namespace:       pod.Namespace,
+			Name:            pod.Name,
+			UID:             pod.UID,
+			ResourceVersion: pod.ResourceVersion,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         v1.EventSource{Component: EVENT_SOURCE_COMPONENT},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	_, err = client.CoreV1().Events(pod.Namespace).Create(event)
+	return base.ToPermissionError(err, "create", "events", pod.Namespace)
+}
+
+// eventName returns the name of the event of a finding on pod, the same for the same finding
+func eventName(pod *v1.Pod, reason string, message string) string {
+	h := fnv.New64a()
+	h.Write([]byte(string(pod.UID) + "/" + reason + "/" + message))
+	return fmt.Sprintf("%s.%x", pod.Name, h.Sum64())
+}
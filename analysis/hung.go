@@ -0,0 +1,259 @@
+package analysis
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xieydd/gpu-metric/base"
+	"github.com/xieydd/gpu-metric/utils"
+	"github.com/xieydd/gpu-metric/workload"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// the activity looked back at before the idle threshold, the history is analyzed since the job
+// started if it is longer, so that the activity before an idle period of any length is seen
+const DEFAULT_HUNG_WINDOW = 2 * time.Hour
+const DEFAULT_HUNG_STEP = time.Minute
+
+// how long the duty cycle of all the GPUs must have been flat before a job is hung
+const DEFAULT_HUNG_THRESHOLD = 30 * time.Minute
+
+// the duty cycle at or below which a GPU is idle, the exporter reports whole percents
+const DEFAULT_HUNG_IDLE_DUTY_CYCLE = 0.0
+
+// the duty cycle above which a GPU was active before it went idle
+const DEFAULT_HUNG_ACTIVE_DUTY_CYCLE = 10.0
+
+// the memory a GPU must hold while idle, more than the context of an idle CUDA process
+const DEFAULT_HUNG_MIN_MEMORY_USED = 1024 * 1024 * 1024
+
+const EVENT_REASON_HUNG = "GPUJobHung"
+
+// the label set on the pods of a hung job by LabelHungJob
+const HUNG_LABEL = "gpu-metric.io/hung"
+
+// HungOptions of the hung job analysis
+type HungOptions struct {
+	Window          time.Duration
+	Step            time.Duration
+	Threshold       time.Duration
+	IdleDutyCycle   float64
+	ActiveDutyCycle float64
+	MinMemoryUsed   float64
+}
+
+func DefaultHungOptions() HungOptions {
+	return HungOptions{
+		Window:          DEFAULT_HUNG_WINDOW,
+		Step:            DEFAULT_HUNG_STEP,
+		Threshold:       DEFAULT_HUNG_THRESHOLD,
+		IdleDutyCycle:   DEFAULT_HUNG_IDLE_DUTY_CYCLE,
+		ActiveDutyCycle: DEFAULT_HUNG_ACTIVE_DUTY_CYCLE,
+		MinMemoryUsed:   DEFAULT_HUNG_MIN_MEMORY_USED,
+	}
+}
+
+// IdleGpu is a GPU which holds memory while its duty cycle is flat
+type IdleGpu struct {
+	Pod        string    `json:"pod"`
+	Node       string    `json:"node,omitempty"`
+	GPU        string    `json:"gpu"`
+	MemoryUsed float64   `json:"memoryUsedBytes"`
+	IdleSince  time.Time `json:"idleSince"`
+}
+
+// HungReport tells whether a job is hung: all its GPUs have been idle for longer than the threshold
+// after a period of activity, while some of them still hold memory, as the processes of a job
+// deadlocked in a collective operation do.
+type HungReport struct {
+	Window string `json:"window"`
+	Hung   bool   `json:"hung"`
+	// Reason explains why the job is not hung
+	Reason string `json:"reason,omitempty"`
+	// Inconclusive is set if the history does not tell whether the job is hung,
+	// such as without metrics or without activity to compare with
+	Inconclusive bool       `json:"inconclusive,omitempty"`
+	IdleSince    *time.Time `json:"idleSince,omitempty"`
+	IdleFor      string     `json:"idleFor,omitempty"`
+	GPUs         []IdleGpu  `json:"gpus"`
+}
+
+// idleRun is the trailing run of idle samples of a GPU
+type idleRun struct {
+	start      float64
+	end        float64
+	wasActive  bool
+	memoryUsed float64
+}
+
+// trailingIdleRun returns the run of idle samples ending the duty series, with the least memory used
+// during the run. ok is false if the last sample is not idle.
+func trailingIdleRun(duty utils.GpuMetricSeries, memory utils.GpuMetricSeries, o HungOptions) (run idleRun, ok bool) {
+	samples := duty.Samples
+	if len(samples) == 0 || samples[len(samples)-1].Value > o.IdleDutyCycle {
+		return run, false
+	}
+	memoryAt := map[float64]float64{}
+	for _, s := range memory.Samples {
+		memoryAt[s.Time] = s.Value
+	}
+	run = idleRun{end: samples[len(samples)-1].Time, memoryUsed: -1}
+	i := len(samples) - 1
+	for ; i >= 0 && samples[i].Value <= o.IdleDutyCycle; i-- {
+		run.start = samples[i].Time
+		if used, ok := memoryAt[samples[i].Time]; ok && (run.memoryUsed < 0 || used < run.memoryUsed) {
+			run.memoryUsed = used
+		}
+	}
+	for ; i >= 0; i-- {
+		if samples[i].Value > o.ActiveDutyCycle {
+			run.wasActive = true
+			break
+		}
+	}
+	if run.memoryUsed < 0 {
+		run.memoryUsed = 0
+	}
+	return run, true
+}
+
+// DetectHung analyzes the duty cycle and memory series of the GPUs of a running job
+func DetectHung(pods []v1.Pod, series []utils.GpuMetricSeries, o HungOptions) *HungReport {
+	report := &HungReport{Window: o.Window.String(), GPUs: []IdleGpu{}}
+	byName := podsByName(pods)
+	duty := seriesOf(series, METRIC_DUTY_CYCLE)
+	memory := seriesOf(series, METRIC_MEMORY_USED)
+	if len(duty) == 0 {
+		report.Reason = "no duty cycle metrics of the GPUs"
+		report.Inconclusive = true
+		return report
+	}
+
+	keys := []GpuKey{}
+	for key := range duty {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Pod != keys[j].Pod {
+			return keys[i].Pod < keys[j].Pod
+		}
+		return keys[i].Id < keys[j].Id
+	})
+	var idleSince, end float64
+	wasActive := false
+	for _, key := range keys {
+		run, ok := trailingIdleRun(duty[key], memory[key], o)
+		if !ok {
+			report.Reason = fmt.Sprintf("GPU %s of %s is busy", key.Id, key.Pod)
+			report.GPUs = []IdleGpu{}
+			return report
+		}
+		if run.start > idleSince {
+			idleSince = run.start
+		}
+		if run.end > end {
+			end = run.end
+		}
+		wasActive = wasActive || run.wasActive
+		if run.memoryUsed >= o.MinMemoryUsed {
+			node := duty[key].NodeName
+			if pod, ok := byName[key.Pod]; ok && node == "" {
+				node = pod.Spec.NodeName
+			}
+			report.GPUs = append(report.GPUs, IdleGpu{
+				Pod:        key.Pod,
+				Node:       node,
+				GPU:        key.Id,
+				MemoryUsed: run.memoryUsed,
+				IdleSince:  unixTime(run.start),
+			})
+		}
+	}
+
+	since := unixTime(idleSince)
+	idleFor := time.Duration((end - idleSince) * float64(time.Second))
+	report.IdleSince = &since
+	report.IdleFor = idleFor.String()
+	switch {
+	case idleFor < o.Threshold:
+		report.Reason = fmt.Sprintf("the GPUs have been idle for %s, less than %s", idleFor, o.Threshold)
+	case !wasActive:
+		report.Reason = fmt.Sprintf("the GPUs have not been active during the last %s", o.Window)
+		report.Inconclusive = true
+	case len(report.GPUs) == 0:
+		report.Reason = "the idle GPUs do not hold memory"
+	default:
+		report.Hung = true
+	}
+	return report
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second))).UTC()
+}
+
+// GetWorkloadHung analyzes the GPUs of the running pods of w since they started, over at least
+// the threshold and the window before now. Only RUNNING workloads can be hung.
+func GetWorkloadHung(client kubernetes.Interface, w workload.Workload, o HungOptions) (*HungReport, error) {
+	if status := w.GetStatus(); status != workload.STATUS_RUNNING {
+		return &HungReport{Window: o.Window.String(), Reason: "the job is " + status, GPUs: []IdleGpu{}}, nil
+	}
+	window := o.Threshold + o.Window
+	if start, ok := jobStart(w.AllPods()); ok && time.Since(start) > window {
+		window = time.Since(start).Round(time.Second)
+	}
+	series, window, err := jobHistory(client, w, window, o.Step)
+	if err != nil {
+		return nil, err
+	}
+	o.Window = window
+	return DetectHung(w.AllPods(), series, o), nil
+}
+
+// RecordHungEvents records a warning event on the pods of the idle GPUs of a hung job, the message
+// does not change while the job stays hung so that it is counted by one event
+func RecordHungEvents(client kubernetes.Interface, w workload.Workload, report *HungReport) error {
+	if !report.Hung {
+		return nil
+	}
+	gpus := map[string][]string{}
+	for _, gpu := range report.GPUs {
+		gpus[gpu.Pod] = append(gpus[gpu.Pod], "GPU "+gpu.GPU)
+	}
+	for _, pod := range w.AllPods() {
+		if len(gpus[pod.Name]) == 0 {
+			continue
+		}
+		message := fmt.Sprintf("%s %s seems hung, the duty cycle of its GPUs is 0 after a period of activity while they hold memory: %s",
+			w.Kind(), w.Name(), strings.Join(gpus[pod.Name], ", "))
+		if err := RecordPodEvent(client, &pod, v1.EventTypeWarning, EVENT_REASON_HUNG, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LabelHungJob sets the HUNG_LABEL on the running pods of a hung job, and removes it
+// from the pods of a job which is no longer hung, but not if the report is inconclusive
+func LabelHungJob(client kubernetes.Interface, w workload.Workload, report *HungReport) error {
+	for _, pod := range w.AllPods() {
+		_, labeled := pod.Labels[HUNG_LABEL]
+		var patch string
+		switch {
+		case report.Hung && !labeled && pod.Status.Phase == v1.PodRunning:
+			patch = fmt.Sprintf(`{"metadata":{"labels":{%q:"true"}}}`, HUNG_LABEL)
+		case !report.Hung && !report.Inconclusive && labeled:
+			patch = fmt.Sprintf(`{"metadata":{"labels":{%q:null}}}`, HUNG_LABEL)
+		default:
+			continue
+		}
+		if _, err := client.CoreV1().Pods(pod.Namespace).Patch(pod.Name, types.MergePatchType, []byte(patch)); err != nil {
+			return base.ToPermissionError(err, "patch", "pods", pod.Namespace)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package analysis
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xieydd/gpu-metric/utils"
+	"github.com/xieydd/gpu-metric/workload"
+	v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const GiB = 1024 * 1024 * 1024
+
+// repeat returns n times value
+func repeat(value float64, n int) []float64 {
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = value
+	}
+	return values
+}
+
+// newHungJob returns 2 workers with 2 GPUs each, busy for active samples and then idle for idle samples
+// while holding 12GiB. The GPU 1 of worker 1 gets busy at the last sample if busy is set.
+func newHungJob(active int, idle int, busy bool) ([]v1.Pod, []utils.GpuMetricSeries) {
+	pods := []v1.Pod{}
+	series := []utils.GpuMetricSeries{}
+	for i := 0; i < 2; i++ {
+		name := fmt.Sprintf("job-worker-%d", i)
+		node := fmt.Sprintf("node%d", i)
+		pods = append(pods, newWorkerPod(name, "worker", i, node))
+		for gpu := 0; gpu < 2; gpu++ {
+			duty := append(repeat(90, active), repeat(0, idle)...)
+			if busy && i == 1 && gpu == 1 {
+				duty[len(duty)-1] = 35
+			}
+			id := fmt.Sprintf("%d", gpu)
+			series = append(series,
+				newSeries(METRIC_DUTY_CYCLE, name, node, id, duty...),
+				newSeries(METRIC_MEMORY_USED, name, node, id, repeat(12*GiB, active+idle)...))
+		}
+	}
+	return pods, series
+}
+
+func TestDetectHung(t *testing.T) {
+	// 20 minutes of activity followed by 40 minutes at 0%
+	pods, series := newHungJob(40, 80, false)
+	report := DetectHung(pods, series, DefaultHungOptions())
+	if !report.Hung {
+		t.Fatalf("job should be hung, got %++v", report)
+	}
+	if report.IdleFor != "39m30s" || report.IdleSince == nil || report.IdleSince.Unix() != 1546300800+40*30 {
+		t.Errorf("unexpected idle period %s since %v", report.IdleFor, report.IdleSince)
+	}
+	if len(report.GPUs) != 4 || report.GPUs[0].Pod != "job-worker-0" || report.GPUs[0].Node != "node0" || report.GPUs[0].MemoryUsed != 12*GiB {
+		t.Errorf("unexpected idle GPUs %++v", report.GPUs)
+	}
+}
+
+func TestDetectHungNotHung(t *testing.T) {
+	cases := []struct {
+		name   string
+		active int
+		idle   int
+		busy   bool
+		reason string
+	}{
+		{"idle shorter than the threshold", 40, 40, false, "less than 30m0s"},
+		{"one GPU busy", 40, 80, true, "GPU 1 of job-worker-1 is busy"},
+		{"never active", 0, 120, false, "have not been active"},
+	}
+	for _, c := range cases {
+		pods, series := newHungJob(c.active, c.idle, c.busy)
+		report := DetectHung(pods, series, DefaultHungOptions())
+		if report.Hung || !strings.Contains(report.Reason, c.reason) {
+			t.Errorf("%s: expect not hung because %s, got %++v", c.name, c.reason, report)
+		}
+	}
+}
+
+func TestDetectHungMemoryReleased(t *testing.T) {
+	pods, series := newHungJob(40, 80, false)
+	for i := range series {
+		if series[i].MetricName == METRIC_MEMORY_USED {
+			// the memory is released once the processes are idle
+			for j := 40; j < len(series[i].Samples); j++ {
+				series[i].Samples[j].Value = 300 * 1024 * 1024
+			}
+		}
+	}
+	report := DetectHung(pods, series, DefaultHungOptions())
+	if report.Hung || report.Reason != "the idle GPUs do not hold memory" {
+		t.Errorf("job without memory held should not be hung, got %++v", report)
+	}
+}
+
+func TestGetWorkloadHungNotRunning(t *testing.T) {
+	pods, _ := newHungJob(40, 80, false)
+	for i := range pods {
+		pods[i].Status.Phase = v1.PodSucceeded
+	}
+	w := workload.NewWorkload("TFJob", "job", "default", pods)
+	report, err := GetWorkloadHung(fake.NewSimpleClientset(), w, DefaultHungOptions())
+	if err != nil {
+		t.Fatalf("failed to analyze, %v", err)
+	}
+	if report.Hung || report.Reason != "the job is SUCCEEDED" {
+		t.Errorf("finished job should not be hung, got %++v", report)
+	}
+}
+
+func TestGetWorkloadHungSinceJobStart(t *testing.T) {
+	// the job started 5h ago, was busy for 30m and has been idle for 4h30m, longer than the window
+	started := time.Now().Add(-5 * time.Hour)
+	var start int64
+	prometheus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start, _ = strconv.ParseInt(r.URL.Query().Get("start"), 10, 64)
+		end, _ := strconv.ParseInt(r.URL.Query().Get("end"), 10, 64)
+		step, _ := strconv.ParseFloat(r.URL.Query().Get("step"), 64)
+		duty, memory := []string{}, []string{}
+		for t := start; t <= end; t += int64(step) {
+			value := 0
+			if t < started.Add(30*time.Minute).Unix() {
+				value = 90
+			}
+			duty = append(duty, fmt.Sprintf(`[%d,"%d"]`, t, value))
+			memory = append(memory, fmt.Sprintf(`[%d,"%d"]`, t, 12*GiB))
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":[`+
+			`{"metric":{"__name__":"%s","namespace_name":"default","pod_name":"job-worker-0","minor_number":"0"},"values":[%s]},`+
+			`{"metric":{"__name__":"%s","namespace_name":"default","pod_name":"job-worker-0","minor_number":"0"},"values":[%s]}]}}`,
+			METRIC_DUTY_CYCLE, strings.Join(duty, ","), METRIC_MEMORY_USED, strings.Join(memory, ","))
+	}))
+	utils.PrometheusEndpoint = prometheus.URL + "/"
+	defer func() {
+		utils.PrometheusEndpoint = ""
+		prometheus.Close()
+	}()
+
+	pod := newWorkerPod("job-worker-0", "worker", 0, "node0")
+	pod.Status.StartTime = &meta_v1.Time{Time: started}
+	w := workload.NewWorkload("TFJob", "job", "default", []v1.Pod{pod})
+	o := DefaultHungOptions()
+	o.Threshold = 3 * time.Hour
+	report, err := GetWorkloadHung(fake.NewSimpleClientset(), w, o)
+	if err != nil {
+		t.Fatalf("failed to analyze, %v", err)
+	}
+	if !report.Hung {
+		t.Errorf("job idle for longer than the window should be hung, got %++v", report)
+	}
+	if start > started.Unix()+60 {
+		t.Errorf("expect the history to start at the job start %d, got %d", started.Unix(), start)
+	}
+}
+
+func TestLabelHungJobInconclusive(t *testing.T) {
+	pods, series := newHungJob(0, 120, false)
+	for i := range pods {
+		pods[i].Labels[HUNG_LABEL] = "true"
+	}
+	client := fake.NewSimpleClientset(&pods[0], &pods[1])
+	w := workload.NewWorkload("TFJob", "job", "default", pods)
+	report := DetectHung(pods, series, DefaultHungOptions())
+	if report.Hung || !report.Inconclusive {
+		t.Fatalf("job without activity should be inconclusive, got %++v", report)
+	}
+	if err := LabelHungJob(client, w, report); err != nil {
+		t.Fatalf("failed to label the job, %v", err)
+	}
+	for _, pod := range pods {
+		labeled, _ := client.CoreV1().Pods("default").Get(pod.Name, meta_v1.GetOptions{})
+		if labeled.Labels[HUNG_LABEL] != "true" {
+			t.Errorf("expect the label of %s to be kept, got %v", pod.Name, labeled.Labels)
+		}
+	}
+
+	// the GPUs are busy again, the fake clientset does not apply null in merge patches
+	client.ClearActions()
+	_, series = newHungJob(40, 80, true)
+	report = DetectHung(pods, series, DefaultHungOptions())
+	if err := LabelHungJob(client, w, report); err != nil {
+		t.Fatalf("failed to label the job, %v", err)
+	}
+	actions := client.Actions()
+	if len(actions) != 2 {
+		t.Fatalf("expect the label of both pods to be removed, got %v", actions)
+	}
+	for _, action := range actions {
+		patch := string(action.(k8stesting.PatchAction).GetPatch())
+		if patch != fmt.Sprintf(`{"metadata":{"labels":{%q:null}}}`, HUNG_LABEL) {
+			t.Errorf("unexpected patch %s", patch)
+		}
+	}
+}
+
+func TestRecordAndLabelHungJob(t *testing.T) {
+	pods, series := newHungJob(40, 80, false)
+	client := fake.NewSimpleClientset(&pods[0], &pods[1])
+	w := workload.NewWorkload("TFJob", "job", "default", pods)
+	report := DetectHung(pods, series, DefaultHungOptions())
+	if err := RecordHungEvents(client, w, report); err != nil {
+		t.Fatalf("failed to record events, %v", err)
+	}
+	events, _ := client.CoreV1().Events("default").List(meta_v1.ListOptions{})
+	if len(events.Items) != 2 {
+		t.Fatalf("expect an event per worker, got %++v", events.Items)
+	}
+	for _, event := range events.Items {
+		if event.Reason != EVENT_REASON_HUNG || !strings.Contains(event.Message, "TFJob job seems hung") ||
+			!strings.Contains(event.Message, "GPU 1") {
+			t.Errorf("unexpected event %++v", event)
+		}
+	}
+
+	if err := LabelHungJob(client, w, report); err != nil {
+		t.Fatalf("failed to label the job, %v", err)
+	}
+	for _, pod := range pods {
+		labeled, _ := client.CoreV1().Pods("default").Get(pod.Name, meta_v1.GetOptions{})
+		if labeled.Labels[HUNG_LABEL] != "true" || labeled.Labels["tf-replica-type"] != "worker" {
+			t.Errorf("unexpected labels of %s, %v", pod.Name, labeled.Labels)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package analysis
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xieydd/gpu-metric/utils"
+	"github.com/xieydd/gpu-metric/workload"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// the longest history of a job fitted, from the start of its pods
+const DEFAULT_MEMORY_TREND_WINDOW = 24 * time.Hour
+const DEFAULT_MEMORY_TREND_STEP = time.Minute
+
+// a GPU whose memory is predicted to be exhausted within the horizon is at risk of OOM
+const DEFAULT_MEMORY_TREND_HORIZON = 6 * time.Hour
+
+// the least growth of the fitted memory over the history, as a fraction of the total memory,
+// below which memory is stable
+const DEFAULT_MEMORY_TREND_MIN_GROWTH = 0.05
+
+// the least share of increases among the changes of memory of a monotonic growth
+const DEFAULT_MEMORY_TREND_MONOTONICITY = 0.9
+
+// the least coefficient of determination of a growing memory, so that a step up as the allocator
+// of a framework warms up is not taken for a trend
+const DEFAULT_MEMORY_TREND_MIN_R2 = 0.8
+
+// the least samples fitted
+const DEFAULT_MEMORY_TREND_MIN_SAMPLES = 10
+
+const EVENT_REASON_MEMORY_LEAK = "GPUMemoryLeak"
+
+// MemoryTrendOptions of the memory trend analysis
+type MemoryTrendOptions struct {
+	Window       time.Duration
+	Step         time.Duration
+	Horizon      time.Duration
+	MinGrowth    float64
+	Monotonicity float64
+	MinR2        float64
+	MinSamples   int
+}
+
+func DefaultMemoryTrendOptions() MemoryTrendOptions {
+	return MemoryTrendOptions{
+		Window:       DEFAULT_MEMORY_TREND_WINDOW,
+		Step:         DEFAULT_MEMORY_TREND_STEP,
+		Horizon:      DEFAULT_MEMORY_TREND_HORIZON,
+		MinGrowth:    DEFAULT_MEMORY_TREND_MIN_GROWTH,
+		Monotonicity: DEFAULT_MEMORY_TREND_MONOTONICITY,
+		MinR2:        DEFAULT_MEMORY_TREND_MIN_R2,
+		MinSamples:   DEFAULT_MEMORY_TREND_MIN_SAMPLES,
+	}
+}
+
+// MemoryTrend is the linear fit of the memory used by a GPU over the history of its job
+type MemoryTrend struct {
+	Pod         string  `json:"pod"`
+	Node        string  `json:"node,omitempty"`
+	GPU         string  `json:"gpu"`
+	MemoryUsed  float64 `json:"memoryUsedBytes"`
+	MemoryTotal float64 `json:"memoryTotalBytes"`
+	// GrowthPerHour is the slope of the fit in bytes per hour
+	GrowthPerHour float64 `json:"growthPerHourBytes"`
+	// R2 is the coefficient of determination of the fit
+	R2 float64 `json:"r2"`
+	// MonotonicGrowth is set if the memory keeps growing, as it does when it leaks
+	MonotonicGrowth  bool       `json:"monotonicGrowth"`
+	TimeToExhaustion string     `json:"timeToExhaustion,omitempty"`
+	ExhaustionAt     *time.Time `json:"exhaustionAt,omitempty"`
+	// OOMRisk is set if the memory is predicted to be exhausted within the horizon
+	OOMRisk bool `json:"oomRisk"`
+}
+
+func (t MemoryTrend) String() string {
+	s := fmt.Sprintf("memory of GPU %s on node %s grows by %.0fMiB/h to %.0fMiB of %.0fMiB", t.GPU, t.Node,
+		t.GrowthPerHour/1024/1024, t.MemoryUsed/1024/1024, t.MemoryTotal/1024/1024)
+	if t.TimeToExhaustion != "" {
+		s += fmt.Sprintf(", exhausted in %s", t.TimeToExhaustion)
+	}
+	return s
+}
+
+// finding describes the trend without the measurements, which change on every analysis
+func (t MemoryTrend) finding() string {
+	if t.OOMRisk {
+		return fmt.Sprintf("memory of GPU %s on node %s is predicted to be exhausted", t.GPU, t.Node)
+	}
+	return fmt.Sprintf("memory of GPU %s on node %s grows monotonically", t.GPU, t.Node)
+}
+
+// MemoryTrendReport is the memory trend of the GPUs of a job
+type MemoryTrendReport struct {
+	Window string        `json:"window"`
+	GPUs   []MemoryTrend `json:"gpus"`
+}
+
+// HasRisks returns true if the memory of a GPU grows monotonically or is predicted to be exhausted
+func (r *MemoryTrendReport) HasRisks() bool {
+	for _, gpu := range r.GPUs {
+		if gpu.MonotonicGrowth || gpu.OOMRisk {
+			return true
+		}
+	}
+	return false
+}
+
+// linearFit returns the least squares fit value = intercept + slope * time of samples, and its R²
+func linearFit(samples []utils.GpuMetricSample) (slope float64, intercept float64, r2 float64) {
+	n := float64(len(samples))
+	if n < 2 {
+		return 0, 0, 0
+	}
+	var sumT, sumV float64
+	for _, s := range samples {
+		sumT += s.Time
+		sumV += s.Value
+	}
+	meanT, meanV := sumT/n, sumV/n
+	var stt, stv, svv float64
+	for _, s := range samples {
+		dt, dv := s.Time-meanT, s.Value-meanV
+		stt += dt * dt
+		stv += dt * dv
+		svv += dv * dv
+	}
+	if stt == 0 {
+		return 0, meanV, 0
+	}
+	slope = stv / stt
+	intercept = meanV - slope*meanT
+	if svv == 0 {
+		return slope, intercept, 1
+	}
+	return slope, intercept, stv * stv / (stt * svv)
+}
+
+// increaseShare returns the share of increases among the changes between consecutive samples
+func increaseShare(samples []utils.GpuMetricSample) float64 {
+	changes, increases := 0, 0
+	for i := 1; i < len(samples); i++ {
+		switch {
+		case samples[i].Value > samples[i-1].Value:
+			changes++
+			increases++
+		case samples[i].Value < samples[i-1].Value:
+			changes++
+		}
+	}
+	if changes == 0 {
+		return 0
+	}
+	return float64(increases) / float64(changes)
+}
+
+// FitMemoryTrend fits the memory used of a GPU against its total memory
+func FitMemoryTrend(used utils.GpuMetricSeries, total utils.GpuMetricSeries, o MemoryTrendOptions) (MemoryTrend, bool) {
+	samples := used.Samples
+	if len(samples) < o.MinSamples || len(total.Samples) == 0 {
+		return MemoryTrend{}, false
+	}
+	last := samples[len(samples)-1]
+	trend := MemoryTrend{
+		Pod:         used.PodName,
+		Node:        used.NodeName,
+		GPU:         used.Id,
+		MemoryUsed:  last.Value,
+		MemoryTotal: total.Samples[len(total.Samples)-1].Value,
+	}
+	slope, _, r2 := linearFit(samples)
+	trend.GrowthPerHour = slope * time.Hour.Seconds()
+	trend.R2 = r2
+	growing := trend.MemoryTotal > 0 && slope*(last.Time-samples[0].Time) >= o.MinGrowth*trend.MemoryTotal && r2 >= o.MinR2
+	trend.MonotonicGrowth = growing && increaseShare(samples) >= o.Monotonicity
+	if growing {
+		left := time.Duration((trend.MemoryTotal - last.Value) / slope * float64(time.Second))
+		if left < 0 {
+			left = 0
+		}
+		left = left.Round(time.Minute)
+		at := unixTime(last.Time).Add(left)
+		trend.TimeToExhaustion = left.String()
+		trend.ExhaustionAt = &at
+		trend.OOMRisk = left <= o.Horizon
+	}
+	return trend, true
+}
+
+// DetectMemoryTrends fits the memory of the GPUs of pods in series
+func DetectMemoryTrends(pods []v1.Pod, series []utils.GpuMetricSeries, o MemoryTrendOptions) *MemoryTrendReport {
+	report := &MemoryTrendReport{Window: o.Window.String(), GPUs: []MemoryTrend{}}
+	byName := podsByName(pods)
+	used := seriesOf(series, METRIC_MEMORY_USED)
+	total := seriesOf(series, METRIC_MEMORY_TOTAL)
+	for key, s := range used {
+		trend, ok := FitMemoryTrend(s, total[key], o)
+		if !ok {
+			continue
+		}
+		if pod, ok := byName[key.Pod]; ok && trend.Node == "" {
+			trend.Node = pod.Spec.NodeName
+		}
+		report.GPUs = append(report.GPUs, trend)
+	}
+	sort.Slice(report.GPUs, func(i, j int) bool {
+		if report.GPUs[i].Pod != report.GPUs[j].Pod {
+			return report.GPUs[i].Pod < report.GPUs[j].Pod
+		}
+		return report.GPUs[i].GPU < report.GPUs[j].GPU
+	})
+	return report
+}
+
+// GetWorkloadMemoryTrends fits the memory of the GPUs of the running pods of w since they started,
+// looking back at most the window of o
+func GetWorkloadMemoryTrends(client kubernetes.Interface, w workload.Workload, o MemoryTrendOptions) (*MemoryTrendReport, error) {
+	series, window, err := jobHistory(client, w, o.Window, o.Step)
+	if err != nil {
+		return nil, err
+	}
+	o.Window = window
+	return DetectMemoryTrends(w.AllPods(), series, o), nil
+}
+
+// RecordMemoryTrendEvents records a warning event on the pods of the GPUs whose memory grows
+// monotonically or is predicted to be exhausted, the message only changes with the findings
+// so that the same findings are counted by one event
+func RecordMemoryTrendEvents(client kubernetes.Interface, w workload.Workload, report *MemoryTrendReport) error {
+	messages := map[string][]string{}
+	for _, gpu := range report.GPUs {
+		if gpu.MonotonicGrowth || gpu.OOMRisk {
+			messages[gpu.Pod] = append(messages[gpu.Pod], gpu.finding())
+		}
+	}
+	for _, pod := range w.AllPods() {
+		if len(messages[pod.Name]) == 0 {
+			continue
+		}
+		message := fmt.Sprintf("GPU memory of %s %s keeps growing, it may run out of memory: %s",
+			w.Kind(), w.Name(), strings.Join(messages[pod.Name], "; "))
+		if err := RecordPodEvent(client, &pod, v1.EventTypeWarning, EVENT_REASON_MEMORY_LEAK, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package analysis
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/xieydd/gpu-metric/utils"
+	"github.com/xieydd/gpu-metric/workload"
+	v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const MiB = 1024 * 1024
+
+// newMemorySeries returns the memory used series of used MiB and the total series of a 16GiB GPU
+func newMemorySeries(pod string, id string, used ...float64) []utils.GpuMetricSeries {
+	for i := range used {
+		used[i] *= MiB
+	}
+	return []utils.GpuMetricSeries{
+		newSeries(METRIC_MEMORY_USED, pod, "node0", id, used...),
+		newSeries(METRIC_MEMORY_TOTAL, pod, "node0", id, repeat(16384*MiB, len(used))...),
+	}
+}
+
+// growing returns n values from start increased by delta
+func growing(start float64, delta float64, n int) []float64 {
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = start + delta*float64(i)
+	}
+	return values
+}
+
+func TestDetectMemoryTrends(t *testing.T) {
+	// the allocator of GPU 2 warms up then stays flat, GPU 3 leaks while it is freed from time to time
+	warmup := append(repeat(4096, 5), repeat(12288, 55)...)
+	leak := growing(4096, 10, 120)
+	for i := 10; i < 120; i += 20 {
+		leak[i] -= 30
+	}
+	series := append(newMemorySeries("job-worker-0", "0", growing(4096, 50, 60)...),
+		newMemorySeries("job-worker-0", "1", repeat(8192, 60)...)...)
+	series = append(series, newMemorySeries("job-worker-0", "2", warmup...)...)
+	series = append(series, newMemorySeries("job-worker-0", "3", leak...)...)
+	// too few samples to be fitted
+	series = append(series, newMemorySeries("job-worker-0", "4", growing(4096, 50, 5)...)...)
+	pods := []v1.Pod{newWorkerPod("job-worker-0", "worker", 0, "node0")}
+
+	report := DetectMemoryTrends(pods, series, DefaultMemoryTrendOptions())
+	if len(report.GPUs) != 4 {
+		t.Fatalf("expect 4 GPUs fitted, got %++v", report.GPUs)
+	}
+	leaking := report.GPUs[0]
+	if !leaking.MonotonicGrowth || !leaking.OOMRisk || leaking.TimeToExhaustion != "1h33m0s" || leaking.ExhaustionAt == nil {
+		t.Errorf("GPU 0 should run out of memory in 1h33m, got %++v", leaking)
+	}
+	if leaking.GrowthPerHour != 6000*MiB || leaking.R2 < 0.999 || leaking.MemoryUsed != 7046*MiB || leaking.MemoryTotal != 16384*MiB {
+		t.Errorf("unexpected fit %++v", leaking)
+	}
+	if stable := report.GPUs[1]; stable.MonotonicGrowth || stable.OOMRisk || stable.TimeToExhaustion != "" || stable.GrowthPerHour != 0 {
+		t.Errorf("GPU 1 should be stable, got %++v", stable)
+	}
+	if warm := report.GPUs[2]; warm.MonotonicGrowth || warm.TimeToExhaustion != "" {
+		t.Errorf("the warm up of GPU 2 should not be a trend, got %++v", warm)
+	}
+	if slow := report.GPUs[3]; !slow.MonotonicGrowth || slow.OOMRisk || slow.TimeToExhaustion == "" {
+		t.Errorf("GPU 3 should leak without risk of OOM within the horizon, got %++v", slow)
+	}
+	if !report.HasRisks() {
+		t.Errorf("report should have risks")
+	}
+}
+
+func TestRecordMemoryTrendEvents(t *testing.T) {
+	pods := []v1.Pod{newWorkerPod("job-worker-0", "worker", 0, "node0"), newWorkerPod("job-worker-1", "worker", 1, "node1")}
+	series := append(newMemorySeries("job-worker-0", "0", growing(4096, 50, 60)...),
+		newMemorySeries("job-worker-1", "0", repeat(8192, 60)...)...)
+	client := fake.NewSimpleClientset()
+	w := workload.NewWorkload("PyTorchJob", "job", "default", pods)
+	report := DetectMemoryTrends(pods, series, DefaultMemoryTrendOptions())
+	if err := RecordMemoryTrendEvents(client, w, report); err != nil {
+		t.Fatalf("failed to record events, %v", err)
+	}
+	events, _ := client.CoreV1().Events("default").List(meta_v1.ListOptions{})
+	if len(events.Items) != 1 {
+		t.Fatalf("expect 1 event, got %++v", events.Items)
+	}
+	event := events.Items[0]
+	if event.InvolvedObject.Name != "job-worker-0" || event.Reason != EVENT_REASON_MEMORY_LEAK ||
+		!strings.Contains(event.Message, "memory of GPU 0 on node node0 is predicted to be exhausted") {
+		t.Errorf("unexpected event %++v", event)
+	}
+	if report.GPUs[0].String() != "memory of GPU 0 on node node0 grows by 6000MiB/h to 7046MiB of 16384MiB, exhausted in 1h33m0s" {
+		t.Errorf("unexpected trend %s", report.GPUs[0].String())
+	}
+}
@@ -0,0 +1,223 @@
+package analysis
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/unisound-ail/atlasctl/cmd"
+	"github.com/xieydd/gpu-metric/utils"
+	"github.com/xieydd/gpu-metric/workload"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// the history of a job the recommendation is based on, from the start of its pods
+const DEFAULT_RIGHT_SIZING_WINDOW = 7 * 24 * time.Hour
+const DEFAULT_RIGHT_SIZING_STEP = time.Minute
+
+// the percentile of the samples taken as the peak usage, so that short spikes do not size the job
+const DEFAULT_RIGHT_SIZING_PERCENTILE = 95.0
+
+// the duty cycle the suggested GPUs are sized to run at, leaving headroom for spikes
+const DEFAULT_RIGHT_SIZING_TARGET_DUTY_CYCLE = 80.0
+
+// the memory headroom over the peak memory used of a smaller or shared GPU
+const DEFAULT_RIGHT_SIZING_MEMORY_HEADROOM = 1.2
+
+// the least history a recommendation is made on
+const DEFAULT_RIGHT_SIZING_MIN_HISTORY = time.Hour
+
+// the fractions of a GPU shared by time-slicing or MIG a single GPU job can be suggested
+var SHARED_GPU_FRACTIONS = []float64{0.25, 0.5}
+
+// RightSizingOptions of the right-sizing recommendation
+type RightSizingOptions struct {
+	Window          time.Duration
+	Step            time.Duration
+	Percentile      float64
+	TargetDutyCycle float64
+	MemoryHeadroom  float64
+	MinHistory      time.Duration
+	// PricePerGPUHour gives the expected savings in money if set
+	PricePerGPUHour float64
+}
+
+func DefaultRightSizingOptions() RightSizingOptions {
+	return RightSizingOptions{
+		Window:          DEFAULT_RIGHT_SIZING_WINDOW,
+		Step:            DEFAULT_RIGHT_SIZING_STEP,
+		Percentile:      DEFAULT_RIGHT_SIZING_PERCENTILE,
+		TargetDutyCycle: DEFAULT_RIGHT_SIZING_TARGET_DUTY_CYCLE,
+		MemoryHeadroom:  DEFAULT_RIGHT_SIZING_MEMORY_HEADROOM,
+		MinHistory:      DEFAULT_RIGHT_SIZING_MIN_HISTORY,
+	}
+}
+
+// RightSizing is the recommended GPU size of a workload and the expected savings
+type RightSizing struct {
+	Window       string `json:"window"`
+	RequestedGPU int64  `json:"requestedGPU"`
+	AllocatedGPU int64  `json:"allocatedGPU"`
+	// MeasuredGPU is the number of GPUs with metrics
+	MeasuredGPU   int     `json:"measuredGPU"`
+	MeanDutyCycle float64 `json:"meanDutyCycle"`
+	// PeakBusyGPU is the percentile of the sum of the duty cycles of the GPUs, in GPUs
+	PeakBusyGPU float64 `json:"peakBusyGPU"`
+	// PeakMemoryUsed is the percentile of the memory used by the GPU using the most
+	PeakMemoryUsed float64 `json:"peakMemoryUsedBytes"`
+	MemoryTotal    float64 `json:"memoryTotalBytes"`
+
+	SuggestedGPU int64 `json:"suggestedGPU"`
+	// SharedGPUFraction is the fraction of a shared GPU the workload fits in, 0 if it needs whole GPUs
+	SharedGPUFraction float64 `json:"sharedGPUFraction,omitempty"`
+	// SmallerGPUMemory is the memory of a smaller GPU the workload fits in, 0 if it needs the memory of its GPUs
+	SmallerGPUMemory float64 `json:"smallerGPUMemoryBytes,omitempty"`
+
+	SavedGPU            float64  `json:"savedGPU"`
+	SavedGPUHoursPerDay float64  `json:"savedGPUHoursPerDay"`
+	SavingsPercent      float64  `json:"savingsPercent"`
+	SavedCostPerDay     float64  `json:"savedCostPerDay,omitempty"`
+	Reasons             []string `json:"reasons"`
+}
+
+// percentile returns the p-th percentile of values by the nearest rank
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// gpuCounter is implemented by the atlasctl training jobs
+type gpuCounter interface {
+	RequestedGPU() int64
+	AllocatedGPU() int64
+}
+
+// GpuCountOf returns the GPUs requested by the pods of w which are not finished and the GPUs allocated
+// to its running pods, or those of the TrainingJob it adapts
+func GpuCountOf(w workload.Workload) (requested int64, allocated int64) {
+	if job, ok := w.(gpuCounter); ok {
+		return job.RequestedGPU(), job.AllocatedGPU()
+	}
+	for _, pod := range w.AllPods() {
+		switch pod.Status.Phase {
+		case v1.PodSucceeded, v1.PodFailed:
+			continue
+		case v1.PodRunning:
+			allocated += utils.GpuInPod(pod)
+		}
+		requested += utils.GpuInPod(pod)
+	}
+	return requested, allocated
+}
+
+// RightSize recommends the GPUs of a workload requesting requested GPUs from the duty cycle and memory
+// series of its GPUs over the window. The suggested count keeps the peak busy GPUs at the target duty
+// cycle, a workload which only needs one GPU may fit a fraction of a shared GPU or a GPU with less memory.
+func RightSize(requested int64, allocated int64, series []utils.GpuMetricSeries, window time.Duration, o RightSizingOptions) *RightSizing {
+	r := &RightSizing{Window: window.String(), RequestedGPU: requested, AllocatedGPU: allocated, SuggestedGPU: requested, Reasons: []string{}}
+	duty := seriesOf(series, METRIC_DUTY_CYCLE)
+	used := seriesOf(series, METRIC_MEMORY_USED)
+	total := seriesOf(series, METRIC_MEMORY_TOTAL)
+	r.MeasuredGPU = len(duty)
+	if requested == 0 {
+		r.Reasons = append(r.Reasons, "the workload does not request GPUs")
+		return r
+	}
+	if len(duty) == 0 {
+		r.Reasons = append(r.Reasons, "no GPU metrics of the workload")
+		return r
+	}
+	if window < o.MinHistory {
+		r.Reasons = append(r.Reasons, fmt.Sprintf("the history of %s is shorter than %s", window, o.MinHistory))
+		return r
+	}
+
+	busyAt := map[float64]float64{}
+	means := []float64{}
+	for key, s := range duty {
+		means = append(means, sampleMean(s.Samples))
+		for _, sample := range s.Samples {
+			busyAt[sample.Time] += sample.Value / 100
+		}
+		memory := []float64{}
+		for _, sample := range used[key].Samples {
+			memory = append(memory, sample.Value)
+		}
+		if peak := percentile(memory, o.Percentile); peak > r.PeakMemoryUsed {
+			r.PeakMemoryUsed = peak
+		}
+		if samples := total[key].Samples; len(samples) > 0 && (r.MemoryTotal == 0 || samples[len(samples)-1].Value < r.MemoryTotal) {
+			r.MemoryTotal = samples[len(samples)-1].Value
+		}
+	}
+	busy := []float64{}
+	for _, v := range busyAt {
+		busy = append(busy, v)
+	}
+	r.MeanDutyCycle = mean(means)
+	r.PeakBusyGPU = percentile(busy, o.Percentile)
+
+	suggested := int64(math.Ceil(r.PeakBusyGPU * 100 / o.TargetDutyCycle))
+	if suggested < 1 {
+		suggested = 1
+	}
+	if suggested > requested {
+		suggested = requested
+	}
+	r.SuggestedGPU = suggested
+	r.Reasons = append(r.Reasons, fmt.Sprintf("p%.0f of the busy GPUs is %.2f of %d, %d GPUs run it at most at %.0f%% duty cycle",
+		o.Percentile, r.PeakBusyGPU, r.MeasuredGPU, suggested, o.TargetDutyCycle))
+	if r.MeasuredGPU < int(allocated) {
+		r.Reasons = append(r.Reasons, fmt.Sprintf("only %d of the %d allocated GPUs have metrics", r.MeasuredGPU, allocated))
+	}
+
+	saved := float64(requested - suggested)
+	if suggested == 1 && r.MemoryTotal > 0 {
+		needed := math.Max(r.PeakBusyGPU, r.PeakMemoryUsed*o.MemoryHeadroom/r.MemoryTotal)
+		for _, fraction := range SHARED_GPU_FRACTIONS {
+			if needed <= fraction {
+				r.SharedGPUFraction = fraction
+				saved = float64(requested) - fraction
+				r.Reasons = append(r.Reasons, fmt.Sprintf("p%.0f duty cycle %.0f%% and memory %.0fMiB of %.0fMiB fit %.0f%% of a shared GPU",
+					o.Percentile, r.PeakBusyGPU*100, r.PeakMemoryUsed/1024/1024, r.MemoryTotal/1024/1024, fraction*100))
+				break
+			}
+		}
+	}
+	if memory := math.Ceil(r.PeakMemoryUsed*o.MemoryHeadroom/1024/1024/1024) * 1024 * 1024 * 1024; r.MemoryTotal > 0 && memory <= r.MemoryTotal/2 {
+		r.SmallerGPUMemory = memory
+		r.Reasons = append(r.Reasons, fmt.Sprintf("p%.0f memory used %.0fMiB fits a GPU with %.0fGiB of memory instead of %.0fGiB",
+			o.Percentile, r.PeakMemoryUsed/1024/1024, memory/1024/1024/1024, r.MemoryTotal/1024/1024/1024))
+	}
+
+	r.SavedGPU = saved
+	r.SavedGPUHoursPerDay = saved * 24
+	r.SavingsPercent = saved / float64(requested) * 100
+	r.SavedCostPerDay = r.SavedGPUHoursPerDay * o.PricePerGPUHour
+	return r
+}
+
+// GetWorkloadRightSizing recommends the GPUs of w from the history of its running pods
+func GetWorkloadRightSizing(client kubernetes.Interface, w workload.Workload, o RightSizingOptions) (*RightSizing, error) {
+	requested, allocated := GpuCountOf(w)
+	series, window, err := jobHistory(client, w, o.Window, o.Step)
+	if err != nil {
+		return nil, err
+	}
+	return RightSize(requested, allocated, series, window, o), nil
+}
+
+// GetTrainingJobRightSizing recommends the GPUs of an atlasctl training job
+func GetTrainingJobRightSizing(client kubernetes.Interface, job cmd.TrainingJob, o RightSizingOptions) (*RightSizing, error) {
+	return GetWorkloadRightSizing(client, workload.FromTrainingJob(job), o)
+}
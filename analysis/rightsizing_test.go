@@ -0,0 +1,95 @@
+package analysis
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xieydd/gpu-metric/utils"
+	"github.com/xieydd/gpu-metric/workload"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// newGpuSeries returns the duty cycle, memory used and 16GiB memory total series of a GPU of worker-0
+func newGpuSeries(id string, duty []float64, used float64) []utils.GpuMetricSeries {
+	return []utils.GpuMetricSeries{
+		newSeries(METRIC_DUTY_CYCLE, "worker-0", "node0", id, duty...),
+		newSeries(METRIC_MEMORY_USED, "worker-0", "node0", id, repeat(used, len(duty))...),
+		newSeries(METRIC_MEMORY_TOTAL, "worker-0", "node0", id, repeat(16384*MiB, len(duty))...),
+	}
+}
+
+func TestRightSizeIdleGPUs(t *testing.T) {
+	// 2 of the 8 GPUs are busy, with a spike of the others
+	series := []utils.GpuMetricSeries{}
+	for i := 0; i < 8; i++ {
+		duty := repeat(0, 100)
+		if i < 2 {
+			duty = repeat(90, 100)
+		}
+		duty[50] = 100
+		series = append(series, newGpuSeries(fmt.Sprintf("%d", i), duty, 12000*MiB)...)
+	}
+	o := DefaultRightSizingOptions()
+	o.PricePerGPUHour = 2.5
+	r := RightSize(8, 8, series, 2*time.Hour, o)
+	if r.SuggestedGPU != 3 || r.PeakBusyGPU != 1.8 || r.MeasuredGPU != 8 {
+		t.Errorf("expect 3 GPUs for 1.8 busy GPUs, got %++v", r)
+	}
+	if r.SavedGPU != 5 || r.SavedGPUHoursPerDay != 120 || r.SavingsPercent != 62.5 || r.SavedCostPerDay != 300 {
+		t.Errorf("unexpected savings %++v", r)
+	}
+	if r.SharedGPUFraction != 0 || r.SmallerGPUMemory != 0 {
+		t.Errorf("job using 12000MiB of its GPUs should not fit smaller GPUs, got %++v", r)
+	}
+}
+
+func TestRightSizeSharedGPU(t *testing.T) {
+	duty := append(repeat(10, 90), repeat(15, 10)...)
+	r := RightSize(1, 1, newGpuSeries("0", duty, 3*1024*MiB), 2*time.Hour, DefaultRightSizingOptions())
+	if r.SuggestedGPU != 1 || r.SharedGPUFraction != 0.25 || r.SmallerGPUMemory != 4*1024*MiB {
+		t.Errorf("expect a quarter of a shared GPU with 4GiB, got %++v", r)
+	}
+	if r.SavedGPU != 0.75 || r.SavingsPercent != 75 || r.SavedCostPerDay != 0 {
+		t.Errorf("unexpected savings %++v", r)
+	}
+	if !strings.Contains(strings.Join(r.Reasons, "\n"), "fit 25% of a shared GPU") {
+		t.Errorf("unexpected reasons %v", r.Reasons)
+	}
+}
+
+func TestRightSizeBusyGPUs(t *testing.T) {
+	series := []utils.GpuMetricSeries{}
+	for i := 0; i < 4; i++ {
+		series = append(series, newGpuSeries(fmt.Sprintf("%d", i), repeat(95, 100), 15000*MiB)...)
+	}
+	r := RightSize(4, 4, series, 2*time.Hour, DefaultRightSizingOptions())
+	if r.SuggestedGPU != 4 || r.SavedGPU != 0 || r.SharedGPUFraction != 0 {
+		t.Errorf("busy job should keep its GPUs, got %++v", r)
+	}
+}
+
+func TestRightSizeWithoutHistory(t *testing.T) {
+	r := RightSize(8, 8, newGpuSeries("0", repeat(0, 20), 0), 10*time.Minute, DefaultRightSizingOptions())
+	if r.SuggestedGPU != 8 || r.SavedGPU != 0 || !strings.Contains(r.Reasons[0], "shorter than 1h0m0s") {
+		t.Errorf("job without enough history should keep its GPUs, got %++v", r)
+	}
+}
+
+func TestGpuCountOf(t *testing.T) {
+	pods := []v1.Pod{}
+	for i, phase := range []v1.PodPhase{v1.PodRunning, v1.PodPending, v1.PodSucceeded} {
+		pod := newWorkerPod(fmt.Sprintf("worker-%d", i), "worker", i, "node0")
+		pod.Status.Phase = phase
+		pod.Spec.Containers = []v1.Container{{Name: "main", Resources: v1.ResourceRequirements{Limits: v1.ResourceList{
+			utils.NVIDIA_GPU_RESOURCE_NAME: resource.MustParse("2"),
+		}}}}
+		pods = append(pods, pod)
+	}
+	requested, allocated := GpuCountOf(workload.NewWorkload("Job", "job", "default", pods))
+	if requested != 4 || allocated != 2 {
+		t.Errorf("expect 4 GPUs requested and 2 allocated, got %d and %d", requested, allocated)
+	}
+}
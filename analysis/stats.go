@@ -0,0 +1,73 @@
+package analysis
+
+import (
+	"math"
+	"sort"
+
+	"github.com/xieydd/gpu-metric/utils"
+)
+
+// the scale of the median absolute deviation to the standard deviation of a normal distribution
+const MAD_SCALE = 0.6745
+
+// the scale of the mean absolute deviation to the standard deviation of a normal distribution
+const MEAN_AD_SCALE = 0.7979
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// robustScores returns the modified z-scores of values, based on the median absolute deviation,
+// falling back to the mean absolute deviation if more than half of the values are equal.
+// All the scores are 0 if the values are equal.
+func robustScores(values []float64) []float64 {
+	scores := make([]float64, len(values))
+	m := median(values)
+	deviations := make([]float64, len(values))
+	for i, v := range values {
+		deviations[i] = math.Abs(v - m)
+	}
+	scale := median(deviations) / MAD_SCALE
+	if scale == 0 {
+		scale = mean(deviations) / MEAN_AD_SCALE
+	}
+	if scale == 0 {
+		return scores
+	}
+	for i, v := range values {
+		scores[i] = (v - m) / scale
+	}
+	return scores
+}
+
+// sampleMean returns the mean value of the samples
+func sampleMean(samples []utils.GpuMetricSample) float64 {
+	sum := 0.0
+	for _, s := range samples {
+		sum += s.Value
+	}
+	if len(samples) == 0 {
+		return 0
+	}
+	return sum / float64(len(samples))
+}
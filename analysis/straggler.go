@@ -0,0 +1,210 @@
+package analysis
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xieydd/gpu-metric/utils"
+	"github.com/xieydd/gpu-metric/workload"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const DEFAULT_STRAGGLER_WINDOW = 10 * time.Minute
+const DEFAULT_STRAGGLER_STEP = 30 * time.Second
+
+// the modified z-score beyond which a worker or GPU is an outlier
+const DEFAULT_STRAGGLER_THRESHOLD = 3.5
+
+// the least difference of duty cycle from the median of an outlier, so that small spreads of
+// well balanced jobs are not reported
+const DEFAULT_STRAGGLER_MIN_DEVIATION = 10.0
+
+// the least number of workers or GPUs compared, the median of fewer is not meaningful
+const DEFAULT_STRAGGLER_MIN_PEERS = 3
+
+const EVENT_REASON_STRAGGLER = "GPUStraggler"
+
+const (
+	OUTLIER_LOW  = "low"
+	OUTLIER_HIGH = "high"
+)
+
+// StragglerOptions of the straggler analysis
+type StragglerOptions struct {
+	Window       time.Duration
+	Step         time.Duration
+	Threshold    float64
+	MinDeviation float64
+	MinPeers     int
+}
+
+func DefaultStragglerOptions() StragglerOptions {
+	return StragglerOptions{
+		Window:       DEFAULT_STRAGGLER_WINDOW,
+		Step:         DEFAULT_STRAGGLER_STEP,
+		Threshold:    DEFAULT_STRAGGLER_THRESHOLD,
+		MinDeviation: DEFAULT_STRAGGLER_MIN_DEVIATION,
+		MinPeers:     DEFAULT_STRAGGLER_MIN_PEERS,
+	}
+}
+
+// Outlier is a worker or GPU whose mean duty cycle over the window deviates from its peers.
+// A low outlier is starved, such as by its input pipeline, a high one is slower than its
+// peers which wait for it at the synchronization points.
+type Outlier struct {
+	Role      string  `json:"role"`
+	Pod       string  `json:"pod"`
+	Node      string  `json:"node,omitempty"`
+	GPU       string  `json:"gpu,omitempty"`
+	DutyCycle float64 `json:"dutyCycle"`
+	Median    float64 `json:"median"`
+	Score     float64 `json:"score"`
+	Direction string  `json:"direction"`
+}
+
+func (o Outlier) String() string {
+	name := o.Pod
+	if o.GPU != "" {
+		name = fmt.Sprintf("GPU %s of %s", o.GPU, o.Pod)
+	}
+	return fmt.Sprintf("%s on node %s has a %s mean duty cycle %.1f%% against the median %.1f%% of its peers (score %.1f)",
+		name, o.Node, o.Direction, o.DutyCycle, o.Median, o.Score)
+}
+
+// finding describes the outlier without the measurements, which change on every analysis
+func (o Outlier) finding() string {
+	name := o.Pod
+	if o.GPU != "" {
+		name = fmt.Sprintf("GPU %s of %s", o.GPU, o.Pod)
+	}
+	return fmt.Sprintf("%s on node %s has a %s duty cycle against its peers", name, o.Node, o.Direction)
+}
+
+// StragglerReport is the outliers of a job, the workers are compared within their role
+// and the GPUs across the job
+type StragglerReport struct {
+	Window  string    `json:"window"`
+	Workers []Outlier `json:"workers"`
+	GPUs    []Outlier `json:"gpus"`
+}
+
+// HasStragglers returns true if any worker or GPU is an outlier
+func (r *StragglerReport) HasStragglers() bool {
+	return len(r.Workers) > 0 || len(r.GPUs) > 0
+}
+
+// DetectStragglers compares the mean duty cycles of the workers and GPUs of pods in series
+func DetectStragglers(pods []v1.Pod, series []utils.GpuMetricSeries, o StragglerOptions) *StragglerReport {
+	report := &StragglerReport{Window: o.Window.String(), Workers: []Outlier{}, GPUs: []Outlier{}}
+	byName := podsByName(pods)
+	duty := seriesOf(series, METRIC_DUTY_CYCLE)
+
+	gpus := []Outlier{}
+	workers := map[string][]Outlier{}
+	podGpus := map[string][]float64{}
+	keys := []GpuKey{}
+	for key := range duty {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Pod != keys[j].Pod {
+			return keys[i].Pod < keys[j].Pod
+		}
+		return keys[i].Id < keys[j].Id
+	})
+	for _, key := range keys {
+		s := duty[key]
+		pod, ok := byName[key.Pod]
+		if !ok || len(s.Samples) == 0 {
+			continue
+		}
+		role, _ := workload.ReplicaOf(pod)
+		if role == "" {
+			role = "Pod"
+		}
+		node := s.NodeName
+		if node == "" {
+			node = pod.Spec.NodeName
+		}
+		value := sampleMean(s.Samples)
+		gpus = append(gpus, Outlier{Role: role, Pod: key.Pod, Node: node, GPU: key.Id, DutyCycle: value})
+		if _, ok := podGpus[key.Pod]; !ok {
+			workers[role] = append(workers[role], Outlier{Role: role, Pod: key.Pod, Node: node})
+		}
+		podGpus[key.Pod] = append(podGpus[key.Pod], value)
+	}
+
+	report.GPUs = outliers(gpus, o)
+	roles := []string{}
+	for role := range workers {
+		roles = append(roles, role)
+	}
+	sort.Slice(roles, func(i, j int) bool { return workload.ReplicaTypeLess(roles[i], roles[j]) })
+	for _, role := range roles {
+		peers := workers[role]
+		for i := range peers {
+			peers[i].DutyCycle = mean(podGpus[peers[i].Pod])
+		}
+		report.Workers = append(report.Workers, outliers(peers, o)...)
+	}
+	return report
+}
+
+// outliers returns the peers whose duty cycle is an outlier
+func outliers(peers []Outlier, o StragglerOptions) []Outlier {
+	result := []Outlier{}
+	if len(peers) < o.MinPeers {
+		return result
+	}
+	values := []float64{}
+	for _, peer := range peers {
+		values = append(values, peer.DutyCycle)
+	}
+	m := median(values)
+	for i, score := range robustScores(values) {
+		if math.Abs(score) < o.Threshold || math.Abs(values[i]-m) < o.MinDeviation {
+			continue
+		}
+		outlier := peers[i]
+		outlier.Median = m
+		outlier.Score = score
+		outlier.Direction = OUTLIER_HIGH
+		if score < 0 {
+			outlier.Direction = OUTLIER_LOW
+		}
+		result = append(result, outlier)
+	}
+	return result
+}
+
+// GetWorkloadStragglers analyzes the duty cycles of the running pods of w over the window before now
+func GetWorkloadStragglers(client kubernetes.Interface, w workload.Workload, o StragglerOptions) (*StragglerReport, error) {
+	series, err := workloadRange(client, w, time.Now(), o.Window, o.Step)
+	if err != nil {
+		return nil, err
+	}
+	return DetectStragglers(w.AllPods(), series, o), nil
+}
+
+// RecordStragglerEvents records a warning event on the pods of the outliers, the message
+// only changes with the outliers so that the same outliers are counted by one event
+func RecordStragglerEvents(client kubernetes.Interface, w workload.Workload, report *StragglerReport) error {
+	messages := map[string][]string{}
+	for _, outlier := range append(append([]Outlier{}, report.Workers...), report.GPUs...) {
+		messages[outlier.Pod] = append(messages[outlier.Pod], outlier.finding())
+	}
+	for _, pod := range w.AllPods() {
+		if len(messages[pod.Name]) == 0 {
+			continue
+		}
+		message := fmt.Sprintf("straggler of %s %s: %s", w.Kind(), w.Name(), strings.Join(messages[pod.Name], "; "))
+		if err := RecordPodEvent(client, &pod, v1.EventTypeWarning, EVENT_REASON_STRAGGLER, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package analysis
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/xieydd/gpu-metric/utils"
+	"github.com/xieydd/gpu-metric/workload"
+	v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newWorkerPod(name string, role string, index int, node string) v1.Pod {
+	return v1.Pod{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels: map[string]string{
+				"tf-replica-type":  role,
+				"tf-replica-index": fmt.Sprintf("%d", index),
+			},
+		},
+		Spec:   v1.PodSpec{NodeName: node},
+		Status: v1.PodStatus{Phase: v1.PodRunning},
+	}
+}
+
+// newSeries returns a series of metric sampled every 30s with values
+func newSeries(metric string, pod string, node string, id string, values ...float64) utils.GpuMetricSeries {
+	s := utils.GpuMetricSeries{MetricName: metric, PodName: pod, PodNamespace: "default", NodeName: node, Id: id}
+	for i, v := range values {
+		s.Samples = append(s.Samples, utils.GpuMetricSample{Time: 1546300800 + float64(30*i), Value: v})
+	}
+	return s
+}
+
+// newStragglerJob returns 4 workers with 2 GPUs each, the GPUs of worker 2 run at slowDuty
+func newStragglerJob(slowDuty float64) ([]v1.Pod, []utils.GpuMetricSeries) {
+	pods := []v1.Pod{newWorkerPod("job-ps-0", "ps", 0, "cpu-node")}
+	series := []utils.GpuMetricSeries{}
+	for i := 0; i < 4; i++ {
+		name := fmt.Sprintf("job-worker-%d", i)
+		node := fmt.Sprintf("node%d", i)
+		pods = append(pods, newWorkerPod(name, "worker", i, node))
+		for gpu := 0; gpu < 2; gpu++ {
+			duty := 88 + float64(i+gpu)
+			if i == 2 {
+				duty = slowDuty
+			}
+			series = append(series,
+				newSeries(METRIC_DUTY_CYCLE, name, node, fmt.Sprintf("%d", gpu), duty-1, duty, duty+1),
+				newSeries(METRIC_MEMORY_USED, name, node, fmt.Sprintf("%d", gpu), 1e9, 1e9, 1e9))
+		}
+	}
+	return pods, series
+}
+
+func TestDetectStragglers(t *testing.T) {
+	pods, series := newStragglerJob(40)
+	report := DetectStragglers(pods, series, DefaultStragglerOptions())
+
+	if len(report.Workers) != 1 {
+		t.Fatalf("expect 1 straggling worker, got %++v", report.Workers)
+	}
+	worker := report.Workers[0]
+	if worker.Pod != "job-worker-2" || worker.Node != "node2" || worker.Role != "Worker" || worker.Direction != OUTLIER_LOW {
+		t.Errorf("unexpected straggler %++v", worker)
+	}
+	if len(report.GPUs) != 2 || report.GPUs[0].Pod != "job-worker-2" || report.GPUs[1].GPU != "1" {
+		t.Errorf("expect the 2 GPUs of worker 2 as outliers, got %++v", report.GPUs)
+	}
+	if !strings.Contains(worker.String(), "job-worker-2 on node node2 has a low mean duty cycle 40.0%") {
+		t.Errorf("unexpected description %s", worker.String())
+	}
+}
+
+func TestDetectStragglersBalanced(t *testing.T) {
+	pods, series := newStragglerJob(89)
+	if report := DetectStragglers(pods, series, DefaultStragglerOptions()); report.HasStragglers() {
+		t.Errorf("expect no straggler in a balanced job, got %++v", report)
+	}
+
+	// a slower GPU is an outlier even if its workers wait for it
+	pods, series = newStragglerJob(99.9)
+	o := DefaultStragglerOptions()
+	o.MinDeviation = 5
+	report := DetectStragglers(pods, series, o)
+	if len(report.Workers) != 1 || report.Workers[0].Direction != OUTLIER_HIGH {
+		t.Errorf("expect a high outlier, got %++v", report.Workers)
+	}
+}
+
+func TestDetectStragglersTooFewPeers(t *testing.T) {
+	pods, series := newStragglerJob(40)
+	o := DefaultStragglerOptions()
+	o.MinPeers = 5
+	if report := DetectStragglers(pods, series, o); len(report.Workers) != 0 {
+		t.Errorf("4 workers are fewer than the peers required, got %++v", report.Workers)
+	}
+}
+
+func TestRecordStragglerEvents(t *testing.T) {
+	pods, series := newStragglerJob(40)
+	client := fake.NewSimpleClientset()
+	w := workload.NewWorkload("TFJob", "job", "default", pods)
+	report := DetectStragglers(pods, series, DefaultStragglerOptions())
+	if err := RecordStragglerEvents(client, w, report); err != nil {
+		t.Fatalf("failed to record events, %v", err)
+	}
+	events, _ := client.CoreV1().Events("default").List(meta_v1.ListOptions{})
+	if len(events.Items) != 1 {
+		t.Fatalf("expect 1 event, got %++v", events.Items)
+	}
+	event := events.Items[0]
+	if event.InvolvedObject.Name != "job-worker-2" || event.Reason != EVENT_REASON_STRAGGLER || event.Type != v1.EventTypeWarning {
+		t.Errorf("unexpected event %++v", event)
+	}
+	if !strings.Contains(event.Message, "straggler of TFJob job") || !strings.Contains(event.Message, "GPU 1 of job-worker-2") {
+		t.Errorf("unexpected message %s", event.Message)
+	}
+
+	// the same outliers measured again are counted by the same event
+	report = DetectStragglers(pods, series, DefaultStragglerOptions())
+	report.GPUs[0].Score++
+	if err := RecordStragglerEvents(client, w, report); err != nil {
+		t.Fatalf("failed to record events, %v", err)
+	}
+	events, _ = client.CoreV1().Events("default").List(meta_v1.ListOptions{})
+	if len(events.Items) != 1 || events.Items[0].Count != 2 {
+		t.Errorf("expect the event to be counted twice, got %++v", events.Items)
+	}
+}
@@ -0,0 +1,77 @@
+package base
+
+import (
+	"fmt"
+	"strings"
+
+	authorization_v1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+)
+
+// PermissionError is returned when the user is not allowed to do something the request needs,
+// instead of returning empty results
+type PermissionError struct {
+	Verb        string
+	Resource    string
+	Subresource string
+	Namespace   string
+	Reason      string
+	// Hint suggests how to do without the permission
+	Hint string
+}
+
+func (e *PermissionError) Error() string {
+	resource := e.Resource
+	if len(e.Subresource) > 0 {
+		resource += "/" + e.Subresource
+	}
+	scope := "in all namespaces"
+	if len(e.Namespace) > 0 {
+		scope = "in namespace " + e.Namespace
+	}
+	message := fmt.Sprintf("permission denied: cannot %s %s %s", e.Verb, resource, scope)
+	if len(e.Reason) > 0 {
+		message += ", " + strings.TrimSuffix(e.Reason, ".")
+	}
+	if len(e.Hint) > 0 {
+		message += ", " + e.Hint
+	}
+	return message
+}
+
+// IsPermissionError returns true if err is a PermissionError
+func IsPermissionError(err error) bool {
+	_, ok := err.(*PermissionError)
+	return ok
+}
+
+// CheckAccess asks the API server with a SelfSubjectAccessReview whether the user can do verb on
+// resource, it returns a PermissionError if not
+func CheckAccess(client kubernetes.Interface, verb string, resource string, subresource string, namespace string) error {
+	review, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(&authorization_v1.SelfSubjectAccessReview{
+		Spec: authorization_v1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorization_v1.ResourceAttributes{
+				Namespace:   namespace,
+				Verb:        verb,
+				Resource:    resource,
+				Subresource: subresource,
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to review access to %s %s, %v", verb, resource, err)
+	}
+	if !review.Status.Allowed {
+		return &PermissionError{Verb: verb, Resource: resource, Subresource: subresource, Namespace: namespace, Reason: review.Status.Reason}
+	}
+	return nil
+}
+
+// ToPermissionError converts a Forbidden error of the API server to a PermissionError
+func ToPermissionError(err error, verb string, resource string, namespace string) error {
+	if !errors.IsForbidden(err) {
+		return err
+	}
+	return &PermissionError{Verb: verb, Resource: resource, Namespace: namespace}
+}
@@ -0,0 +1,72 @@
+package base
+
+import (
+	"strings"
+	"testing"
+
+	authorization_v1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newNamespacedClient returns a client which is only allowed to access namespace default
+func newNamespacedClient() *fake.Clientset {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorization_v1.SelfSubjectAccessReview)
+		review.Status.Allowed = review.Spec.ResourceAttributes.Namespace == "default"
+		if !review.Status.Allowed {
+			review.Status.Reason = "RBAC: no cluster role binding."
+		}
+		return true, review, nil
+	})
+	client.PrependReactor("list", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() == "default" {
+			return false, nil, nil
+		}
+		return true, nil, errors.NewForbidden(schema.GroupResource{Resource: action.GetResource().Resource}, "", nil)
+	})
+	return client
+}
+
+func TestCheckAccess(t *testing.T) {
+	client := newNamespacedClient()
+	if err := CheckAccess(client, "list", "pods", "", "default"); err != nil {
+		t.Errorf("list pods in default should be allowed, got %v", err)
+	}
+	err := CheckAccess(client, "get", "services", "proxy", "kube-system")
+	if !IsPermissionError(err) {
+		t.Fatalf("expect PermissionError, got %v", err)
+	}
+	expected := "permission denied: cannot get services/proxy in namespace kube-system, RBAC: no cluster role binding"
+	if err.Error() != expected {
+		t.Errorf("expect %q, got %q", expected, err.Error())
+	}
+}
+
+func TestPortSelectionWithoutClusterPermissions(t *testing.T) {
+	client := newNamespacedClient()
+	allocator, err := NewPortAllocator(100, 110)
+	if err != nil {
+		t.Fatalf("failed to NewPortAllocator, %++v", err)
+	}
+	_, err = allocator.Select(client)
+	if !IsPermissionError(err) || !strings.Contains(err.Error(), "cannot list pods in all namespaces") {
+		t.Fatalf("expect PermissionError, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "set the port explicitly") {
+		t.Errorf("permission error should suggest a workaround, got %v", err)
+	}
+
+	// a requested port is reserved unchecked, and returned with the PermissionError
+	port, err := allocator.SelectWithDefault(client, 105)
+	if !IsPermissionError(err) || port != 105 {
+		t.Errorf("expect port 105 with a PermissionError, got %d, %v", port, err)
+	}
+	if port, err := allocator.SelectWithDefault(client, 0); !IsPermissionError(err) || port != 0 {
+		t.Errorf("expect no port to be selected automatically, got %d, %v", port, err)
+	}
+}
@@ -0,0 +1,117 @@
+package base
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// the client-go defaults of 5 QPS and 10 burst are too low to scan the pods of large clusters
+const DEFAULT_CLIENT_QPS = 20
+const DEFAULT_CLIENT_BURST = 40
+const DEFAULT_USER_AGENT = "gpu-metric"
+
+// the namespace of the pod mounted with its service account
+const SERVICE_ACCOUNT_NAMESPACE_FILE = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// ClientOptions configures the kubernetes client, the zero value loads the default kubeconfig,
+// or the service account of the pod when running in the cluster without a kubeconfig
+type ClientOptions struct {
+	// Kubeconfig is the path to the kubeconfig file, KUBECONFIG and ~/.kube/config by default
+	Kubeconfig string
+	// Context is the kubeconfig context, the current context by default
+	Context string
+	// Namespace overrides the namespace of the context
+	Namespace string
+	// InCluster uses the service account of the pod and ignores the kubeconfig
+	InCluster bool
+	// Impersonate and ImpersonateGroups act as another user, like kubectl --as and --as-group
+	Impersonate       string
+	ImpersonateGroups []string
+	QPS               float32
+	Burst             int
+	Timeout           time.Duration
+	UserAgent         string
+}
+
+func (o ClientOptions) clientConfig() clientcmd.ClientConfig {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = o.Kubeconfig
+	overrides := &clientcmd.ConfigOverrides{
+		CurrentContext: o.Context,
+	}
+	overrides.Context.Namespace = o.Namespace
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides)
+}
+
+// RESTConfig returns the REST config of the options, shared by the clientset,
+// the prometheus proxy and the other clients
+func (o ClientOptions) RESTConfig() (*rest.Config, error) {
+	var restConfig *rest.Config
+	var err error
+	if o.InCluster {
+		restConfig, err = rest.InClusterConfig()
+	} else {
+		restConfig, err = o.clientConfig().ClientConfig()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubernetes client config, %v", err)
+	}
+
+	if len(o.Impersonate) > 0 || len(o.ImpersonateGroups) > 0 {
+		if len(o.Impersonate) == 0 {
+			return nil, fmt.Errorf("impersonating groups requires impersonating a user")
+		}
+		restConfig.Impersonate = rest.ImpersonationConfig{UserName: o.Impersonate, Groups: o.ImpersonateGroups}
+	}
+	restConfig.QPS = o.QPS
+	if restConfig.QPS == 0 {
+		restConfig.QPS = DEFAULT_CLIENT_QPS
+	}
+	restConfig.Burst = o.Burst
+	if restConfig.Burst == 0 {
+		restConfig.Burst = DEFAULT_CLIENT_BURST
+	}
+	if o.Timeout > 0 {
+		restConfig.Timeout = o.Timeout
+	}
+	restConfig.UserAgent = o.UserAgent
+	if len(restConfig.UserAgent) == 0 {
+		restConfig.UserAgent = fmt.Sprintf("%s %s", DEFAULT_USER_AGENT, rest.DefaultKubernetesUserAgent())
+	}
+	return restConfig, nil
+}
+
+// GetNamespace returns the namespace of the options, the context or the pod
+func (o ClientOptions) GetNamespace() (string, error) {
+	if len(o.Namespace) > 0 {
+		return o.Namespace, nil
+	}
+	if o.InCluster {
+		data, err := ioutil.ReadFile(SERVICE_ACCOUNT_NAMESPACE_FILE)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	namespace, _, err := o.clientConfig().Namespace()
+	return namespace, err
+}
+
+// NewClient creates the kubernetes client and returns it with its REST config
+func NewClient(o ClientOptions) (kubernetes.Interface, *rest.Config, error) {
+	restConfig, err := o.RESTConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, restConfig, nil
+}
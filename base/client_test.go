@@ -0,0 +1,102 @@
+package base
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: dev
+  cluster:
+    server: https://dev.example.com
+- name: prod
+  cluster:
+    server: https://prod.example.com
+users:
+- name: admin
+  user:
+    token: secret
+contexts:
+- name: dev
+  context:
+    cluster: dev
+    user: admin
+    namespace: team-a
+- name: prod
+  context:
+    cluster: prod
+    user: admin
+current-context: dev
+`
+
+func writeTestKubeconfig(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	if err != nil {
+		t.Fatalf("failed to create temp dir, %++v", err)
+	}
+	path := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(path, []byte(testKubeconfig), 0600); err != nil {
+		t.Fatalf("failed to write kubeconfig, %++v", err)
+	}
+	return path
+}
+
+func TestNewClient(t *testing.T) {
+	path := writeTestKubeconfig(t)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	client, restConfig, err := NewClient(ClientOptions{Kubeconfig: path})
+	if err != nil || client == nil {
+		t.Fatalf("failed to NewClient, %++v", err)
+	}
+	if restConfig.Host != "https://dev.example.com" || restConfig.BearerToken != "secret" {
+		t.Errorf("expect the current context dev, got %s", restConfig.Host)
+	}
+	if restConfig.QPS != DEFAULT_CLIENT_QPS || restConfig.Burst != DEFAULT_CLIENT_BURST {
+		t.Errorf("expect default QPS and burst, got %v and %d", restConfig.QPS, restConfig.Burst)
+	}
+	if !strings.HasPrefix(restConfig.UserAgent, DEFAULT_USER_AGENT+" ") {
+		t.Errorf("unexpected user agent %s", restConfig.UserAgent)
+	}
+	if namespace, err := (ClientOptions{Kubeconfig: path}).GetNamespace(); err != nil || namespace != "team-a" {
+		t.Errorf("expect namespace team-a, got %s, %v", namespace, err)
+	}
+
+	options := ClientOptions{
+		Kubeconfig:        path,
+		Context:           "prod",
+		Impersonate:       "alice",
+		ImpersonateGroups: []string{"team-b"},
+		QPS:               50,
+		Burst:             100,
+		UserAgent:         "job-portal",
+	}
+	_, restConfig, err = NewClient(options)
+	if err != nil {
+		t.Fatalf("failed to NewClient, %++v", err)
+	}
+	if restConfig.Host != "https://prod.example.com" {
+		t.Errorf("expect context prod, got %s", restConfig.Host)
+	}
+	if restConfig.Impersonate.UserName != "alice" || len(restConfig.Impersonate.Groups) != 1 {
+		t.Errorf("unexpected impersonation %++v", restConfig.Impersonate)
+	}
+	if restConfig.QPS != 50 || restConfig.Burst != 100 || restConfig.UserAgent != "job-portal" {
+		t.Errorf("unexpected rest config %++v", restConfig)
+	}
+	if namespace, err := options.GetNamespace(); err != nil || namespace != "default" {
+		t.Errorf("expect namespace default, got %s, %v", namespace, err)
+	}
+
+	if _, _, err := NewClient(ClientOptions{Kubeconfig: path, ImpersonateGroups: []string{"team-b"}}); err == nil {
+		t.Errorf("impersonating groups without user should fail")
+	}
+	if _, _, err := NewClient(ClientOptions{Kubeconfig: path, Context: "missing"}); err == nil {
+		t.Errorf("missing context should fail")
+	}
+}
@@ -0,0 +1,87 @@
+package base
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// nodeProtocol keys the ports used or reserved on a node with a protocol
+type nodeProtocol struct {
+	node     string
+	protocol v1.Protocol
+}
+
+// SelectForNodes reserves the lowest port of the range which is free with protocol on all the
+// nodes, for hostNetwork pods which will be scheduled on them. Pods on other nodes don't
+// block the port, NodePort services block it on every node.
+func (a *PortAllocator) SelectForNodes(client kubernetes.Interface, nodes []string, protocol v1.Protocol) (int, error) {
+	if len(nodes) == 0 {
+		return 0, fmt.Errorf("no candidate nodes to select port")
+	}
+	if err := a.ensureInitialized(client); err != nil {
+		return 0, err
+	}
+	protocol = protocolOrDefault(protocol)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	unavailable := a.reserved
+	if used := a.clusterUsed[protocol]; used != nil {
+		unavailable.union(used)
+	}
+	for _, node := range nodes {
+		key := nodeProtocol{node: node, protocol: protocol}
+		for port := range a.nodeUsed[key] {
+			unavailable.set(port)
+		}
+		for port := range a.nodeReserved[key] {
+			unavailable.set(port)
+		}
+	}
+	for port := a.min; port < a.max; port++ {
+		if unavailable.has(port) || a.nodePortRange.Contains(port) {
+			continue
+		}
+		for _, node := range nodes {
+			key := nodeProtocol{node: node, protocol: protocol}
+			if a.nodeReserved[key] == nil {
+				a.nodeReserved[key] = map[int]bool{}
+			}
+			a.nodeReserved[key][port] = true
+		}
+		return port, nil
+	}
+	return 0, fmt.Errorf("failed to select a %s port in [%d, %d) available on nodes %v", protocol, a.min, a.max, nodes)
+}
+
+// ReleaseForNodes makes a port reserved by SelectForNodes available again
+func (a *PortAllocator) ReleaseForNodes(port int, nodes []string, protocol v1.Protocol) {
+	protocol = protocolOrDefault(protocol)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, node := range nodes {
+		key := nodeProtocol{node: node, protocol: protocol}
+		delete(a.nodeReserved[key], port)
+		if len(a.nodeReserved[key]) == 0 {
+			delete(a.nodeReserved, key)
+		}
+	}
+}
+
+// nodeReservedAny returns the ports reserved on any node, the caller must hold the lock
+func (a *PortAllocator) nodeReservedAny() portBitmap {
+	reserved := portBitmap{}
+	for _, ports := range a.nodeReserved {
+		for port := range ports {
+			reserved.set(port)
+		}
+	}
+	return reserved
+}
+
+// Select a port available with protocol on all the candidate nodes of a hostNetwork job
+func SelectAvailablePortForNodes(client kubernetes.Interface, nodes []string, protocol v1.Protocol) (int, error) {
+	return defaultPortAllocator.SelectForNodes(client, nodes, protocol)
+}
@@ -0,0 +1,83 @@
+package base
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newHostNetworkPod(name string, node string, port int32, protocol v1.Protocol) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: meta_v1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: v1.PodSpec{
+			NodeName:    node,
+			HostNetwork: true,
+			Containers: []v1.Container{{
+				Name:  "c",
+				Ports: []v1.ContainerPort{{ContainerPort: port, Protocol: protocol}},
+			}},
+		},
+	}
+}
+
+func TestSelectForNodes(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newHostNetworkPod("a", "node1", 100, v1.ProtocolTCP),
+		newHostNetworkPod("b", "node2", 101, ""),
+		newHostNetworkPod("c", "node3", 102, v1.ProtocolTCP),
+		newHostNetworkPod("d", "node1", 103, v1.ProtocolUDP),
+		&v1.Service{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "svc", Namespace: "default"},
+			Spec: v1.ServiceSpec{
+				Type:  v1.ServiceTypeNodePort,
+				Ports: []v1.ServicePort{{Port: 80, NodePort: 104}},
+			},
+		},
+	)
+	allocator, err := NewPortAllocator(100, 110)
+	if err != nil {
+		t.Fatalf("failed to NewPortAllocator, %++v", err)
+	}
+
+	// 100 and 101 are used on the candidates, 102 only on node3
+	port, err := allocator.SelectForNodes(client, []string{"node1", "node2"}, v1.ProtocolTCP)
+	if err != nil || port != 102 {
+		t.Errorf("expect port 102, got %d, %v", port, err)
+	}
+	// 101 is only used on node2
+	port, err = allocator.SelectForNodes(client, []string{"node1"}, v1.ProtocolTCP)
+	if err != nil || port != 101 {
+		t.Errorf("expect port 101, got %d, %v", port, err)
+	}
+	// node reservations don't block other nodes, NodePort 104 is used on every node
+	port, err = allocator.SelectForNodes(client, []string{"node4"}, "")
+	if err != nil || port != 100 {
+		t.Errorf("expect port 100, got %d, %v", port, err)
+	}
+	// TCP ports don't block UDP
+	port, err = allocator.SelectForNodes(client, []string{"node1"}, v1.ProtocolUDP)
+	if err != nil || port != 100 {
+		t.Errorf("expect port 100, got %d, %v", port, err)
+	}
+	// a cluster wide port must be free on every node
+	port, err = allocator.Select(client)
+	if err != nil || port != 105 {
+		t.Errorf("expect port 105, got %d, %v", port, err)
+	}
+
+	allocator.ReleaseForNodes(102, []string{"node1", "node2"}, v1.ProtocolTCP)
+	port, err = allocator.SelectForNodes(client, []string{"node2"}, v1.ProtocolTCP)
+	if err != nil || port != 100 {
+		t.Errorf("expect port 100, got %d, %v", port, err)
+	}
+	port, err = allocator.SelectForNodes(client, []string{"node2"}, v1.ProtocolTCP)
+	if err != nil || port != 102 {
+		t.Errorf("expect released port 102, got %d, %v", port, err)
+	}
+
+	if _, err := allocator.SelectForNodes(client, nil, v1.ProtocolTCP); err == nil {
+		t.Errorf("SelectForNodes without nodes should return error")
+	}
+}
@@ -0,0 +1,76 @@
+package base
+
+import (
+	v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+)
+
+// LIST_PAGE_SIZE is the number of objects fetched per request when scanning large lists
+const LIST_PAGE_SIZE = 500
+
+// ACTIVE_POD_FIELD_SELECTOR selects the pods scheduled on a node which are not terminated
+var ACTIVE_POD_FIELD_SELECTOR = fields.AndSelectors(
+	fields.OneTermNotEqualSelector("spec.nodeName", ""),
+	fields.OneTermNotEqualSelector("status.phase", string(v1.PodSucceeded)),
+	fields.OneTermNotEqualSelector("status.phase", string(v1.PodFailed)),
+).String()
+
+// RUNNING_POD_FIELD_SELECTOR selects the running pods
+var RUNNING_POD_FIELD_SELECTOR = fields.OneTermEqualSelector("status.phase", string(v1.PodRunning)).String()
+
+// EachPod calls fn on each pod of namespace matching opts, the pods are listed page by page
+// so that the whole list of a large cluster is never held in memory at once
+func EachPod(client kubernetes.Interface, namespace string, opts meta_v1.ListOptions, fn func(pod *v1.Pod) error) error {
+	if opts.Limit == 0 {
+		opts.Limit = LIST_PAGE_SIZE
+	}
+	for {
+		podList, err := client.CoreV1().Pods(namespace).List(opts)
+		if err != nil {
+			return ToPermissionError(err, "list", "pods", namespace)
+		}
+		for i := range podList.Items {
+			if err := fn(&podList.Items[i]); err != nil {
+				return err
+			}
+		}
+		if len(podList.Continue) == 0 {
+			return nil
+		}
+		opts.Continue = podList.Continue
+	}
+}
+
+// ListAllPods returns the pods of namespace matching opts, listed page by page
+func ListAllPods(client kubernetes.Interface, namespace string, opts meta_v1.ListOptions) ([]v1.Pod, error) {
+	pods := []v1.Pod{}
+	err := EachPod(client, namespace, opts, func(pod *v1.Pod) error {
+		pods = append(pods, *pod)
+		return nil
+	})
+	return pods, err
+}
+
+// EachService calls fn on each service of namespace matching opts, listed page by page
+func EachService(client kubernetes.Interface, namespace string, opts meta_v1.ListOptions, fn func(service *v1.Service) error) error {
+	if opts.Limit == 0 {
+		opts.Limit = LIST_PAGE_SIZE
+	}
+	for {
+		serviceList, err := client.CoreV1().Services(namespace).List(opts)
+		if err != nil {
+			return ToPermissionError(err, "list", "services", namespace)
+		}
+		for i := range serviceList.Items {
+			if err := fn(&serviceList.Items[i]); err != nil {
+				return err
+			}
+		}
+		if len(serviceList.Continue) == 0 {
+			return nil
+		}
+		opts.Continue = serviceList.Continue
+	}
+}
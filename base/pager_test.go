@@ -0,0 +1,138 @@
+package base
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// pagingClient serves the pods page by page like the API server, as the fake clientset
+// ignores Limit and Continue
+type pagingClient struct {
+	*fake.Clientset
+	pods     []v1.Pod
+	requests []meta_v1.ListOptions
+}
+
+func (c *pagingClient) CoreV1() corev1.CoreV1Interface {
+	return &pagingCoreV1{CoreV1Interface: c.Clientset.CoreV1(), client: c}
+}
+
+type pagingCoreV1 struct {
+	corev1.CoreV1Interface
+	client *pagingClient
+}
+
+func (c *pagingCoreV1) Pods(namespace string) corev1.PodInterface {
+	return &pagingPods{PodInterface: c.CoreV1Interface.Pods(namespace), client: c.client}
+}
+
+type pagingPods struct {
+	corev1.PodInterface
+	client *pagingClient
+}
+
+func (p *pagingPods) List(opts meta_v1.ListOptions) (*v1.PodList, error) {
+	p.client.requests = append(p.client.requests, opts)
+	start := 0
+	if len(opts.Continue) > 0 {
+		var err error
+		if start, err = strconv.Atoi(opts.Continue); err != nil {
+			return nil, err
+		}
+	}
+	end := len(p.client.pods)
+	if opts.Limit > 0 && start+int(opts.Limit) < end {
+		end = start + int(opts.Limit)
+	}
+	list := &v1.PodList{Items: p.client.pods[start:end]}
+	if end < len(p.client.pods) {
+		list.Continue = strconv.Itoa(end)
+	}
+	return list, nil
+}
+
+func newTestPods(n int) []v1.Pod {
+	pods := make([]v1.Pod, 0, n)
+	for i := 0; i < n; i++ {
+		pod := newHostNetworkPod(fmt.Sprintf("pod-%d", i), fmt.Sprintf("node-%d", i%1000), int32(20000+i%10000), v1.ProtocolTCP)
+		if i%10 == 0 {
+			pod.Status.Phase = v1.PodSucceeded
+		}
+		pods = append(pods, *pod)
+	}
+	return pods
+}
+
+func TestEachPodPaging(t *testing.T) {
+	client := &pagingClient{Clientset: fake.NewSimpleClientset(), pods: newTestPods(1200)}
+	ports, err := getClusterUsedNodePorts(client)
+	if err != nil {
+		t.Fatalf("failed to getClusterUsedNodePorts, %++v", err)
+	}
+	// the terminated pods are skipped even if the server ignores the field selector
+	if len(ports) != 1080 {
+		t.Errorf("expect 1080 used ports, got %d", len(ports))
+	}
+	if len(client.requests) != 3 {
+		t.Fatalf("expect 3 pages, got %d", len(client.requests))
+	}
+	for i, opts := range client.requests {
+		if opts.Limit != LIST_PAGE_SIZE || opts.FieldSelector != ACTIVE_POD_FIELD_SELECTOR {
+			t.Errorf("unexpected list options %++v", opts)
+		}
+		if i > 0 && opts.Continue != strconv.Itoa(i*LIST_PAGE_SIZE) {
+			t.Errorf("page %d should continue from %d, got %q", i, i*LIST_PAGE_SIZE, opts.Continue)
+		}
+	}
+	expected := "spec.nodeName!=,status.phase!=Succeeded,status.phase!=Failed"
+	if ACTIVE_POD_FIELD_SELECTOR != expected {
+		t.Errorf("expect field selector %s, got %s", expected, ACTIVE_POD_FIELD_SELECTOR)
+	}
+}
+
+func benchmarkGetClusterUsedNodePorts(b *testing.B, client kubernetes.Interface) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := getClusterUsedNodePorts(client); err != nil {
+			b.Fatalf("failed to getClusterUsedNodePorts, %++v", err)
+		}
+	}
+}
+
+func BenchmarkGetClusterUsedNodePorts20kPodsPaged(b *testing.B) {
+	benchmarkGetClusterUsedNodePorts(b, &pagingClient{Clientset: fake.NewSimpleClientset(), pods: newTestPods(20000)})
+}
+
+func BenchmarkGetClusterUsedNodePorts20kPodsFake(b *testing.B) {
+	pods := newTestPods(20000)
+	objects := make([]runtime.Object, 0, len(pods))
+	for i := range pods {
+		objects = append(objects, &pods[i])
+	}
+	benchmarkGetClusterUsedNodePorts(b, fake.NewSimpleClientset(objects...))
+}
+
+func BenchmarkPortAllocatorRefresh20kPods(b *testing.B) {
+	client := &pagingClient{Clientset: fake.NewSimpleClientset(), pods: newTestPods(20000)}
+	allocator, err := NewPortAllocator(AUTO_SELECT_PORT_MIN, AUTO_SELECT_PORT_MAX)
+	if err != nil {
+		b.Fatalf("failed to NewPortAllocator, %++v", err)
+	}
+	allocator.SetNodePortRange(PortRange{Min: 30000, Max: 32767})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := allocator.Refresh(client); err != nil {
+			b.Fatalf("failed to Refresh, %++v", err)
+		}
+	}
+}
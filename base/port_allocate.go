@@ -1,119 +1,368 @@
 package base
 
 import (
-	"k8s.io/client-go/kubernetes"
-	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	v1 "k8s.io/api/core/v1"
-	log "github.com/sirupsen/logrus"
 	"fmt"
-)
+	"sync"
 
-var k8sClusterUsedPorts = []int{}
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
 
 const AUTO_SELECT_PORT_MIN = 20000
 const AUTO_SELECT_PORT_MAX = 30000
 
-// If default port is available, use it
-// If not set defaultPort, select port automatically
-func SelectAvailablePortWithDefault(client *kubernetes.Clientset, port int) (int, error) {
-	// if set port, return the port
-	if port != 0 {
-		return port, nil
-	}
-	return SelectAvailablePort(client)
+const MAX_PORT = 65535
+
+// defaultPortAllocator backs the package level functions
+var defaultPortAllocator, _ = NewPortAllocator(AUTO_SELECT_PORT_MIN, AUTO_SELECT_PORT_MAX)
+
+// portBitmap is a set of ports
+type portBitmap [(MAX_PORT + 1) / 64]uint64
+
+func (b *portBitmap) set(port int) {
+	b[port/64] |= 1 << uint(port%64)
 }
 
-// Select a available port in range (AUTO_SELECT_PORT_MIN ~ AUTO_SELECT_PORT_MAX), and exclude used ports in k8s
-// if 20000 is selected this time, make sure next time it will select 20001
-func SelectAvailablePort(client *kubernetes.Clientset) (int, error) {
-	if _, err := initK8sClusterUsedPort(client); err != nil {
-		return 0, err
+func (b *portBitmap) clear(port int) {
+	b[port/64] &^= 1 << uint(port%64)
+}
+
+func (b *portBitmap) has(port int) bool {
+	return b[port/64]&(1<<uint(port%64)) != 0
+}
+
+func (b *portBitmap) union(other *portBitmap) {
+	for i := range b {
+		b[i] |= other[i]
 	}
-	port := AUTO_SELECT_PORT_MIN
-	for port < AUTO_SELECT_PORT_MAX {
-		if ! isPortInUsed(port) {
-			setUsedPort(port)
-			return port, nil
-		}
-		port ++
+}
+
+// PortAllocator selects available ports in [min, max), excluding the ports used in the k8s cluster
+// and the ports it already reserved. It is safe for concurrent use.
+type PortAllocator struct {
+	mu  sync.Mutex
+	min int
+	max int
+
+	// ports used by pods and services of the cluster on any node, replaced on Refresh
+	used portBitmap
+	// the pods and services using a port
+	usedBy map[int][]UsedPort
+	// ports used on every node by NodePort services, by protocol
+	clusterUsed map[v1.Protocol]*portBitmap
+	clusterRefs map[v1.Protocol]map[int]int
+	// the number of pods using a port on a node, by protocol
+	nodeUsed map[nodeProtocol]map[int]int
+	// ports reserved by this allocator, kept on Refresh until released
+	reserved portBitmap
+	// ports reserved by this allocator on some nodes only
+	nodeReserved map[nodeProtocol]map[int]bool
+	// ports the API server allocates NodePort services from, never selected
+	nodePortRange PortRange
+	// nodePortRange is set explicitly instead of discovered on Refresh
+	nodePortRangeSet bool
+
+	initialized bool
+	// used ports are kept up to date by a PortTracker instead of Refresh
+	tracker *PortTracker
+}
+
+// NewPortAllocator returns an allocator of the ports in [min, max)
+func NewPortAllocator(min int, max int) (*PortAllocator, error) {
+	if min <= 0 || max > MAX_PORT+1 || min >= max {
+		return nil, fmt.Errorf("invalid port range [%d, %d)", min, max)
 	}
-	return 0, fmt.Errorf("failed to select a available port")
+	return &PortAllocator{
+		min:          min,
+		max:          max,
+		usedBy:       map[int][]UsedPort{},
+		clusterUsed:  map[v1.Protocol]*portBitmap{},
+		clusterRefs:  map[v1.Protocol]map[int]int{},
+		nodeUsed:     map[nodeProtocol]map[int]int{},
+		nodeReserved: map[nodeProtocol]map[int]bool{},
+	}, nil
+}
+
+// Range returns the range [min, max) of the allocator
+func (a *PortAllocator) Range() (int, int) {
+	return a.min, a.max
+}
+
+// SetNodePortRange sets the service-node-port-range of the API server instead of discovering it
+func (a *PortAllocator) SetNodePortRange(r PortRange) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.nodePortRange = r
+	a.nodePortRangeSet = true
+}
+
+// NodePortRange returns the NodePort range excluded from selection
+func (a *PortAllocator) NodePortRange() PortRange {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.nodePortRange
 }
 
-func initK8sClusterUsedPort(client *kubernetes.Clientset) ([]int, error) {
-	if len(k8sClusterUsedPorts) == 0 {
+// Refresh replaces the used ports with the ports currently used in the cluster,
+// and discovers the NodePort range unless it was set.
+// The used ports of an allocator tracked by a PortTracker are not replaced.
+func (a *PortAllocator) Refresh(client kubernetes.Interface) error {
+	a.mu.Lock()
+	discover := !a.nodePortRangeSet
+	tracked := a.tracker != nil
+	a.mu.Unlock()
+
+	ports := []UsedPort{}
+	if !tracked {
 		var err error
-		k8sClusterUsedPorts, err = getClusterUsedNodePorts(client)
-		if err != nil {
-			return k8sClusterUsedPorts, err
+		if ports, err = getClusterUsedNodePorts(client); err != nil {
+			return err
 		}
 	}
-	return k8sClusterUsedPorts, nil
+	nodePortRange := PortRange{}
+	if discover {
+		nodePortRange = DiscoverNodePortRange(client)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if discover && !a.nodePortRangeSet {
+		a.nodePortRange = nodePortRange
+	}
+	if !tracked {
+		a.setUsedPorts(ports)
+	}
+	return nil
 }
 
-// Gather used node ports for k8s cluster
-// 1. HostNetwork pod's HostPort
-// 2. NodePort / Loadbalancer Service's NodePort
+func (a *PortAllocator) setUsedPorts(ports []UsedPort) {
+	a.used = portBitmap{}
+	a.usedBy = map[int][]UsedPort{}
+	a.clusterUsed = map[v1.Protocol]*portBitmap{}
+	a.clusterRefs = map[v1.Protocol]map[int]int{}
+	a.nodeUsed = map[nodeProtocol]map[int]int{}
+	a.updateUsedPorts(nil, ports)
+	a.initialized = true
+}
 
-func getClusterUsedNodePorts(client *kubernetes.Clientset) ([]int, error) {
-	pods, err := client.CoreV1().Pods("").List(meta_v1.ListOptions{})
-	if err != nil {
-		return k8sClusterUsedPorts, err
+// updateUsedPorts removes the ports no longer used and adds the newly used ones,
+// the caller must hold the lock
+func (a *PortAllocator) updateUsedPorts(removed []UsedPort, added []UsedPort) {
+	for _, port := range removed {
+		a.addUsedPort(port, -1)
 	}
-	for _, pod := range pods.Items {
-		// fileter pod
-		if excludeInactivePod(&pod) {
-			continue
+	for _, port := range added {
+		a.addUsedPort(port, 1)
+	}
+}
+
+func (a *PortAllocator) addUsedPort(port UsedPort, delta int) {
+	if !validPort(port.Port) {
+		return
+	}
+	if delta > 0 {
+		a.usedBy[port.Port] = append(a.usedBy[port.Port], port)
+	} else {
+		a.usedBy[port.Port] = removeUsedPort(a.usedBy[port.Port], port)
+	}
+	if len(a.usedBy[port.Port]) > 0 {
+		a.used.set(port.Port)
+	} else {
+		delete(a.usedBy, port.Port)
+		a.used.clear(port.Port)
+	}
+
+	protocol := protocolOrDefault(port.Protocol)
+	if len(port.NodeName) == 0 {
+		if a.clusterRefs[protocol] == nil {
+			a.clusterRefs[protocol] = map[int]int{}
+			a.clusterUsed[protocol] = &portBitmap{}
 		}
-		for _, container := range pod.Spec.Containers {
-			for _, port := range container.Ports {
-				usedHostPort := port.HostPort
-				if pod.Spec.HostNetwork {
-					usedHostPort = port.ContainerPort
-				}
-
-				k8sClusterUsedPorts = append(k8sClusterUsedPorts, int(usedHostPort))
-			}
+		if addRef(a.clusterRefs[protocol], port.Port, delta) {
+			a.clusterUsed[protocol].set(port.Port)
+		} else {
+			a.clusterUsed[protocol].clear(port.Port)
 		}
+		return
 	}
-
-	services, err := client.CoreV1().Services("").List(meta_v1.ListOptions{})
-	if err != nil {
-		return k8sClusterUsedPorts, err
+	key := nodeProtocol{node: port.NodeName, protocol: protocol}
+	if a.nodeUsed[key] == nil {
+		a.nodeUsed[key] = map[int]int{}
 	}
-	for _, service := range services.Items {
-		if service.Spec.Type == v1.ServiceTypeNodePort || service.Spec.Type == v1.ServiceTypeLoadBalancer {
-			for _, port := range service.Spec.Ports {
-				k8sClusterUsedPorts = append(k8sClusterUsedPorts, int(port.NodePort))
-			}
+	addRef(a.nodeUsed[key], port.Port, delta)
+	if len(a.nodeUsed[key]) == 0 {
+		delete(a.nodeUsed, key)
+	}
+}
+
+func removeUsedPort(ports []UsedPort, port UsedPort) []UsedPort {
+	for i := range ports {
+		if ports[i] == port {
+			return append(ports[:i:i], ports[i+1:]...)
 		}
 	}
-	log.Debug("Get K8S used ports, %++v", k8sClusterUsedPorts)
-	return k8sClusterUsedPorts, nil
+	return ports
+}
+
+// addRef adds delta to the references of port and returns true if port is still referenced
+func addRef(refs map[int]int, port int, delta int) bool {
+	refs[port] += delta
+	if refs[port] <= 0 {
+		delete(refs, port)
+		return false
+	}
+	return true
 }
 
-// exclude Inactive pod when compute ports
-func excludeInactivePod(pod *v1.Pod) bool {
-	// pod not assigned
-	if len(pod.Spec.NodeName) == 0 {
-		return true
+// ensureInitialized gathers the cluster used ports on first use,
+// a tracked allocator fails until the tracker is ready instead
+func (a *PortAllocator) ensureInitialized(client kubernetes.Interface) error {
+	a.mu.Lock()
+	initialized := a.initialized
+	tracked := a.tracker != nil
+	a.mu.Unlock()
+	if initialized {
+		return nil
 	}
-	// pod is Successed or failed
-	if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
-		return true
+	if tracked {
+		return ErrPortTrackerNotReady
+	}
+	return a.Refresh(client)
+}
+
+// Reserve marks port as used by the caller, it fails with a PortConflictError if the port is already used or reserved
+func (a *PortAllocator) Reserve(port int) error {
+	if !validPort(port) {
+		return fmt.Errorf("invalid port %d", port)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.conflict(port); err != nil {
+		return err
+	}
+	a.reserved.set(port)
+	return nil
+}
+
+// Release makes a reserved port available again
+func (a *PortAllocator) Release(port int) {
+	if !validPort(port) {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.reserved.clear(port)
+}
+
+// IsPortInUsed returns true if port is used in the cluster, reserved,
+// or may be allocated to a NodePort service by the API server
+func (a *PortAllocator) IsPortInUsed(port int) bool {
+	if !validPort(port) {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	nodeReserved := a.nodeReservedAny()
+	return a.used.has(port) || a.reserved.has(port) || nodeReserved.has(port) || a.nodePortRange.Contains(port)
+}
+
+// Select reserves the lowest available port of the range,
+// if 20000 is selected this time, make sure next time it will select 20001
+func (a *PortAllocator) Select(client kubernetes.Interface) (int, error) {
+	if err := a.ensureInitialized(client); err != nil {
+		return 0, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	nodeReserved := a.nodeReservedAny()
+	for port := a.min; port < a.max; port++ {
+		if !a.used.has(port) && !a.reserved.has(port) && !nodeReserved.has(port) && !a.nodePortRange.Contains(port) {
+			a.reserved.set(port)
+			return port, nil
+		}
 	}
-	return false
+	return 0, fmt.Errorf("failed to select a available port in [%d, %d)", a.min, a.max)
 }
 
-func isPortInUsed(port int) bool {
-	for _, usedPort := range k8sClusterUsedPorts {
-		if port == usedPort {
-			return true
+// SelectWithDefault reserves port if it is set and available, otherwise selects a port automatically.
+// A PortConflictError explains why a set port is not available. If the user is not allowed to list the
+// used ports, a set port is reserved unchecked and returned with the PermissionError, so that the caller
+// decides whether to use it.
+func (a *PortAllocator) SelectWithDefault(client kubernetes.Interface, port int) (int, error) {
+	if port == 0 {
+		return a.Select(client)
+	}
+	if !validPort(port) {
+		return 0, fmt.Errorf("invalid port %d", port)
+	}
+	if err := a.ensureInitialized(client); err != nil {
+		if !IsPermissionError(err) {
+			return 0, err
 		}
+		// with namespace scoped permissions the requested port can't be checked
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.reserved.set(port)
+		return port, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.conflict(port); err != nil {
+		return 0, err
+	}
+	a.reserved.set(port)
+	return port, nil
+}
+
+// conflict returns a PortConflictError if port is not available, the caller must hold the lock
+func (a *PortAllocator) conflict(port int) error {
+	nodeReserved := a.nodeReservedAny()
+	switch {
+	case a.used.has(port):
+		return &PortConflictError{Port: port, Holders: append([]UsedPort{}, a.usedBy[port]...)}
+	case a.reserved.has(port) || nodeReserved.has(port):
+		return &PortConflictError{Port: port, Reason: "reserved by a previous selection"}
+	case a.nodePortRange.Contains(port):
+		return &PortConflictError{Port: port, Reason: fmt.Sprintf("in the NodePort range %s of the API server", a.nodePortRange)}
+	}
+	return nil
+}
+
+// Check returns a PortConflictError if port is not available
+func (a *PortAllocator) Check(port int) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.conflict(port)
+}
+
+// UsedBy returns the pods and services using port
+func (a *PortAllocator) UsedBy(port int) []UsedPort {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]UsedPort{}, a.usedBy[port]...)
+}
+
+// If default port is available, use it
+// If not set defaultPort, select port automatically
+// If the port can't be checked, it is returned with a PermissionError
+func SelectAvailablePortWithDefault(client kubernetes.Interface, port int) (int, error) {
+	return defaultPortAllocator.SelectWithDefault(client, port)
+}
+
+// Select a available port in range (AUTO_SELECT_PORT_MIN ~ AUTO_SELECT_PORT_MAX), and exclude used ports in k8s
+// if 20000 is selected this time, make sure next time it will select 20001
+func SelectAvailablePort(client kubernetes.Interface) (int, error) {
+	return defaultPortAllocator.Select(client)
+}
+
+// protocolOrDefault returns TCP for an unset protocol, as the API server defaults it
+func protocolOrDefault(protocol v1.Protocol) v1.Protocol {
+	if len(protocol) == 0 {
+		return v1.ProtocolTCP
 	}
-	return false
+	return protocol
 }
 
-func setUsedPort(port int) {
-	k8sClusterUsedPorts = append(k8sClusterUsedPorts, port)
+func validPort(port int) bool {
+	return port > 0 && port <= MAX_PORT
 }
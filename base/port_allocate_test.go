@@ -1,7 +1,12 @@
 package base
 
 import (
+	"sync"
 	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 
@@ -25,8 +30,12 @@ func TestSelectAvailablePort(t *testing.T)  {
 		t.Errorf("Port should be %d, when latest port is %d", port1 + 1, port1)
 	}
 
-	k8sClusterUsedPorts = []int {20000, 20001}
-	port3, err := SelectAvailablePort(clientset)
+	allocator, err := NewPortAllocator(AUTO_SELECT_PORT_MIN, AUTO_SELECT_PORT_MAX)
+	if err != nil {
+		t.Fatalf("failed to NewPortAllocator, %++v", err)
+	}
+	allocator.setUsedPorts([]UsedPort {{Port: 20000}, {Port: 20001}})
+	port3, err := allocator.Select(clientset)
 	if err != nil {
 		t.Errorf("failed to SelectAvailablePort, %++v", err)
 	}
@@ -34,13 +43,90 @@ func TestSelectAvailablePort(t *testing.T)  {
 	if port3 != 20002 {
 		t.Errorf("Port should be 30002, when 30000,30001 is used")
 	}
-	port4, err := SelectAvailablePortWithDefault(clientset, port3)
+	port4, err := allocator.SelectWithDefault(clientset, port3)
 	if err == nil {
 		t.Errorf("SelectAvailablePortWithDefault with used port should return error")
 	}
-	port4, err = SelectAvailablePortWithDefault(clientset, 0)
+	port4, err = allocator.SelectWithDefault(clientset, 0)
 	t.Logf("port is %d", port4)
 	if port4 == port3 {
 		t.Errorf("If default port is used, chose another one")
 	}
 }
+
+func TestPortAllocatorConcurrentSelect(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&v1.Pod{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "host", Namespace: "default"},
+			Spec: v1.PodSpec{
+				NodeName:    "node1",
+				HostNetwork: true,
+				Containers:  []v1.Container{{Name: "c", Ports: []v1.ContainerPort{{ContainerPort: 100}}}},
+			},
+		},
+		&v1.Service{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "svc", Namespace: "default"},
+			Spec: v1.ServiceSpec{
+				Type:  v1.ServiceTypeNodePort,
+				Ports: []v1.ServicePort{{Port: 80, NodePort: 101}},
+			},
+		},
+	)
+	allocator, err := NewPortAllocator(100, 200)
+	if err != nil {
+		t.Fatalf("failed to NewPortAllocator, %++v", err)
+	}
+
+	var wg sync.WaitGroup
+	ports := make(chan int, 98)
+	for i := 0; i < 98; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			port, err := allocator.Select(client)
+			if err != nil {
+				t.Errorf("failed to Select, %++v", err)
+				return
+			}
+			ports <- port
+		}()
+	}
+	wg.Wait()
+	close(ports)
+
+	seen := map[int]bool{}
+	for port := range ports {
+		if port == 100 || port == 101 {
+			t.Errorf("port %d is used in cluster and should not be selected", port)
+		}
+		if seen[port] {
+			t.Errorf("port %d is selected twice", port)
+		}
+		seen[port] = true
+	}
+	if _, err := allocator.Select(client); err == nil {
+		t.Errorf("Select should fail when the range is exhausted")
+	}
+
+	allocator.Release(150)
+	if err := allocator.Reserve(150); err != nil {
+		t.Errorf("released port should be reserved again, %++v", err)
+	}
+	if err := allocator.Reserve(100); err == nil {
+		t.Errorf("Reserve a port used in cluster should return error")
+	}
+	if err := allocator.Refresh(client); err != nil {
+		t.Fatalf("failed to Refresh, %++v", err)
+	}
+	if !allocator.IsPortInUsed(150) {
+		t.Errorf("reserved port should be kept on Refresh")
+	}
+}
+
+func TestNewPortAllocatorInvalidRange(t *testing.T) {
+	for _, r := range [][2]int{{0, 10}, {10, 10}, {20, 10}, {10, 70000}} {
+		if _, err := NewPortAllocator(r[0], r[1]); err == nil {
+			t.Errorf("range %v should be invalid", r)
+		}
+	}
+}
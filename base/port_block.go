@@ -0,0 +1,67 @@
+package base
+
+import (
+	"fmt"
+	"sync"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// PortBlock is a set of ports reserved together, such as the SSH, TensorBoard and rendezvous
+// ports of a distributed job, and released together
+type PortBlock struct {
+	Ports     []int
+	allocator *PortAllocator
+	once      sync.Once
+}
+
+// Release makes all the ports of the block available again, it is safe to call more than once
+func (b *PortBlock) Release() {
+	b.once.Do(func() {
+		b.allocator.mu.Lock()
+		defer b.allocator.mu.Unlock()
+		for _, port := range b.Ports {
+			b.allocator.reserved.clear(port)
+		}
+	})
+}
+
+// AllocateBlock reserves n available ports at once, the lowest ones or the lowest n consecutive
+// ports if contiguous. Either all the ports are reserved or none of them.
+func (a *PortAllocator) AllocateBlock(client kubernetes.Interface, n int, contiguous bool) (*PortBlock, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid number of ports %d", n)
+	}
+	if err := a.ensureInitialized(client); err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	nodeReserved := a.nodeReservedAny()
+	ports := make([]int, 0, n)
+	for port := a.min; port < a.max && len(ports) < n; port++ {
+		if a.used.has(port) || a.reserved.has(port) || nodeReserved.has(port) || a.nodePortRange.Contains(port) {
+			if contiguous {
+				ports = ports[:0]
+			}
+			continue
+		}
+		ports = append(ports, port)
+	}
+	if len(ports) < n {
+		kind := "available"
+		if contiguous {
+			kind = "contiguous available"
+		}
+		return nil, fmt.Errorf("failed to select %d %s ports in [%d, %d)", n, kind, a.min, a.max)
+	}
+	for _, port := range ports {
+		a.reserved.set(port)
+	}
+	return &PortBlock{Ports: ports, allocator: a}, nil
+}
+
+// Select n available ports at once in range (AUTO_SELECT_PORT_MIN ~ AUTO_SELECT_PORT_MAX), optionally contiguous
+func AllocatePortBlock(client kubernetes.Interface, n int, contiguous bool) (*PortBlock, error) {
+	return defaultPortAllocator.AllocateBlock(client, n, contiguous)
+}
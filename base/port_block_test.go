@@ -0,0 +1,85 @@
+package base
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestAllocateBlock(t *testing.T) {
+	client := fake.NewSimpleClientset(newHostNetworkPod("a", "node1", 102, v1.ProtocolTCP))
+	allocator, err := NewPortAllocator(100, 110)
+	if err != nil {
+		t.Fatalf("failed to NewPortAllocator, %++v", err)
+	}
+
+	scattered, err := allocator.AllocateBlock(client, 3, false)
+	if err != nil || !reflect.DeepEqual(scattered.Ports, []int{100, 101, 103}) {
+		t.Fatalf("expect ports [100 101 103], got %v, %v", scattered, err)
+	}
+	contiguous, err := allocator.AllocateBlock(client, 3, true)
+	if err != nil || !reflect.DeepEqual(contiguous.Ports, []int{104, 105, 106}) {
+		t.Fatalf("expect ports [104 105 106], got %v, %v", contiguous, err)
+	}
+
+	// only 107-109 are left, nothing is reserved when the block doesn't fit
+	if _, err := allocator.AllocateBlock(client, 4, false); err == nil {
+		t.Errorf("AllocateBlock should fail when not enough ports are available")
+	}
+	if allocator.IsPortInUsed(107) {
+		t.Errorf("a failed AllocateBlock should not reserve any port")
+	}
+
+	scattered.Release()
+	scattered.Release()
+	for _, port := range []int{100, 101, 103} {
+		if allocator.IsPortInUsed(port) {
+			t.Errorf("port %d should be released", port)
+		}
+	}
+	// 100, 101 and 103 are free again but not contiguous
+	block, err := allocator.AllocateBlock(client, 3, true)
+	if err != nil || !reflect.DeepEqual(block.Ports, []int{107, 108, 109}) {
+		t.Errorf("expect ports [107 108 109], got %v, %v", block, err)
+	}
+}
+
+func TestAllocateBlockConcurrent(t *testing.T) {
+	allocator, err := NewPortAllocator(100, 200)
+	if err != nil {
+		t.Fatalf("failed to NewPortAllocator, %++v", err)
+	}
+	client := fake.NewSimpleClientset()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	seen := map[int]bool{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			block, err := allocator.AllocateBlock(client, 5, true)
+			if err != nil {
+				t.Errorf("failed to AllocateBlock, %++v", err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for i, port := range block.Ports {
+				if seen[port] {
+					t.Errorf("port %d is allocated twice", port)
+				}
+				if i > 0 && port != block.Ports[i-1]+1 {
+					t.Errorf("block %v is not contiguous", block.Ports)
+				}
+				seen[port] = true
+			}
+		}()
+	}
+	wg.Wait()
+	if len(seen) != 100 {
+		t.Errorf("expect 100 ports allocated, got %d", len(seen))
+	}
+}
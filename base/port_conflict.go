@@ -0,0 +1,78 @@
+package base
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+)
+
+// PORT_SOURCE_RESERVATION is a port reserved in the cluster by a ClusterPortAllocator
+const PORT_SOURCE_RESERVATION = "reservation"
+
+// PortConflictError is returned when a requested port is not available,
+// Holders are the pods and services using it if any
+type PortConflictError struct {
+	Port    int
+	Holders []UsedPort
+	Reason  string
+}
+
+func (e *PortConflictError) Error() string {
+	if len(e.Holders) == 0 {
+		return fmt.Sprintf("port %d is not available, %s", e.Port, e.Reason)
+	}
+	holders := make([]string, 0, len(e.Holders))
+	for _, holder := range e.Holders {
+		holders = append(holders, holder.String())
+	}
+	return fmt.Sprintf("port %d is in used by %s", e.Port, strings.Join(holders, ", "))
+}
+
+// String describes the holder of the port, e.g. "Pod default/worker-0 on node node1 (TCP hostPort)"
+func (p UsedPort) String() string {
+	node := ""
+	if len(p.NodeName) > 0 {
+		node = " on node " + p.NodeName
+	}
+	usage := p.Source
+	if len(p.Protocol) > 0 {
+		usage = string(p.Protocol) + " " + usage
+	}
+	return fmt.Sprintf("%s%s (%s)", p.Owner, node, usage)
+}
+
+// WhoUses returns the pods, services and reservations using port in the cluster
+func WhoUses(client kubernetes.Interface, port int) ([]UsedPort, error) {
+	return ListUsedPorts(client, PortRange{Min: port, Max: port})
+}
+
+// ListUsedPorts returns the pods, services and reservations using a port in r, sorted by port
+func ListUsedPorts(client kubernetes.Interface, r PortRange) ([]UsedPort, error) {
+	ports, err := getClusterUsedNodePorts(client)
+	if err != nil {
+		return nil, err
+	}
+	reservations, err := NewClusterPortAllocator(client, defaultPortAllocator).List()
+	if err != nil && !errors.IsForbidden(err) {
+		return nil, err
+	}
+	for _, reservation := range reservations {
+		ports = append(ports, UsedPort{
+			Port:   reservation.Port,
+			Source: PORT_SOURCE_RESERVATION,
+			Owner:  reservation.Owner,
+		})
+	}
+
+	result := []UsedPort{}
+	for _, port := range ports {
+		if r.Contains(port.Port) {
+			result = append(result, port)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Port < result[j].Port })
+	return result, nil
+}
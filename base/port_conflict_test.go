@@ -0,0 +1,89 @@
+package base
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSelectWithDefaultConflict(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newHostNetworkPod("worker-0", "node1", 100, v1.ProtocolUDP),
+		&v1.Service{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "svc", Namespace: "default"},
+			Spec: v1.ServiceSpec{
+				Type:  v1.ServiceTypeNodePort,
+				Ports: []v1.ServicePort{{Port: 80, NodePort: 101}},
+			},
+		},
+	)
+	allocator, err := NewPortAllocator(100, 110)
+	if err != nil {
+		t.Fatalf("failed to NewPortAllocator, %++v", err)
+	}
+
+	_, err = allocator.SelectWithDefault(client, 100)
+	conflict, ok := err.(*PortConflictError)
+	if !ok {
+		t.Fatalf("expect PortConflictError, got %v", err)
+	}
+	if len(conflict.Holders) != 1 || conflict.Holders[0].Owner.Name != "worker-0" {
+		t.Errorf("unexpected holders %++v", conflict.Holders)
+	}
+	expected := "port 100 is in used by Pod default/worker-0 on node node1 (UDP hostNetwork)"
+	if err.Error() != expected {
+		t.Errorf("expect error %q, got %q", expected, err.Error())
+	}
+	_, err = allocator.SelectWithDefault(client, 101)
+	expected = "port 101 is in used by Service default/svc (TCP nodePort)"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expect error %q, got %v", expected, err)
+	}
+
+	port, err := allocator.SelectWithDefault(client, 105)
+	if err != nil || port != 105 {
+		t.Errorf("expect port 105, got %d, %v", port, err)
+	}
+	if _, err := allocator.SelectWithDefault(client, 105); err == nil {
+		t.Errorf("a selected port should not be selected again")
+	}
+
+	allocator.SetNodePortRange(PortRange{Min: 108, Max: 109})
+	if _, err := allocator.SelectWithDefault(client, 108); err == nil {
+		t.Errorf("a port in the NodePort range should not be selected")
+	}
+}
+
+func TestListUsedPorts(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newHostNetworkPod("a", "node1", 100, v1.ProtocolTCP),
+		newHostNetworkPod("b", "node2", 100, v1.ProtocolTCP),
+		newHostNetworkPod("c", "node2", 200, v1.ProtocolTCP),
+	)
+	owner := PortOwner{Kind: OWNER_KIND_JOB, Namespace: "default", Name: "job"}
+	allocator, _ := NewPortAllocator(100, 110)
+	if err := NewClusterPortAllocator(client, allocator).Reserve(105, owner); err != nil {
+		t.Fatalf("failed to Reserve, %++v", err)
+	}
+
+	users, err := WhoUses(client, 100)
+	if err != nil {
+		t.Fatalf("failed to WhoUses, %++v", err)
+	}
+	if len(users) != 2 || users[0].Owner.Name != "a" || users[1].Owner.Name != "b" {
+		t.Errorf("unexpected users of port 100 %++v", users)
+	}
+
+	ports, err := ListUsedPorts(client, PortRange{Min: 100, Max: 199})
+	if err != nil {
+		t.Fatalf("failed to ListUsedPorts, %++v", err)
+	}
+	if len(ports) != 3 || ports[2].Port != 105 || ports[2].Source != PORT_SOURCE_RESERVATION || ports[2].Owner != owner {
+		t.Errorf("unexpected used ports %++v", ports)
+	}
+	if ports[2].String() != "Job default/job (reservation)" {
+		t.Errorf("unexpected description %q", ports[2].String())
+	}
+}
@@ -0,0 +1,221 @@
+package base
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// the default service-node-port-range of the API server
+const DEFAULT_NODE_PORT_RANGE = "30000-32767"
+
+// the flag and label of the API server static pods set up by kubeadm
+const NODE_PORT_RANGE_FLAG = "--service-node-port-range"
+const API_SERVER_POD_LABEL = "component=kube-apiserver"
+
+const OWNER_KIND_SERVICE = "Service"
+
+// how a port is used
+const (
+	PORT_SOURCE_HOST_PORT              = "hostPort"
+	PORT_SOURCE_HOST_NETWORK           = "hostNetwork"
+	PORT_SOURCE_NODE_PORT              = "nodePort"
+	PORT_SOURCE_HEALTH_CHECK_NODE_PORT = "healthCheckNodePort"
+)
+
+// UsedPort is a port used on a node, or on all the nodes when NodeName is empty
+type UsedPort struct {
+	Port     int         `json:"port"`
+	Protocol v1.Protocol `json:"protocol"`
+	NodeName string      `json:"node,omitempty"`
+	Source   string      `json:"source"`
+	// the pod or service holding the port
+	Owner     PortOwner `json:"owner"`
+	Container string    `json:"container,omitempty"`
+}
+
+// PortRange is the ports from Min to Max inclusive
+type PortRange struct {
+	Min int
+	Max int
+}
+
+// ParsePortRange parses a range in the API server format, "30000-32767" or "30000+2768"
+func ParsePortRange(value string) (PortRange, error) {
+	value = strings.TrimSpace(value)
+	if parts := strings.SplitN(value, "-", 2); len(parts) == 2 {
+		min, err1 := strconv.Atoi(parts[0])
+		max, err2 := strconv.Atoi(parts[1])
+		if err1 == nil && err2 == nil && validPort(min) && validPort(max) && min <= max {
+			return PortRange{Min: min, Max: max}, nil
+		}
+	} else if parts := strings.SplitN(value, "+", 2); len(parts) == 2 {
+		base, err1 := strconv.Atoi(parts[0])
+		size, err2 := strconv.Atoi(parts[1])
+		if err1 == nil && err2 == nil && size > 0 && validPort(base) && validPort(base+size-1) {
+			return PortRange{Min: base, Max: base + size - 1}, nil
+		}
+	}
+	return PortRange{}, fmt.Errorf("invalid port range %q", value)
+}
+
+func (r PortRange) Contains(port int) bool {
+	return r.Max > 0 && port >= r.Min && port <= r.Max
+}
+
+func (r PortRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// DiscoverNodePortRange reads the service-node-port-range flag of the API server pods,
+// it returns the default range if the API server doesn't run as pods or the flag isn't set
+func DiscoverNodePortRange(client kubernetes.Interface) PortRange {
+	defaultRange, _ := ParsePortRange(DEFAULT_NODE_PORT_RANGE)
+	pods, err := client.CoreV1().Pods(meta_v1.NamespaceSystem).List(meta_v1.ListOptions{LabelSelector: API_SERVER_POD_LABEL})
+	if err != nil {
+		log.Debugf("failed to list API server pods, use NodePort range %s, %v", defaultRange, err)
+		return defaultRange
+	}
+	for _, pod := range pods.Items {
+		for _, container := range pod.Spec.Containers {
+			value, ok := flagValue(append(container.Command, container.Args...), NODE_PORT_RANGE_FLAG)
+			if !ok {
+				continue
+			}
+			r, err := ParsePortRange(value)
+			if err != nil {
+				log.Warnf("ignore %s of pod %s/%s, %v", NODE_PORT_RANGE_FLAG, pod.Namespace, pod.Name, err)
+				continue
+			}
+			return r
+		}
+	}
+	return defaultRange
+}
+
+// flagValue finds "--flag=value" or "--flag value" in args
+func flagValue(args []string, flag string) (string, bool) {
+	for i, arg := range args {
+		if strings.HasPrefix(arg, flag+"=") {
+			return strings.TrimPrefix(arg, flag+"="), true
+		}
+		if arg == flag && i+1 < len(args) {
+			return args[i+1], true
+		}
+	}
+	return "", false
+}
+
+// Gather used node ports for k8s cluster
+// 1. Pod's HostPort, or ContainerPort for HostNetwork pod, of containers and init containers,
+//    used on the node of the pod
+// 2. Service's NodePort and HealthCheckNodePort, used on all the nodes, including the ports
+//    out of the current service-node-port-range allocated before it changed
+// Ephemeral containers can't declare ports, so they are not gathered.
+
+func getClusterUsedNodePorts(client kubernetes.Interface) ([]UsedPort, error) {
+	usedPorts := []UsedPort{}
+	// terminated pods are skipped by the server, podUsedPorts still checks for the servers
+	// which ignore the field selector
+	err := EachPod(client, "", meta_v1.ListOptions{FieldSelector: ACTIVE_POD_FIELD_SELECTOR}, func(pod *v1.Pod) error {
+		usedPorts = append(usedPorts, podUsedPorts(pod)...)
+		return nil
+	})
+	if err != nil {
+		return usedPorts, withPortSelectionHint(err)
+	}
+
+	err = EachService(client, "", meta_v1.ListOptions{}, func(service *v1.Service) error {
+		usedPorts = append(usedPorts, serviceUsedPorts(service)...)
+		return nil
+	})
+	if err != nil {
+		return usedPorts, withPortSelectionHint(err)
+	}
+	log.Debugf("Get K8S used ports, %++v", usedPorts)
+	return usedPorts, nil
+}
+
+// withPortSelectionHint explains that the used ports can't be gathered with namespace scoped permissions
+func withPortSelectionHint(err error) error {
+	if permissionErr, ok := err.(*PermissionError); ok {
+		permissionErr.Hint = "the ports used in the cluster can not be gathered, set the port explicitly or ask the cluster admin to select it"
+	}
+	return err
+}
+
+// podUsedPorts returns the node ports used by an active pod
+func podUsedPorts(pod *v1.Pod) []UsedPort {
+	usedPorts := []UsedPort{}
+	// fileter pod
+	if excludeInactivePod(pod) {
+		return usedPorts
+	}
+	owner := PortOwner{Kind: OWNER_KIND_POD, Namespace: pod.Namespace, Name: pod.Name}
+	containers := append(append([]v1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+	for _, container := range containers {
+		for _, port := range container.Ports {
+			usedHostPort, source := port.HostPort, PORT_SOURCE_HOST_PORT
+			if pod.Spec.HostNetwork {
+				usedHostPort, source = port.ContainerPort, PORT_SOURCE_HOST_NETWORK
+			}
+			if usedHostPort == 0 {
+				continue
+			}
+			usedPorts = append(usedPorts, UsedPort{
+				Port:      int(usedHostPort),
+				Protocol:  protocolOrDefault(port.Protocol),
+				NodeName:  pod.Spec.NodeName,
+				Source:    source,
+				Owner:     owner,
+				Container: container.Name,
+			})
+		}
+	}
+	return usedPorts
+}
+
+// serviceUsedPorts returns the NodePorts and HealthCheckNodePort of a service
+func serviceUsedPorts(service *v1.Service) []UsedPort {
+	usedPorts := []UsedPort{}
+	owner := PortOwner{Kind: OWNER_KIND_SERVICE, Namespace: service.Namespace, Name: service.Name}
+	for _, port := range service.Spec.Ports {
+		if port.NodePort == 0 {
+			continue
+		}
+		usedPorts = append(usedPorts, UsedPort{
+			Port:     int(port.NodePort),
+			Protocol: protocolOrDefault(port.Protocol),
+			Source:   PORT_SOURCE_NODE_PORT,
+			Owner:    owner,
+		})
+	}
+	// kube-proxy serves the health check of LoadBalancer services with Local traffic policy over TCP
+	if service.Spec.HealthCheckNodePort != 0 {
+		usedPorts = append(usedPorts, UsedPort{
+			Port:     int(service.Spec.HealthCheckNodePort),
+			Protocol: v1.ProtocolTCP,
+			Source:   PORT_SOURCE_HEALTH_CHECK_NODE_PORT,
+			Owner:    owner,
+		})
+	}
+	return usedPorts
+}
+
+// exclude Inactive pod when compute ports
+func excludeInactivePod(pod *v1.Pod) bool {
+	// pod not assigned
+	if len(pod.Spec.NodeName) == 0 {
+		return true
+	}
+	// pod is Successed or failed
+	if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package base
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestGetClusterUsedNodePorts(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&v1.Pod{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "worker", Namespace: "ns1"},
+			Spec: v1.PodSpec{
+				NodeName:       "node1",
+				InitContainers: []v1.Container{{Name: "init", Ports: []v1.ContainerPort{{ContainerPort: 80, HostPort: 100}}}},
+				Containers: []v1.Container{{Name: "main", Ports: []v1.ContainerPort{
+					{ContainerPort: 53, HostPort: 101, Protocol: v1.ProtocolUDP},
+					{ContainerPort: 8080},
+				}}},
+			},
+		},
+		&v1.Pod{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "done", Namespace: "ns1"},
+			Spec: v1.PodSpec{
+				NodeName:    "node1",
+				HostNetwork: true,
+				Containers:  []v1.Container{{Name: "main", Ports: []v1.ContainerPort{{ContainerPort: 102}}}},
+			},
+			Status: v1.PodStatus{Phase: v1.PodSucceeded},
+		},
+		&v1.Service{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "lb", Namespace: "ns2"},
+			Spec: v1.ServiceSpec{
+				Type:                v1.ServiceTypeLoadBalancer,
+				Ports:               []v1.ServicePort{{Port: 80, NodePort: 40000}},
+				HealthCheckNodePort: 40001,
+			},
+		},
+	)
+
+	ports, err := getClusterUsedNodePorts(client)
+	if err != nil {
+		t.Fatalf("failed to getClusterUsedNodePorts, %++v", err)
+	}
+	worker := PortOwner{Kind: OWNER_KIND_POD, Namespace: "ns1", Name: "worker"}
+	lb := PortOwner{Kind: OWNER_KIND_SERVICE, Namespace: "ns2", Name: "lb"}
+	expected := []UsedPort{
+		{Port: 100, Protocol: v1.ProtocolTCP, NodeName: "node1", Source: PORT_SOURCE_HOST_PORT, Owner: worker, Container: "init"},
+		{Port: 101, Protocol: v1.ProtocolUDP, NodeName: "node1", Source: PORT_SOURCE_HOST_PORT, Owner: worker, Container: "main"},
+		{Port: 40000, Protocol: v1.ProtocolTCP, Source: PORT_SOURCE_NODE_PORT, Owner: lb},
+		{Port: 40001, Protocol: v1.ProtocolTCP, Source: PORT_SOURCE_HEALTH_CHECK_NODE_PORT, Owner: lb},
+	}
+	if !reflect.DeepEqual(ports, expected) {
+		t.Errorf("expect used ports %++v, got %++v", expected, ports)
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	for value, expected := range map[string]PortRange{
+		"30000-32767": {Min: 30000, Max: 32767},
+		"30000+2768":  {Min: 30000, Max: 32767},
+		" 1-1 ":       {Min: 1, Max: 1},
+	} {
+		r, err := ParsePortRange(value)
+		if err != nil || r != expected {
+			t.Errorf("expect %q to be %v, got %v, %v", value, expected, r, err)
+		}
+	}
+	for _, value := range []string{"", "30000", "32767-30000", "0-10", "60000+10000", "a-b"} {
+		if _, err := ParsePortRange(value); err == nil {
+			t.Errorf("expect %q to be invalid", value)
+		}
+	}
+}
+
+func TestDiscoverNodePortRange(t *testing.T) {
+	if r := DiscoverNodePortRange(fake.NewSimpleClientset()); r.String() != DEFAULT_NODE_PORT_RANGE {
+		t.Errorf("expect default range, got %s", r)
+	}
+
+	client := fake.NewSimpleClientset(&v1.Pod{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name:      "kube-apiserver-master",
+			Namespace: meta_v1.NamespaceSystem,
+			Labels:    map[string]string{"component": "kube-apiserver"},
+		},
+		Spec: v1.PodSpec{Containers: []v1.Container{{
+			Name:    "kube-apiserver",
+			Command: []string{"kube-apiserver", "--secure-port=6443", "--service-node-port-range=20000-22767"},
+		}}},
+	})
+	r := DiscoverNodePortRange(client)
+	if r != (PortRange{Min: 20000, Max: 22767}) {
+		t.Errorf("expect range 20000-22767, got %s", r)
+	}
+
+	// the discovered range is never selected
+	allocator, err := NewPortAllocator(AUTO_SELECT_PORT_MIN, AUTO_SELECT_PORT_MAX)
+	if err != nil {
+		t.Fatalf("failed to NewPortAllocator, %++v", err)
+	}
+	port, err := allocator.Select(client)
+	if err != nil || port != 22768 {
+		t.Errorf("expect port 22768, got %d, %v", port, err)
+	}
+	if err := allocator.Reserve(20000); err == nil {
+		t.Errorf("Reserve a port in the NodePort range should return error")
+	}
+
+	allocator.SetNodePortRange(PortRange{Min: 22768, Max: 22800})
+	if err := allocator.Refresh(client); err != nil {
+		t.Fatalf("failed to Refresh, %++v", err)
+	}
+	if allocator.NodePortRange() != (PortRange{Min: 22768, Max: 22800}) {
+		t.Errorf("explicit NodePort range should be kept on Refresh, got %s", allocator.NodePortRange())
+	}
+}
+
+func TestFlagValue(t *testing.T) {
+	args := []string{"kube-apiserver", "--service-node-port-range", "1-2"}
+	if value, ok := flagValue(args, NODE_PORT_RANGE_FLAG); !ok || value != "1-2" {
+		t.Errorf("expect 1-2, got %s", value)
+	}
+	if _, ok := flagValue(args[:2], NODE_PORT_RANGE_FLAG); ok {
+		t.Errorf("flag without value should not be found")
+	}
+}
@@ -0,0 +1,335 @@
+package base
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const PORT_RESERVATION_CONFIGMAP = "gpu-metric-port-reservations"
+const PORT_RESERVATION_NAMESPACE = "kube-system"
+const DEFAULT_PORT_RESERVATION_TTL = 10 * time.Minute
+
+// JOB_RELEASE_LABEL is the label set by atlasctl/arena on all the pods of a training job
+const JOB_RELEASE_LABEL = "release"
+
+const (
+	OWNER_KIND_POD = "Pod"
+	OWNER_KIND_JOB = "Job"
+)
+
+// retries of a configmap update conflicting with another process
+const maxReservationRetries = 10
+
+// PortOwner is the pod or training job which will use a reserved port
+type PortOwner struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+func (o PortOwner) String() string {
+	return fmt.Sprintf("%s %s/%s", o.Kind, o.Namespace, o.Name)
+}
+
+// PortReservation is a port reserved in the cluster
+type PortReservation struct {
+	Port     int       `json:"port"`
+	Owner    PortOwner `json:"owner"`
+	Reserved time.Time `json:"reserved"`
+	Expires  time.Time `json:"expires"`
+}
+
+// PortReservedError is returned when a port is reserved by another owner
+type PortReservedError struct {
+	Reservation PortReservation
+}
+
+func (e *PortReservedError) Error() string {
+	return fmt.Sprintf("port %d is reserved by %s", e.Reservation.Port, e.Reservation.Owner)
+}
+
+// ClusterPortAllocator records port reservations in a ConfigMap, so processes on different
+// machines never select the same port. Updates use the resourceVersion of the ConfigMap for
+// optimistic concurrency.
+//
+// A reservation is kept until its TTL expires, giving the owner time to be created. After
+// that it is kept as long as the owning pod or job exists, and released once it disappears.
+type ClusterPortAllocator struct {
+	client    kubernetes.Interface
+	allocator *PortAllocator
+	namespace string
+	name      string
+	ttl       time.Duration
+	now       func() time.Time
+}
+
+// NewClusterPortAllocator returns a cluster coordinated allocator, allocator gives the range
+// and excludes the ports used by the cluster
+func NewClusterPortAllocator(client kubernetes.Interface, allocator *PortAllocator) *ClusterPortAllocator {
+	return &ClusterPortAllocator{
+		client:    client,
+		allocator: allocator,
+		namespace: PORT_RESERVATION_NAMESPACE,
+		name:      PORT_RESERVATION_CONFIGMAP,
+		ttl:       DEFAULT_PORT_RESERVATION_TTL,
+		now:       time.Now,
+	}
+}
+
+// SetConfigMap changes the ConfigMap holding the reservations
+func (c *ClusterPortAllocator) SetConfigMap(namespace string, name string) {
+	c.namespace = namespace
+	c.name = name
+}
+
+// SetTTL changes how long a reservation is kept without its owner
+func (c *ClusterPortAllocator) SetTTL(ttl time.Duration) {
+	c.ttl = ttl
+}
+
+// Select reserves the lowest port that is neither used in the cluster nor reserved
+func (c *ClusterPortAllocator) Select(owner PortOwner) (int, error) {
+	if err := c.allocator.ensureInitialized(c.client); err != nil {
+		return 0, err
+	}
+	selected := 0
+	_, err := c.update(func(reservations map[int]PortReservation, invalid map[string]string) error {
+		min, max := c.allocator.Range()
+		for port := min; port < max; port++ {
+			if _, ok := reservations[port]; ok || c.allocator.IsPortInUsed(port) {
+				continue
+			}
+			// the owner of an entry which can not be decoded is unknown, it may still use the port
+			if _, ok := invalid[strconv.Itoa(port)]; ok {
+				continue
+			}
+			selected = port
+			reservations[port] = c.newReservation(port, owner)
+			return nil
+		}
+		return fmt.Errorf("failed to select a available port in [%d, %d)", min, max)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return selected, nil
+}
+
+// Reserve reserves port for owner, reserving a port again for the same owner renews it
+func (c *ClusterPortAllocator) Reserve(port int, owner PortOwner) error {
+	if !validPort(port) {
+		return fmt.Errorf("invalid port %d", port)
+	}
+	if err := c.allocator.ensureInitialized(c.client); err != nil {
+		return err
+	}
+	_, err := c.update(func(reservations map[int]PortReservation, invalid map[string]string) error {
+		reservation, ok := reservations[port]
+		if ok && reservation.Owner != owner {
+			return &PortReservedError{Reservation: reservation}
+		}
+		if _, ok := invalid[strconv.Itoa(port)]; ok {
+			return fmt.Errorf("port %d has a reservation which can not be decoded in %s/%s, release it first", port, c.namespace, c.name)
+		}
+		if !ok {
+			if err := c.allocator.Check(port); err != nil {
+				return err
+			}
+		}
+		reservations[port] = c.newReservation(port, owner)
+		return nil
+	})
+	return err
+}
+
+// Release removes the reservation of port, even if it can not be decoded
+func (c *ClusterPortAllocator) Release(port int) error {
+	_, err := c.update(func(reservations map[int]PortReservation, invalid map[string]string) error {
+		delete(reservations, port)
+		delete(invalid, strconv.Itoa(port))
+		return nil
+	})
+	return err
+}
+
+// Collect releases the reservations whose TTL expired and whose owner is gone
+func (c *ClusterPortAllocator) Collect() ([]PortReservation, error) {
+	return c.update(func(reservations map[int]PortReservation, invalid map[string]string) error {
+		return nil
+	})
+}
+
+// List returns the reservations sorted by port, without the stale ones which the next update releases
+func (c *ClusterPortAllocator) List() ([]PortReservation, error) {
+	configMap, err := c.client.CoreV1().ConfigMaps(c.namespace).Get(c.name, meta_v1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return []PortReservation{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	reservations, _ := decodeReservations(configMap)
+	c.collect(reservations)
+	return sortReservations(reservations), nil
+}
+
+func (c *ClusterPortAllocator) newReservation(port int, owner PortOwner) PortReservation {
+	now := c.now()
+	return PortReservation{Port: port, Owner: owner, Reserved: now, Expires: now.Add(c.ttl)}
+}
+
+// update releases the stale reservations, applies mutate and writes the reservations back,
+// it retries when the ConfigMap is changed by another process meanwhile. The entries which can
+// not be decoded are passed to mutate as they are, and kept unless mutate deletes them.
+func (c *ClusterPortAllocator) update(mutate func(reservations map[int]PortReservation, invalid map[string]string) error) ([]PortReservation, error) {
+	for i := 0; i < maxReservationRetries; i++ {
+		configMap, err := c.client.CoreV1().ConfigMaps(c.namespace).Get(c.name, meta_v1.GetOptions{})
+		create := errors.IsNotFound(err)
+		if create {
+			configMap = &v1.ConfigMap{ObjectMeta: meta_v1.ObjectMeta{Name: c.name, Namespace: c.namespace}}
+		} else if err != nil {
+			return nil, err
+		}
+		reservations, invalid := decodeReservations(configMap)
+
+		released := c.collect(reservations)
+		if err := mutate(reservations, invalid); err != nil {
+			return nil, err
+		}
+		data, err := encodeReservations(reservations)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range invalid {
+			data[key] = value
+		}
+		if len(data) == len(configMap.Data) && (len(data) == 0 || reflect.DeepEqual(data, configMap.Data)) {
+			return released, nil
+		}
+		configMap.Data = data
+
+		if create {
+			_, err = c.client.CoreV1().ConfigMaps(c.namespace).Create(configMap)
+		} else {
+			_, err = c.client.CoreV1().ConfigMaps(c.namespace).Update(configMap)
+		}
+		if errors.IsConflict(err) || errors.IsAlreadyExists(err) {
+			log.Debugf("port reservations %s/%s changed, retry", c.namespace, c.name)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return released, nil
+	}
+	return nil, fmt.Errorf("failed to update port reservations %s/%s after %d retries", c.namespace, c.name, maxReservationRetries)
+}
+
+// collect removes the stale reservations from reservations and returns them
+func (c *ClusterPortAllocator) collect(reservations map[int]PortReservation) []PortReservation {
+	released := []PortReservation{}
+	now := c.now()
+	for port, reservation := range reservations {
+		if now.Before(reservation.Expires) {
+			continue
+		}
+		exists, err := c.ownerExists(reservation.Owner)
+		if err != nil {
+			log.Warnf("failed to check the owner of port %d, %v", port, err)
+			continue
+		}
+		if !exists {
+			delete(reservations, port)
+			released = append(released, reservation)
+		}
+	}
+	sort.Slice(released, func(i, j int) bool { return released[i].Port < released[j].Port })
+	return released
+}
+
+// ownerExists returns true if the owning pod, or any pod of the owning job, is still active
+func (c *ClusterPortAllocator) ownerExists(owner PortOwner) (bool, error) {
+	var pods []v1.Pod
+	switch owner.Kind {
+	case OWNER_KIND_POD:
+		pod, err := c.client.CoreV1().Pods(owner.Namespace).Get(owner.Name, meta_v1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		pods = []v1.Pod{*pod}
+	case OWNER_KIND_JOB:
+		podList, err := c.client.CoreV1().Pods(owner.Namespace).List(meta_v1.ListOptions{
+			LabelSelector: fmt.Sprintf("%s=%s", JOB_RELEASE_LABEL, owner.Name),
+		})
+		if err != nil {
+			return false, err
+		}
+		pods = podList.Items
+	default:
+		// unknown owners are released when expired
+		return false, nil
+	}
+	for _, pod := range pods {
+		if pod.Status.Phase != v1.PodSucceeded && pod.Status.Phase != v1.PodFailed {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// decodeReservations returns the reservations of configMap, and the entries which can not be decoded
+func decodeReservations(configMap *v1.ConfigMap) (map[int]PortReservation, map[string]string) {
+	reservations := map[int]PortReservation{}
+	invalid := map[string]string{}
+	for key, value := range configMap.Data {
+		port, err := strconv.Atoi(key)
+		if err != nil || !validPort(port) {
+			log.Warnf("keep invalid port reservation %s in %s/%s", key, configMap.Namespace, configMap.Name)
+			invalid[key] = value
+			continue
+		}
+		var reservation PortReservation
+		if err := json.Unmarshal([]byte(value), &reservation); err != nil {
+			log.Warnf("keep the reservation of port %d in %s/%s which can not be decoded, %v", port, configMap.Namespace, configMap.Name, err)
+			invalid[key] = value
+			continue
+		}
+		reservation.Port = port
+		reservations[port] = reservation
+	}
+	return reservations, invalid
+}
+
+func encodeReservations(reservations map[int]PortReservation) (map[string]string, error) {
+	data := map[string]string{}
+	for port, reservation := range reservations {
+		value, err := json.Marshal(reservation)
+		if err != nil {
+			return nil, err
+		}
+		data[strconv.Itoa(port)] = string(value)
+	}
+	return data, nil
+}
+
+func sortReservations(reservations map[int]PortReservation) []PortReservation {
+	result := make([]PortReservation, 0, len(reservations))
+	for _, reservation := range reservations {
+		result = append(result, reservation)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Port < result[j].Port })
+	return result
+}
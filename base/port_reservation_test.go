@@ -0,0 +1,182 @@
+package base
+
+import (
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newTestClusterPortAllocator(t *testing.T, client *fake.Clientset) *ClusterPortAllocator {
+	allocator, err := NewPortAllocator(100, 110)
+	if err != nil {
+		t.Fatalf("failed to NewPortAllocator, %++v", err)
+	}
+	return NewClusterPortAllocator(client, allocator)
+}
+
+func TestClusterPortAllocatorSelect(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	job1 := PortOwner{Kind: OWNER_KIND_JOB, Namespace: "default", Name: "job1"}
+	job2 := PortOwner{Kind: OWNER_KIND_JOB, Namespace: "default", Name: "job2"}
+
+	// two processes share the reservations through the cluster
+	port1, err := newTestClusterPortAllocator(t, client).Select(job1)
+	if err != nil {
+		t.Fatalf("failed to Select, %++v", err)
+	}
+	port2, err := newTestClusterPortAllocator(t, client).Select(job2)
+	if err != nil {
+		t.Fatalf("failed to Select, %++v", err)
+	}
+	if port1 != 100 || port2 != 101 {
+		t.Errorf("expect ports 100 and 101, got %d and %d", port1, port2)
+	}
+
+	allocator := newTestClusterPortAllocator(t, client)
+	err = allocator.Reserve(port1, job2)
+	if _, ok := err.(*PortReservedError); !ok {
+		t.Errorf("Reserve a port reserved by another owner should return PortReservedError, got %v", err)
+	}
+	if err := allocator.Reserve(port1, job1); err != nil {
+		t.Errorf("owner should renew its reservation, %++v", err)
+	}
+
+	if err := allocator.Release(port1); err != nil {
+		t.Fatalf("failed to Release, %++v", err)
+	}
+	reservations, err := allocator.List()
+	if err != nil {
+		t.Fatalf("failed to List, %++v", err)
+	}
+	if len(reservations) != 1 || reservations[0].Port != port2 || reservations[0].Owner != job2 {
+		t.Errorf("unexpected reservations %++v", reservations)
+	}
+}
+
+func TestClusterPortAllocatorCollect(t *testing.T) {
+	client := fake.NewSimpleClientset(&v1.Pod{
+		ObjectMeta: meta_v1.ObjectMeta{Name: "job1-worker-0", Namespace: "default", Labels: map[string]string{JOB_RELEASE_LABEL: "job1"}},
+		Status:     v1.PodStatus{Phase: v1.PodRunning},
+	})
+	allocator := newTestClusterPortAllocator(t, client)
+	now := time.Now()
+	allocator.now = func() time.Time { return now }
+
+	running := PortOwner{Kind: OWNER_KIND_JOB, Namespace: "default", Name: "job1"}
+	gone := PortOwner{Kind: OWNER_KIND_POD, Namespace: "default", Name: "deleted"}
+	if err := allocator.Reserve(100, running); err != nil {
+		t.Fatalf("failed to Reserve, %++v", err)
+	}
+	if err := allocator.Reserve(101, gone); err != nil {
+		t.Fatalf("failed to Reserve, %++v", err)
+	}
+
+	released, err := allocator.Collect()
+	if err != nil {
+		t.Fatalf("failed to Collect, %++v", err)
+	}
+	if len(released) != 0 {
+		t.Errorf("reservations within TTL should be kept, released %++v", released)
+	}
+
+	now = now.Add(DEFAULT_PORT_RESERVATION_TTL)
+	released, err = allocator.Collect()
+	if err != nil {
+		t.Fatalf("failed to Collect, %++v", err)
+	}
+	if len(released) != 1 || released[0].Port != 101 {
+		t.Errorf("only the reservation of the deleted pod should be released, got %++v", released)
+	}
+	// the port of the gone owner can be selected again
+	port, err := allocator.Select(running)
+	if err != nil || port != 101 {
+		t.Errorf("expect port 101, got %d, %v", port, err)
+	}
+}
+
+func TestClusterPortAllocatorRetryOnConflict(t *testing.T) {
+	tracker := k8stesting.NewObjectTracker(scheme.Scheme, scheme.Codecs.UniversalDecoder())
+	tracker.Add(&v1.ConfigMap{
+		ObjectMeta: meta_v1.ObjectMeta{Name: PORT_RESERVATION_CONFIGMAP, Namespace: PORT_RESERVATION_NAMESPACE},
+	})
+	client := &fake.Clientset{}
+	client.AddReactor("*", "*", k8stesting.ObjectReaction(tracker))
+	conflicts := 0
+	client.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			return false, nil, nil
+		}
+		conflicts++
+		// another process reserved port 100 meanwhile
+		configMap := action.(k8stesting.UpdateAction).GetObject().(*v1.ConfigMap).DeepCopy()
+		configMap.Data = map[string]string{"100": `{"owner":{"kind":"Pod","namespace":"default","name":"other"},"expires":"2100-01-01T00:00:00Z"}`}
+		if err := tracker.Update(schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}, configMap, configMap.Namespace); err != nil {
+			return true, nil, err
+		}
+		return true, nil, errors.NewConflict(schema.GroupResource{Resource: "configmaps"}, configMap.Name, nil)
+	})
+
+	port, err := newTestClusterPortAllocator(t, client).Select(PortOwner{Kind: OWNER_KIND_POD, Namespace: "default", Name: "mine"})
+	if err != nil {
+		t.Fatalf("failed to Select, %++v", err)
+	}
+	if conflicts != 1 || port != 101 {
+		t.Errorf("expect port 101 after one conflict, got %d after %d conflicts", port, conflicts)
+	}
+}
+
+func TestClusterPortAllocatorInvalidEntries(t *testing.T) {
+	client := fake.NewSimpleClientset(&v1.ConfigMap{
+		ObjectMeta: meta_v1.ObjectMeta{Name: PORT_RESERVATION_CONFIGMAP, Namespace: PORT_RESERVATION_NAMESPACE},
+		Data:       map[string]string{"100": "{not json", "note": "reserved by hand"},
+	})
+	allocator := newTestClusterPortAllocator(t, client)
+	owner := PortOwner{Kind: OWNER_KIND_POD, Namespace: "default", Name: "mine"}
+
+	port, err := allocator.Select(owner)
+	if err != nil || port != 101 {
+		t.Errorf("the port of an entry which can not be decoded should not be selected, got %d, %v", port, err)
+	}
+	if err := allocator.Reserve(100, owner); err == nil {
+		t.Errorf("Reserve should not overwrite an entry which can not be decoded")
+	}
+	configMap, _ := client.CoreV1().ConfigMaps(PORT_RESERVATION_NAMESPACE).Get(PORT_RESERVATION_CONFIGMAP, meta_v1.GetOptions{})
+	if configMap.Data["100"] != "{not json" || configMap.Data["note"] != "reserved by hand" || configMap.Data["101"] == "" {
+		t.Errorf("the entries which can not be decoded should be kept, got %v", configMap.Data)
+	}
+
+	if err := allocator.Release(100); err != nil {
+		t.Fatalf("failed to Release, %++v", err)
+	}
+	configMap, _ = client.CoreV1().ConfigMaps(PORT_RESERVATION_NAMESPACE).Get(PORT_RESERVATION_CONFIGMAP, meta_v1.GetOptions{})
+	if _, ok := configMap.Data["100"]; ok {
+		t.Errorf("Release should remove the entry of the port, got %v", configMap.Data)
+	}
+}
+
+func TestClusterPortAllocatorListPrunesStale(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	allocator := newTestClusterPortAllocator(t, client)
+	now := time.Now()
+	allocator.now = func() time.Time { return now }
+	if err := allocator.Reserve(100, PortOwner{Kind: OWNER_KIND_POD, Namespace: "default", Name: "deleted"}); err != nil {
+		t.Fatalf("failed to Reserve, %++v", err)
+	}
+
+	now = now.Add(DEFAULT_PORT_RESERVATION_TTL)
+	reservations, err := allocator.List()
+	if err != nil {
+		t.Fatalf("failed to List, %++v", err)
+	}
+	if len(reservations) != 0 {
+		t.Errorf("the expired reservation of a deleted pod should not be listed, got %++v", reservations)
+	}
+}
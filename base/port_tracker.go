@@ -0,0 +1,201 @@
+package base
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ErrPortTrackerNotReady is returned when selecting a port before the tracker synced the cluster
+var ErrPortTrackerNotReady = errors.New("port tracker is not ready")
+
+// PortTrackerMetrics describes the state of a PortTracker
+type PortTrackerMetrics struct {
+	Ready     bool `json:"ready"`
+	Pods      int  `json:"pods"`
+	Services  int  `json:"services"`
+	UsedPorts int  `json:"usedPorts"`
+	// the pod and service events handled since started
+	PodEvents     int64     `json:"podEvents"`
+	ServiceEvents int64     `json:"serviceEvents"`
+	LastUpdate    time.Time `json:"lastUpdate"`
+	SyncDuration  float64   `json:"syncDurationSeconds"`
+}
+
+// PortTracker watches pods and services, and keeps the used ports of an allocator up to date
+// for the whole life of a long-running process
+type PortTracker struct {
+	client    kubernetes.Interface
+	allocator *PortAllocator
+	factory   informers.SharedInformerFactory
+	pods      cache.SharedIndexInformer
+	services  cache.SharedIndexInformer
+
+	mu sync.Mutex
+	// the used ports by pod and service key, applied to the allocator once synced
+	podPorts     map[string][]UsedPort
+	servicePorts map[string][]UsedPort
+	metrics      PortTrackerMetrics
+	ready        chan struct{}
+}
+
+// NewPortTracker returns a tracker of the used ports of allocator, allocator must not be used
+// by another tracker. The allocator fails with ErrPortTrackerNotReady until the tracker synced.
+func NewPortTracker(client kubernetes.Interface, allocator *PortAllocator, resync time.Duration) *PortTracker {
+	factory := informers.NewSharedInformerFactory(client, resync)
+	t := &PortTracker{
+		client:       client,
+		allocator:    allocator,
+		factory:      factory,
+		pods:         factory.Core().V1().Pods().Informer(),
+		services:     factory.Core().V1().Services().Informer(),
+		podPorts:     map[string][]UsedPort{},
+		servicePorts: map[string][]UsedPort{},
+		ready:        make(chan struct{}),
+	}
+	t.pods.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { t.updatePod(obj) },
+		UpdateFunc: func(_, obj interface{}) { t.updatePod(obj) },
+		DeleteFunc: func(obj interface{}) { t.deletePod(obj) },
+	})
+	t.services.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { t.updateService(obj) },
+		UpdateFunc: func(_, obj interface{}) { t.updateService(obj) },
+		DeleteFunc: func(obj interface{}) { t.deleteService(obj) },
+	})
+
+	allocator.mu.Lock()
+	allocator.tracker = t
+	allocator.initialized = false
+	allocator.mu.Unlock()
+	return t
+}
+
+// Run starts watching until stopCh is closed, the tracker is ready once the caches synced
+func (t *PortTracker) Run(stopCh <-chan struct{}) {
+	start := time.Now()
+	t.factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, t.pods.HasSynced, t.services.HasSynced) {
+		log.Warnf("port tracker stopped before the caches synced")
+		return
+	}
+	// discover the NodePort range
+	if err := t.allocator.Refresh(t.client); err != nil {
+		log.Warnf("failed to refresh port allocator, %v", err)
+	}
+
+	t.mu.Lock()
+	ports := []UsedPort{}
+	for _, p := range t.podPorts {
+		ports = append(ports, p...)
+	}
+	for _, p := range t.servicePorts {
+		ports = append(ports, p...)
+	}
+	t.allocator.mu.Lock()
+	t.allocator.setUsedPorts(ports)
+	t.allocator.mu.Unlock()
+	t.metrics.Ready = true
+	t.metrics.SyncDuration = time.Since(start).Seconds()
+	t.metrics.LastUpdate = time.Now()
+	close(t.ready)
+	t.mu.Unlock()
+	log.Debugf("port tracker synced %d used ports in %v", len(ports), time.Since(start))
+}
+
+// Ready returns true once the tracker synced the cluster
+func (t *PortTracker) Ready() bool {
+	select {
+	case <-t.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// WaitForReady blocks until the tracker is ready or stopCh is closed
+func (t *PortTracker) WaitForReady(stopCh <-chan struct{}) bool {
+	select {
+	case <-t.ready:
+		return true
+	case <-stopCh:
+		return false
+	}
+}
+
+// Metrics returns a snapshot of the tracker state
+func (t *PortTracker) Metrics() PortTrackerMetrics {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	metrics := t.metrics
+	metrics.Pods = len(t.podPorts)
+	metrics.Services = len(t.servicePorts)
+	t.allocator.mu.Lock()
+	metrics.UsedPorts = len(t.allocator.usedBy)
+	t.allocator.mu.Unlock()
+	return metrics
+}
+
+func (t *PortTracker) updatePod(obj interface{}) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return
+	}
+	t.setPorts(t.podPorts, pod.Namespace+"/"+pod.Name, podUsedPorts(pod), &t.metrics.PodEvents)
+}
+
+func (t *PortTracker) deletePod(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return
+	}
+	t.setPorts(t.podPorts, pod.Namespace+"/"+pod.Name, nil, &t.metrics.PodEvents)
+}
+
+func (t *PortTracker) updateService(obj interface{}) {
+	service, ok := obj.(*v1.Service)
+	if !ok {
+		return
+	}
+	t.setPorts(t.servicePorts, service.Namespace+"/"+service.Name, serviceUsedPorts(service), &t.metrics.ServiceEvents)
+}
+
+func (t *PortTracker) deleteService(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	service, ok := obj.(*v1.Service)
+	if !ok {
+		return
+	}
+	t.setPorts(t.servicePorts, service.Namespace+"/"+service.Name, nil, &t.metrics.ServiceEvents)
+}
+
+// setPorts replaces the used ports of an object, and applies the difference to the allocator once ready
+func (t *PortTracker) setPorts(objects map[string][]UsedPort, key string, ports []UsedPort, events *int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	*events++
+	removed := objects[key]
+	if len(ports) == 0 {
+		delete(objects, key)
+	} else {
+		objects[key] = ports
+	}
+	if !t.Ready() {
+		return
+	}
+	t.allocator.mu.Lock()
+	t.allocator.updateUsedPorts(removed, ports)
+	t.allocator.mu.Unlock()
+	t.metrics.LastUpdate = time.Now()
+}
@@ -0,0 +1,86 @@
+package base
+
+import (
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPortTracker(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newHostNetworkPod("a", "node1", 100, v1.ProtocolTCP),
+		&v1.Service{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "svc", Namespace: "default"},
+			Spec: v1.ServiceSpec{
+				Type:  v1.ServiceTypeNodePort,
+				Ports: []v1.ServicePort{{Port: 80, NodePort: 101}},
+			},
+		},
+	)
+	allocator, err := NewPortAllocator(100, 110)
+	if err != nil {
+		t.Fatalf("failed to NewPortAllocator, %++v", err)
+	}
+	tracker := NewPortTracker(client, allocator, 0)
+	if _, err := allocator.Select(client); err != ErrPortTrackerNotReady {
+		t.Errorf("Select before the tracker is ready should return ErrPortTrackerNotReady, got %v", err)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go tracker.Run(stopCh)
+	if !tracker.WaitForReady(stopCh) {
+		t.Fatalf("tracker is not ready")
+	}
+	metrics := tracker.Metrics()
+	if !metrics.Ready || metrics.Pods != 1 || metrics.Services != 1 || metrics.UsedPorts != 2 {
+		t.Errorf("unexpected metrics %++v", metrics)
+	}
+	port, err := allocator.Select(client)
+	if err != nil || port != 102 {
+		t.Errorf("expect port 102, got %d, %v", port, err)
+	}
+
+	// new pods are tracked without refresh
+	if _, err := client.CoreV1().Pods("default").Create(newHostNetworkPod("b", "node2", 103, v1.ProtocolTCP)); err != nil {
+		t.Fatalf("failed to create pod, %++v", err)
+	}
+	waitFor(t, func() bool { return allocator.IsPortInUsed(103) })
+	port, err = allocator.Select(client)
+	if err != nil || port != 104 {
+		t.Errorf("expect port 104, got %d, %v", port, err)
+	}
+
+	// the ports of deleted pods and services are available again
+	if err := client.CoreV1().Pods("default").Delete("a", &meta_v1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete pod, %++v", err)
+	}
+	if err := client.CoreV1().Services("default").Delete("svc", &meta_v1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete service, %++v", err)
+	}
+	waitFor(t, func() bool { return !allocator.IsPortInUsed(100) && !allocator.IsPortInUsed(101) })
+
+	// a finished pod releases its port
+	pod := newHostNetworkPod("b", "node2", 103, v1.ProtocolTCP)
+	pod.Status.Phase = v1.PodSucceeded
+	if _, err := client.CoreV1().Pods("default").Update(pod); err != nil {
+		t.Fatalf("failed to update pod, %++v", err)
+	}
+	waitFor(t, func() bool { return !allocator.IsPortInUsed(103) })
+	if metrics := tracker.Metrics(); metrics.PodEvents < 4 || metrics.ServiceEvents < 2 {
+		t.Errorf("unexpected metrics %++v", metrics)
+	}
+}
@@ -0,0 +1,261 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xieydd/gpu-metric/utils"
+)
+
+const DASHBOARD_HISTORY_SIZE = 30
+const DASHBOARD_BAR_WIDTH = 20
+
+const (
+	SORT_BY_NAME = iota
+	SORT_BY_DUTY_CYCLE
+	SORT_BY_MEMORY
+)
+
+var sortByNames = []string{"name", "duty cycle", "memory"}
+
+var sparkTicks = []rune("▁▂▃▄▅▆▇█")
+
+// Dashboard keeps the state of the watch mode between refreshes: the latest
+// instances, a short duty cycle history per GPU, and the sort/filter settings
+type Dashboard struct {
+	Title string
+
+	instances []utils.InstanceGpuUsage
+	history   map[string][]float64
+	updated   time.Time
+	lastErr   error
+
+	sortBy    int
+	reverse   bool
+	filter    string
+	filtering bool
+	input     string
+}
+
+func NewDashboard(title string) *Dashboard {
+	return &Dashboard{
+		Title:   title,
+		history: map[string][]float64{},
+	}
+}
+
+func historyKey(instance utils.InstanceGpuUsage, gpu utils.GpuUsage) string {
+	return instance.Namespace + "/" + instance.Name + "/" + gpu.Index
+}
+
+// Update replaces the instances and appends their duty cycle to the history,
+// the history of GPUs which disappeared is dropped
+func (d *Dashboard) Update(instances []utils.InstanceGpuUsage, err error, now time.Time) {
+	d.lastErr = err
+	if err != nil {
+		return
+	}
+	d.updated = now
+	d.instances = instances
+	history := map[string][]float64{}
+	for _, instance := range instances {
+		for _, gpu := range instance.GPUs {
+			key := historyKey(instance, gpu)
+			samples := append(d.history[key], gpu.DutyCycle)
+			if len(samples) > DASHBOARD_HISTORY_SIZE {
+				samples = samples[len(samples)-DASHBOARD_HISTORY_SIZE:]
+			}
+			history[key] = samples
+		}
+	}
+	d.history = history
+}
+
+// HandleKey applies a key press, returns true if the dashboard should quit
+//
+//	q, ctrl-c: quit
+//	s: switch the sort column, r: reverse the order
+//	/: type a filter on the instance name (enter to apply, esc to cancel), c: clear the filter
+func (d *Dashboard) HandleKey(key byte) bool {
+	if d.filtering {
+		switch key {
+		case '\r', '\n':
+			d.filter = d.input
+			d.filtering = false
+		case 27:
+			d.filtering = false
+		case 127, 8:
+			if len(d.input) > 0 {
+				d.input = d.input[:len(d.input)-1]
+			}
+		case 3:
+			return true
+		default:
+			if key >= 32 && key < 127 {
+				d.input += string(key)
+			}
+		}
+		return false
+	}
+	switch key {
+	case 'q', 3:
+		return true
+	case 's':
+		d.sortBy = (d.sortBy + 1) % len(sortByNames)
+	case 'r':
+		d.reverse = !d.reverse
+	case '/':
+		d.filtering = true
+		d.input = d.filter
+	case 'c':
+		d.filter = ""
+	}
+	return false
+}
+
+// Visible returns the filtered and sorted instances
+func (d *Dashboard) Visible() []utils.InstanceGpuUsage {
+	visible := []utils.InstanceGpuUsage{}
+	for _, instance := range d.instances {
+		if d.filter != "" && !strings.Contains(instance.Namespace+"/"+instance.Name, d.filter) {
+			continue
+		}
+		visible = append(visible, instance)
+	}
+	less := func(a, b utils.InstanceGpuUsage) bool {
+		switch d.sortBy {
+		case SORT_BY_DUTY_CYCLE:
+			if averageDutyCycle(a) != averageDutyCycle(b) {
+				return averageDutyCycle(a) > averageDutyCycle(b)
+			}
+		case SORT_BY_MEMORY:
+			if memoryUsed(a) != memoryUsed(b) {
+				return memoryUsed(a) > memoryUsed(b)
+			}
+		}
+		return a.Namespace+"/"+a.Name < b.Namespace+"/"+b.Name
+	}
+	sort.SliceStable(visible, func(i, j int) bool {
+		if d.reverse {
+			return less(visible[j], visible[i])
+		}
+		return less(visible[i], visible[j])
+	})
+	return visible
+}
+
+// Render draws the dashboard, lines are separated by \r\n since the terminal is in raw mode
+func (d *Dashboard) Render() string {
+	buf := &bytes.Buffer{}
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(buf, format+"\r\n", args...)
+	}
+	updated := "never"
+	if !d.updated.IsZero() {
+		updated = d.updated.Format("15:04:05")
+	}
+	line("%s    updated: %s    sort: %s    filter: %s", d.Title, updated, d.sortName(), d.filterText())
+	line("keys: q quit, s sort, r reverse, / filter, c clear filter")
+	if d.lastErr != nil {
+		line("error: %v", d.lastErr)
+	}
+	line("")
+
+	for _, instance := range d.Visible() {
+		name := instance.Name
+		if instance.Namespace != "" {
+			name = instance.Namespace + "/" + name
+		}
+		if instance.Node != "" {
+			line("%s  %s  %s", name, instance.Status, instance.Node)
+		} else {
+			line("%s  %s", name, instance.Status)
+		}
+		if len(instance.GPUs) == 0 {
+			line("  GPU %s", NOT_AVAILABLE)
+			continue
+		}
+		for _, gpu := range instance.GPUs {
+			memoryRatio := 0.0
+			if gpu.MemoryTotal > 0 {
+				memoryRatio = gpu.MemoryUsed / gpu.MemoryTotal
+			}
+			line("  GPU %-2s UTIL %s %4s  MEM %s %s  %s",
+				gpu.Index,
+				renderBar(gpu.DutyCycle/100, DASHBOARD_BAR_WIDTH),
+				formatDutyCycle(gpu.DutyCycle),
+				renderBar(memoryRatio, DASHBOARD_BAR_WIDTH),
+				formatMemory(gpu.MemoryUsed, gpu.MemoryTotal),
+				renderSparkline(d.history[historyKey(instance, gpu)]))
+		}
+	}
+	return buf.String()
+}
+
+func (d *Dashboard) sortName() string {
+	name := sortByNames[d.sortBy]
+	if d.reverse {
+		name += " (reversed)"
+	}
+	return name
+}
+
+func (d *Dashboard) filterText() string {
+	if d.filtering {
+		return d.input + "_"
+	}
+	if d.filter == "" {
+		return "<none>"
+	}
+	return d.filter
+}
+
+// renderBar renders ratio (0 ~ 1) as [#####.....]
+func renderBar(ratio float64, width int) string {
+	if ratio < 0 {
+		ratio = 0
+	}
+	if ratio > 1 {
+		ratio = 1
+	}
+	filled := int(ratio*float64(width) + 0.5)
+	return "[" + strings.Repeat("#", filled) + strings.Repeat(".", width-filled) + "]"
+}
+
+// renderSparkline renders duty cycle samples (0 ~ 100) with block characters
+func renderSparkline(samples []float64) string {
+	runes := []rune{}
+	for _, v := range samples {
+		i := int(v / 100 * float64(len(sparkTicks)-1))
+		if i < 0 {
+			i = 0
+		}
+		if i >= len(sparkTicks) {
+			i = len(sparkTicks) - 1
+		}
+		runes = append(runes, sparkTicks[i])
+	}
+	return string(runes)
+}
+
+func averageDutyCycle(instance utils.InstanceGpuUsage) float64 {
+	if len(instance.GPUs) == 0 {
+		return -1
+	}
+	var sum float64
+	for _, gpu := range instance.GPUs {
+		sum += gpu.DutyCycle
+	}
+	return sum / float64(len(instance.GPUs))
+}
+
+func memoryUsed(instance utils.InstanceGpuUsage) float64 {
+	var sum float64
+	for _, gpu := range instance.GPUs {
+		sum += gpu.MemoryUsed
+	}
+	return sum
+}
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xieydd/gpu-metric/utils"
+)
+
+func TestDashboardHistory(t *testing.T) {
+	dashboard := NewDashboard("test")
+	for i := 0; i < DASHBOARD_HISTORY_SIZE+5; i++ {
+		dashboard.Update([]utils.InstanceGpuUsage{
+			{Name: "worker-0", GPUs: []utils.GpuUsage{{Index: "0", DutyCycle: float64(i)}}},
+		}, nil, time.Now())
+	}
+	samples := dashboard.history["/worker-0/0"]
+	if len(samples) != DASHBOARD_HISTORY_SIZE {
+		t.Errorf("history should keep %d samples, got %d", DASHBOARD_HISTORY_SIZE, len(samples))
+	}
+	if samples[len(samples)-1] != float64(DASHBOARD_HISTORY_SIZE+4) {
+		t.Errorf("latest sample should be kept, got %v", samples)
+	}
+
+	// a failed refresh keeps the previous state
+	dashboard.Update(nil, fmt.Errorf("prometheus is down"), time.Now())
+	if len(dashboard.instances) != 1 || !strings.Contains(dashboard.Render(), "prometheus is down") {
+		t.Errorf("failed refresh should keep instances and display the error")
+	}
+
+	// GPUs which disappeared are dropped from the history
+	dashboard.Update([]utils.InstanceGpuUsage{{Name: "worker-1"}}, nil, time.Now())
+	if len(dashboard.history) != 0 {
+		t.Errorf("history of removed GPUs should be dropped, got %v", dashboard.history)
+	}
+}
+
+func TestDashboardSortAndFilter(t *testing.T) {
+	dashboard := NewDashboard("test")
+	dashboard.Update([]utils.InstanceGpuUsage{
+		{Name: "worker-a", GPUs: []utils.GpuUsage{{Index: "0", DutyCycle: 10, MemoryUsed: 300}}},
+		{Name: "worker-b", GPUs: []utils.GpuUsage{{Index: "0", DutyCycle: 90, MemoryUsed: 100}}},
+		{Name: "ps-0"},
+	}, nil, time.Now())
+
+	names := func() string {
+		result := []string{}
+		for _, instance := range dashboard.Visible() {
+			result = append(result, instance.Name)
+		}
+		return strings.Join(result, ",")
+	}
+	if names() != "ps-0,worker-a,worker-b" {
+		t.Errorf("default sort should be by name, got %s", names())
+	}
+	dashboard.HandleKey('s')
+	if names() != "worker-b,worker-a,ps-0" {
+		t.Errorf("unexpected sort by duty cycle, got %s", names())
+	}
+	dashboard.HandleKey('s')
+	if names() != "worker-a,worker-b,ps-0" {
+		t.Errorf("unexpected sort by memory, got %s", names())
+	}
+	dashboard.HandleKey('r')
+	if names() != "ps-0,worker-b,worker-a" {
+		t.Errorf("unexpected reversed sort by memory, got %s", names())
+	}
+
+	for _, key := range []byte("/worker\r") {
+		if dashboard.HandleKey(key) {
+			t.Fatalf("typing a filter should not quit")
+		}
+	}
+	if names() != "worker-b,worker-a" {
+		t.Errorf("unexpected filtered instances, got %s", names())
+	}
+	dashboard.HandleKey('c')
+	if names() != "ps-0,worker-b,worker-a" {
+		t.Errorf("filter should be cleared, got %s", names())
+	}
+	if !dashboard.HandleKey('q') {
+		t.Errorf("q should quit")
+	}
+}
+
+func TestRenderSparkline(t *testing.T) {
+	if s := renderSparkline([]float64{0, 50, 100}); s != "▁▄█" {
+		t.Errorf("unexpected sparkline %s", s)
+	}
+	if s := renderBar(0.5, 10); s != "[#####.....]" {
+		t.Errorf("unexpected bar %s", s)
+	}
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/xieydd/gpu-metric/doctor"
+)
+
+// DoctorOptions holds the flags of the doctor command
+type DoctorOptions struct {
+	doctor.Options
+	Output string
+}
+
+func (o *DoctorOptions) Validate() error {
+	switch o.Output {
+	case "", OUTPUT_JSON, OUTPUT_YAML:
+	default:
+		return fmt.Errorf("unsupported output format %q, must be one of: json|yaml", o.Output)
+	}
+	if o.MaxStaleness <= 0 {
+		return fmt.Errorf("--max-staleness must be positive")
+	}
+	return nil
+}
+
+func NewDoctorCommand(opts *KubeOptions) *cobra.Command {
+	doctorOpts := &DoctorOptions{Options: doctor.DefaultOptions()}
+	var command = &cobra.Command{
+		Use:   "doctor",
+		Short: "Diagnose the GPU monitoring stack and suggest fixes.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := doctorOpts.Validate(); err != nil {
+				return err
+			}
+			client, err := opts.ClientSet()
+			if err != nil {
+				return err
+			}
+			results := doctor.Run(client, doctorOpts.Options)
+			if err := printDoctorResults(os.Stdout, doctorOpts.Output, results); err != nil {
+				return err
+			}
+			if doctor.HasFailure(results) {
+				return fmt.Errorf("some checks failed")
+			}
+			return nil
+		},
+	}
+	command.Flags().StringVarP(&doctorOpts.Output, "output", "o", "", "Output format. One of: json|yaml.")
+	command.Flags().StringVar(&doctorOpts.ExporterNamespace, "exporter-namespace", doctorOpts.ExporterNamespace, "Namespace of the GPU exporter DaemonSet.")
+	command.Flags().StringVar(&doctorOpts.ExporterDaemonSet, "exporter-daemonset", doctorOpts.ExporterDaemonSet, "Name of the GPU exporter DaemonSet.")
+	command.Flags().StringVar(&doctorOpts.ExporterJob, "exporter-job", doctorOpts.ExporterJob, "Prometheus job scraping the GPU exporter.")
+	command.Flags().DurationVar(&doctorOpts.MaxStaleness, "max-staleness", doctor.DEFAULT_MAX_STALENESS, "Age after which the GPU metrics are stale.")
+	return command
+}
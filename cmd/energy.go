@@ -0,0 +1,225 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/xieydd/gpu-metric/analysis"
+)
+
+const ENERGY_BY_NAMESPACE = "namespace"
+const ENERGY_BY_JOB = "job"
+const ENERGY_BY_POD = "pod"
+
+const DEFAULT_ENERGY_SINCE = 24 * time.Hour
+
+// EnergyOptions holds the flags of the energy command
+type EnergyOptions struct {
+	Since           time.Duration
+	Start           string
+	End             string
+	By              string
+	PUE             float64
+	CarbonIntensity float64
+	Output          string
+}
+
+// addEnergyFlags adds the flags converting the energy of the GPUs to the energy of the facility and its emissions
+func addEnergyFlags(command *cobra.Command, pue *float64, carbonIntensity *float64) {
+	command.Flags().Float64Var(pue, "pue", analysis.DEFAULT_PUE, "Power usage effectiveness of the data center, the energy of the GPUs is multiplied by it.")
+	command.Flags().Float64Var(carbonIntensity, "carbon-intensity", analysis.DEFAULT_CARBON_INTENSITY, "Carbon intensity of the grid in gCO2e/kWh.")
+}
+
+func (o *EnergyOptions) AddFlags(command *cobra.Command) {
+	command.Flags().DurationVar(&o.Since, "since", DEFAULT_ENERGY_SINCE, "Account the energy of the last duration, ignored if --start is set.")
+	command.Flags().StringVar(&o.Start, "start", "", "Start of the accounted range in RFC3339, such as 2019-01-01T00:00:00Z.")
+	command.Flags().StringVar(&o.End, "end", "", "End of the accounted range in RFC3339, now if not set.")
+	command.Flags().StringVar(&o.By, "by", ENERGY_BY_NAMESPACE, "Aggregate the energy by namespace, job or pod.")
+	addEnergyFlags(command, &o.PUE, &o.CarbonIntensity)
+	command.Flags().StringVarP(&o.Output, "output", "o", "", "Output format. One of: json|yaml|csv.")
+}
+
+func (o *EnergyOptions) Validate() error {
+	switch o.Output {
+	case "", OUTPUT_JSON, OUTPUT_YAML, OUTPUT_CSV:
+	default:
+		return fmt.Errorf("unsupported output format %q, must be one of: json|yaml|csv", o.Output)
+	}
+	switch o.By {
+	case ENERGY_BY_NAMESPACE, ENERGY_BY_JOB, ENERGY_BY_POD:
+	default:
+		return fmt.Errorf("unsupported aggregation %q, must be one of: namespace|job|pod", o.By)
+	}
+	if o.Start == "" && o.Since <= 0 {
+		return fmt.Errorf("--since must be positive")
+	}
+	return o.analysisOptions().Validate()
+}
+
+// Range returns the accounted range
+func (o *EnergyOptions) Range(now time.Time) (time.Time, time.Time, error) {
+	end := now
+	if o.End != "" {
+		t, err := time.Parse(time.RFC3339, o.End)
+		if err != nil {
+			return end, end, fmt.Errorf("invalid --end %q, %v", o.End, err)
+		}
+		end = t
+	}
+	start := end.Add(-o.Since)
+	if o.Start != "" {
+		t, err := time.Parse(time.RFC3339, o.Start)
+		if err != nil {
+			return start, end, fmt.Errorf("invalid --start %q, %v", o.Start, err)
+		}
+		start = t
+	}
+	if !start.Before(end) {
+		return start, end, fmt.Errorf("the start %s is not before the end %s", start.Format(time.RFC3339), end.Format(time.RFC3339))
+	}
+	return start, end, nil
+}
+
+func (o *EnergyOptions) analysisOptions() analysis.EnergyOptions {
+	energyOpts := analysis.DefaultEnergyOptions()
+	energyOpts.PUE = o.PUE
+	energyOpts.CarbonIntensity = o.CarbonIntensity
+	return energyOpts
+}
+
+func NewEnergyCommand(opts *KubeOptions) *cobra.Command {
+	energyOpts := &EnergyOptions{}
+	var command = &cobra.Command{
+		Use:   "energy [NAMESPACE...]",
+		Short: "Account the energy and carbon emissions of the GPUs by namespace, job or pod.",
+		Long: "Account the energy and carbon emissions of the GPUs by namespace, job or pod from their power draw. " +
+			"Without names, all the namespaces are accounted unless --namespace is set. Use -o csv to export it for chargeback.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := energyOpts.Validate(); err != nil {
+				return err
+			}
+			start, end, err := energyOpts.Range(time.Now())
+			if err != nil {
+				return err
+			}
+			client, err := opts.ClientSet()
+			if err != nil {
+				return err
+			}
+			names := args
+			if len(names) == 0 && opts.Namespace != "" && !opts.AllNamespaces {
+				names = []string{opts.Namespace}
+			}
+			report, err := analysis.GetNamespacesEnergy(client, names, start, end, energyOpts.analysisOptions())
+			if err != nil {
+				return err
+			}
+			return printEnergy(os.Stdout, energyOpts.Output, energyOpts.By, report)
+		},
+	}
+	energyOpts.AddFlags(command)
+	return command
+}
+
+// energyRows returns the header and the rows of the energy of the report aggregated by by
+func energyRows(by string, report *analysis.EnergyReport) ([]string, [][]string, []analysis.Energy) {
+	header := []string{}
+	rows := [][]string{}
+	energies := []analysis.Energy{}
+	switch by {
+	case ENERGY_BY_POD:
+		header = []string{"NAMESPACE", "POD", "JOB", "NODE", "GPUS"}
+		for _, pod := range report.Pods {
+			rows = append(rows, []string{pod.Namespace, pod.Pod, pod.Job, pod.Node, strconv.Itoa(pod.GPUs)})
+			energies = append(energies, pod.Energy)
+		}
+	case ENERGY_BY_JOB:
+		header = []string{"NAMESPACE", "JOB", "PODS"}
+		for _, job := range report.Jobs {
+			rows = append(rows, []string{job.Namespace, job.Job, strconv.Itoa(job.Pods)})
+			energies = append(energies, job.Energy)
+		}
+	default:
+		header = []string{"NAMESPACE", "JOBS", "PODS"}
+		for _, namespace := range report.Namespaces {
+			rows = append(rows, []string{namespace.Namespace, strconv.Itoa(namespace.Jobs), strconv.Itoa(namespace.Pods)})
+			energies = append(energies, namespace.Energy)
+		}
+	}
+	return header, rows, energies
+}
+
+func printEnergy(out io.Writer, format string, by string, report *analysis.EnergyReport) error {
+	switch format {
+	case OUTPUT_JSON, OUTPUT_YAML:
+		return printObject(out, format, report)
+	case OUTPUT_CSV:
+		return printEnergyCSV(out, by, report)
+	}
+	if !report.Available {
+		fmt.Fprintf(out, "no GPU power draw metrics %s from %s to %s\n", analysis.METRIC_POWER_USAGE,
+			report.Start.Local().Format(time.RFC3339), report.End.Local().Format(time.RFC3339))
+		return nil
+	}
+	header, rows, energies := energyRows(by, report)
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, column := range header {
+		fmt.Fprintf(w, "%s\t", column)
+	}
+	fmt.Fprintln(w, "GPU HOURS\tGPU ENERGY(kWh)\tENERGY(kWh)\tCO2E(kg)")
+	for i, row := range rows {
+		for _, column := range row {
+			fmt.Fprintf(w, "%s\t", column)
+		}
+		e := energies[i]
+		fmt.Fprintf(w, "%.2f\t%.3f\t%.3f\t%.3f\n", e.GPUHours, e.GPUEnergyKWh, e.EnergyKWh, e.CO2eKg)
+	}
+	fmt.Fprint(w, "TOTAL\t")
+	for i := 1; i < len(header); i++ {
+		fmt.Fprint(w, "\t")
+	}
+	fmt.Fprintf(w, "%.2f\t%.3f\t%.3f\t%.3f\n", report.Total.GPUHours, report.Total.GPUEnergyKWh, report.Total.EnergyKWh, report.Total.CO2eKg)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "\nFrom %s to %s, PUE %.2f, carbon intensity %.0f gCO2e/kWh\n", report.Start.Local().Format(time.RFC3339),
+		report.End.Local().Format(time.RFC3339), report.PUE, report.CarbonIntensity)
+	return nil
+}
+
+// printEnergyCSV prints one record per row with the range and the factors applied, for chargeback
+func printEnergyCSV(out io.Writer, by string, report *analysis.EnergyReport) error {
+	header, rows, energies := energyRows(by, report)
+	w := csv.NewWriter(out)
+	record := []string{"start", "end"}
+	for _, column := range header {
+		record = append(record, strings.ToLower(column))
+	}
+	record = append(record, "gpu_hours", "gpu_energy_kwh", "pue", "energy_kwh", "carbon_intensity_gco2e_per_kwh", "co2e_kg")
+	if err := w.Write(record); err != nil {
+		return err
+	}
+	start, end := report.Start.UTC().Format(time.RFC3339), report.End.UTC().Format(time.RFC3339)
+	for i, row := range rows {
+		e := energies[i]
+		record := append([]string{start, end}, row...)
+		record = append(record, formatFloat(e.GPUHours), formatFloat(e.GPUEnergyKWh), formatFloat(report.PUE),
+			formatFloat(e.EnergyKWh), formatFloat(report.CarbonIntensity), formatFloat(e.CO2eKg))
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', 6, 64)
+}
@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/xieydd/gpu-metric/installer"
+)
+
+// InstallOptions holds the flags of the install, upgrade and uninstall commands
+type InstallOptions struct {
+	installer.Options
+	FieldManager string
+	DryRun       bool
+	Output       string
+}
+
+func (o *InstallOptions) Validate() error {
+	switch o.Output {
+	case "", OUTPUT_JSON, OUTPUT_YAML:
+	default:
+		return fmt.Errorf("unsupported output format %q, must be one of: json|yaml", o.Output)
+	}
+	return o.Options.Validate()
+}
+
+func (o *InstallOptions) AddFlags(command *cobra.Command) {
+	command.Flags().StringVar(&o.Options.Namespace, "monitoring-namespace", o.Options.Namespace, "Namespace of prometheus and the GPU exporter, created if it is not kube-system.")
+	command.Flags().StringVar(&o.NodeSelector, "node-selector", o.NodeSelector, "Labels of the GPU nodes running the exporter, key (the label exists) or key=value, separated by commas.")
+	command.Flags().StringVar(&o.PrometheusImage, "prometheus-image", o.PrometheusImage, "Image of prometheus.")
+	command.Flags().StringVar(&o.ExporterImage, "exporter-image", o.ExporterImage, "Image of the GPU exporter.")
+	command.Flags().StringVar(&o.Retention, "retention", o.Retention, "Storage retention of prometheus, such as 360h or 15d.")
+	command.Flags().DurationVar(&o.ScrapeInterval, "scrape-interval", o.ScrapeInterval, "Scrape interval of the GPU exporter.")
+	command.Flags().BoolVar(&o.Alerts, "alerts", o.Alerts, "Add the alerting rules of the GPU memory predicted to be exhausted.")
+	command.Flags().DurationVar(&o.AlertHorizon, "alert-horizon", o.AlertHorizon, "Alert when the GPU memory is predicted to be exhausted within this duration.")
+	command.Flags().StringVar(&o.FieldManager, "field-manager", installer.DEFAULT_FIELD_MANAGER, "Field manager of the applied fields.")
+	command.Flags().BoolVar(&o.DryRun, "dry-run", false, "Only print the changes to the live objects.")
+	command.Flags().StringVarP(&o.Output, "output", "o", "", "Output format of --dry-run. One of: json|yaml.")
+}
+
+func newInstaller(opts *KubeOptions, installOpts *InstallOptions) (*installer.Installer, error) {
+	client, err := opts.ClientSet()
+	if err != nil {
+		return nil, err
+	}
+	// the objects are addressed by absolute paths, any REST client of the cluster sends them
+	i := installer.NewInstaller(client.CoreV1().RESTClient())
+	i.FieldManager = installOpts.FieldManager
+	return i, nil
+}
+
+func NewInstallCommand(opts *KubeOptions) *cobra.Command {
+	installOpts := &InstallOptions{Options: installer.DefaultOptions()}
+	var command = &cobra.Command{
+		Use:   "install",
+		Short: "Install prometheus and the GPU exporter.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runApply(opts, installOpts, false)
+		},
+	}
+	installOpts.AddFlags(command)
+	return command
+}
+
+func NewUpgradeCommand(opts *KubeOptions) *cobra.Command {
+	installOpts := &InstallOptions{Options: installer.DefaultOptions()}
+	var command = &cobra.Command{
+		Use:   "upgrade",
+		Short: "Upgrade prometheus and the GPU exporter by server-side apply.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runApply(opts, installOpts, true)
+		},
+	}
+	installOpts.AddFlags(command)
+	return command
+}
+
+func runApply(opts *KubeOptions, installOpts *InstallOptions, upgrade bool) error {
+	if err := installOpts.Validate(); err != nil {
+		return err
+	}
+	objects, err := installer.Render(installOpts.Options)
+	if err != nil {
+		return err
+	}
+	i, err := newInstaller(opts, installOpts)
+	if err != nil {
+		return err
+	}
+	if installOpts.DryRun {
+		diffs, err := i.Diff(objects)
+		if err != nil {
+			return err
+		}
+		return printObjectDiffs(os.Stdout, installOpts.Output, diffs)
+	}
+	if upgrade {
+		err = i.Upgrade(objects)
+	} else {
+		err = i.Install(objects)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "%d objects applied in %s\n", len(objects), installOpts.Options.Namespace)
+	return nil
+}
+
+func NewUninstallCommand(opts *KubeOptions) *cobra.Command {
+	installOpts := &InstallOptions{Options: installer.DefaultOptions()}
+	var command = &cobra.Command{
+		Use:   "uninstall",
+		Short: "Delete prometheus and the GPU exporter.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := installOpts.Validate(); err != nil {
+				return err
+			}
+			objects, err := installer.Render(installOpts.Options)
+			if err != nil {
+				return err
+			}
+			i, err := newInstaller(opts, installOpts)
+			if err != nil {
+				return err
+			}
+			names, err := i.Uninstall(objects, installOpts.DryRun)
+			verb := "deleted"
+			if installOpts.DryRun {
+				verb = "would be deleted"
+			}
+			for _, name := range names {
+				fmt.Fprintf(os.Stdout, "%s %s\n", name, verb)
+			}
+			return err
+		},
+	}
+	installOpts.AddFlags(command)
+	return command
+}
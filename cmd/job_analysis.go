@@ -0,0 +1,389 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/xieydd/gpu-metric/analysis"
+	"github.com/xieydd/gpu-metric/utils"
+	"github.com/xieydd/gpu-metric/workload"
+	"k8s.io/client-go/kubernetes"
+)
+
+// JobAnalysisOptions selects the analyses shown after the GPU usage of a job or workload
+type JobAnalysisOptions struct {
+	Stragglers      bool
+	Hung            bool
+	HungThreshold   time.Duration
+	LabelHung       bool
+	MemoryTrend     bool
+	Bottlenecks     bool
+	RightSize       bool
+	GpuHourPrice    float64
+	Energy          bool
+	PUE             float64
+	CarbonIntensity float64
+	RecordEvents    bool
+	Window          time.Duration
+}
+
+func (o *JobAnalysisOptions) AddFlags(command *cobra.Command) {
+	command.Flags().BoolVar(&o.Stragglers, "stragglers", false, "Detect the workers and GPUs whose duty cycle deviates from their peers.")
+	command.Flags().BoolVar(&o.Hung, "hung", false, "Detect whether the job is hung: its GPUs hold memory while their duty cycle has been 0 after a period of activity.")
+	command.Flags().DurationVar(&o.HungThreshold, "hung-threshold", analysis.DEFAULT_HUNG_THRESHOLD, "How long the GPUs of a hung job have been idle.")
+	command.Flags().BoolVar(&o.LabelHung, "label-hung", false, fmt.Sprintf("Label the pods of a hung job with %s=true, and remove the label once it is no longer hung.", analysis.HUNG_LABEL))
+	command.Flags().BoolVar(&o.MemoryTrend, "memory-trend", false, "Fit the trend of the GPU memory used since the job started, flag monotonic growth and estimate the time to exhaustion.")
+	command.Flags().BoolVar(&o.Bottlenecks, "bottlenecks", false, "Classify the pods as GPU-bound, CPU/input-bound, IO-bound or network-bound from the GPU and cAdvisor metrics over the window.")
+	command.Flags().BoolVar(&o.RightSize, "right-size", false, "Recommend the GPU count of the job, whether it fits a smaller or shared GPU and the expected savings from its history.")
+	command.Flags().Float64Var(&o.GpuHourPrice, "gpu-hour-price", 0, "Price of a GPU hour, to show the expected savings of --right-size in money.")
+	command.Flags().BoolVar(&o.Energy, "energy", false, "Account the energy used by the GPUs of the job over its lifetime from their power draw, in kWh and kg CO2e.")
+	addEnergyFlags(command, &o.PUE, &o.CarbonIntensity)
+	command.Flags().BoolVar(&o.RecordEvents, "record-events", false, "Record the findings of the analyses as events on the pods.")
+	command.Flags().DurationVar(&o.Window, "window", analysis.DEFAULT_STRAGGLER_WINDOW, "Window of the metric history analyzed, the hung job analysis looks back at least "+analysis.DEFAULT_HUNG_WINDOW.String()+
+		" before --hung-threshold and since the job started, the memory trend and right-sizing since the job started, up to "+analysis.DEFAULT_MEMORY_TREND_WINDOW.String()+
+		" and "+analysis.DEFAULT_RIGHT_SIZING_WINDOW.String()+".")
+}
+
+// Enabled returns true if any analysis is selected
+func (o *JobAnalysisOptions) Enabled() bool {
+	return o.Stragglers || o.Hung || o.MemoryTrend || o.Bottlenecks || o.RightSize || o.Energy
+}
+
+func (o *JobAnalysisOptions) Validate() error {
+	if o.RecordEvents && !o.Enabled() {
+		return fmt.Errorf("--record-events requires an analysis such as --stragglers")
+	}
+	if o.LabelHung && !o.Hung {
+		return fmt.Errorf("--label-hung requires --hung")
+	}
+	if o.GpuHourPrice < 0 || (o.GpuHourPrice > 0 && !o.RightSize) {
+		return fmt.Errorf("--gpu-hour-price must be positive and requires --right-size")
+	}
+	if o.Energy {
+		if err := o.energyOptions().Validate(); err != nil {
+			return err
+		}
+	}
+	if o.Enabled() && o.Window <= 0 {
+		return fmt.Errorf("--window must be positive")
+	}
+	if o.Hung && o.HungThreshold <= 0 {
+		return fmt.Errorf("--hung-threshold must be positive")
+	}
+	return nil
+}
+
+// hungWindow is the activity looked back at by the hung job analysis before the idle threshold
+func (o *JobAnalysisOptions) hungWindow() time.Duration {
+	if o.Window > analysis.DEFAULT_HUNG_WINDOW {
+		return o.Window
+	}
+	return analysis.DEFAULT_HUNG_WINDOW
+}
+
+// memoryTrendWindow is the longest history of the memory trend analysis
+func (o *JobAnalysisOptions) memoryTrendWindow() time.Duration {
+	if o.Window > analysis.DEFAULT_MEMORY_TREND_WINDOW {
+		return o.Window
+	}
+	return analysis.DEFAULT_MEMORY_TREND_WINDOW
+}
+
+// rightSizingWindow is the longest history of the right-sizing recommendation
+func (o *JobAnalysisOptions) rightSizingWindow() time.Duration {
+	if o.Window > analysis.DEFAULT_RIGHT_SIZING_WINDOW {
+		return o.Window
+	}
+	return analysis.DEFAULT_RIGHT_SIZING_WINDOW
+}
+
+func (o *JobAnalysisOptions) energyOptions() analysis.EnergyOptions {
+	energyOpts := analysis.DefaultEnergyOptions()
+	energyOpts.PUE = o.PUE
+	energyOpts.CarbonIntensity = o.CarbonIntensity
+	return energyOpts
+}
+
+// JobAnalysis is the result of the selected analyses
+type JobAnalysis struct {
+	Stragglers  *analysis.StragglerReport   `json:"stragglers,omitempty"`
+	Hung        *analysis.HungReport        `json:"hung,omitempty"`
+	MemoryTrend *analysis.MemoryTrendReport `json:"memoryTrend,omitempty"`
+	Bottlenecks *analysis.BottleneckReport  `json:"bottlenecks,omitempty"`
+	RightSizing *analysis.RightSizing       `json:"rightSizing,omitempty"`
+	Energy      *analysis.EnergyReport      `json:"energy,omitempty"`
+}
+
+// Run runs the selected analyses of w, and records their findings as events if requested
+func (o *JobAnalysisOptions) Run(client kubernetes.Interface, w workload.Workload) (*JobAnalysis, error) {
+	result := &JobAnalysis{}
+	if o.Stragglers {
+		stragglerOpts := analysis.DefaultStragglerOptions()
+		stragglerOpts.Window = o.Window
+		report, err := analysis.GetWorkloadStragglers(client, w, stragglerOpts)
+		if err != nil {
+			return nil, err
+		}
+		if o.RecordEvents {
+			if err := analysis.RecordStragglerEvents(client, w, report); err != nil {
+				return nil, err
+			}
+		}
+		result.Stragglers = report
+	}
+	if o.Hung {
+		hungOpts := analysis.DefaultHungOptions()
+		hungOpts.Window = o.hungWindow()
+		hungOpts.Threshold = o.HungThreshold
+		report, err := analysis.GetWorkloadHung(client, w, hungOpts)
+		if err != nil {
+			return nil, err
+		}
+		if o.RecordEvents {
+			if err := analysis.RecordHungEvents(client, w, report); err != nil {
+				return nil, err
+			}
+		}
+		if o.LabelHung {
+			if err := analysis.LabelHungJob(client, w, report); err != nil {
+				return nil, err
+			}
+		}
+		result.Hung = report
+	}
+	if o.MemoryTrend {
+		trendOpts := analysis.DefaultMemoryTrendOptions()
+		trendOpts.Window = o.memoryTrendWindow()
+		report, err := analysis.GetWorkloadMemoryTrends(client, w, trendOpts)
+		if err != nil {
+			return nil, err
+		}
+		if o.RecordEvents {
+			if err := analysis.RecordMemoryTrendEvents(client, w, report); err != nil {
+				return nil, err
+			}
+		}
+		result.MemoryTrend = report
+	}
+	if o.Bottlenecks {
+		bottleneckOpts := analysis.DefaultBottleneckOptions()
+		bottleneckOpts.Window = o.Window
+		report, err := analysis.GetWorkloadBottlenecks(client, w, bottleneckOpts)
+		if err != nil {
+			return nil, err
+		}
+		result.Bottlenecks = report
+	}
+	if o.RightSize {
+		rightSizingOpts := analysis.DefaultRightSizingOptions()
+		rightSizingOpts.Window = o.rightSizingWindow()
+		rightSizingOpts.PricePerGPUHour = o.GpuHourPrice
+		recommendation, err := analysis.GetWorkloadRightSizing(client, w, rightSizingOpts)
+		if err != nil {
+			return nil, err
+		}
+		result.RightSizing = recommendation
+	}
+	if o.Energy {
+		report, err := analysis.GetWorkloadEnergy(client, w, o.energyOptions())
+		if err != nil {
+			return nil, err
+		}
+		result.Energy = report
+	}
+	return result, nil
+}
+
+// printWorkloadView prints the GPU usage of the pods of w, by role if requested, and the selected analyses
+func printWorkloadView(client kubernetes.Interface, w workload.Workload, topOpts *TopOptions, withNamespace bool) error {
+	var usage interface{}
+	var printUsage func() error
+	if topOpts.ByRole {
+		roles, err := utils.GetWorkloadRoleGpuMetric(client, w)
+		if err != nil {
+			return err
+		}
+		usage = roles
+		printUsage = func() error { return printRoles(os.Stdout, topOpts.Output, roles) }
+	} else {
+		usages, err := utils.GetWorkloadGpuUsage(client, w)
+		if err != nil {
+			return err
+		}
+		usage = usages
+		printUsage = func() error {
+			return printInstances(os.Stdout, topOpts.Output, "INSTANCE NAME", withNamespace, true, usages)
+		}
+	}
+	if !topOpts.Analysis.Enabled() {
+		return printUsage()
+	}
+	jobAnalysis, err := topOpts.Analysis.Run(client, w)
+	if err != nil {
+		return err
+	}
+	return printJobView(os.Stdout, topOpts.Output, usage, printUsage, jobAnalysis)
+}
+
+// printJobView prints the usage of a job followed by its analysis, as one object for json and yaml
+func printJobView(out io.Writer, format string, usage interface{}, printUsage func() error, jobAnalysis *JobAnalysis) error {
+	if format == OUTPUT_JSON || format == OUTPUT_YAML {
+		return printObject(out, format, struct {
+			Usage    interface{}  `json:"usage"`
+			Analysis *JobAnalysis `json:"analysis"`
+		}{usage, jobAnalysis})
+	}
+	if err := printUsage(); err != nil {
+		return err
+	}
+	return printJobAnalysis(out, jobAnalysis)
+}
+
+func printJobAnalysis(out io.Writer, jobAnalysis *JobAnalysis) error {
+	if report := jobAnalysis.Stragglers; report != nil {
+		fmt.Fprintf(out, "\nStragglers over the last %s:\n", report.Window)
+		if !report.HasStragglers() {
+			fmt.Fprintln(out, "  none")
+		} else {
+			w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "ROLE\tINSTANCE NAME\tGPU\tNODE\tDUTY CYCLE\tPEER MEDIAN\tSCORE\tDIRECTION")
+			for _, outlier := range append(append([]analysis.Outlier{}, report.Workers...), report.GPUs...) {
+				gpu := outlier.GPU
+				if gpu == "" {
+					gpu = "*"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%.1f%%\t%.1f%%\t%.1f\t%s\n", outlier.Role, outlier.Pod, gpu, outlier.Node,
+					outlier.DutyCycle, outlier.Median, outlier.Score, outlier.Direction)
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if report := jobAnalysis.Hung; report != nil {
+		if !report.Hung {
+			fmt.Fprintf(out, "\nNot hung: %s\n", report.Reason)
+		} else {
+			fmt.Fprintf(out, "\nHung: the GPUs have been idle for %s since %s after a period of activity\n",
+				report.IdleFor, report.IdleSince.Local().Format(time.RFC3339))
+			w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "INSTANCE NAME\tGPU\tNODE\tGPU(Memory MiB)\tIDLE SINCE")
+			for _, gpu := range report.GPUs {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%.0fMiB\t%s\n", gpu.Pod, gpu.GPU, gpu.Node, gpu.MemoryUsed/1024/1024,
+					gpu.IdleSince.Local().Format(time.RFC3339))
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if report := jobAnalysis.MemoryTrend; report != nil {
+		fmt.Fprintf(out, "\nGPU memory trend over the last %s:\n", report.Window)
+		if len(report.GPUs) == 0 {
+			fmt.Fprintln(out, "  not enough history")
+		} else {
+			w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "INSTANCE NAME\tGPU\tNODE\tGPU(Memory MiB)\tGROWTH\tTIME TO EXHAUSTION\tTREND")
+			for _, gpu := range report.GPUs {
+				exhaustion := gpu.TimeToExhaustion
+				if exhaustion == "" {
+					exhaustion = NOT_AVAILABLE
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%.0fMiB / %.0fMiB\t%+.0fMiB/h\t%s\t%s\n", gpu.Pod, gpu.GPU, gpu.Node,
+					gpu.MemoryUsed/1024/1024, gpu.MemoryTotal/1024/1024, gpu.GrowthPerHour/1024/1024, exhaustion, memoryTrendOf(gpu))
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if report := jobAnalysis.Bottlenecks; report != nil {
+		fmt.Fprintf(out, "\nBottlenecks over the last %s:\n", report.Window)
+		if len(report.Pods) == 0 {
+			fmt.Fprintln(out, "  no running pod uses GPUs")
+		} else {
+			w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "ROLE\tINSTANCE NAME\tNODE\tBOTTLENECK\tEVIDENCE")
+			for _, pod := range report.Pods {
+				for i, evidence := range pod.Evidence {
+					if i == 0 {
+						fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", pod.Role, pod.Pod, pod.Node, pod.Bottleneck, evidence)
+					} else {
+						fmt.Fprintf(w, "\t\t\t\t%s\n", evidence)
+					}
+				}
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if r := jobAnalysis.RightSizing; r != nil {
+		fmt.Fprintf(out, "\nRight-sizing over the last %s:\n", r.Window)
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "  Requested GPUs:\t%d (%d allocated, %d with metrics)\n", r.RequestedGPU, r.AllocatedGPU, r.MeasuredGPU)
+		if r.MeasuredGPU > 0 {
+			fmt.Fprintf(w, "  Mean duty cycle:\t%.1f%%\n", r.MeanDutyCycle)
+			fmt.Fprintf(w, "  Peak busy GPUs:\t%.2f\n", r.PeakBusyGPU)
+			fmt.Fprintf(w, "  Peak memory:\t%.0fMiB / %.0fMiB\n", r.PeakMemoryUsed/1024/1024, r.MemoryTotal/1024/1024)
+		}
+		suggested := fmt.Sprintf("%d", r.SuggestedGPU)
+		if r.SharedGPUFraction > 0 {
+			suggested = fmt.Sprintf("%.0f%% of a shared GPU", r.SharedGPUFraction*100)
+		}
+		fmt.Fprintf(w, "  Suggested GPUs:\t%s\n", suggested)
+		if r.SmallerGPUMemory > 0 {
+			fmt.Fprintf(w, "  Smaller GPU:\tfits a GPU with %.0fGiB of memory\n", r.SmallerGPUMemory/1024/1024/1024)
+		}
+		savings := fmt.Sprintf("%.2f GPUs (%.0f%%), %.1f GPU hours per day", r.SavedGPU, r.SavingsPercent, r.SavedGPUHoursPerDay)
+		if r.SavedCostPerDay > 0 {
+			savings += fmt.Sprintf(", %.2f per day", r.SavedCostPerDay)
+		}
+		fmt.Fprintf(w, "  Expected savings:\t%s\n", savings)
+		for i, reason := range r.Reasons {
+			if i == 0 {
+				fmt.Fprintf(w, "  Reasons:\t%s\n", reason)
+			} else {
+				fmt.Fprintf(w, "\t%s\n", reason)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	if report := jobAnalysis.Energy; report != nil {
+		fmt.Fprintf(out, "\nEnergy from %s to %s:\n", report.Start.Local().Format(time.RFC3339), report.End.Local().Format(time.RFC3339))
+		if !report.Available {
+			fmt.Fprintln(out, "  no GPU power draw metrics")
+		} else {
+			w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+			fmt.Fprintf(w, "  GPU hours:\t%.2f\n", report.Total.GPUHours)
+			fmt.Fprintf(w, "  GPU energy:\t%.3f kWh\n", report.Total.GPUEnergyKWh)
+			fmt.Fprintf(w, "  Energy:\t%.3f kWh (PUE %.2f)\n", report.Total.EnergyKWh, report.PUE)
+			fmt.Fprintf(w, "  Emissions:\t%.3f kg CO2e (%.0f gCO2e/kWh)\n", report.Total.CO2eKg, report.CarbonIntensity)
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// memoryTrendOf summarizes the trend of the memory of a GPU
+func memoryTrendOf(trend analysis.MemoryTrend) string {
+	switch {
+	case trend.OOMRisk && trend.MonotonicGrowth:
+		return "leak, OOM risk"
+	case trend.OOMRisk:
+		return "OOM risk"
+	case trend.MonotonicGrowth:
+		return "leak"
+	case trend.TimeToExhaustion != "":
+		return "growing"
+	}
+	return "stable"
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"os"
+
+	"github.com/xieydd/gpu-metric/cmd"
+)
+
+func main() {
+	if err := cmd.NewRootCommand().Execute(); err != nil {
+		os.Exit(1)
+	}
+}
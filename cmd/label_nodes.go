@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/xieydd/gpu-metric/labeler"
+)
+
+// LabelNodesOptions holds the flags of the label-nodes command
+type LabelNodesOptions struct {
+	labeler.Options
+	Once    bool
+	Workers int
+}
+
+func NewLabelNodesCommand(opts *KubeOptions) *cobra.Command {
+	labelOpts := &LabelNodesOptions{Options: labeler.DefaultOptions()}
+	var command = &cobra.Command{
+		Use:   "label-nodes",
+		Short: "Label the GPU nodes with the exporter selector, GPU model and count labels, and keep them up to date.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := labelOpts.Validate(); err != nil {
+				return err
+			}
+			if labelOpts.Workers <= 0 {
+				return fmt.Errorf("--workers must be positive")
+			}
+			client, err := opts.ClientSet()
+			if err != nil {
+				return err
+			}
+			l := labeler.NewLabeler(client, labelOpts.Options)
+			if labelOpts.Once {
+				changed, err := l.LabelNodes()
+				for _, name := range changed {
+					fmt.Fprintf(os.Stdout, "node/%s labeled\n", name)
+				}
+				return err
+			}
+
+			stopCh := make(chan struct{})
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+			go func() {
+				<-signals
+				close(stopCh)
+			}()
+			l.Run(labelOpts.Workers, stopCh)
+			return nil
+		},
+	}
+	command.Flags().BoolVar(&labelOpts.Once, "once", false, "Label the nodes once and exit instead of watching them.")
+	command.Flags().IntVar(&labelOpts.Workers, "workers", 2, "Number of nodes labeled concurrently.")
+	command.Flags().StringSliceVar(&labelOpts.Resources, "resource", labelOpts.Resources, "Extended resources of the GPUs.")
+	command.Flags().StringVar(&labelOpts.SelectorLabel, "selector-label", labelOpts.SelectorLabel, "Label selecting the nodes of the exporter, key or key=value. The value of a key only is the GPU count.")
+	command.Flags().StringVar(&labelOpts.ModelLabel, "model-label", labelOpts.ModelLabel, "Label of the GPU model, empty to disable.")
+	command.Flags().StringVar(&labelOpts.CountLabel, "count-label", labelOpts.CountLabel, "Label of the GPU count, empty to disable.")
+	command.Flags().StringSliceVar(&labelOpts.ModelSourceLabels, "model-source-label", labelOpts.ModelSourceLabels, "Node labels the GPU model is read from, the first one set is used.")
+	command.Flags().DurationVar(&labelOpts.Resync, "resync", labelOpts.Resync, "Interval all the nodes are labeled again.")
+	return command
+}
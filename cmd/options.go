@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/xieydd/gpu-metric/base"
+	"k8s.io/client-go/kubernetes"
+)
+
+// KubeOptions holds the kubeconfig flags shared by all the commands,
+// they follow the conventions of kubectl
+type KubeOptions struct {
+	Kubeconfig        string
+	Context           string
+	Namespace         string
+	AllNamespaces     bool
+	Impersonate       string
+	ImpersonateGroups []string
+	PrometheusURL     string
+	PrometheusService string
+	Debug             bool
+}
+
+func (o *KubeOptions) AddFlags(command *cobra.Command) {
+	flags := command.PersistentFlags()
+	flags.StringVar(&o.Kubeconfig, "kubeconfig", "", "Path to the kubeconfig file to use for CLI requests.")
+	flags.StringVar(&o.Context, "context", "", "The name of the kubeconfig context to use.")
+	flags.StringVarP(&o.Namespace, "namespace", "n", "", "If present, the namespace scope for this CLI request.")
+	flags.BoolVarP(&o.AllNamespaces, "all-namespaces", "A", false, "If present, list the requested object(s) across all namespaces.")
+	flags.StringVar(&o.Impersonate, "as", "", "Username to impersonate for the operation.")
+	flags.StringArrayVar(&o.ImpersonateGroups, "as-group", []string{}, "Group to impersonate for the operation, this flag can be repeated to specify multiple groups.")
+	flags.StringVar(&o.PrometheusService, "prometheus-service", "", "Prometheus service to query as namespace/name:port instead of the discovered one.")
+	flags.StringVar(&o.PrometheusURL, "prometheus-url", "", "URL of a prometheus to query directly instead of through the API server proxy, for users without access to kube-system.")
+	flags.BoolVar(&o.Debug, "debug", false, "Enable debug logging.")
+}
+
+// ClientOptions returns the options of the kubernetes client
+func (o *KubeOptions) ClientOptions() base.ClientOptions {
+	return base.ClientOptions{
+		Kubeconfig:        o.Kubeconfig,
+		Context:           o.Context,
+		Namespace:         o.Namespace,
+		Impersonate:       o.Impersonate,
+		ImpersonateGroups: o.ImpersonateGroups,
+		UserAgent:         "kubectl-gpu",
+	}
+}
+
+// ClientSet creates the kubernetes client from the kubeconfig flags
+func (o *KubeOptions) ClientSet() (kubernetes.Interface, error) {
+	client, _, err := base.NewClient(o.ClientOptions())
+	return client, err
+}
+
+// GetNamespace returns the namespace of the request, empty means all namespaces
+func (o *KubeOptions) GetNamespace() (string, error) {
+	if o.AllNamespaces {
+		return "", nil
+	}
+	return o.ClientOptions().GetNamespace()
+}
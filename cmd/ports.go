@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"github.com/xieydd/gpu-metric/base"
+)
+
+// PortsOptions holds the flags of the ports commands
+type PortsOptions struct {
+	Range  string
+	Output string
+}
+
+func (o *PortsOptions) Validate() error {
+	switch o.Output {
+	case "", OUTPUT_WIDE, OUTPUT_JSON, OUTPUT_YAML:
+		return nil
+	}
+	return fmt.Errorf("unsupported output format %q, must be one of: wide|json|yaml", o.Output)
+}
+
+func NewPortsCommand(opts *KubeOptions) *cobra.Command {
+	portsOpts := &PortsOptions{}
+	var command = &cobra.Command{
+		Use:   "ports",
+		Short: "Inspect the node ports used in the cluster.",
+	}
+	command.PersistentFlags().StringVarP(&portsOpts.Output, "output", "o", "", "Output format. One of: wide|json|yaml.")
+	command.AddCommand(NewPortsWhoCommand(opts, portsOpts))
+	command.AddCommand(NewPortsListCommand(opts, portsOpts))
+	return command
+}
+
+func NewPortsWhoCommand(opts *KubeOptions, portsOpts *PortsOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "who PORT",
+		Short: "Display the pods, services and reservations using a port.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := portsOpts.Validate(); err != nil {
+				return err
+			}
+			port, err := strconv.Atoi(args[0])
+			if err != nil || port <= 0 || port > base.MAX_PORT {
+				return fmt.Errorf("invalid port %q", args[0])
+			}
+			client, err := opts.ClientSet()
+			if err != nil {
+				return err
+			}
+			ports, err := base.WhoUses(client, port)
+			if err != nil {
+				return err
+			}
+			if len(ports) == 0 && portsOpts.Output == "" {
+				fmt.Fprintf(os.Stdout, "port %d is not used\n", port)
+				return nil
+			}
+			return printUsedPorts(os.Stdout, portsOpts.Output, ports)
+		},
+	}
+}
+
+func NewPortsListCommand(opts *KubeOptions, portsOpts *PortsOptions) *cobra.Command {
+	var command = &cobra.Command{
+		Use:   "list",
+		Short: "Display the ports used in a range.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := portsOpts.Validate(); err != nil {
+				return err
+			}
+			r, err := base.ParsePortRange(portsOpts.Range)
+			if err != nil {
+				return err
+			}
+			client, err := opts.ClientSet()
+			if err != nil {
+				return err
+			}
+			ports, err := base.ListUsedPorts(client, r)
+			if err != nil {
+				return err
+			}
+			return printUsedPorts(os.Stdout, portsOpts.Output, ports)
+		},
+	}
+	defaultRange := base.PortRange{Min: base.AUTO_SELECT_PORT_MIN, Max: base.AUTO_SELECT_PORT_MAX - 1}
+	command.Flags().StringVar(&portsOpts.Range, "range", defaultRange.String(), "Port range to list, such as 20000-29999 or 20000+10000.")
+	return command
+}
@@ -0,0 +1,248 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/ghodss/yaml"
+	"github.com/xieydd/gpu-metric/base"
+	"github.com/xieydd/gpu-metric/doctor"
+	"github.com/xieydd/gpu-metric/installer"
+	"github.com/xieydd/gpu-metric/utils"
+)
+
+const OUTPUT_WIDE = "wide"
+const OUTPUT_JSON = "json"
+const OUTPUT_YAML = "yaml"
+const OUTPUT_CSV = "csv"
+
+const NOT_AVAILABLE = "N/A"
+
+// NO_GPU_REQUESTED is displayed instead of N/A for the pods which do not request GPUs, such as PS pods
+const NO_GPU_REQUESTED = "-"
+
+func printObject(out io.Writer, format string, obj interface{}) error {
+	var data []byte
+	var err error
+	switch format {
+	case OUTPUT_JSON:
+		data, err = json.MarshalIndent(obj, "", "    ")
+		data = append(data, '\n')
+	case OUTPUT_YAML:
+		data, err = yaml.Marshal(obj)
+	default:
+		return fmt.Errorf("unsupported output format %s", format)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(data)
+	return err
+}
+
+// printInstances prints pods or nodes with one line per GPU device, the
+// instance columns are only filled on the line of the first device.
+func printInstances(out io.Writer, format string, nameHeader string, withNamespace bool, withNode bool, instances []utils.InstanceGpuUsage) error {
+	if format == OUTPUT_JSON || format == OUTPUT_YAML {
+		return printObject(out, format, instances)
+	}
+	withNamespace = withNamespace || format == OUTPUT_WIDE
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	header := ""
+	if withNamespace {
+		header += "NAMESPACE\t"
+	}
+	header += nameHeader + "\tSTATUS\t"
+	if withNode {
+		header += "NODE\t"
+	}
+	fmt.Fprintf(w, "%sGPU(Device Index)\tGPU(Duty Cycle)\tGPU(Memory MiB)\n", header)
+
+	for _, instance := range instances {
+		prefix := ""
+		blank := ""
+		if withNamespace {
+			prefix += instance.Namespace + "\t"
+			blank += "\t"
+		}
+		prefix += instance.Name + "\t" + instance.Status + "\t"
+		blank += "\t\t"
+		if withNode {
+			prefix += instance.Node + "\t"
+			blank += "\t"
+		}
+		if len(instance.GPUs) == 0 {
+			missing := NOT_AVAILABLE
+			if instance.RequestedGPU == 0 {
+				missing = NO_GPU_REQUESTED
+			}
+			fmt.Fprintf(w, "%s%s\t%s\t%s\n", prefix, missing, missing, missing)
+			continue
+		}
+		for i, gpu := range instance.GPUs {
+			if i > 0 {
+				prefix = blank
+			}
+			fmt.Fprintf(w, "%s%s\t%s\t%s\n", prefix, gpu.Index, formatDutyCycle(gpu.DutyCycle), formatMemory(gpu.MemoryUsed, gpu.MemoryTotal))
+		}
+	}
+	return w.Flush()
+}
+
+func printNamespaces(out io.Writer, format string, namespaces []utils.NamespaceGpuUsage) error {
+	if format == OUTPUT_JSON || format == OUTPUT_YAML {
+		return printObject(out, format, namespaces)
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "NAMESPACE\tPODS\tGPUS\tGPU(Average Duty Cycle)\tGPU(Memory MiB)\n")
+	for _, ns := range namespaces {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", ns.Namespace, ns.Pods, ns.GPUs,
+			formatDutyCycle(ns.AverageDutyCycle), formatMemory(ns.MemoryUsed, ns.MemoryTotal))
+	}
+	return w.Flush()
+}
+
+// printRoles prints the GPU usage of a distributed job grouped by replica role, one summary line
+// per role followed by one line per replica
+func printRoles(out io.Writer, format string, roles []utils.RoleGpuMetric) error {
+	if format == OUTPUT_JSON || format == OUTPUT_YAML {
+		return printObject(out, format, roles)
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ROLE\tINDEX\tINSTANCE NAME\tSTATUS\tNODE\tGPU(Requested)\tGPU(Mean Duty Cycle)\tGPU(Min/Max Duty Cycle)\tGPU(Memory MiB)\n")
+	for _, role := range roles {
+		fmt.Fprintf(w, "%s\t*\t%d replicas\t\t\t%d\t%s\n", role.Role, len(role.Replicas), role.RequestedGPU,
+			formatDutyColumns(role.RequestedGPU, role.GPUs, role.MeanDuty, role.MinDuty, role.MaxDuty, role.MemoryUsed, role.MemoryTotal))
+		for _, replica := range role.Replicas {
+			var mean, min, max, used, total float64
+			for i, gpu := range replica.GPUs {
+				if i == 0 || gpu.DutyCycle < min {
+					min = gpu.DutyCycle
+				}
+				if i == 0 || gpu.DutyCycle > max {
+					max = gpu.DutyCycle
+				}
+				mean += gpu.DutyCycle
+				used += gpu.MemoryUsed
+				total += gpu.MemoryTotal
+			}
+			if len(replica.GPUs) > 0 {
+				mean = mean / float64(len(replica.GPUs))
+			}
+			fmt.Fprintf(w, "\t%s\t%s\t%s\t%s\t%d\t%s\n", replica.Index, replica.PodName, replica.Status, replica.NodeName, replica.RequestedGPU,
+				formatDutyColumns(replica.RequestedGPU, len(replica.GPUs), mean, min, max, used, total))
+		}
+	}
+	return w.Flush()
+}
+
+func formatDutyColumns(requested int64, gpus int, mean float64, min float64, max float64, used float64, total float64) string {
+	if gpus == 0 {
+		missing := NOT_AVAILABLE
+		if requested == 0 {
+			missing = NO_GPU_REQUESTED
+		}
+		return missing + "\t" + missing + "\t" + missing
+	}
+	return formatDutyCycle(mean) + "\t" + formatDutyCycle(min) + " / " + formatDutyCycle(max) + "\t" + formatMemory(used, total)
+}
+
+func formatDutyCycle(dutyCycle float64) string {
+	return fmt.Sprintf("%.0f%%", dutyCycle)
+}
+
+func formatMemory(used float64, total float64) string {
+	return fmt.Sprintf("%.0fMiB / %.0fMiB", used/1024/1024, total/1024/1024)
+}
+
+// printUsedPorts prints one line per port user, the wide format adds the container
+func printUsedPorts(out io.Writer, format string, ports []base.UsedPort) error {
+	if format == OUTPUT_JSON || format == OUTPUT_YAML {
+		return printObject(out, format, ports)
+	}
+	wide := format == OUTPUT_WIDE
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	header := "PORT\tPROTOCOL\tSOURCE\tKIND\tNAMESPACE\tNAME\tNODE"
+	if wide {
+		header += "\tCONTAINER"
+	}
+	fmt.Fprintln(w, header)
+	for _, port := range ports {
+		protocol, node := string(port.Protocol), port.NodeName
+		if len(protocol) == 0 {
+			protocol = "<any>"
+		}
+		if len(node) == 0 {
+			node = "<all>"
+		}
+		line := fmt.Sprintf("%d\t%s\t%s\t%s\t%s\t%s\t%s", port.Port, protocol, port.Source,
+			port.Owner.Kind, port.Owner.Namespace, port.Owner.Name, node)
+		if wide {
+			line += "\t" + port.Container
+		}
+		fmt.Fprintln(w, line)
+	}
+	return w.Flush()
+}
+
+func printDoctorResults(out io.Writer, format string, results []doctor.Result) error {
+	if format == OUTPUT_JSON || format == OUTPUT_YAML {
+		return printObject(out, format, results)
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tSTATUS\tMESSAGE")
+	for _, result := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", result.Name, result.Status, result.Message)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	for _, result := range results {
+		if result.Fix != "" && result.Status != doctor.STATUS_PASS {
+			fmt.Fprintf(out, "\nTo fix %s:\n  %s\n", result.Name, result.Fix)
+		}
+	}
+	return nil
+}
+
+func printObjectDiffs(out io.Writer, format string, diffs []installer.ObjectDiff) error {
+	if format == OUTPUT_JSON || format == OUTPUT_YAML {
+		return printObject(out, format, diffs)
+	}
+	for _, diff := range diffs {
+		name := diff.Name
+		if diff.Namespace != "" {
+			name = diff.Namespace + "/" + name
+		}
+		fmt.Fprintf(out, "%s %s %s\n", diff.Kind, name, diff.Action)
+		if diff.Diff != "" {
+			fmt.Fprintln(out, diff.Diff)
+		}
+	}
+	return nil
+}
+
+func printPrometheusDiscovery(out io.Writer, format string, discovery *utils.PrometheusDiscovery) error {
+	if format == OUTPUT_JSON || format == OUTPUT_YAML {
+		return printObject(out, format, discovery)
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\tSERVICE\tSOURCE\tORIGIN\tHEALTHY\tGPU NODES")
+	for i, c := range discovery.Candidates {
+		selected := ""
+		if i == discovery.Selected {
+			selected = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%d\n", selected, c.Ref(), c.Source, c.Origin, c.Healthy, c.GpuNodes)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintln(out)
+	for _, line := range discovery.Explanation {
+		fmt.Fprintln(out, line)
+	}
+	return nil
+}
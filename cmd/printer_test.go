@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xieydd/gpu-metric/analysis"
+	"github.com/xieydd/gpu-metric/base"
+	"github.com/xieydd/gpu-metric/utils"
+)
+
+func TestPrintInstances(t *testing.T) {
+	instances := []utils.InstanceGpuUsage{
+		{Name: "style-transfer-tfjob-ps-0", Status: "Running", Node: "192.168.0.95"},
+		{Name: "style-transfer-tfjob-worker-0", Status: "Running", Node: "192.168.0.98", RequestedGPU: 2, GPUs: []utils.GpuUsage{
+			{Index: "0", DutyCycle: 98, MemoryUsed: 15641 * 1024 * 1024, MemoryTotal: 16276 * 1024 * 1024},
+			{Index: "1", DutyCycle: 0, MemoryUsed: 15481 * 1024 * 1024, MemoryTotal: 16276 * 1024 * 1024},
+		}},
+	}
+	out := &bytes.Buffer{}
+	if err := printInstances(out, "", "INSTANCE NAME", false, true, instances); err != nil {
+		t.Fatalf("failed to printInstances, %++v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expect 4 lines, got %d:\n%s", len(lines), out.String())
+	}
+	if strings.Contains(lines[1], "N/A") || !strings.Contains(lines[1], NO_GPU_REQUESTED) {
+		t.Errorf("pod which does not request GPU should display %s, got %s", NO_GPU_REQUESTED, lines[1])
+	}
+	if !strings.Contains(lines[2], "98%") || !strings.Contains(lines[2], "15641MiB / 16276MiB") {
+		t.Errorf("unexpected line %s", lines[2])
+	}
+	if strings.Contains(lines[3], "worker-0") || !strings.HasPrefix(strings.TrimSpace(lines[3]), "1") {
+		t.Errorf("second GPU line should only contain device columns, got %s", lines[3])
+	}
+}
+
+func TestPrintInstancesJson(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := printInstances(out, OUTPUT_JSON, "NAME", false, true, []utils.InstanceGpuUsage{{Name: "pod-0", Status: "Running"}})
+	if err != nil {
+		t.Fatalf("failed to printInstances, %++v", err)
+	}
+	if !strings.Contains(out.String(), `"name": "pod-0"`) {
+		t.Errorf("unexpected json output %s", out.String())
+	}
+}
+
+func TestPrintInstancesWithoutMetrics(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := printInstances(out, "", "NAME", false, true, []utils.InstanceGpuUsage{{Name: "worker-0", Status: "Running", RequestedGPU: 1}})
+	if err != nil {
+		t.Fatalf("failed to printInstances, %++v", err)
+	}
+	if !strings.Contains(out.String(), NOT_AVAILABLE) {
+		t.Errorf("pod requesting GPU without metrics should display %s, got %s", NOT_AVAILABLE, out.String())
+	}
+}
+
+func TestPrintUsedPorts(t *testing.T) {
+	ports := []base.UsedPort{
+		{Port: 20000, Protocol: "TCP", NodeName: "node1", Source: base.PORT_SOURCE_HOST_NETWORK,
+			Owner: base.PortOwner{Kind: base.OWNER_KIND_POD, Namespace: "default", Name: "worker-0"}, Container: "tensorflow"},
+		{Port: 20001, Source: base.PORT_SOURCE_RESERVATION,
+			Owner: base.PortOwner{Kind: base.OWNER_KIND_JOB, Namespace: "default", Name: "mnist"}},
+	}
+	out := &bytes.Buffer{}
+	if err := printUsedPorts(out, OUTPUT_WIDE, ports); err != nil {
+		t.Fatalf("failed to printUsedPorts, %++v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expect 3 lines, got %d:\n%s", len(lines), out.String())
+	}
+	if fields := strings.Fields(lines[1]); len(fields) != 8 || fields[6] != "node1" || fields[7] != "tensorflow" {
+		t.Errorf("unexpected line %s", lines[1])
+	}
+	if fields := strings.Fields(lines[2]); len(fields) != 7 || fields[1] != "<any>" || fields[6] != "<all>" {
+		t.Errorf("unexpected line %s", lines[2])
+	}
+}
+
+func TestPrintJobAnalysis(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := printJobAnalysis(out, &JobAnalysis{
+		Stragglers: &analysis.StragglerReport{Window: "10m0s"},
+		Hung:       &analysis.HungReport{Window: "2h0m0s", Reason: "GPU 0 of worker-0 is busy"},
+		RightSizing: &analysis.RightSizing{Window: "24h0m0s", RequestedGPU: 8, AllocatedGPU: 8, MeasuredGPU: 8, SuggestedGPU: 3,
+			SavedGPU: 5, SavingsPercent: 62.5, SavedGPUHoursPerDay: 120, SavedCostPerDay: 300, Reasons: []string{"first", "second"}},
+	})
+	if err != nil {
+		t.Fatalf("failed to printJobAnalysis, %++v", err)
+	}
+	for _, expected := range []string{
+		"Stragglers over the last 10m0s:\n  none",
+		"Not hung: GPU 0 of worker-0 is busy",
+		"Suggested GPUs:    3",
+		"Expected savings:  5.00 GPUs (62%), 120.0 GPU hours per day, 300.00 per day",
+		"Reasons:           first\n                     second\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expect %q in\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestPrintEnergyCSV(t *testing.T) {
+	out := &bytes.Buffer{}
+	report := &analysis.EnergyReport{
+		Start: time.Unix(1546300800, 0), End: time.Unix(1546304400, 0), PUE: 1.5, CarbonIntensity: 400, Available: true,
+		Jobs: []analysis.JobEnergy{{Namespace: "default", Job: "job", Pods: 2,
+			Energy: analysis.Energy{GPUHours: 3, GPUEnergyKWh: 0.6, EnergyKWh: 0.9, CO2eKg: 0.36}}},
+	}
+	if err := printEnergy(out, OUTPUT_CSV, ENERGY_BY_JOB, report); err != nil {
+		t.Fatalf("failed to printEnergy, %++v", err)
+	}
+	expected := "start,end,namespace,job,pods,gpu_hours,gpu_energy_kwh,pue,energy_kwh,carbon_intensity_gco2e_per_kwh,co2e_kg\n" +
+		"2019-01-01T00:00:00Z,2019-01-01T01:00:00Z,default,job,2,3.000000,0.600000,1.500000,0.900000,400.000000,0.360000\n"
+	if out.String() != expected {
+		t.Errorf("expect\n%s\ngot\n%s", expected, out.String())
+	}
+}
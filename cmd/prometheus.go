@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/xieydd/gpu-metric/utils"
+)
+
+func NewPrometheusCommand(opts *KubeOptions) *cobra.Command {
+	var output string
+	var command = &cobra.Command{
+		Use:   "prometheus",
+		Short: "Display the prometheus candidates and explain which one is queried.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			switch output {
+			case "", OUTPUT_JSON, OUTPUT_YAML:
+			default:
+				return fmt.Errorf("unsupported output format %q, must be one of: json|yaml", output)
+			}
+			client, err := opts.ClientSet()
+			if err != nil {
+				return err
+			}
+			return printPrometheusDiscovery(os.Stdout, output, utils.DiscoverPrometheus(client))
+		},
+	}
+	command.Flags().StringVarP(&output, "output", "o", "", "Output format. One of: json|yaml.")
+	return command
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/xieydd/gpu-metric/utils"
+)
+
+// NewRootCommand returns the command of the kubectl gpu plugin
+func NewRootCommand() *cobra.Command {
+	opts := &KubeOptions{}
+	var command = &cobra.Command{
+		Use:          "kubectl-gpu",
+		Short:        "Display GPU usage of pods, nodes, namespaces and jobs.",
+		SilenceUsage: true,
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if opts.Debug {
+				log.SetLevel(log.DebugLevel)
+			}
+			if opts.PrometheusURL != "" {
+				utils.PrometheusEndpoint = opts.PrometheusURL
+			}
+			if opts.PrometheusService != "" {
+				utils.PrometheusService = opts.PrometheusService
+			}
+		},
+	}
+	opts.AddFlags(command)
+
+	command.AddCommand(NewTopCommand(opts))
+	command.AddCommand(NewEnergyCommand(opts))
+	command.AddCommand(NewServeCommand(opts))
+	command.AddCommand(NewPortsCommand(opts))
+	command.AddCommand(NewDoctorCommand(opts))
+	command.AddCommand(NewInstallCommand(opts))
+	command.AddCommand(NewUpgradeCommand(opts))
+	command.AddCommand(NewUninstallCommand(opts))
+	command.AddCommand(NewLabelNodesCommand(opts))
+	command.AddCommand(NewPrometheusCommand(opts))
+	return command
+}
@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/xieydd/gpu-metric/server"
+)
+
+func NewServeCommand(opts *KubeOptions) *cobra.Command {
+	serverOpts := server.Options{}
+	var command = &cobra.Command{
+		Use:   "serve",
+		Short: "Serve the GPU metrics as a JSON REST API, the OpenAPI description is on /openapi.json.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := opts.ClientSet()
+			if err != nil {
+				return err
+			}
+			return server.NewServer(client, serverOpts).Run()
+		},
+	}
+	command.Flags().StringVar(&serverOpts.Address, "address", ":8080", "Address the server listens on.")
+	command.Flags().DurationVar(&serverOpts.CacheTTL, "cache-ttl", 15*time.Second, "How long the responses are cached and shared between requests.")
+	return command
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// TopOptions holds the flags of the top commands
+type TopOptions struct {
+	Selector string
+	Output   string
+	Watch    bool
+	Interval time.Duration
+	ByRole   bool
+	Analysis JobAnalysisOptions
+}
+
+func (o *TopOptions) AddFlags(command *cobra.Command) {
+	command.Flags().StringVarP(&o.Selector, "selector", "l", "", "Selector (label query) to filter on, supports '=', '==', and '!='.")
+	command.Flags().StringVarP(&o.Output, "output", "o", "", "Output format. One of: wide|json|yaml.")
+}
+
+// AddWatchFlags adds the flags of the live watch mode
+func (o *TopOptions) AddWatchFlags(command *cobra.Command) {
+	command.Flags().BoolVarP(&o.Watch, "watch", "w", false, "Refresh the GPU usage on an interval and display it in an interactive dashboard.")
+	command.Flags().DurationVar(&o.Interval, "interval", 5*time.Second, "Refresh interval of the watch mode.")
+}
+
+// AddByRoleFlags adds the flag grouping the pods of distributed jobs by replica role
+func (o *TopOptions) AddByRoleFlags(command *cobra.Command) {
+	command.Flags().BoolVar(&o.ByRole, "by-role", false, "Group the pods by replica role (chief, worker, ps, evaluator, launcher) with per role aggregates.")
+}
+
+// AddAnalysisFlags adds the flags of the job analyses
+func (o *TopOptions) AddAnalysisFlags(command *cobra.Command) {
+	o.Analysis.AddFlags(command)
+}
+
+func (o *TopOptions) Validate() error {
+	if o.Watch && o.ByRole {
+		return fmt.Errorf("--by-role can not be used with --watch")
+	}
+	if o.Watch && o.Output != "" {
+		return fmt.Errorf("--output can not be used with --watch")
+	}
+	if o.Watch && o.Analysis.Enabled() {
+		return fmt.Errorf("--watch can not be used with the job analyses")
+	}
+	if err := o.Analysis.Validate(); err != nil {
+		return err
+	}
+	if o.Watch && o.Interval <= 0 {
+		return fmt.Errorf("--interval must be positive")
+	}
+	switch o.Output {
+	case "", OUTPUT_WIDE, OUTPUT_JSON, OUTPUT_YAML:
+		return nil
+	}
+	return fmt.Errorf("unsupported output format %q, must be one of: wide|json|yaml", o.Output)
+}
+
+func NewTopCommand(opts *KubeOptions) *cobra.Command {
+	var command = &cobra.Command{
+		Use:   "top",
+		Short: "Display GPU (duty cycle and memory) usage of resources.",
+	}
+	command.AddCommand(NewTopPodCommand(opts))
+	command.AddCommand(NewTopNodeCommand(opts))
+	command.AddCommand(NewTopNamespaceCommand(opts))
+	command.AddCommand(NewTopJobCommand(opts))
+	command.AddCommand(NewTopWorkloadCommand(opts))
+	return command
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/xieydd/gpu-metric/utils"
+	"github.com/xieydd/gpu-metric/workload"
+)
+
+func NewTopJobCommand(opts *KubeOptions) *cobra.Command {
+	topOpts := &TopOptions{}
+	var command = &cobra.Command{
+		Use:     "job NAME",
+		Aliases: []string{"jobs"},
+		Short:   "Display GPU usage of the pods of a training job.",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := topOpts.Validate(); err != nil {
+				return err
+			}
+			client, err := opts.ClientSet()
+			if err != nil {
+				return err
+			}
+			namespace, err := opts.GetNamespace()
+			if err != nil {
+				return err
+			}
+			selector := fmt.Sprintf("%s=%s", utils.JOB_RELEASE_LABEL, args[0])
+			if topOpts.Selector != "" {
+				selector = selector + "," + topOpts.Selector
+			}
+			if topOpts.ByRole || topOpts.Analysis.Enabled() {
+				w, err := workload.NewResolver(client).BySelector(namespace, selector)
+				if err != nil {
+					return err
+				}
+				if len(w.AllPods()) == 0 {
+					return fmt.Errorf("no pods found for job %s", args[0])
+				}
+				return printWorkloadView(client, w, topOpts, opts.AllNamespaces)
+			}
+			if topOpts.Watch {
+				return runWatch("kubectl gpu top job "+args[0], topOpts.Interval, func() ([]utils.InstanceGpuUsage, error) {
+					return utils.GetPodsGpuUsage(client, namespace, selector, nil)
+				})
+			}
+			usages, err := utils.GetPodsGpuUsage(client, namespace, selector, nil)
+			if err != nil {
+				return err
+			}
+			if len(usages) == 0 {
+				return fmt.Errorf("no pods found for job %s", args[0])
+			}
+			return printInstances(os.Stdout, topOpts.Output, "INSTANCE NAME", opts.AllNamespaces, true, usages)
+		},
+	}
+	topOpts.AddFlags(command)
+	topOpts.AddWatchFlags(command)
+	topOpts.AddByRoleFlags(command)
+	topOpts.AddAnalysisFlags(command)
+	return command
+}
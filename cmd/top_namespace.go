@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/xieydd/gpu-metric/utils"
+)
+
+func NewTopNamespaceCommand(opts *KubeOptions) *cobra.Command {
+	topOpts := &TopOptions{}
+	var command = &cobra.Command{
+		Use:     "namespace [NAME...]",
+		Aliases: []string{"namespaces", "ns"},
+		Short:   "Display aggregated GPU usage of namespaces.",
+		Long:    "Display aggregated GPU usage of namespaces. Without names, all the namespaces running GPU pods are displayed unless --namespace is set.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := topOpts.Validate(); err != nil {
+				return err
+			}
+			client, err := opts.ClientSet()
+			if err != nil {
+				return err
+			}
+			names := args
+			if len(names) == 0 && opts.Namespace != "" && !opts.AllNamespaces {
+				names = []string{opts.Namespace}
+			}
+			usages, err := utils.GetNamespacesGpuUsage(client, topOpts.Selector, names)
+			if err != nil {
+				return err
+			}
+			return printNamespaces(os.Stdout, topOpts.Output, usages)
+		},
+	}
+	topOpts.AddFlags(command)
+	return command
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/xieydd/gpu-metric/utils"
+)
+
+func NewTopNodeCommand(opts *KubeOptions) *cobra.Command {
+	topOpts := &TopOptions{}
+	var command = &cobra.Command{
+		Use:     "node [NAME...]",
+		Aliases: []string{"nodes", "no"},
+		Short:   "Display GPU usage of nodes.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := topOpts.Validate(); err != nil {
+				return err
+			}
+			client, err := opts.ClientSet()
+			if err != nil {
+				return err
+			}
+			if topOpts.Watch {
+				return runWatch("kubectl gpu top node", topOpts.Interval, func() ([]utils.InstanceGpuUsage, error) {
+					return utils.GetNodesGpuUsage(client, topOpts.Selector, args)
+				})
+			}
+			usages, err := utils.GetNodesGpuUsage(client, topOpts.Selector, args)
+			if err != nil {
+				return err
+			}
+			return printInstances(os.Stdout, topOpts.Output, "NAME", false, false, usages)
+		},
+	}
+	topOpts.AddFlags(command)
+	topOpts.AddWatchFlags(command)
+	return command
+}
@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/xieydd/gpu-metric/utils"
+)
+
+func NewTopPodCommand(opts *KubeOptions) *cobra.Command {
+	topOpts := &TopOptions{}
+	var command = &cobra.Command{
+		Use:     "pod [NAME...]",
+		Aliases: []string{"pods", "po"},
+		Short:   "Display GPU usage of pods.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := topOpts.Validate(); err != nil {
+				return err
+			}
+			client, err := opts.ClientSet()
+			if err != nil {
+				return err
+			}
+			namespace, err := opts.GetNamespace()
+			if err != nil {
+				return err
+			}
+			if topOpts.Watch {
+				return runWatch("kubectl gpu top pod", topOpts.Interval, func() ([]utils.InstanceGpuUsage, error) {
+					return utils.GetPodsGpuUsage(client, namespace, topOpts.Selector, args)
+				})
+			}
+			usages, err := utils.GetPodsGpuUsage(client, namespace, topOpts.Selector, args)
+			if err != nil {
+				return err
+			}
+			return printInstances(os.Stdout, topOpts.Output, "NAME", opts.AllNamespaces, true, usages)
+		},
+	}
+	topOpts.AddFlags(command)
+	topOpts.AddWatchFlags(command)
+	return command
+}
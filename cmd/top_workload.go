@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/xieydd/gpu-metric/utils"
+	"github.com/xieydd/gpu-metric/workload"
+)
+
+func NewTopWorkloadCommand(opts *KubeOptions) *cobra.Command {
+	topOpts := &TopOptions{}
+	var command = &cobra.Command{
+		Use:     "workload KIND/NAME",
+		Aliases: []string{"workloads", "wl"},
+		Short:   "Display GPU usage of the pods of a workload.",
+		Long: `Display GPU usage of the pods of a workload. The pods are found by walking their owner references,
+supported kinds are pod, deployment, replicaset, statefulset, daemonset, job, cronjob, tfjob, pytorchjob and mpijob.`,
+		Example: "  kubectl gpu top workload deployment/notebook\n  kubectl gpu top workload tfjob/mnist -n kubeflow",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := topOpts.Validate(); err != nil {
+				return err
+			}
+			client, err := opts.ClientSet()
+			if err != nil {
+				return err
+			}
+			namespace, err := opts.GetNamespace()
+			if err != nil {
+				return err
+			}
+			if topOpts.ByRole || topOpts.Analysis.Enabled() {
+				w, err := workload.NewResolver(client).Resolve(namespace, args[0])
+				if err != nil {
+					return err
+				}
+				return printWorkloadView(client, w, topOpts, false)
+			}
+			fetch := func() ([]utils.InstanceGpuUsage, error) {
+				w, err := workload.NewResolver(client).Resolve(namespace, args[0])
+				if err != nil {
+					return nil, err
+				}
+				return utils.GetWorkloadGpuUsage(client, w)
+			}
+			if topOpts.Watch {
+				return runWatch("kubectl gpu top workload "+args[0], topOpts.Interval, fetch)
+			}
+			usages, err := fetch()
+			if err != nil {
+				return err
+			}
+			return printInstances(os.Stdout, topOpts.Output, "INSTANCE NAME", false, true, usages)
+		},
+	}
+	topOpts.AddWatchFlags(command)
+	topOpts.AddByRoleFlags(command)
+	topOpts.AddAnalysisFlags(command)
+	command.Flags().StringVarP(&topOpts.Output, "output", "o", "", "Output format. One of: wide|json|yaml.")
+	return command
+}
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/xieydd/gpu-metric/utils"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const CLEAR_SCREEN = "\033[H\033[2J"
+
+// runWatch refreshes the instances every interval and redraws the dashboard in
+// place until the user quits. Keys are only read if stdin is a terminal.
+func runWatch(title string, interval time.Duration, fetch func() ([]utils.InstanceGpuUsage, error)) error {
+	dashboard := NewDashboard(title)
+
+	keys := make(chan byte)
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		state, err := terminal.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		defer terminal.Restore(fd, state)
+		go readKeys(keys)
+	}
+
+	refresh := func() {
+		instances, err := fetch()
+		dashboard.Update(instances, err, time.Now())
+	}
+	draw := func() {
+		fmt.Fprint(os.Stdout, CLEAR_SCREEN+dashboard.Render())
+	}
+
+	refresh()
+	draw()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			refresh()
+		case key := <-keys:
+			if dashboard.HandleKey(key) {
+				return nil
+			}
+		}
+		draw()
+	}
+}
+
+func readKeys(keys chan<- byte) {
+	buf := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		if n == 1 {
+			keys <- buf[0]
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package doctor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/xieydd/gpu-metric/base"
+	"github.com/xieydd/gpu-metric/utils"
+	apps_v1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	STATUS_PASS = "pass"
+	STATUS_WARN = "warn"
+	STATUS_FAIL = "fail"
+	// a check is skipped when a check it depends on failed
+	STATUS_SKIP = "skip"
+)
+
+// names of the exporter objects in kubernetes-artifacts/prometheus/gpu-exporter.yaml
+const DEFAULT_EXPORTER_DAEMONSET = "node-gpu-exporter"
+const DEFAULT_EXPORTER_JOB = "kubernetes-service-endpoints"
+const DEFAULT_MAX_STALENESS = 2 * time.Minute
+
+// the metric exported once per GPU node, used to check the freshness of the metrics
+const GPU_NUM_DEVICES_METRIC = "nvidia_gpu_num_devices"
+
+// the labels the queries of utils rely on
+var NODE_LABELS = []string{"node_name", "uuid", "minor_number"}
+var POD_LABELS = []string{"pod_name", "namespace_name", "container_name"}
+
+// the labels of other exporters, such as dcgm-exporter, for the labels of POD_LABELS
+var POD_LABEL_ALTERNATIVES = map[string]string{"pod": "pod_name", "namespace": "namespace_name", "container": "container_name"}
+
+// the number of names listed in a message
+const MAX_LISTED_NAMES = 5
+
+// Result is the outcome of one check with a suggested fix if it did not pass
+type Result struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Fix     string `json:"fix,omitempty"`
+}
+
+// Options of the checks
+type Options struct {
+	// ExporterNamespace and ExporterDaemonSet locate the GPU exporter DaemonSet
+	ExporterNamespace string
+	ExporterDaemonSet string
+	// ExporterJob is the job label of the exporter targets in prometheus
+	ExporterJob string
+	// MaxStaleness is the age after which the GPU metrics are stale
+	MaxStaleness time.Duration
+}
+
+func DefaultOptions() Options {
+	return Options{
+		ExporterNamespace: utils.KUBE_SYSTEM_NAMESPACE,
+		ExporterDaemonSet: DEFAULT_EXPORTER_DAEMONSET,
+		ExporterJob:       DEFAULT_EXPORTER_JOB,
+		MaxStaleness:      DEFAULT_MAX_STALENESS,
+	}
+}
+
+// doctor holds the state shared by the checks
+type doctor struct {
+	client                kubernetes.Interface
+	options               Options
+	prometheusServiceName string
+	daemonSet             *apps_v1.DaemonSet
+}
+
+// Run runs all the checks in order, the checks querying prometheus are skipped
+// if prometheus is not found
+func Run(client kubernetes.Interface, options Options) []Result {
+	d := &doctor{client: client, options: options}
+	results := []Result{d.checkPrometheusService()}
+	results = append(results, d.checkExporterDaemonSet()...)
+	for _, check := range []struct {
+		name string
+		run  func() Result
+	}{
+		{"exporter-targets", d.checkExporterTargets},
+		{"metric-freshness", d.checkMetricFreshness},
+		{"label-schema", d.checkLabelSchema},
+	} {
+		if d.prometheusServiceName == "" {
+			results = append(results, Result{Name: check.name, Status: STATUS_SKIP, Message: "prometheus is not available"})
+			continue
+		}
+		result := check.run()
+		result.Name = check.name
+		results = append(results, result)
+	}
+	return results
+}
+
+// HasFailure returns true if any check failed
+func HasFailure(results []Result) bool {
+	for _, result := range results {
+		if result.Status == STATUS_FAIL {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *doctor) checkPrometheusService() Result {
+	result := Result{Name: "prometheus-service"}
+	name, err := utils.FindPrometheusService(d.client)
+	switch {
+	case base.IsPermissionError(err):
+		result.Status, result.Message = STATUS_FAIL, err.Error()
+		result.Fix = "ask the cluster admin for the access to the prometheus services, or set --prometheus-url"
+		if namespace := err.(*base.PermissionError).Namespace; namespace != "" {
+			result.Fix = fmt.Sprintf("ask the cluster admin for the access to the services in %s, or set --prometheus-url", namespace)
+		}
+	case err != nil:
+		result.Status, result.Message = STATUS_FAIL, fmt.Sprintf("failed to find prometheus, %v", err)
+	case name == "":
+		result.Status = STATUS_FAIL
+		result.Message = utils.PrometheusNotFoundMessage()
+		result.Fix = "kubectl gpu install, or set --prometheus-service to the prometheus service"
+	default:
+		// make sure prometheus answers
+		if _, err := utils.QueryPrometheus(d.client, name, "vector(1)"); err != nil {
+			result.Status, result.Message = STATUS_FAIL, fmt.Sprintf("prometheus %s does not answer queries, %v", name, err)
+			result.Fix = "kubectl gpu prometheus, to check the health of the prometheus candidates"
+			return result
+		}
+		d.prometheusServiceName = name
+		result.Status, result.Message = STATUS_PASS, fmt.Sprintf("prometheus %s answers queries", name)
+	}
+	return result
+}
+
+// checkExporterDaemonSet checks the exporter DaemonSet exists, and selects and runs on the GPU nodes
+func (d *doctor) checkExporterDaemonSet() []Result {
+	result := Result{Name: "exporter-daemonset"}
+	ds, err := d.client.AppsV1().DaemonSets(d.options.ExporterNamespace).Get(d.options.ExporterDaemonSet, meta_v1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		result.Status = STATUS_FAIL
+		result.Message = fmt.Sprintf("DaemonSet %s/%s is not found", d.options.ExporterNamespace, d.options.ExporterDaemonSet)
+		result.Fix = "kubectl apply -f kubernetes-artifacts/prometheus/gpu-exporter.yaml"
+		return []Result{result, {Name: "exporter-nodes", Status: STATUS_SKIP, Message: "the exporter DaemonSet is not available"}}
+	case err != nil:
+		result.Status, result.Message = STATUS_FAIL, base.ToPermissionError(err, "get", "daemonsets", d.options.ExporterNamespace).Error()
+		return []Result{result, {Name: "exporter-nodes", Status: STATUS_SKIP, Message: "the exporter DaemonSet is not available"}}
+	}
+	d.daemonSet = ds
+
+	status := ds.Status
+	if status.NumberReady < status.DesiredNumberScheduled {
+		result.Status = STATUS_WARN
+		result.Message = fmt.Sprintf("%d of %d exporter pods are ready", status.NumberReady, status.DesiredNumberScheduled)
+		result.Fix = fmt.Sprintf("kubectl -n %s describe daemonset %s", ds.Namespace, ds.Name)
+	} else {
+		result.Status = STATUS_PASS
+		result.Message = fmt.Sprintf("%d of %d exporter pods are ready", status.NumberReady, status.DesiredNumberScheduled)
+	}
+	return []Result{result, d.checkExporterNodes(ds)}
+}
+
+// checkExporterNodes compares the nodes with GPU capacity with the nodes selected by the DaemonSet
+func (d *doctor) checkExporterNodes(ds *apps_v1.DaemonSet) Result {
+	result := Result{Name: "exporter-nodes"}
+	nodes, err := utils.ListGpuNodes(d.client, "", nil)
+	if err != nil {
+		result.Status, result.Message = STATUS_FAIL, fmt.Sprintf("failed to list GPU nodes, %v", err)
+		return result
+	}
+	if len(nodes) == 0 {
+		result.Status = STATUS_WARN
+		result.Message = fmt.Sprintf("no node has %s capacity", utils.NVIDIA_GPU_RESOURCE_NAME)
+		result.Fix = "install the NVIDIA device plugin on the GPU nodes"
+		return result
+	}
+	unselected := []string{}
+	for _, node := range nodes {
+		if !nodeSelected(&ds.Spec.Template.Spec, &node) {
+			unselected = append(unselected, node.Name)
+		}
+	}
+	if len(unselected) == 0 {
+		result.Status = STATUS_PASS
+		result.Message = fmt.Sprintf("all %d GPU nodes are selected by the exporter", len(nodes))
+		return result
+	}
+	result.Status = STATUS_FAIL
+	result.Message = fmt.Sprintf("%d of %d GPU nodes are not selected by the exporter: %s", len(unselected), len(nodes), listNames(unselected))
+	if labels := selectorLabels(&ds.Spec.Template.Spec); len(labels) > 0 {
+		result.Fix = fmt.Sprintf("kubectl label node %s %s", strings.Join(unselected, " "), strings.Join(labels, " "))
+	} else {
+		result.Fix = fmt.Sprintf("change the node selector of DaemonSet %s/%s to a label of the GPU nodes", ds.Namespace, ds.Name)
+	}
+	return result
+}
+
+func (d *doctor) checkExporterTargets() Result {
+	query := fmt.Sprintf(`up{job="%s"}`, d.options.ExporterJob)
+	if d.daemonSet != nil && d.daemonSet.Spec.Selector != nil && d.daemonSet.Spec.Selector.MatchLabels["app"] != "" {
+		// the app label of the exporter service is mapped to the target labels
+		query = fmt.Sprintf(`up{job="%s", app="%s"}`, d.options.ExporterJob, d.daemonSet.Spec.Selector.MatchLabels["app"])
+	}
+	targets, err := utils.QueryPrometheus(d.client, d.prometheusServiceName, query)
+	if err != nil {
+		return Result{Status: STATUS_FAIL, Message: fmt.Sprintf("failed to query %s, %v", query, err)}
+	}
+	if len(targets) == 0 {
+		return Result{
+			Status:  STATUS_FAIL,
+			Message: fmt.Sprintf("prometheus has no target for %s", query),
+			Fix:     fmt.Sprintf("check the service %s has the annotation prometheus.io/scrape: 'true' and endpoints", d.options.ExporterDaemonSet),
+		}
+	}
+	down := []string{}
+	for _, target := range targets {
+		if v, ok := utils.SampleValue(target); !ok || v != 1 {
+			down = append(down, target.Metric["instance"])
+		}
+	}
+	sort.Strings(down)
+	if len(down) > 0 {
+		return Result{
+			Status:  STATUS_FAIL,
+			Message: fmt.Sprintf("%d of %d exporter targets are down: %s", len(down), len(targets), listNames(down)),
+			Fix:     "check the exporter pods on these nodes and that prometheus can reach their port 9445",
+		}
+	}
+	result := Result{Status: STATUS_PASS, Message: fmt.Sprintf("%d exporter targets are up", len(targets))}
+	if d.daemonSet != nil && int32(len(targets)) < d.daemonSet.Status.NumberReady {
+		result.Status = STATUS_WARN
+		result.Message = fmt.Sprintf("%d exporter targets are up for %d ready exporter pods", len(targets), d.daemonSet.Status.NumberReady)
+		result.Fix = fmt.Sprintf("check the endpoints of the service %s", d.options.ExporterDaemonSet)
+	}
+	return result
+}
+
+func (d *doctor) checkMetricFreshness() Result {
+	query := fmt.Sprintf("time() - timestamp(%s)", GPU_NUM_DEVICES_METRIC)
+	ages, err := utils.QueryPrometheus(d.client, d.prometheusServiceName, query)
+	if err != nil {
+		return Result{Status: STATUS_FAIL, Message: fmt.Sprintf("failed to query %s, %v", query, err)}
+	}
+	if len(ages) == 0 {
+		return Result{
+			Status:  STATUS_FAIL,
+			Message: fmt.Sprintf("no %s series in prometheus", GPU_NUM_DEVICES_METRIC),
+			Fix:     "check the exporter targets are scraped",
+		}
+	}
+	stale := []string{}
+	oldest := 0.0
+	for _, age := range ages {
+		v, ok := utils.SampleValue(age)
+		if !ok {
+			continue
+		}
+		if v > oldest {
+			oldest = v
+		}
+		if v > d.options.MaxStaleness.Seconds() {
+			stale = append(stale, age.Metric["node_name"])
+		}
+	}
+	sort.Strings(stale)
+	if len(stale) > 0 {
+		return Result{
+			Status:  STATUS_WARN,
+			Message: fmt.Sprintf("the metrics of %d nodes are older than %v: %s", len(stale), d.options.MaxStaleness, listNames(stale)),
+			Fix:     "check the scrape interval of prometheus and the exporter pods on these nodes",
+		}
+	}
+	return Result{Status: STATUS_PASS, Message: fmt.Sprintf("the metrics of %d nodes are at most %.0fs old", len(ages), oldest)}
+}
+
+func (d *doctor) checkLabelSchema() Result {
+	missing := []string{}
+	for _, metric := range utils.GPU_METRIC_LIST {
+		series, err := utils.QueryPrometheus(d.client, d.prometheusServiceName, fmt.Sprintf("topk(1, %s)", metric))
+		if err != nil {
+			return Result{Status: STATUS_FAIL, Message: fmt.Sprintf("failed to query %s, %v", metric, err)}
+		}
+		if len(series) == 0 {
+			missing = append(missing, metric)
+			continue
+		}
+		if labels := missingLabels(series[0].Metric, NODE_LABELS); len(labels) > 0 {
+			return Result{
+				Status:  STATUS_FAIL,
+				Message: fmt.Sprintf("%s has no label %s", metric, strings.Join(labels, ", ")),
+				Fix:     "deploy the exporter of kubernetes-artifacts/prometheus/gpu-exporter.yaml, or relabel the metrics",
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return Result{
+			Status:  STATUS_FAIL,
+			Message: fmt.Sprintf("missing metrics %s", strings.Join(missing, ", ")),
+			Fix:     "deploy the exporter of kubernetes-artifacts/prometheus/gpu-exporter.yaml",
+		}
+	}
+
+	// the series of the GPUs used by pods carry the pod labels
+	metric := utils.GPU_METRIC_LIST[0]
+	series, err := utils.QueryPrometheus(d.client, d.prometheusServiceName, fmt.Sprintf(`topk(1, %s{pod_name!=""})`, metric))
+	if err != nil {
+		return Result{Status: STATUS_FAIL, Message: fmt.Sprintf("failed to query %s, %v", metric, err)}
+	}
+	if len(series) > 0 {
+		if labels := missingLabels(series[0].Metric, POD_LABELS); len(labels) > 0 {
+			return Result{
+				Status:  STATUS_FAIL,
+				Message: fmt.Sprintf("%s of pods has no label %s", metric, strings.Join(labels, ", ")),
+				Fix:     "relabel the pod metrics to " + strings.Join(POD_LABELS, ", "),
+			}
+		}
+		return Result{Status: STATUS_PASS, Message: "the GPU metrics have the expected node and pod labels"}
+	}
+
+	// no series with pod_name, either no GPU pod runs or the exporter uses other labels
+	series, err = utils.QueryPrometheus(d.client, d.prometheusServiceName, fmt.Sprintf(`topk(1, %s{pod!=""})`, metric))
+	if err != nil {
+		return Result{Status: STATUS_FAIL, Message: fmt.Sprintf("failed to query %s, %v", metric, err)}
+	}
+	if len(series) > 0 {
+		renames := []string{}
+		for label, expected := range POD_LABEL_ALTERNATIVES {
+			if _, ok := series[0].Metric[label]; ok {
+				renames = append(renames, fmt.Sprintf("%s to %s", label, expected))
+			}
+		}
+		sort.Strings(renames)
+		return Result{
+			Status:  STATUS_FAIL,
+			Message: fmt.Sprintf("%s labels pods with pod instead of pod_name", metric),
+			Fix:     "add relabel rules renaming " + strings.Join(renames, ", "),
+		}
+	}
+	return Result{Status: STATUS_WARN, Message: "no GPU metric is bound to a pod, the pod labels can not be checked until a GPU pod runs"}
+}
+
+func missingLabels(metric map[string]string, labels []string) []string {
+	missing := []string{}
+	for _, label := range labels {
+		if _, ok := metric[label]; !ok {
+			missing = append(missing, label)
+		}
+	}
+	return missing
+}
+
+func listNames(names []string) string {
+	if len(names) > MAX_LISTED_NAMES {
+		return fmt.Sprintf("%s and %d more", strings.Join(names[:MAX_LISTED_NAMES], ", "), len(names)-MAX_LISTED_NAMES)
+	}
+	return strings.Join(names, ", ")
+}
+
+// nodeSelected returns true if the node selector and required node affinity of spec match node
+func nodeSelected(spec *v1.PodSpec, node *v1.Node) bool {
+	for key, value := range spec.NodeSelector {
+		if node.Labels[key] != value {
+			return false
+		}
+	}
+	if spec.Affinity == nil || spec.Affinity.NodeAffinity == nil || spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return true
+	}
+	// the terms are ORed, the expressions of a term are ANDed
+	for _, term := range spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		matched := true
+		for _, expr := range term.MatchExpressions {
+			if !expressionMatches(expr, node.Labels) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func expressionMatches(expr v1.NodeSelectorRequirement, labels map[string]string) bool {
+	value, ok := labels[expr.Key]
+	switch expr.Operator {
+	case v1.NodeSelectorOpExists:
+		return ok
+	case v1.NodeSelectorOpDoesNotExist:
+		return !ok
+	case v1.NodeSelectorOpIn:
+		return ok && containsValue(expr.Values, value)
+	case v1.NodeSelectorOpNotIn:
+		return !ok || !containsValue(expr.Values, value)
+	}
+	// Gt and Lt are not used to select GPU nodes
+	return false
+}
+
+func containsValue(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// selectorLabels returns the labels as key=value which make a node match the node selector of spec, or
+// the first required affinity term: the value of an In expression is its first value, an Exists one is true
+func selectorLabels(spec *v1.PodSpec) []string {
+	labels := []string{}
+	for key, value := range spec.NodeSelector {
+		labels = append(labels, key+"="+value)
+	}
+	sort.Strings(labels)
+	if len(labels) > 0 {
+		return labels
+	}
+	if spec.Affinity == nil || spec.Affinity.NodeAffinity == nil || spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return labels
+	}
+	for _, term := range spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+		for _, expr := range term.MatchExpressions {
+			switch {
+			case expr.Operator == v1.NodeSelectorOpIn && len(expr.Values) > 0:
+				labels = append(labels, expr.Key+"="+expr.Values[0])
+			case expr.Operator == v1.NodeSelectorOpExists:
+				labels = append(labels, expr.Key+"=true")
+			}
+		}
+		if len(labels) > 0 {
+			return labels
+		}
+	}
+	return labels
+}
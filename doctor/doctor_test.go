@@ -0,0 +1,203 @@
+package doctor
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/xieydd/gpu-metric/utils"
+	apps_v1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const exporterLabel = "unisound.accelerator/nvidia_count"
+
+func newGpuNode(name string, labels map[string]string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: meta_v1.ObjectMeta{Name: name, Labels: labels},
+		Status: v1.NodeStatus{
+			Capacity: v1.ResourceList{utils.NVIDIA_GPU_RESOURCE_NAME: resource.MustParse("8")},
+		},
+	}
+}
+
+func newExporterDaemonSet(ready int32) *apps_v1.DaemonSet {
+	return &apps_v1.DaemonSet{
+		ObjectMeta: meta_v1.ObjectMeta{Name: DEFAULT_EXPORTER_DAEMONSET, Namespace: utils.KUBE_SYSTEM_NAMESPACE},
+		Spec: apps_v1.DaemonSetSpec{
+			Selector: &meta_v1.LabelSelector{MatchLabels: map[string]string{"app": DEFAULT_EXPORTER_DAEMONSET}},
+			Template: v1.PodTemplateSpec{
+				Spec: v1.PodSpec{
+					Affinity: &v1.Affinity{NodeAffinity: &v1.NodeAffinity{
+						RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{
+							NodeSelectorTerms: []v1.NodeSelectorTerm{{
+								MatchExpressions: []v1.NodeSelectorRequirement{{Key: exporterLabel, Operator: v1.NodeSelectorOpExists}},
+							}},
+						},
+					}},
+				},
+			},
+		},
+		Status: apps_v1.DaemonSetStatus{DesiredNumberScheduled: 2, NumberReady: ready},
+	}
+}
+
+// fakePrometheus answers the queries in responses with a vector of the given series
+func fakePrometheus(responses map[string]string) func() {
+	prometheus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// unknown queries have an empty result
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[%s]}}`, responses[r.URL.Query().Get("query")])
+	}))
+	utils.PrometheusEndpoint = prometheus.URL + "/"
+	return func() {
+		utils.PrometheusEndpoint = ""
+		prometheus.Close()
+	}
+}
+
+func healthyResponses() map[string]string {
+	responses := map[string]string{
+		"vector(1)": `{"metric":{},"value":[1546300800,"1"]}`,
+		`up{job="kubernetes-service-endpoints", app="node-gpu-exporter"}`: `{"metric":{"instance":"10.0.0.1:9445"},"value":[1546300800,"1"]},` +
+			`{"metric":{"instance":"10.0.0.2:9445"},"value":[1546300800,"1"]}`,
+		"time() - timestamp(nvidia_gpu_num_devices)": `{"metric":{"node_name":"node1"},"value":[1546300800,"5"]},` +
+			`{"metric":{"node_name":"node2"},"value":[1546300800,"8"]}`,
+		`topk(1, nvidia_gpu_duty_cycle{pod_name!=""})`: `{"metric":{"node_name":"node1","uuid":"GPU-1","minor_number":"0","pod_name":"worker-0","namespace_name":"default","container_name":"tf"},"value":[1546300800,"80"]}`,
+	}
+	for _, metric := range utils.GPU_METRIC_LIST {
+		responses[fmt.Sprintf("topk(1, %s)", metric)] = `{"metric":{"node_name":"node1","uuid":"GPU-1","minor_number":"0"},"value":[1546300800,"1"]}`
+	}
+	return responses
+}
+
+func resultOf(t *testing.T, results []Result, name string) Result {
+	for _, result := range results {
+		if result.Name == name {
+			return result
+		}
+	}
+	t.Fatalf("no result of check %s in %++v", name, results)
+	return Result{}
+}
+
+func TestRunHealthy(t *testing.T) {
+	defer fakePrometheus(healthyResponses())()
+	client := fake.NewSimpleClientset(
+		newGpuNode("node1", map[string]string{exporterLabel: "8"}),
+		newGpuNode("node2", map[string]string{exporterLabel: "8"}),
+		newExporterDaemonSet(2),
+	)
+
+	results := Run(client, DefaultOptions())
+	if len(results) != 6 {
+		t.Fatalf("expect 6 checks, got %++v", results)
+	}
+	for _, result := range results {
+		if result.Status != STATUS_PASS {
+			t.Errorf("expect check %s to pass, got %++v", result.Name, result)
+		}
+	}
+	if HasFailure(results) {
+		t.Errorf("expect no failure")
+	}
+}
+
+func TestRunWithUnlabeledNodeAndDownTarget(t *testing.T) {
+	responses := healthyResponses()
+	responses[`up{job="kubernetes-service-endpoints", app="node-gpu-exporter"}`] = `{"metric":{"instance":"10.0.0.1:9445"},"value":[1546300800,"0"]}`
+	responses["time() - timestamp(nvidia_gpu_num_devices)"] = `{"metric":{"node_name":"node1"},"value":[1546300800,"600"]}`
+	defer fakePrometheus(responses)()
+	client := fake.NewSimpleClientset(
+		newGpuNode("node1", map[string]string{exporterLabel: "8"}),
+		newGpuNode("node2", nil),
+		newExporterDaemonSet(1),
+	)
+
+	results := Run(client, DefaultOptions())
+	if !HasFailure(results) {
+		t.Errorf("expect failures")
+	}
+	if result := resultOf(t, results, "exporter-daemonset"); result.Status != STATUS_WARN {
+		t.Errorf("expect not ready exporter pods to warn, got %++v", result)
+	}
+	result := resultOf(t, results, "exporter-nodes")
+	if result.Status != STATUS_FAIL || !strings.Contains(result.Message, "node2") {
+		t.Errorf("expect node2 to be reported, got %++v", result)
+	}
+	if result.Fix != "kubectl label node node2 "+exporterLabel+"=true" {
+		t.Errorf("unexpected fix %q", result.Fix)
+	}
+	if result := resultOf(t, results, "exporter-targets"); result.Status != STATUS_FAIL || !strings.Contains(result.Message, "10.0.0.1:9445") {
+		t.Errorf("expect the down target to be reported, got %++v", result)
+	}
+	if result := resultOf(t, results, "metric-freshness"); result.Status != STATUS_WARN || !strings.Contains(result.Message, "node1") {
+		t.Errorf("expect stale metrics of node1, got %++v", result)
+	}
+}
+
+func TestRunWithoutPrometheus(t *testing.T) {
+	client := fake.NewSimpleClientset(newGpuNode("node1", map[string]string{exporterLabel: "8"}))
+	results := Run(client, DefaultOptions())
+
+	// the fake SelfSubjectAccessReview denies the access to kube-system
+	if result := resultOf(t, results, "prometheus-service"); result.Status != STATUS_FAIL || result.Fix == "" {
+		t.Errorf("expect prometheus check to fail with a fix, got %++v", result)
+	}
+	if result := resultOf(t, results, "exporter-daemonset"); result.Status != STATUS_FAIL || !strings.Contains(result.Fix, "gpu-exporter.yaml") {
+		t.Errorf("expect missing exporter to fail, got %++v", result)
+	}
+	for _, name := range []string{"exporter-nodes", "exporter-targets", "metric-freshness", "label-schema"} {
+		if result := resultOf(t, results, name); result.Status != STATUS_SKIP {
+			t.Errorf("expect check %s to be skipped, got %++v", name, result)
+		}
+	}
+}
+
+func TestLabelSchemaWithOtherPodLabels(t *testing.T) {
+	responses := healthyResponses()
+	delete(responses, `topk(1, nvidia_gpu_duty_cycle{pod_name!=""})`)
+	responses[`topk(1, nvidia_gpu_duty_cycle{pod!=""})`] = `{"metric":{"node_name":"node1","uuid":"GPU-1","minor_number":"0","pod":"worker-0","namespace":"default"},"value":[1546300800,"80"]}`
+	defer fakePrometheus(responses)()
+	client := fake.NewSimpleClientset(newGpuNode("node1", map[string]string{exporterLabel: "8"}), newExporterDaemonSet(2))
+
+	result := resultOf(t, Run(client, DefaultOptions()), "label-schema")
+	if result.Status != STATUS_FAIL || result.Fix != "add relabel rules renaming namespace to namespace_name, pod to pod_name" {
+		t.Errorf("expect the relabel fix, got %++v", result)
+	}
+}
+
+func TestNodeSelected(t *testing.T) {
+	spec := &v1.PodSpec{NodeSelector: map[string]string{"gpu": "true"}}
+	if nodeSelected(spec, newGpuNode("node1", map[string]string{"gpu": "false"})) {
+		t.Errorf("node with a different label value should not be selected")
+	}
+	if !nodeSelected(spec, newGpuNode("node1", map[string]string{"gpu": "true"})) {
+		t.Errorf("node with the label should be selected")
+	}
+	if labels := selectorLabels(spec); len(labels) != 1 || labels[0] != "gpu=true" {
+		t.Errorf("expect label gpu=true, got %v", labels)
+	}
+}
+
+func TestSelectorLabels(t *testing.T) {
+	if labels := selectorLabels(&v1.PodSpec{NodeSelector: map[string]string{"accelerator": "nvidia-tesla-v100"}}); len(labels) != 1 ||
+		labels[0] != "accelerator=nvidia-tesla-v100" {
+		t.Errorf("expect the value of the node selector, got %v", labels)
+	}
+	spec := &v1.PodSpec{Affinity: &v1.Affinity{NodeAffinity: &v1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{NodeSelectorTerms: []v1.NodeSelectorTerm{{
+			MatchExpressions: []v1.NodeSelectorRequirement{
+				{Key: "gpu-type", Operator: v1.NodeSelectorOpIn, Values: []string{"v100", "p100"}},
+				{Key: "gpu", Operator: v1.NodeSelectorOpExists},
+			},
+		}}},
+	}}}
+	if labels := selectorLabels(spec); len(labels) != 2 || labels[0] != "gpu-type=v100" || labels[1] != "gpu=true" {
+		t.Errorf("expect the first value of In and true of Exists, got %v", labels)
+	}
+}
@@ -0,0 +1,83 @@
+package installer
+
+import (
+	"strings"
+)
+
+// the unchanged lines shown around a change
+const DIFF_CONTEXT_LINES = 3
+
+// lineDiff returns the lines removed from before prefixed by "-" and the lines added to after
+// prefixed by "+", with the unchanged lines around them
+func lineDiff(before string, after string) string {
+	a, b := splitLines(before), splitLines(after)
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	lines := []string{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, "  "+a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, "- "+a[i])
+			i++
+		default:
+			lines = append(lines, "+ "+b[j])
+			j++
+		}
+	}
+	return strings.Join(withContext(lines), "\n")
+}
+
+// withContext keeps the changed lines and DIFF_CONTEXT_LINES unchanged lines around them
+func withContext(lines []string) []string {
+	keep := make([]bool, len(lines))
+	for i, line := range lines {
+		if strings.HasPrefix(line, "  ") {
+			continue
+		}
+		for k := i - DIFF_CONTEXT_LINES; k <= i+DIFF_CONTEXT_LINES; k++ {
+			if k >= 0 && k < len(lines) {
+				keep[k] = true
+			}
+		}
+	}
+	result := []string{}
+	for i, line := range lines {
+		if !keep[i] {
+			continue
+		}
+		if i > 0 && !keep[i-1] && len(result) > 0 {
+			result = append(result, "  ...")
+		}
+		result = append(result, line)
+	}
+	return result
+}
+
+func splitLines(s string) []string {
+	s = strings.TrimSuffix(s, "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
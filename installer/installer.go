@@ -0,0 +1,289 @@
+package installer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/xieydd/gpu-metric/base"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+)
+
+// the field manager owning the fields applied by the installer
+const DEFAULT_FIELD_MANAGER = "kubectl-gpu"
+
+// the content type of a server-side apply patch, not defined by this version of apimachinery
+const APPLY_PATCH_TYPE = types.PatchType("application/apply-patch+yaml")
+
+const (
+	ACTION_CREATE    = "create"
+	ACTION_UPDATE    = "update"
+	ACTION_UNCHANGED = "unchanged"
+)
+
+// the plural resource names of the kinds in the manifests
+var kindResources = map[string]string{
+	"Namespace":          "namespaces",
+	"ConfigMap":          "configmaps",
+	"ServiceAccount":     "serviceaccounts",
+	"Service":            "services",
+	"ClusterRole":        "clusterroles",
+	"ClusterRoleBinding": "clusterrolebindings",
+	"Deployment":         "deployments",
+	"DaemonSet":          "daemonsets",
+}
+
+// the fields set by the API server, ignored when comparing the live objects with the manifests
+var serverMetadataFields = []string{"managedFields", "resourceVersion", "uid", "generation", "creationTimestamp", "selfLink"}
+var serverAnnotations = []string{"deployment.kubernetes.io/revision", "deprecated.daemonset.template.generation", "kubectl.kubernetes.io/last-applied-configuration"}
+
+// ObjectDiff is the change applying a manifest makes to the live object
+type ObjectDiff struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	Action    string `json:"action"`
+	Diff      string `json:"diff,omitempty"`
+}
+
+// AlreadyInstalledError is returned by Install if some objects exist
+type AlreadyInstalledError struct {
+	Objects []string
+}
+
+func (e *AlreadyInstalledError) Error() string {
+	return fmt.Sprintf("%s already exist, use upgrade instead", strings.Join(e.Objects, ", "))
+}
+
+// Installer applies the rendered manifests by server-side apply
+type Installer struct {
+	client       rest.Interface
+	FieldManager string
+}
+
+// NewInstaller returns an installer sending requests by client, any REST client of the
+// cluster works as the objects are addressed by absolute paths
+func NewInstaller(client rest.Interface) *Installer {
+	return &Installer{client: client, FieldManager: DEFAULT_FIELD_MANAGER}
+}
+
+// Install applies the objects, it fails with an AlreadyInstalledError if any of them exists.
+// An existing Namespace is not an installation, it may have been created for the manifests.
+func (i *Installer) Install(objects []*unstructured.Unstructured) error {
+	existing := []string{}
+	for _, obj := range objects {
+		if obj.GetKind() == "Namespace" {
+			continue
+		}
+		live, err := i.get(obj)
+		if err != nil {
+			return err
+		}
+		if live != nil {
+			existing = append(existing, objectName(obj))
+		}
+	}
+	if len(existing) > 0 {
+		return &AlreadyInstalledError{Objects: existing}
+	}
+	return i.applyAll(objects, false)
+}
+
+// Upgrade applies the objects, taking over the fields set by other managers such as kubectl apply
+func (i *Installer) Upgrade(objects []*unstructured.Unstructured) error {
+	return i.applyAll(objects, true)
+}
+
+func (i *Installer) applyAll(objects []*unstructured.Unstructured, force bool) error {
+	for _, obj := range objects {
+		if _, err := i.apply(obj, force, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Uninstall deletes the objects in the reverse order, and returns the names of the deleted ones.
+// If dryRun is set nothing is deleted and the existing objects are returned.
+// The Namespace is kept, deleting it would delete everything else in it.
+func (i *Installer) Uninstall(objects []*unstructured.Unstructured, dryRun bool) ([]string, error) {
+	deleted := []string{}
+	for j := len(objects) - 1; j >= 0; j-- {
+		obj := objects[j]
+		if obj.GetKind() == "Namespace" {
+			continue
+		}
+		if dryRun {
+			live, err := i.get(obj)
+			if err != nil {
+				return deleted, err
+			}
+			if live != nil {
+				deleted = append(deleted, objectName(obj))
+			}
+			continue
+		}
+		path, err := objectPath(obj)
+		if err != nil {
+			return deleted, err
+		}
+		err = i.client.Delete().AbsPath(path).Body([]byte(`{"propagationPolicy":"Background"}`)).Do().Error()
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return deleted, i.requestError(err, "delete", obj)
+		}
+		deleted = append(deleted, objectName(obj))
+	}
+	return deleted, nil
+}
+
+// Diff compares the live objects with the result of a server-side dry-run apply of the objects.
+// The objects in a Namespace which does not exist yet are created as they are, they can't be
+// dry-run applied as the API server rejects the objects of a missing namespace.
+func (i *Installer) Diff(objects []*unstructured.Unstructured) ([]ObjectDiff, error) {
+	diffs := []ObjectDiff{}
+	missingNamespaces := map[string]bool{}
+	for _, obj := range objects {
+		if missingNamespaces[obj.GetNamespace()] {
+			diffs = append(diffs, ObjectDiff{Kind: obj.GetKind(), Namespace: obj.GetNamespace(), Name: obj.GetName(),
+				Action: ACTION_CREATE, Diff: lineDiff("", normalizedYAML(obj))})
+			continue
+		}
+		live, err := i.get(obj)
+		if err != nil {
+			return nil, err
+		}
+		if obj.GetKind() == "Namespace" && live == nil {
+			missingNamespaces[obj.GetName()] = true
+		}
+		applied, err := i.apply(obj, true, true)
+		if err != nil {
+			return nil, err
+		}
+		diff := ObjectDiff{Kind: obj.GetKind(), Namespace: obj.GetNamespace(), Name: obj.GetName()}
+		before, after := "", normalizedYAML(applied)
+		if live != nil {
+			before = normalizedYAML(live)
+		}
+		switch {
+		case live == nil:
+			diff.Action = ACTION_CREATE
+		case before == after:
+			diff.Action = ACTION_UNCHANGED
+		default:
+			diff.Action = ACTION_UPDATE
+		}
+		if diff.Action != ACTION_UNCHANGED {
+			diff.Diff = lineDiff(before, after)
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs, nil
+}
+
+// get returns the live object, or nil if it does not exist
+func (i *Installer) get(obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	path, err := objectPath(obj)
+	if err != nil {
+		return nil, err
+	}
+	data, err := i.client.Get().AbsPath(path).Do().Raw()
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, i.requestError(err, "get", obj)
+	}
+	return decodeObject(data)
+}
+
+func (i *Installer) apply(obj *unstructured.Unstructured, force bool, dryRun bool) (*unstructured.Unstructured, error) {
+	path, err := objectPath(obj)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(obj.Object)
+	if err != nil {
+		return nil, err
+	}
+	request := i.client.Patch(APPLY_PATCH_TYPE).AbsPath(path).Param("fieldManager", i.FieldManager).Body(body)
+	if force {
+		request = request.Param("force", "true")
+	}
+	if dryRun {
+		request = request.Param("dryRun", "All")
+	}
+	data, err := request.Do().Raw()
+	if err != nil {
+		return nil, i.requestError(err, "patch", obj)
+	}
+	return decodeObject(data)
+}
+
+func (i *Installer) requestError(err error, verb string, obj *unstructured.Unstructured) error {
+	if errors.IsForbidden(err) {
+		return base.ToPermissionError(err, verb, kindResources[obj.GetKind()], obj.GetNamespace())
+	}
+	return fmt.Errorf("failed to %s %s: %v", verb, objectName(obj), err)
+}
+
+func decodeObject(data []byte) (*unstructured.Unstructured, error) {
+	obj := map[string]interface{}{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("failed to decode object: %v", err)
+	}
+	return &unstructured.Unstructured{Object: obj}, nil
+}
+
+// objectPath returns the API path of obj
+func objectPath(obj *unstructured.Unstructured) (string, error) {
+	resource, ok := kindResources[obj.GetKind()]
+	if !ok {
+		return "", fmt.Errorf("unsupported kind %s", obj.GetKind())
+	}
+	path := "/apis/" + obj.GetAPIVersion()
+	if obj.GetAPIVersion() == "v1" {
+		path = "/api/v1"
+	}
+	if obj.GetNamespace() != "" {
+		path += "/namespaces/" + obj.GetNamespace()
+	}
+	return path + "/" + resource + "/" + obj.GetName(), nil
+}
+
+// objectName returns the kind and name of obj, such as "Deployment kube-system/prometheus-deployment"
+func objectName(obj *unstructured.Unstructured) string {
+	if obj.GetNamespace() == "" {
+		return fmt.Sprintf("%s %s", obj.GetKind(), obj.GetName())
+	}
+	return fmt.Sprintf("%s %s/%s", obj.GetKind(), obj.GetNamespace(), obj.GetName())
+}
+
+// normalizedYAML returns obj without the fields set by the API server
+func normalizedYAML(obj *unstructured.Unstructured) string {
+	obj = obj.DeepCopy()
+	delete(obj.Object, "status")
+	for _, field := range serverMetadataFields {
+		unstructured.RemoveNestedField(obj.Object, "metadata", field)
+	}
+	annotations := obj.GetAnnotations()
+	for _, annotation := range serverAnnotations {
+		delete(annotations, annotation)
+	}
+	if len(annotations) == 0 {
+		unstructured.RemoveNestedField(obj.Object, "metadata", "annotations")
+	} else {
+		obj.SetAnnotations(annotations)
+	}
+	data, err := yaml.Marshal(obj.Object)
+	if err != nil {
+		return fmt.Sprintf("%v", obj.Object)
+	}
+	return string(data)
+}
@@ -0,0 +1,319 @@
+package installer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+)
+
+// the namespaces of the fake API server which are not stored as objects
+var fakeSystemNamespaces = map[string]bool{"default": true, "kube-system": true}
+
+// fakeAPIServer stores the applied objects by path, it rejects the writes into a missing namespace
+type fakeAPIServer struct {
+	mu       sync.Mutex
+	objects  map[string]map[string]interface{}
+	managers map[string]string
+	patches  int
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := r.URL.Path
+	switch r.Method {
+	case http.MethodGet:
+		if obj, ok := s.objects[path]; ok {
+			json.NewEncoder(w).Encode(obj)
+			return
+		}
+	case http.MethodPatch:
+		if r.Header.Get("Content-Type") != string(APPLY_PATCH_TYPE) {
+			http.Error(w, "unexpected content type "+r.Header.Get("Content-Type"), http.StatusUnsupportedMediaType)
+			return
+		}
+		if namespace := namespaceOfPath(path); namespace != "" && !fakeSystemNamespaces[namespace] {
+			if _, ok := s.objects["/api/v1/namespaces/"+namespace]; !ok {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","message":"namespaces \"` + namespace +
+					`\" not found","reason":"NotFound","code":404}`))
+				return
+			}
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		obj := map[string]interface{}{}
+		json.Unmarshal(body, &obj)
+		// the API server sets the server fields
+		obj["metadata"].(map[string]interface{})["resourceVersion"] = "1"
+		obj["status"] = map[string]interface{}{}
+		if r.URL.Query().Get("dryRun") == "" {
+			s.patches++
+			s.objects[path] = obj
+			s.managers[path] = r.URL.Query().Get("fieldManager")
+		}
+		json.NewEncoder(w).Encode(obj)
+		return
+	case http.MethodDelete:
+		if _, ok := s.objects[path]; ok {
+			delete(s.objects, path)
+			w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Success"}`))
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"NotFound","code":404}`))
+}
+
+// namespaceOfPath returns the namespace of the path of a namespaced object
+func namespaceOfPath(path string) string {
+	parts := strings.Split(path, "/")
+	for i := 0; i+3 < len(parts); i++ {
+		if parts[i] == "namespaces" {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+func newFakeInstaller(t *testing.T) (*Installer, *fakeAPIServer, func()) {
+	apiServer := &fakeAPIServer{objects: map[string]map[string]interface{}{}, managers: map[string]string{}}
+	server := httptest.NewServer(apiServer)
+	client, err := rest.RESTClientFor(&rest.Config{
+		Host:  server.URL,
+		QPS:   1000,
+		Burst: 1000,
+		ContentConfig: rest.ContentConfig{
+			GroupVersion:         &schema.GroupVersion{Version: "v1"},
+			NegotiatedSerializer: scheme.Codecs,
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create REST client, %v", err)
+	}
+	return NewInstaller(client), apiServer, server.Close
+}
+
+func TestRenderDefault(t *testing.T) {
+	objects, err := Render(DefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to render, %v", err)
+	}
+	kinds := []string{}
+	for _, obj := range objects {
+		kinds = append(kinds, obj.GetKind())
+	}
+	expected := "ConfigMap,ClusterRole,ServiceAccount,ClusterRoleBinding,ConfigMap,Deployment,Service,DaemonSet,Service"
+	if strings.Join(kinds, ",") != expected {
+		t.Errorf("expect kinds %s, got %s", expected, strings.Join(kinds, ","))
+	}
+	path, _ := objectPath(objects[5])
+	if path != "/apis/apps/v1/namespaces/kube-system/deployments/prometheus-deployment" {
+		t.Errorf("unexpected deployment path %s", path)
+	}
+	path, _ = objectPath(objects[1])
+	if path != "/apis/rbac.authorization.k8s.io/v1/clusterroles/prometheus" {
+		t.Errorf("unexpected cluster role path %s", path)
+	}
+}
+
+func TestRenderOptions(t *testing.T) {
+	o := DefaultOptions()
+	o.Namespace = "monitoring"
+	o.NodeSelector = "accelerator/nvidia_gpu=true,gpu"
+	o.ExporterImage = "exporter:v2"
+	o.Retention = "15d"
+	o.ScrapeInterval = 5 * time.Second
+	objects, err := Render(o)
+	if err != nil {
+		t.Fatalf("failed to render, %v", err)
+	}
+	if objects[0].GetKind() != "Namespace" || objects[0].GetName() != "monitoring" {
+		t.Fatalf("expect the namespace monitoring to be rendered first, got %s %s", objects[0].GetKind(), objects[0].GetName())
+	}
+	objects = objects[1:]
+
+	binding := objects[3].Object["subjects"].([]interface{})[0].(map[string]interface{})
+	if binding["namespace"] != "monitoring" {
+		t.Errorf("expect the service account of namespace monitoring to be bound, got %v", binding)
+	}
+	if retention := objects[0].Object["data"].(map[string]interface{})["storage-retention"]; retention != "15d" {
+		t.Errorf("expect retention 15d, got %v", retention)
+	}
+	config := objects[4].Object["data"].(map[string]interface{})["prometheus.yml"].(string)
+	if !strings.Contains(config, "scrape_interval: 5s") || !strings.Contains(config, "scrape_timeout: 5s") {
+		t.Errorf("expect the scrape timeout limited by the interval, got %s", config)
+	}
+
+	daemonSet, _ := json.Marshal(objects[7].Object)
+	for _, expected := range []string{
+		`{"key":"accelerator/nvidia_gpu","operator":"In","values":["true"]}`,
+		`{"key":"gpu","operator":"Exists"}`,
+		`"image":"exporter:v2"`,
+		`"namespace":"monitoring"`,
+	} {
+		if !strings.Contains(string(daemonSet), expected) {
+			t.Errorf("expect %s in the DaemonSet, got %s", expected, daemonSet)
+		}
+	}
+}
+
+func TestRenderAlerts(t *testing.T) {
+	objects, _ := Render(DefaultOptions())
+	if _, ok := objects[4].Object["data"].(map[string]interface{})["gpu-memory.rules"]; ok {
+		t.Errorf("alerting rules should only be rendered with alerts")
+	}
+	o := DefaultOptions()
+	o.Alerts = true
+	o.AlertHorizon = 4 * time.Hour
+	objects, err := Render(o)
+	if err != nil {
+		t.Fatalf("failed to render, %v", err)
+	}
+	rules := objects[4].Object["data"].(map[string]interface{})["gpu-memory.rules"].(string)
+	for _, expected := range []string{
+		`predict_linear(nvidia_gpu_memory_used_bytes{pod_name!=""}[1h], 14400) >= nvidia_gpu_memory_total_bytes{pod_name!=""}`,
+		`summary: GPU memory of {{ $labels.namespace_name }}/{{ $labels.pod_name }} is predicted to be exhausted within 4h0m0s`,
+	} {
+		if !strings.Contains(rules, expected) {
+			t.Errorf("expect %s in the rules, got %s", expected, rules)
+		}
+	}
+}
+
+func TestRenderInvalidOptions(t *testing.T) {
+	for _, mutate := range []func(o *Options){
+		func(o *Options) { o.Namespace = "Kube System" },
+		func(o *Options) { o.NodeSelector = "" },
+		func(o *Options) { o.NodeSelector = "=true" },
+		func(o *Options) { o.Retention = "15 days" },
+		func(o *Options) { o.ScrapeInterval = 1500 * time.Millisecond },
+		func(o *Options) { o.ExporterImage = "" },
+		func(o *Options) { o.Alerts, o.AlertHorizon = true, 0 },
+	} {
+		o := DefaultOptions()
+		mutate(&o)
+		if _, err := Render(o); err == nil {
+			t.Errorf("expect options %++v to be invalid", o)
+		}
+	}
+}
+
+func TestInstallUpgradeUninstall(t *testing.T) {
+	installer, apiServer, stop := newFakeInstaller(t)
+	defer stop()
+	objects, _ := Render(DefaultOptions())
+
+	diffs, err := installer.Diff(objects)
+	if err != nil {
+		t.Fatalf("failed to diff, %v", err)
+	}
+	if len(diffs) != len(objects) || diffs[0].Action != ACTION_CREATE || !strings.Contains(diffs[0].Diff, "+ data:") {
+		t.Errorf("expect all objects to be created, got %++v", diffs)
+	}
+	if apiServer.patches != 0 {
+		t.Errorf("diff should not change objects")
+	}
+
+	if err := installer.Install(objects); err != nil {
+		t.Fatalf("failed to install, %v", err)
+	}
+	if len(apiServer.objects) != len(objects) || apiServer.managers["/api/v1/namespaces/kube-system/services/prometheus-svc"] != DEFAULT_FIELD_MANAGER {
+		t.Errorf("expect all objects applied by %s, got %v", DEFAULT_FIELD_MANAGER, apiServer.managers)
+	}
+	if _, ok := installer.Install(objects).(*AlreadyInstalledError); !ok {
+		t.Errorf("expect AlreadyInstalledError on the second install")
+	}
+
+	// the server fields are not a change
+	diffs, _ = installer.Diff(objects)
+	for _, diff := range diffs {
+		if diff.Action != ACTION_UNCHANGED {
+			t.Errorf("expect %s %s unchanged, got %++v", diff.Kind, diff.Name, diff)
+		}
+	}
+
+	o := DefaultOptions()
+	o.Retention = "15d"
+	upgraded, _ := Render(o)
+	diffs, _ = installer.Diff(upgraded)
+	if diffs[0].Action != ACTION_UPDATE || !strings.Contains(diffs[0].Diff, "-   storage-retention: 360h\n+   storage-retention: 15d") {
+		t.Errorf("expect retention to change, got %++v", diffs[0])
+	}
+	if err := installer.Upgrade(upgraded); err != nil {
+		t.Fatalf("failed to upgrade, %v", err)
+	}
+	if diffs, _ = installer.Diff(upgraded); diffs[0].Action != ACTION_UNCHANGED {
+		t.Errorf("expect retention to be upgraded, got %++v", diffs[0])
+	}
+
+	names, err := installer.Uninstall(objects, true)
+	if err != nil || len(names) != len(objects) || len(apiServer.objects) != len(objects) {
+		t.Errorf("dry run uninstall should list all objects and delete none, got %v %v", names, err)
+	}
+	names, err = installer.Uninstall(objects, false)
+	if err != nil || len(names) != len(objects) || names[0] != "Service kube-system/node-gpu-exporter" {
+		t.Errorf("expect all objects deleted in reverse order, got %v %v", names, err)
+	}
+	if len(apiServer.objects) != 0 {
+		t.Errorf("expect no object left, got %v", apiServer.objects)
+	}
+}
+
+func TestInstallIntoNamespace(t *testing.T) {
+	installer, apiServer, stop := newFakeInstaller(t)
+	defer stop()
+	o := DefaultOptions()
+	o.Namespace = "monitoring"
+	objects, _ := Render(o)
+
+	// the objects of a missing namespace are created
+	diffs, err := installer.Diff(objects)
+	if err != nil {
+		t.Fatalf("failed to diff, %v", err)
+	}
+	for _, diff := range diffs {
+		if diff.Action != ACTION_CREATE || !strings.Contains(diff.Diff, "+ kind: "+diff.Kind) {
+			t.Errorf("expect %s %s to be created, got %++v", diff.Kind, diff.Name, diff)
+		}
+	}
+	if apiServer.patches != 0 || len(apiServer.objects) != 0 {
+		t.Errorf("diff should not change objects")
+	}
+
+	// the namespace created beforehand is not an installation
+	apiServer.objects["/api/v1/namespaces/monitoring"] = map[string]interface{}{"apiVersion": "v1", "kind": "Namespace",
+		"metadata": map[string]interface{}{"name": "monitoring"}}
+	if err := installer.Install(objects); err != nil {
+		t.Fatalf("failed to install, %v", err)
+	}
+	if len(apiServer.objects) != len(objects) || apiServer.managers["/api/v1/namespaces/monitoring"] != DEFAULT_FIELD_MANAGER {
+		t.Errorf("expect the namespace and all objects applied, got %v", apiServer.managers)
+	}
+
+	names, err := installer.Uninstall(objects, false)
+	if err != nil || len(names) != len(objects)-1 {
+		t.Errorf("expect all objects but the namespace deleted, got %v %v", names, err)
+	}
+	if _, ok := apiServer.objects["/api/v1/namespaces/monitoring"]; !ok || len(apiServer.objects) != 1 {
+		t.Errorf("expect only the namespace left, got %v", apiServer.objects)
+	}
+}
+
+func TestLineDiff(t *testing.T) {
+	diff := lineDiff("a\nb\nc\nd\ne\nf\ng\nh\ni\n", "a\nb\nc\nd\nE\nf\ng\nh\ni\n")
+	expected := "  b\n  c\n  d\n- e\n+ E\n  f\n  g\n  h"
+	if diff != expected {
+		t.Errorf("expect diff\n%s\ngot\n%s", expected, diff)
+	}
+}
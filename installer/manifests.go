@@ -0,0 +1,260 @@
+package installer
+
+// The manifests of kubernetes-artifacts/prometheus as templates of Options,
+// using the API versions served by the API servers supporting server-side apply
+
+// the namespace of the manifests, rendered unless it is kube-system
+const namespaceManifest = `apiVersion: v1
+kind: Namespace
+metadata:
+  name: {{ .Namespace }}
+`
+
+const prometheusManifest = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: prometheus-env
+  namespace: {{ .Namespace }}
+data:
+  storage-retention: {{ .Retention }}
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: prometheus
+rules:
+- apiGroups: ["", "extensions", "apps"]
+  resources:
+  - nodes
+  - nodes/proxy
+  - services
+  - endpoints
+  - pods
+  - deployments
+  verbs: ["get", "list", "watch"]
+- nonResourceURLs: ["/metrics"]
+  verbs: ["get"]
+---
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: prometheus
+  namespace: {{ .Namespace }}
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: prometheus
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: prometheus
+subjects:
+- kind: ServiceAccount
+  name: prometheus
+  namespace: {{ .Namespace }}
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: prometheus-configmap
+  namespace: {{ .Namespace }}
+data:
+  prometheus.yml: |-
+    rule_files:
+      - "/etc/prometheus-rules/*.rules"
+      - "/etc/prometheus/*.rules"
+    scrape_configs:
+    - job_name: kubernetes-service-endpoints
+      scrape_interval: {{ duration .ScrapeInterval }}
+      scrape_timeout: {{ duration .ScrapeTimeout }}
+      kubernetes_sd_configs:
+      - api_server: null
+        role: endpoints
+      relabel_configs:
+      - source_labels: [__meta_kubernetes_service_annotation_prometheus_io_scrape]
+        action: keep
+        regex: true
+      - source_labels: [__meta_kubernetes_service_annotation_prometheus_io_scheme]
+        action: replace
+        target_label: __scheme__
+        regex: (https?)
+      - source_labels: [__meta_kubernetes_service_annotation_prometheus_io_path]
+        action: replace
+        target_label: __metrics_path__
+        regex: (.+)
+      - source_labels: [__address__, __meta_kubernetes_service_annotation_prometheus_io_port]
+        action: replace
+        target_label: __address__
+        regex: (.+)(?::\d+);(\d+)
+        replacement: $1:$2
+      - action: labelmap
+        regex: __meta_kubernetes_service_label_(.+)
+      - source_labels: [__meta_kubernetes_service_namespace]
+        action: replace
+        target_label: kubernetes_namespace
+      - source_labels: [__meta_kubernetes_service_name]
+        action: replace
+        target_label: kubernetes_name
+{{- if .Alerts }}
+  gpu-memory.rules: |-
+    groups:
+    - name: gpu-memory
+      rules:
+      - alert: GPUMemoryExhaustionPredicted
+        expr: predict_linear(nvidia_gpu_memory_used_bytes{pod_name!=""}[1h], {{ seconds .AlertHorizon }}) >= nvidia_gpu_memory_total_bytes{pod_name!=""}
+        for: 15m
+        labels:
+          severity: warning
+        annotations:
+          summary: {{ "GPU memory of {{ $labels.namespace_name }}/{{ $labels.pod_name }} is predicted to be exhausted" }} within {{ .AlertHorizon }}
+          description: {{ "The memory used by GPU {{ $labels.minor_number }} on node {{ $labels.node_name }} keeps growing, run kubectl gpu top job with --memory-trend to see the trend." }}
+{{- end }}
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: prometheus-deployment
+  namespace: {{ .Namespace }}
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app: prometheus
+  template:
+    metadata:
+      name: prometheus
+      labels:
+        app: prometheus
+    spec:
+      serviceAccountName: prometheus
+      containers:
+      - name: prometheus
+        image: {{ .PrometheusImage }}
+        args:
+        - '--storage.tsdb.path=/prometheus'
+        - '--storage.tsdb.retention=$(STORAGE_RETENTION)'
+        - '--web.enable-lifecycle'
+        - '--storage.tsdb.no-lockfile'
+        - '--config.file=/etc/prometheus/prometheus.yml'
+        ports:
+        - name: web
+          containerPort: 9090
+        env:
+        - name: STORAGE_RETENTION
+          valueFrom:
+            configMapKeyRef:
+              name: prometheus-env
+              key: storage-retention
+        volumeMounts:
+        - name: config-volume
+          mountPath: /etc/prometheus
+        - name: prometheus-data
+          mountPath: /prometheus
+      volumes:
+      - name: config-volume
+        configMap:
+          name: prometheus-configmap
+      - name: prometheus-data
+        emptyDir: {}
+---
+apiVersion: v1
+kind: Service
+metadata:
+  labels:
+    name: prometheus-svc
+    kubernetes.io/name: "Prometheus"
+  name: prometheus-svc
+  namespace: {{ .Namespace }}
+spec:
+  selector:
+    app: prometheus
+  ports:
+  - name: prometheus
+    protocol: TCP
+    port: 9090
+    targetPort: 9090
+`
+
+const exporterManifest = `apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: node-gpu-exporter
+  namespace: {{ .Namespace }}
+spec:
+  selector:
+    matchLabels:
+      app: node-gpu-exporter
+  template:
+    metadata:
+      labels:
+        app: node-gpu-exporter
+    spec:
+      affinity:
+        nodeAffinity:
+          requiredDuringSchedulingIgnoredDuringExecution:
+            nodeSelectorTerms:
+            - matchExpressions:
+{{- range .NodeSelector }}
+              - key: {{ .Key }}
+                operator: {{ .Operator }}
+{{- if .Values }}
+                values:
+{{- range .Values }}
+                - {{ printf "%q" . }}
+{{- end }}
+{{- end }}
+{{- end }}
+      hostPID: true
+      containers:
+      - name: node-gpu-exporter
+        image: {{ .ExporterImage }}
+        imagePullPolicy: Always
+        env:
+        - name: MY_NODE_NAME
+          valueFrom:
+            fieldRef:
+              fieldPath: spec.nodeName
+        - name: MY_POD_NAME
+          valueFrom:
+            fieldRef:
+              fieldPath: metadata.name
+        - name: MY_NODE_IP
+          valueFrom:
+            fieldRef:
+              fieldPath: status.hostIP
+        - name: EXCLUDE_PODS
+          value: $(MY_POD_NAME),nvidia-device-plugin-$(MY_NODE_NAME),nvidia-device-plugin-ctr
+        - name: CADVISOR_URL
+          value: http://$(MY_NODE_IP):10255
+        ports:
+        - containerPort: 9445
+          hostPort: 9445
+        resources:
+          requests:
+            memory: 30Mi
+            cpu: 100m
+          limits:
+            memory: 50Mi
+            cpu: 200m
+---
+apiVersion: v1
+kind: Service
+metadata:
+  annotations:
+    prometheus.io/scrape: 'true'
+  name: node-gpu-exporter
+  namespace: {{ .Namespace }}
+  labels:
+    app: node-gpu-exporter
+    k8s-app: node-gpu-exporter
+spec:
+  type: ClusterIP
+  clusterIP: None
+  ports:
+  - name: http-metrics
+    port: 9445
+    protocol: TCP
+  selector:
+    app: node-gpu-exporter
+`
@@ -0,0 +1,166 @@
+package installer
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/xieydd/gpu-metric/analysis"
+	"github.com/xieydd/gpu-metric/utils"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// the node label selecting the GPU nodes in kubernetes-artifacts/prometheus/gpu-exporter.yaml
+const DEFAULT_NODE_SELECTOR = "unisound.accelerator/nvidia_count"
+const DEFAULT_PROMETHEUS_IMAGE = "registry.cn-hangzhou.aliyuncs.com/acs/prometheus:v2.2.0-rc.0"
+const DEFAULT_EXPORTER_IMAGE = "registry.cn-hangzhou.aliyuncs.com/acs/gpu-prometheus-exporter:0.1-f48bc3c"
+const DEFAULT_RETENTION = "360h"
+const DEFAULT_SCRAPE_INTERVAL = 10 * time.Second
+
+// the scrape timeout of prometheus, lowered to the scrape interval if it is shorter
+const MAX_SCRAPE_TIMEOUT = 10 * time.Second
+
+// the retention format of prometheus, such as 360h or 15d
+var retentionPattern = regexp.MustCompile(`^[0-9]+(ms|s|m|h|d|w|y)$`)
+
+// Options of the rendered manifests
+type Options struct {
+	Namespace string
+	// NodeSelector selects the GPU nodes of the exporter, a comma separated list of
+	// key (the label exists) or key=value requirements
+	NodeSelector    string
+	PrometheusImage string
+	ExporterImage   string
+	// Retention is the storage retention of prometheus, such as 360h or 15d
+	Retention      string
+	ScrapeInterval time.Duration
+	// Alerts adds the alerting rules of the GPU memory predicted to be exhausted within AlertHorizon
+	Alerts       bool
+	AlertHorizon time.Duration
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Namespace:       utils.KUBE_SYSTEM_NAMESPACE,
+		NodeSelector:    DEFAULT_NODE_SELECTOR,
+		PrometheusImage: DEFAULT_PROMETHEUS_IMAGE,
+		ExporterImage:   DEFAULT_EXPORTER_IMAGE,
+		Retention:       DEFAULT_RETENTION,
+		ScrapeInterval:  DEFAULT_SCRAPE_INTERVAL,
+		AlertHorizon:    analysis.DEFAULT_MEMORY_TREND_HORIZON,
+	}
+}
+
+// nodeRequirement is a match expression of the exporter node affinity
+type nodeRequirement struct {
+	Key      string
+	Operator string
+	Values   []string
+}
+
+// templateData is what the manifest templates are rendered with
+type templateData struct {
+	Options
+	NodeSelector  []nodeRequirement
+	ScrapeTimeout time.Duration
+}
+
+var manifestTemplates = template.Must(template.New("prometheus").Funcs(template.FuncMap{
+	"duration": prometheusDuration,
+	"seconds":  func(d time.Duration) int64 { return int64(d / time.Second) },
+}).Parse(prometheusManifest))
+
+func init() {
+	template.Must(manifestTemplates.New("namespace").Parse(namespaceManifest))
+	template.Must(manifestTemplates.New("exporter").Parse(exporterManifest))
+}
+
+func (o Options) Validate() error {
+	if errs := validation.IsDNS1123Label(o.Namespace); len(errs) > 0 {
+		return fmt.Errorf("invalid namespace %q: %s", o.Namespace, strings.Join(errs, ", "))
+	}
+	if o.PrometheusImage == "" || o.ExporterImage == "" {
+		return fmt.Errorf("image is not set")
+	}
+	if !retentionPattern.MatchString(o.Retention) {
+		return fmt.Errorf("invalid retention %q, must be a number with a unit such as 360h or 15d", o.Retention)
+	}
+	if o.ScrapeInterval < time.Second || o.ScrapeInterval%time.Second != 0 {
+		return fmt.Errorf("invalid scrape interval %v, must be whole seconds", o.ScrapeInterval)
+	}
+	if o.Alerts && o.AlertHorizon < time.Minute {
+		return fmt.Errorf("invalid alert horizon %v, must be at least 1m", o.AlertHorizon)
+	}
+	_, err := parseNodeSelector(o.NodeSelector)
+	return err
+}
+
+// parseNodeSelector parses "key1,key2=value" into an Exists and an In requirement
+func parseNodeSelector(selector string) ([]nodeRequirement, error) {
+	requirements := []nodeRequirement{}
+	for _, part := range strings.Split(selector, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if kv[0] == "" {
+			return nil, fmt.Errorf("invalid node selector %q", part)
+		}
+		if len(kv) == 1 {
+			requirements = append(requirements, nodeRequirement{Key: kv[0], Operator: "Exists"})
+		} else {
+			requirements = append(requirements, nodeRequirement{Key: kv[0], Operator: "In", Values: []string{kv[1]}})
+		}
+	}
+	if len(requirements) == 0 {
+		return nil, fmt.Errorf("node selector is not set, the exporter must only run on GPU nodes")
+	}
+	return requirements, nil
+}
+
+// prometheusDuration formats d in seconds, prometheus does not parse "1m0s"
+func prometheusDuration(d time.Duration) string {
+	return fmt.Sprintf("%ds", int64(d/time.Second))
+}
+
+// Render returns the objects of the prometheus and exporter manifests in the order they are applied,
+// preceded by their Namespace unless it is kube-system
+func Render(o Options) ([]*unstructured.Unstructured, error) {
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	nodeSelector, _ := parseNodeSelector(o.NodeSelector)
+	data := templateData{Options: o, NodeSelector: nodeSelector, ScrapeTimeout: o.ScrapeInterval}
+	if data.ScrapeTimeout > MAX_SCRAPE_TIMEOUT {
+		data.ScrapeTimeout = MAX_SCRAPE_TIMEOUT
+	}
+
+	names := []string{"prometheus", "exporter"}
+	if o.Namespace != utils.KUBE_SYSTEM_NAMESPACE {
+		names = append([]string{"namespace"}, names...)
+	}
+	objects := []*unstructured.Unstructured{}
+	for _, name := range names {
+		var buf bytes.Buffer
+		if err := manifestTemplates.ExecuteTemplate(&buf, name, data); err != nil {
+			return nil, fmt.Errorf("failed to render %s manifest: %v", name, err)
+		}
+		for _, doc := range strings.Split(buf.String(), "\n---\n") {
+			obj := map[string]interface{}{}
+			if err := yaml.Unmarshal([]byte(doc), &obj); err != nil {
+				return nil, fmt.Errorf("failed to parse %s manifest: %v", name, err)
+			}
+			if len(obj) == 0 {
+				continue
+			}
+			objects = append(objects, &unstructured.Unstructured{Object: obj})
+		}
+	}
+	return objects, nil
+}
@@ -0,0 +1,292 @@
+package labeler
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xieydd/gpu-metric/base"
+	"github.com/xieydd/gpu-metric/installer"
+	"github.com/xieydd/gpu-metric/utils"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const DEFAULT_MODEL_LABEL = "gpu-metric.io/gpu-model"
+const DEFAULT_COUNT_LABEL = "gpu-metric.io/gpu-count"
+
+// MANAGED_LABELS_ANNOTATION lists the labels set by the labeler, only these labels are removed
+// when the GPU capacity goes away
+const MANAGED_LABELS_ANNOTATION = "gpu-metric.io/managed-labels"
+
+// the node labels of the GPU model set by NVIDIA GPU feature discovery and the cloud providers
+var DEFAULT_MODEL_SOURCE_LABELS = []string{"nvidia.com/gpu.product", "cloud.google.com/gke-accelerator", "accelerator"}
+
+const DEFAULT_RESYNC = 10 * time.Minute
+
+// the characters not allowed in a label value
+var invalidLabelValueChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Options of the labeler
+type Options struct {
+	// Resources are the extended resources of GPUs
+	Resources []string
+	// SelectorLabel is the label selecting the nodes of the exporter DaemonSet, key or key=value,
+	// the value of a key only is the GPU count
+	SelectorLabel string
+	ModelLabel    string
+	CountLabel    string
+	// ModelSourceLabels are the node labels the GPU model is read from, the first one set is used
+	ModelSourceLabels []string
+	Resync            time.Duration
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Resources:         []string{utils.NVIDIA_GPU_RESOURCE_NAME, utils.DEPRECATED_NVIDIA_GPU_RESOURCE_NAME},
+		SelectorLabel:     installer.DEFAULT_NODE_SELECTOR,
+		ModelLabel:        DEFAULT_MODEL_LABEL,
+		CountLabel:        DEFAULT_COUNT_LABEL,
+		ModelSourceLabels: DEFAULT_MODEL_SOURCE_LABELS,
+		Resync:            DEFAULT_RESYNC,
+	}
+}
+
+func (o Options) Validate() error {
+	if len(o.Resources) == 0 {
+		return fmt.Errorf("no GPU resource is set")
+	}
+	if key, _ := splitSelectorLabel(o.SelectorLabel); key == "" {
+		return fmt.Errorf("invalid selector label %q", o.SelectorLabel)
+	}
+	return nil
+}
+
+func splitSelectorLabel(label string) (string, string) {
+	kv := strings.SplitN(label, "=", 2)
+	if len(kv) == 1 {
+		return kv[0], ""
+	}
+	return kv[0], kv[1]
+}
+
+// GpuCount returns the GPU capacity of node in the first of resources it has
+func GpuCount(node *v1.Node, resources []string) int64 {
+	for _, resource := range resources {
+		if val, ok := node.Status.Capacity[v1.ResourceName(resource)]; ok && val.Value() > 0 {
+			return val.Value()
+		}
+	}
+	return 0
+}
+
+// DesiredLabels returns the labels the labeler sets on node, none if it has no GPU capacity
+func DesiredLabels(node *v1.Node, o Options) map[string]string {
+	labels := map[string]string{}
+	count := GpuCount(node, o.Resources)
+	if count == 0 {
+		return labels
+	}
+	key, value := splitSelectorLabel(o.SelectorLabel)
+	if value == "" {
+		value = strconv.FormatInt(count, 10)
+	}
+	labels[key] = value
+	if o.CountLabel != "" {
+		labels[o.CountLabel] = strconv.FormatInt(count, 10)
+	}
+	if o.ModelLabel != "" {
+		for _, source := range o.ModelSourceLabels {
+			if model := labelValue(node.Labels[source]); model != "" {
+				labels[o.ModelLabel] = model
+				break
+			}
+		}
+	}
+	return labels
+}
+
+// labelValue sanitizes s into a label value, such as "Tesla-P100-PCIE-16GB" for "Tesla P100-PCIE-16GB"
+func labelValue(s string) string {
+	s = invalidLabelValueChars.ReplaceAllString(s, "-")
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	return strings.Trim(s, "-_.")
+}
+
+// labelPatch returns the merge patch turning the managed labels of node into desired,
+// and false if node is up to date. Only the labels created by the labeler are recorded as managed,
+// a desired label set beforehand, such as by an admin, is updated but never removed.
+func labelPatch(node *v1.Node, desired map[string]string) ([]byte, bool, error) {
+	managed := map[string]bool{}
+	for _, key := range strings.Split(node.Annotations[MANAGED_LABELS_ANNOTATION], ",") {
+		if key != "" {
+			managed[key] = true
+		}
+	}
+
+	labels := map[string]interface{}{}
+	for key := range managed {
+		if _, ok := desired[key]; !ok {
+			if _, set := node.Labels[key]; set {
+				// null removes the label
+				labels[key] = nil
+			}
+		}
+	}
+	keys := []string{}
+	for key, value := range desired {
+		if _, set := node.Labels[key]; !set || managed[key] {
+			keys = append(keys, key)
+		}
+		if node.Labels[key] != value {
+			labels[key] = value
+		}
+	}
+	sort.Strings(keys)
+	annotation := strings.Join(keys, ",")
+
+	annotations := map[string]interface{}{}
+	if annotation != node.Annotations[MANAGED_LABELS_ANNOTATION] {
+		annotations[MANAGED_LABELS_ANNOTATION] = annotation
+		if annotation == "" {
+			annotations[MANAGED_LABELS_ANNOTATION] = nil
+		}
+	}
+	if len(labels) == 0 && len(annotations) == 0 {
+		return nil, false, nil
+	}
+	metadata := map[string]interface{}{}
+	if len(labels) > 0 {
+		metadata["labels"] = labels
+	}
+	if len(annotations) > 0 {
+		metadata["annotations"] = annotations
+	}
+	patch, err := json.Marshal(map[string]interface{}{"metadata": metadata})
+	return patch, true, err
+}
+
+// Labeler keeps the exporter selector, GPU model and count labels of the nodes up to date
+type Labeler struct {
+	client  kubernetes.Interface
+	options Options
+	factory informers.SharedInformerFactory
+	nodes   cache.SharedIndexInformer
+	queue   workqueue.RateLimitingInterface
+}
+
+func NewLabeler(client kubernetes.Interface, options Options) *Labeler {
+	factory := informers.NewSharedInformerFactory(client, options.Resync)
+	l := &Labeler{
+		client:  client,
+		options: options,
+		factory: factory,
+		nodes:   factory.Core().V1().Nodes().Informer(),
+		queue:   workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "gpu-node-labeler"),
+	}
+	l.nodes.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    l.enqueue,
+		UpdateFunc: func(_, obj interface{}) { l.enqueue(obj) },
+	})
+	return l
+}
+
+func (l *Labeler) enqueue(obj interface{}) {
+	if node, ok := obj.(*v1.Node); ok {
+		l.queue.Add(node.Name)
+	}
+}
+
+// Run labels the nodes until stopCh is closed
+func (l *Labeler) Run(workers int, stopCh <-chan struct{}) {
+	defer l.queue.ShutDown()
+	l.factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, l.nodes.HasSynced) {
+		log.Warnf("node labeler stopped before the caches synced")
+		return
+	}
+	log.Infof("node labeler started")
+	for i := 0; i < workers; i++ {
+		go wait.Until(l.runWorker, time.Second, stopCh)
+	}
+	<-stopCh
+}
+
+func (l *Labeler) runWorker() {
+	for l.processNextItem() {
+	}
+}
+
+func (l *Labeler) processNextItem() bool {
+	key, quit := l.queue.Get()
+	if quit {
+		return false
+	}
+	defer l.queue.Done(key)
+	if err := l.sync(key.(string)); err != nil {
+		log.Warnf("failed to label node %s, %v", key, err)
+		l.queue.AddRateLimited(key)
+		return true
+	}
+	l.queue.Forget(key)
+	return true
+}
+
+func (l *Labeler) sync(name string) error {
+	obj, exists, err := l.nodes.GetIndexer().GetByKey(name)
+	if err != nil || !exists {
+		return err
+	}
+	_, err = l.LabelNode(obj.(*v1.Node))
+	return err
+}
+
+// LabelNode patches the labels of node, and returns true if they changed
+func (l *Labeler) LabelNode(node *v1.Node) (bool, error) {
+	patch, changed, err := labelPatch(node, DesiredLabels(node, l.options))
+	if err != nil || !changed {
+		return false, err
+	}
+	_, err = l.client.CoreV1().Nodes().Patch(node.Name, types.MergePatchType, patch)
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, base.ToPermissionError(err, "patch", "nodes", "")
+	}
+	log.Infof("labeled node %s: %s", node.Name, patch)
+	return true, nil
+}
+
+// LabelNodes labels all the nodes once, and returns the names of the changed nodes
+func (l *Labeler) LabelNodes() ([]string, error) {
+	nodes, err := l.client.CoreV1().Nodes().List(meta_v1.ListOptions{})
+	if err != nil {
+		return nil, base.ToPermissionError(err, "list", "nodes", "")
+	}
+	changed := []string{}
+	for i := range nodes.Items {
+		ok, err := l.LabelNode(&nodes.Items[i])
+		if err != nil {
+			return changed, err
+		}
+		if ok {
+			changed = append(changed, nodes.Items[i].Name)
+		}
+	}
+	return changed, nil
+}
@@ -0,0 +1,176 @@
+package labeler
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newNode(name string, gpus string, labels map[string]string, annotations map[string]string) *v1.Node {
+	node := &v1.Node{ObjectMeta: meta_v1.ObjectMeta{Name: name, Labels: labels, Annotations: annotations}}
+	if gpus != "" {
+		node.Status.Capacity = v1.ResourceList{"nvidia.com/gpu": resource.MustParse(gpus)}
+	}
+	return node
+}
+
+// newPatchingClient returns a fake client whose patches remove the labels set to null,
+// the patch reaction of the fake client merges the patched object into the old one
+func newPatchingClient(nodes ...runtime.Object) *fake.Clientset {
+	tracker := k8stesting.NewObjectTracker(scheme.Scheme, scheme.Codecs.UniversalDecoder())
+	for _, node := range nodes {
+		tracker.Add(node)
+	}
+	client := &fake.Clientset{}
+	client.AddReactor("*", "*", k8stesting.ObjectReaction(tracker))
+	client.PrependReactor("patch", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		obj, err := tracker.Get(v1.SchemeGroupVersion.WithResource("nodes"), "", patch.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+		old, _ := json.Marshal(obj)
+		patched, err := strategicpatch.StrategicMergePatch(old, patch.GetPatch(), &v1.Node{})
+		if err != nil {
+			return true, nil, err
+		}
+		node := &v1.Node{}
+		if err := json.Unmarshal(patched, node); err != nil {
+			return true, nil, err
+		}
+		return true, node, tracker.Update(v1.SchemeGroupVersion.WithResource("nodes"), node, "")
+	})
+	return client
+}
+
+func getNode(t *testing.T, client *fake.Clientset, name string) *v1.Node {
+	node, err := client.CoreV1().Nodes().Get(name, meta_v1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get node %s, %v", name, err)
+	}
+	return node
+}
+
+func TestDesiredLabels(t *testing.T) {
+	o := DefaultOptions()
+	node := newNode("node1", "8", map[string]string{"nvidia.com/gpu.product": "Tesla P100-PCIE-16GB"}, nil)
+	labels := DesiredLabels(node, o)
+	expected := map[string]string{
+		"unisound.accelerator/nvidia_count": "8",
+		DEFAULT_COUNT_LABEL:                 "8",
+		DEFAULT_MODEL_LABEL:                 "Tesla-P100-PCIE-16GB",
+	}
+	if len(labels) != len(expected) {
+		t.Errorf("expect labels %v, got %v", expected, labels)
+	}
+	for key, value := range expected {
+		if labels[key] != value {
+			t.Errorf("expect label %s=%s, got %v", key, value, labels)
+		}
+	}
+
+	o.SelectorLabel = "accelerator/nvidia_gpu=true"
+	o.Resources = []string{"example.com/gpu"}
+	if labels := DesiredLabels(node, o); len(labels) != 0 {
+		t.Errorf("node without the configured resource should have no label, got %v", labels)
+	}
+	node.Status.Capacity["example.com/gpu"] = resource.MustParse("2")
+	if labels := DesiredLabels(node, o); labels["accelerator/nvidia_gpu"] != "true" || labels[DEFAULT_COUNT_LABEL] != "2" {
+		t.Errorf("expect the configured selector value and resource count, got %v", labels)
+	}
+}
+
+func TestLabelNodes(t *testing.T) {
+	client := newPatchingClient(
+		newNode("gpu-node", "4", nil, nil),
+		// the GPUs went away, the hand made label is kept
+		newNode("drained-node", "0", map[string]string{
+			"unisound.accelerator/nvidia_count": "4",
+			DEFAULT_COUNT_LABEL:                 "4",
+			"team":                              "vision",
+		}, map[string]string{MANAGED_LABELS_ANNOTATION: DEFAULT_COUNT_LABEL + ",unisound.accelerator/nvidia_count"}),
+		newNode("cpu-node", "", map[string]string{"team": "infra"}, nil),
+	)
+	l := NewLabeler(client, DefaultOptions())
+
+	changed, err := l.LabelNodes()
+	if err != nil {
+		t.Fatalf("failed to label nodes, %v", err)
+	}
+	if len(changed) != 2 {
+		t.Errorf("expect gpu-node and drained-node to change, got %v", changed)
+	}
+
+	node := getNode(t, client, "gpu-node")
+	if node.Labels["unisound.accelerator/nvidia_count"] != "4" || node.Labels[DEFAULT_COUNT_LABEL] != "4" {
+		t.Errorf("expect gpu-node to be labeled, got %v", node.Labels)
+	}
+	if node.Annotations[MANAGED_LABELS_ANNOTATION] != DEFAULT_COUNT_LABEL+",unisound.accelerator/nvidia_count" {
+		t.Errorf("expect the managed labels to be recorded, got %v", node.Annotations)
+	}
+	node = getNode(t, client, "drained-node")
+	if len(node.Labels) != 1 || node.Labels["team"] != "vision" {
+		t.Errorf("expect only the managed labels removed, got %v", node.Labels)
+	}
+	if _, ok := node.Annotations[MANAGED_LABELS_ANNOTATION]; ok {
+		t.Errorf("expect the managed labels annotation removed, got %v", node.Annotations)
+	}
+
+	if changed, _ := l.LabelNodes(); len(changed) != 0 {
+		t.Errorf("expect no change on the second pass, got %v", changed)
+	}
+}
+
+func TestLabelNodesKeepsPresetLabels(t *testing.T) {
+	// the selector label is set by the admin, the count label by nobody
+	client := newPatchingClient(newNode("gpu-node", "4", map[string]string{"unisound.accelerator/nvidia_count": "4"}, nil))
+	l := NewLabeler(client, DefaultOptions())
+	if _, err := l.LabelNodes(); err != nil {
+		t.Fatalf("failed to label nodes, %v", err)
+	}
+	node := getNode(t, client, "gpu-node")
+	if node.Annotations[MANAGED_LABELS_ANNOTATION] != DEFAULT_COUNT_LABEL {
+		t.Errorf("expect only the created label to be recorded, got %v", node.Annotations)
+	}
+
+	// the GPUs go away
+	node.Status.Capacity["nvidia.com/gpu"] = resource.MustParse("0")
+	if _, err := client.CoreV1().Nodes().UpdateStatus(node); err != nil {
+		t.Fatalf("failed to update node, %v", err)
+	}
+	if _, err := l.LabelNodes(); err != nil {
+		t.Fatalf("failed to label nodes, %v", err)
+	}
+	node = getNode(t, client, "gpu-node")
+	if len(node.Labels) != 1 || node.Labels["unisound.accelerator/nvidia_count"] != "4" {
+		t.Errorf("expect the admin label kept and the created label removed, got %v", node.Labels)
+	}
+}
+
+func TestLabelerLabelsNewNodes(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	l := NewLabeler(client, DefaultOptions())
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go l.Run(1, stopCh)
+
+	// an autoscaled GPU node joins
+	client.CoreV1().Nodes().Create(newNode("autoscaled-node", "2", nil, nil))
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if getNode(t, client, "autoscaled-node").Labels[DEFAULT_COUNT_LABEL] == "2" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("expect the new node to be labeled, got %v", getNode(t, client, "autoscaled-node").Labels)
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Cache keeps the rendered responses for ttl and shares them between requests,
+// concurrent requests of the same key wait for a single load
+type Cache struct {
+	ttl     time.Duration
+	now     func() time.Time
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	ready   chan struct{}
+	body    []byte
+	etag    string
+	err     error
+	expires time.Time
+}
+
+func NewCache(ttl time.Duration) *Cache {
+	return &Cache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: map[string]*cacheEntry{},
+	}
+}
+
+// Get returns the cached body and its ETag, load is called if the entry is missing or expired.
+// Errors are returned to all the waiting requests but are not cached.
+func (c *Cache) Get(key string, load func() ([]byte, error)) ([]byte, string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok {
+		select {
+		case <-entry.ready:
+			if c.now().After(entry.expires) {
+				ok = false
+			}
+		default:
+			// loading by another request
+		}
+	}
+	if !ok {
+		entry = &cacheEntry{ready: make(chan struct{})}
+		c.entries[key] = entry
+		c.mu.Unlock()
+
+		entry.body, entry.err = load()
+		if entry.err == nil {
+			entry.etag = ETag(entry.body)
+		}
+		entry.expires = c.now().Add(c.ttl)
+		close(entry.ready)
+		if entry.err != nil {
+			c.mu.Lock()
+			if c.entries[key] == entry {
+				delete(c.entries, key)
+			}
+			c.mu.Unlock()
+		}
+		return entry.body, entry.etag, entry.err
+	}
+	c.mu.Unlock()
+
+	<-entry.ready
+	return entry.body, entry.etag, entry.err
+}
+
+// Purge drops the expired entries
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for key, entry := range c.entries {
+		select {
+		case <-entry.ready:
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			}
+		default:
+		}
+	}
+}
+
+// ETag returns a strong entity tag of body
+func ETag(body []byte) string {
+	sum := sha1.Sum(body)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheGet(t *testing.T) {
+	now := time.Unix(1000, 0)
+	cache := NewCache(10 * time.Second)
+	cache.now = func() time.Time { return now }
+
+	loads := 0
+	load := func() ([]byte, error) {
+		loads++
+		return []byte(fmt.Sprintf(`{"load":%d}`, loads)), nil
+	}
+	body1, etag1, err := cache.Get("key", load)
+	if err != nil {
+		t.Fatalf("failed to Get, %++v", err)
+	}
+	body2, etag2, _ := cache.Get("key", load)
+	if loads != 1 || string(body1) != string(body2) || etag1 != etag2 {
+		t.Errorf("second Get should be served from cache, loads: %d", loads)
+	}
+
+	now = now.Add(11 * time.Second)
+	_, etag3, _ := cache.Get("key", load)
+	if loads != 2 || etag3 == etag1 {
+		t.Errorf("expired entry should be reloaded, loads: %d", loads)
+	}
+
+	_, _, err = cache.Get("failed", func() ([]byte, error) { return nil, fmt.Errorf("prometheus is down") })
+	if err == nil {
+		t.Errorf("load error should be returned")
+	}
+	if _, ok := cache.entries["failed"]; ok {
+		t.Errorf("errors should not be cached")
+	}
+
+	now = now.Add(11 * time.Second)
+	cache.Purge()
+	if len(cache.entries) != 0 {
+		t.Errorf("expired entries should be purged, got %d", len(cache.entries))
+	}
+}
+
+func TestCacheSharedLoad(t *testing.T) {
+	cache := NewCache(time.Minute)
+	release := make(chan struct{})
+	loads := 0
+	load := func() ([]byte, error) {
+		loads++
+		<-release
+		return []byte("{}"), nil
+	}
+
+	var wg sync.WaitGroup
+	started := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		close(started)
+		cache.Get("key", load)
+	}()
+	<-started
+	// wait until the first request owns the entry
+	for {
+		cache.mu.Lock()
+		_, ok := cache.entries["key"]
+		cache.mu.Unlock()
+		if ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cache.Get("key", load)
+		}()
+	}
+	close(release)
+	wg.Wait()
+	if loads != 1 {
+		t.Errorf("concurrent requests should share one load, got %d", loads)
+	}
+}
@@ -0,0 +1,532 @@
+package server
+
+// OPENAPI_SPEC describes the REST API, it is served on /openapi.json
+const OPENAPI_SPEC = `{
+  "openapi": "3.0.0",
+  "info": {
+    "title": "GPU metric API",
+    "description": "GPU duty cycle and memory usage of the cluster, nodes, namespaces, pods and training jobs. Endpoints return the instant usage, or the metric series when start is set. Responses carry an ETag and honour If-None-Match.",
+    "version": "v1"
+  },
+  "paths": {
+    "/api/v1/cluster": {
+      "get": {
+        "summary": "Aggregated GPU usage of all the GPU nodes",
+        "parameters": [{"$ref": "#/components/parameters/start"}, {"$ref": "#/components/parameters/end"}, {"$ref": "#/components/parameters/step"}],
+        "responses": {
+          "200": {"description": "ClusterGpuUsage, or GpuMetricSeries list for a range query", "content": {"application/json": {"schema": {"oneOf": [{"$ref": "#/components/schemas/ClusterGpuUsage"}, {"$ref": "#/components/schemas/GpuMetricSeriesList"}]}}}},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/nodes": {
+      "get": {
+        "summary": "GPU usage of the GPU nodes",
+        "parameters": [{"$ref": "#/components/parameters/labelSelector"}, {"$ref": "#/components/parameters/start"}, {"$ref": "#/components/parameters/end"}, {"$ref": "#/components/parameters/step"}],
+        "responses": {
+          "200": {"description": "InstanceGpuUsage list, or GpuMetricSeries list for a range query", "content": {"application/json": {"schema": {"oneOf": [{"$ref": "#/components/schemas/InstanceGpuUsageList"}, {"$ref": "#/components/schemas/GpuMetricSeriesList"}]}}}},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/nodes/{node}": {
+      "get": {
+        "summary": "GPU usage of a node",
+        "parameters": [{"$ref": "#/components/parameters/node"}, {"$ref": "#/components/parameters/start"}, {"$ref": "#/components/parameters/end"}, {"$ref": "#/components/parameters/step"}],
+        "responses": {
+          "200": {"description": "InstanceGpuUsage, or GpuMetricSeries list for a range query", "content": {"application/json": {"schema": {"oneOf": [{"$ref": "#/components/schemas/InstanceGpuUsage"}, {"$ref": "#/components/schemas/GpuMetricSeriesList"}]}}}},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/namespaces": {
+      "get": {
+        "summary": "Aggregated GPU usage of the namespaces running GPU pods",
+        "parameters": [{"$ref": "#/components/parameters/labelSelector"}, {"$ref": "#/components/parameters/start"}, {"$ref": "#/components/parameters/end"}, {"$ref": "#/components/parameters/step"}],
+        "responses": {
+          "200": {"description": "NamespaceGpuUsage list, or GpuMetricSeries list for a range query", "content": {"application/json": {"schema": {"oneOf": [{"$ref": "#/components/schemas/NamespaceGpuUsageList"}, {"$ref": "#/components/schemas/GpuMetricSeriesList"}]}}}},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/namespaces/{namespace}": {
+      "get": {
+        "summary": "Aggregated GPU usage of a namespace",
+        "parameters": [{"$ref": "#/components/parameters/namespace"}, {"$ref": "#/components/parameters/start"}, {"$ref": "#/components/parameters/end"}, {"$ref": "#/components/parameters/step"}],
+        "responses": {
+          "200": {"description": "NamespaceGpuUsage, or GpuMetricSeries list for a range query", "content": {"application/json": {"schema": {"oneOf": [{"$ref": "#/components/schemas/NamespaceGpuUsage"}, {"$ref": "#/components/schemas/GpuMetricSeriesList"}]}}}},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/namespaces/{namespace}/pods": {
+      "get": {
+        "summary": "GPU usage of the pods of a namespace",
+        "parameters": [{"$ref": "#/components/parameters/namespace"}, {"$ref": "#/components/parameters/labelSelector"}, {"$ref": "#/components/parameters/start"}, {"$ref": "#/components/parameters/end"}, {"$ref": "#/components/parameters/step"}],
+        "responses": {
+          "200": {"description": "InstanceGpuUsage list, or GpuMetricSeries list for a range query", "content": {"application/json": {"schema": {"oneOf": [{"$ref": "#/components/schemas/InstanceGpuUsageList"}, {"$ref": "#/components/schemas/GpuMetricSeriesList"}]}}}},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/namespaces/{namespace}/pods/{pod}": {
+      "get": {
+        "summary": "GPU usage of a pod",
+        "parameters": [{"$ref": "#/components/parameters/namespace"}, {"$ref": "#/components/parameters/pod"}, {"$ref": "#/components/parameters/start"}, {"$ref": "#/components/parameters/end"}, {"$ref": "#/components/parameters/step"}],
+        "responses": {
+          "200": {"description": "InstanceGpuUsage, or GpuMetricSeries list for a range query", "content": {"application/json": {"schema": {"oneOf": [{"$ref": "#/components/schemas/InstanceGpuUsage"}, {"$ref": "#/components/schemas/GpuMetricSeriesList"}]}}}},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/namespaces/{namespace}/workloads/{kind}/{name}": {
+      "get": {
+        "summary": "GPU usage of the pods of a workload, found by walking the owner references of the pods",
+        "parameters": [{"$ref": "#/components/parameters/namespace"}, {"$ref": "#/components/parameters/kind"}, {"$ref": "#/components/parameters/name"}, {"$ref": "#/components/parameters/start"}, {"$ref": "#/components/parameters/end"}, {"$ref": "#/components/parameters/step"}],
+        "responses": {
+          "200": {"description": "InstanceGpuUsage list, or GpuMetricSeries list for a range query", "content": {"application/json": {"schema": {"oneOf": [{"$ref": "#/components/schemas/InstanceGpuUsageList"}, {"$ref": "#/components/schemas/GpuMetricSeriesList"}]}}}},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/namespaces/{namespace}/jobs/{job}": {
+      "get": {
+        "summary": "GPU usage of the pods of a training job (pods labeled release=<job>)",
+        "parameters": [{"$ref": "#/components/parameters/namespace"}, {"$ref": "#/components/parameters/job"}, {"$ref": "#/components/parameters/start"}, {"$ref": "#/components/parameters/end"}, {"$ref": "#/components/parameters/step"}],
+        "responses": {
+          "200": {"description": "InstanceGpuUsage list, or GpuMetricSeries list for a range query", "content": {"application/json": {"schema": {"oneOf": [{"$ref": "#/components/schemas/InstanceGpuUsageList"}, {"$ref": "#/components/schemas/GpuMetricSeriesList"}]}}}},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/namespaces/{namespace}/jobs/{job}/stragglers": {
+      "get": {
+        "summary": "Workers and GPUs of a training job whose duty cycle deviates from their peers",
+        "parameters": [{"$ref": "#/components/parameters/namespace"}, {"$ref": "#/components/parameters/job"}, {"$ref": "#/components/parameters/window"}],
+        "responses": {
+          "200": {"description": "StragglerReport", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/StragglerReport"}}}},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/namespaces/{namespace}/jobs/{job}/hung": {
+      "get": {
+        "summary": "Whether a training job is hung: its GPUs hold memory while their duty cycle has been 0 after a period of activity",
+        "parameters": [{"$ref": "#/components/parameters/namespace"}, {"$ref": "#/components/parameters/job"}, {"$ref": "#/components/parameters/window"}],
+        "responses": {
+          "200": {"description": "HungReport", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/HungReport"}}}},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/namespaces/{namespace}/workloads/{kind}/{name}/hung": {
+      "get": {
+        "summary": "Whether a workload is hung: its GPUs hold memory while their duty cycle has been 0 after a period of activity",
+        "parameters": [{"$ref": "#/components/parameters/namespace"}, {"$ref": "#/components/parameters/kind"}, {"$ref": "#/components/parameters/name"}, {"$ref": "#/components/parameters/window"}],
+        "responses": {
+          "200": {"description": "HungReport", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/HungReport"}}}},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/namespaces/{namespace}/jobs/{job}/memory-trend": {
+      "get": {
+        "summary": "Trend of the memory used by the GPUs of a training job since it started, with the time to exhaustion",
+        "parameters": [{"$ref": "#/components/parameters/namespace"}, {"$ref": "#/components/parameters/job"}, {"$ref": "#/components/parameters/window"}],
+        "responses": {
+          "200": {"description": "MemoryTrendReport", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/MemoryTrendReport"}}}},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/namespaces/{namespace}/workloads/{kind}/{name}/memory-trend": {
+      "get": {
+        "summary": "Trend of the memory used by the GPUs of a workload since it started, with the time to exhaustion",
+        "parameters": [{"$ref": "#/components/parameters/namespace"}, {"$ref": "#/components/parameters/kind"}, {"$ref": "#/components/parameters/name"}, {"$ref": "#/components/parameters/window"}],
+        "responses": {
+          "200": {"description": "MemoryTrendReport", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/MemoryTrendReport"}}}},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/namespaces/{namespace}/jobs/{job}/bottlenecks": {
+      "get": {
+        "summary": "Bottleneck of each pod of a training job using GPUs, from its GPU and cAdvisor metrics, with the evidence",
+        "parameters": [{"$ref": "#/components/parameters/namespace"}, {"$ref": "#/components/parameters/job"}, {"$ref": "#/components/parameters/window"}],
+        "responses": {
+          "200": {"description": "BottleneckReport", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/BottleneckReport"}}}},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/namespaces/{namespace}/workloads/{kind}/{name}/bottlenecks": {
+      "get": {
+        "summary": "Bottleneck of each pod of a workload using GPUs, from its GPU and cAdvisor metrics, with the evidence",
+        "parameters": [{"$ref": "#/components/parameters/namespace"}, {"$ref": "#/components/parameters/kind"}, {"$ref": "#/components/parameters/name"}, {"$ref": "#/components/parameters/window"}],
+        "responses": {
+          "200": {"description": "BottleneckReport", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/BottleneckReport"}}}},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/namespaces/{namespace}/jobs/{job}/energy": {
+      "get": {
+        "summary": "Energy used by the GPUs of a training job over its lifetime, or the last window if set, and its carbon emissions",
+        "parameters": [{"$ref": "#/components/parameters/namespace"}, {"$ref": "#/components/parameters/job"}, {"$ref": "#/components/parameters/window"}],
+        "responses": {
+          "200": {"description": "EnergyReport", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/EnergyReport"}}}},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/namespaces/{namespace}/workloads/{kind}/{name}/energy": {
+      "get": {
+        "summary": "Energy used by the GPUs of a workload over its lifetime, or the last window if set, and its carbon emissions",
+        "parameters": [{"$ref": "#/components/parameters/namespace"}, {"$ref": "#/components/parameters/kind"}, {"$ref": "#/components/parameters/name"}, {"$ref": "#/components/parameters/window"}],
+        "responses": {
+          "200": {"description": "EnergyReport", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/EnergyReport"}}}},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/namespaces/{namespace}/jobs/{job}/right-sizing": {
+      "get": {
+        "summary": "Suggested GPU count of a training job, whether it fits a smaller or shared GPU and the expected savings",
+        "parameters": [{"$ref": "#/components/parameters/namespace"}, {"$ref": "#/components/parameters/job"}, {"$ref": "#/components/parameters/window"}],
+        "responses": {
+          "200": {"description": "RightSizing", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/RightSizing"}}}},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/namespaces/{namespace}/workloads/{kind}/{name}/right-sizing": {
+      "get": {
+        "summary": "Suggested GPU count of a workload, whether it fits a smaller or shared GPU and the expected savings",
+        "parameters": [{"$ref": "#/components/parameters/namespace"}, {"$ref": "#/components/parameters/kind"}, {"$ref": "#/components/parameters/name"}, {"$ref": "#/components/parameters/window"}],
+        "responses": {
+          "200": {"description": "RightSizing", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/RightSizing"}}}},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/namespaces/{namespace}/workloads/{kind}/{name}/stragglers": {
+      "get": {
+        "summary": "Workers and GPUs of a workload whose duty cycle deviates from their peers",
+        "parameters": [{"$ref": "#/components/parameters/namespace"}, {"$ref": "#/components/parameters/kind"}, {"$ref": "#/components/parameters/name"}, {"$ref": "#/components/parameters/window"}],
+        "responses": {
+          "200": {"description": "StragglerReport", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/StragglerReport"}}}},
+          "304": {"$ref": "#/components/responses/NotModified"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "parameters": {
+      "node": {"name": "node", "in": "path", "required": true, "schema": {"type": "string"}},
+      "namespace": {"name": "namespace", "in": "path", "required": true, "schema": {"type": "string"}},
+      "pod": {"name": "pod", "in": "path", "required": true, "schema": {"type": "string"}},
+      "job": {"name": "job", "in": "path", "required": true, "schema": {"type": "string"}},
+      "kind": {"name": "kind", "in": "path", "required": true, "description": "pod, deployment, replicaset, statefulset, daemonset, job, cronjob, tfjob, pytorchjob or mpijob", "schema": {"type": "string"}},
+      "name": {"name": "name", "in": "path", "required": true, "schema": {"type": "string"}},
+      "labelSelector": {"name": "labelSelector", "in": "query", "description": "Kubernetes label selector", "schema": {"type": "string"}},
+      "start": {"name": "start", "in": "query", "description": "Start of a range query, unix seconds or RFC3339. Instant query if not set.", "schema": {"type": "string"}},
+      "end": {"name": "end", "in": "query", "description": "End of a range query, unix seconds or RFC3339, defaults to now", "schema": {"type": "string"}},
+      "step": {"name": "step", "in": "query", "description": "Resolution of a range query, duration (30s) or seconds, defaults to 1m", "schema": {"type": "string"}},
+      "window": {"name": "window", "in": "query", "description": "Duration ending now which is analysed, such as 10m, defaults to 10m for stragglers and bottlenecks, 2h for hung jobs, 24h for the memory trend and 7d for right-sizing, which do not look back before the job started, and the lifetime of the job for energy", "schema": {"type": "string"}}
+    },
+    "responses": {
+      "NotModified": {"description": "The representation matches If-None-Match"},
+      "Error": {"description": "Error", "content": {"application/json": {"schema": {"type": "object", "properties": {"error": {"type": "string"}}}}}}
+    },
+    "schemas": {
+      "GpuUsage": {
+        "type": "object",
+        "properties": {
+          "index": {"type": "string"},
+          "dutyCycle": {"type": "number"},
+          "memoryUsedBytes": {"type": "number"},
+          "memoryTotalBytes": {"type": "number"}
+        }
+      },
+      "InstanceGpuUsage": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "namespace": {"type": "string"},
+          "status": {"type": "string"},
+          "node": {"type": "string"},
+          "gpus": {"type": "array", "items": {"$ref": "#/components/schemas/GpuUsage"}}
+        }
+      },
+      "InstanceGpuUsageList": {"type": "array", "items": {"$ref": "#/components/schemas/InstanceGpuUsage"}},
+      "NamespaceGpuUsage": {
+        "type": "object",
+        "properties": {
+          "namespace": {"type": "string"},
+          "pods": {"type": "integer"},
+          "gpus": {"type": "integer"},
+          "averageDutyCycle": {"type": "number"},
+          "memoryUsedBytes": {"type": "number"},
+          "memoryTotalBytes": {"type": "number"}
+        }
+      },
+      "NamespaceGpuUsageList": {"type": "array", "items": {"$ref": "#/components/schemas/NamespaceGpuUsage"}},
+      "ClusterGpuUsage": {
+        "type": "object",
+        "properties": {
+          "nodes": {"type": "integer"},
+          "gpus": {"type": "integer"},
+          "averageDutyCycle": {"type": "number"},
+          "memoryUsedBytes": {"type": "number"},
+          "memoryTotalBytes": {"type": "number"}
+        }
+      },
+      "GpuMetricSeries": {
+        "type": "object",
+        "properties": {
+          "metricName": {"type": "string"},
+          "pod": {"type": "string"},
+          "namespace": {"type": "string"},
+          "container": {"type": "string"},
+          "node": {"type": "string"},
+          "uuid": {"type": "string"},
+          "id": {"type": "string"},
+          "samples": {"type": "array", "items": {"type": "object", "properties": {"time": {"type": "number"}, "value": {"type": "number"}}}}
+        }
+      },
+      "GpuMetricSeriesList": {"type": "array", "items": {"$ref": "#/components/schemas/GpuMetricSeries"}},
+      "Outlier": {
+        "type": "object",
+        "properties": {
+          "role": {"type": "string"},
+          "pod": {"type": "string"},
+          "node": {"type": "string"},
+          "gpu": {"type": "string"},
+          "dutyCycle": {"type": "number"},
+          "median": {"type": "number"},
+          "score": {"type": "number"},
+          "direction": {"type": "string", "enum": ["low", "high"]}
+        }
+      },
+      "StragglerReport": {
+        "type": "object",
+        "properties": {
+          "window": {"type": "string"},
+          "workers": {"type": "array", "items": {"$ref": "#/components/schemas/Outlier"}},
+          "gpus": {"type": "array", "items": {"$ref": "#/components/schemas/Outlier"}}
+        }
+      },
+      "IdleGpu": {
+        "type": "object",
+        "properties": {
+          "pod": {"type": "string"},
+          "node": {"type": "string"},
+          "gpu": {"type": "string"},
+          "memoryUsedBytes": {"type": "number"},
+          "idleSince": {"type": "string", "format": "date-time"}
+        }
+      },
+      "HungReport": {
+        "type": "object",
+        "properties": {
+          "window": {"type": "string"},
+          "hung": {"type": "boolean"},
+          "reason": {"type": "string", "description": "Why the job is not hung"},
+          "idleSince": {"type": "string", "format": "date-time"},
+          "idleFor": {"type": "string"},
+          "gpus": {"type": "array", "items": {"$ref": "#/components/schemas/IdleGpu"}}
+        }
+      },
+      "MemoryTrend": {
+        "type": "object",
+        "properties": {
+          "pod": {"type": "string"},
+          "node": {"type": "string"},
+          "gpu": {"type": "string"},
+          "memoryUsedBytes": {"type": "number"},
+          "memoryTotalBytes": {"type": "number"},
+          "growthPerHourBytes": {"type": "number"},
+          "r2": {"type": "number"},
+          "monotonicGrowth": {"type": "boolean"},
+          "timeToExhaustion": {"type": "string"},
+          "exhaustionAt": {"type": "string", "format": "date-time"},
+          "oomRisk": {"type": "boolean"}
+        }
+      },
+      "MemoryTrendReport": {
+        "type": "object",
+        "properties": {
+          "window": {"type": "string"},
+          "gpus": {"type": "array", "items": {"$ref": "#/components/schemas/MemoryTrend"}}
+        }
+      },
+      "PodBottleneck": {
+        "type": "object",
+        "properties": {
+          "role": {"type": "string"},
+          "pod": {"type": "string"},
+          "node": {"type": "string"},
+          "bottleneck": {"type": "string", "enum": ["GPU-bound", "CPU/input-bound", "IO-bound", "network-bound", "unknown"]},
+          "evidence": {"type": "array", "items": {"type": "string"}},
+          "resources": {
+            "type": "object",
+            "description": "Mean usage over the window, rates per second, the metrics not reported by cAdvisor are omitted",
+            "properties": {
+              "dutyCycle": {"type": "number"},
+              "cpuUsage": {"type": "number"},
+              "cpuLimit": {"type": "number"},
+              "cpuThrottled": {"type": "number"},
+              "fsReadBytes": {"type": "number"},
+              "fsWriteBytes": {"type": "number"},
+              "fsIOBusy": {"type": "number"},
+              "networkReceiveBytes": {"type": "number"},
+              "networkTransmitBytes": {"type": "number"}
+            }
+          }
+        }
+      },
+      "BottleneckReport": {
+        "type": "object",
+        "properties": {
+          "window": {"type": "string"},
+          "pods": {"type": "array", "items": {"$ref": "#/components/schemas/PodBottleneck"}}
+        }
+      },
+      "RightSizing": {
+        "type": "object",
+        "properties": {
+          "window": {"type": "string"},
+          "requestedGPU": {"type": "integer"},
+          "allocatedGPU": {"type": "integer"},
+          "measuredGPU": {"type": "integer", "description": "GPUs with metrics"},
+          "meanDutyCycle": {"type": "number"},
+          "peakBusyGPU": {"type": "number", "description": "95th percentile of the sum of the duty cycles, in GPUs"},
+          "peakMemoryUsedBytes": {"type": "number"},
+          "memoryTotalBytes": {"type": "number"},
+          "suggestedGPU": {"type": "integer"},
+          "sharedGPUFraction": {"type": "number", "description": "Fraction of a shared GPU the workload fits in"},
+          "smallerGPUMemoryBytes": {"type": "number", "description": "Memory of a smaller GPU the workload fits in"},
+          "savedGPU": {"type": "number"},
+          "savedGPUHoursPerDay": {"type": "number"},
+          "savingsPercent": {"type": "number"},
+          "reasons": {"type": "array", "items": {"type": "string"}}
+        }
+      },
+      "PodEnergy": {
+        "type": "object",
+        "properties": {
+          "namespace": {"type": "string"},
+          "pod": {"type": "string"},
+          "job": {"type": "string"},
+          "node": {"type": "string"},
+          "gpus": {"type": "integer"},
+          "gpuHours": {"type": "number"},
+          "gpuEnergyKWh": {"type": "number"},
+          "energyKWh": {"type": "number", "description": "Energy of the GPUs by the PUE"},
+          "co2eKg": {"type": "number"}
+        }
+      },
+      "JobEnergy": {
+        "type": "object",
+        "properties": {
+          "namespace": {"type": "string"},
+          "job": {"type": "string"},
+          "pods": {"type": "integer"},
+          "gpuHours": {"type": "number"},
+          "gpuEnergyKWh": {"type": "number"},
+          "energyKWh": {"type": "number", "description": "Energy of the GPUs by the PUE"},
+          "co2eKg": {"type": "number"}
+        }
+      },
+      "NamespaceEnergy": {
+        "type": "object",
+        "properties": {
+          "namespace": {"type": "string"},
+          "jobs": {"type": "integer"},
+          "pods": {"type": "integer"},
+          "gpuHours": {"type": "number"},
+          "gpuEnergyKWh": {"type": "number"},
+          "energyKWh": {"type": "number", "description": "Energy of the GPUs by the PUE"},
+          "co2eKg": {"type": "number"}
+        }
+      },
+      "EnergyReport": {
+        "type": "object",
+        "properties": {
+          "start": {"type": "string", "format": "date-time"},
+          "end": {"type": "string", "format": "date-time"},
+          "pue": {"type": "number"},
+          "carbonIntensity": {"type": "number", "description": "gCO2e/kWh"},
+          "available": {"type": "boolean", "description": "Whether the exporter reports the power draw of the GPUs"},
+          "pods": {"type": "array", "items": {"$ref": "#/components/schemas/PodEnergy"}},
+          "jobs": {"type": "array", "items": {"$ref": "#/components/schemas/JobEnergy"}},
+          "namespaces": {"type": "array", "items": {"$ref": "#/components/schemas/NamespaceEnergy"}},
+          "total": {
+            "type": "object",
+            "properties": {
+              "gpuHours": {"type": "number"},
+              "gpuEnergyKWh": {"type": "number"},
+              "energyKWh": {"type": "number", "description": "Energy of the GPUs by the PUE"},
+              "co2eKg": {"type": "number"}
+            }
+          }
+        }
+      }
+    }
+  }
+}
+`
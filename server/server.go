@@ -0,0 +1,495 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xieydd/gpu-metric/analysis"
+	"github.com/xieydd/gpu-metric/base"
+	"github.com/xieydd/gpu-metric/utils"
+	"github.com/xieydd/gpu-metric/workload"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+)
+
+const API_PREFIX = "api/v1"
+const DEFAULT_RANGE_STEP = time.Minute
+
+// Prometheus rejects range queries with more than 11000 points per series
+const MAX_RANGE_POINTS = 11000
+
+// Options of the REST API server
+type Options struct {
+	Address  string
+	CacheTTL time.Duration
+}
+
+// Server exposes the GPU metrics of the cluster, nodes, namespaces, pods and jobs as JSON
+type Server struct {
+	client  kubernetes.Interface
+	options Options
+	cache   *Cache
+}
+
+// NotFoundError is returned by the loaders when the requested object does not exist
+type NotFoundError struct {
+	Kind string
+	Name string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s %s not found", e.Kind, e.Name)
+}
+
+// BadRequestError is returned for invalid request parameters
+type BadRequestError struct {
+	Message string
+}
+
+func (e *BadRequestError) Error() string {
+	return e.Message
+}
+
+// timeRange holds the parameters of a range query
+type timeRange struct {
+	Start time.Time
+	End   time.Time
+	Step  time.Duration
+}
+
+func NewServer(client kubernetes.Interface, options Options) *Server {
+	return &Server{
+		client:  client,
+		options: options,
+		cache:   NewCache(options.CacheTTL),
+	}
+}
+
+// Run serves the API until the listener fails
+func (s *Server) Run() error {
+	go func() {
+		for range time.Tick(time.Minute) {
+			s.cache.Purge()
+		}
+	}()
+	log.Infof("serving GPU metrics API on %s", s.options.Address)
+	return http.ListenAndServe(s.options.Address, s)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "healthz":
+		w.Write([]byte("ok"))
+	case path == "openapi.json":
+		s.serveCached(w, r, path, func() (interface{}, error) {
+			return json.RawMessage(OPENAPI_SPEC), nil
+		})
+	case path == API_PREFIX || strings.HasPrefix(path, API_PREFIX+"/"):
+		parts := strings.Split(strings.TrimPrefix(strings.TrimPrefix(path, API_PREFIX), "/"), "/")
+		load, err := s.route(parts, r)
+		if err != nil {
+			writeError(w, statusOf(err), err)
+			return
+		}
+		s.serveCached(w, r, r.URL.Path+"?"+r.URL.Query().Encode(), load)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("path /%s not found", path))
+	}
+}
+
+// serveCached writes the cached JSON of load, replying 304 if the request's If-None-Match matches
+func (s *Server) serveCached(w http.ResponseWriter, r *http.Request, key string, load func() (interface{}, error)) {
+	body, etag, err := s.cache.Get(key, func() ([]byte, error) {
+		obj, err := load()
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(obj)
+	})
+	if err != nil {
+		log.Debugf("failed to load %s: %v", key, err)
+		writeError(w, statusOf(err), err)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(s.options.CacheTTL.Seconds())))
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(body)
+}
+
+// route returns the loader of the resource identified by parts, the path after /api/v1
+func (s *Server) route(parts []string, r *http.Request) (func() (interface{}, error), error) {
+	query := r.URL.Query()
+	selector := query.Get("labelSelector")
+	tr, err := parseTimeRange(query.Get("start"), query.Get("end"), query.Get("step"), time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case len(parts) == 1 && parts[0] == "cluster":
+		if tr != nil {
+			return func() (interface{}, error) { return s.clusterRange(tr) }, nil
+		}
+		return func() (interface{}, error) { return utils.GetClusterGpuUsage(s.client) }, nil
+	case len(parts) == 1 && parts[0] == "nodes":
+		return s.nodes(selector, nil, tr), nil
+	case len(parts) == 2 && parts[0] == "nodes":
+		return s.nodes("", []string{parts[1]}, tr), nil
+	case len(parts) == 1 && parts[0] == "namespaces":
+		return s.namespaces(selector, nil, tr), nil
+	case len(parts) == 2 && parts[0] == "namespaces":
+		return s.namespaces("", []string{parts[1]}, tr), nil
+	case len(parts) == 3 && parts[0] == "namespaces" && parts[2] == "pods":
+		return s.pods(parts[1], selector, nil, tr), nil
+	case len(parts) == 4 && parts[0] == "namespaces" && parts[2] == "pods":
+		return s.pods(parts[1], "", []string{parts[3]}, tr), nil
+	case len(parts) == 5 && parts[0] == "namespaces" && parts[2] == "workloads":
+		kind, err := workload.NormalizeKind(parts[3])
+		if err != nil {
+			return nil, &BadRequestError{Message: err.Error()}
+		}
+		return s.workload(parts[1], kind, parts[4], tr), nil
+	case len(parts) == 6 && parts[0] == "namespaces" && parts[2] == "workloads":
+		kind, err := workload.NormalizeKind(parts[3])
+		if err != nil {
+			return nil, &BadRequestError{Message: err.Error()}
+		}
+		resolve := func() (workload.Workload, error) {
+			return workload.NewResolver(s.client).ByOwner(parts[1], kind, parts[4])
+		}
+		return s.analysis(parts[5], kind, parts[1]+"/"+parts[4], resolve, query)
+	case len(parts) == 4 && parts[0] == "namespaces" && parts[2] == "jobs":
+		jobSelector := fmt.Sprintf("%s=%s", utils.JOB_RELEASE_LABEL, parts[3])
+		return s.job(parts[1], parts[3], jobSelector, tr), nil
+	case len(parts) == 5 && parts[0] == "namespaces" && parts[2] == "jobs":
+		jobSelector := fmt.Sprintf("%s=%s", utils.JOB_RELEASE_LABEL, parts[3])
+		resolve := func() (workload.Workload, error) {
+			return workload.NewResolver(s.client).BySelector(parts[1], jobSelector)
+		}
+		return s.analysis(parts[4], "job", parts[1]+"/"+parts[3], resolve, query)
+	}
+	return nil, &NotFoundError{Kind: "path", Name: "/" + API_PREFIX + "/" + strings.Join(parts, "/")}
+}
+
+func (s *Server) clusterRange(tr *timeRange) (interface{}, error) {
+	prometheusServiceName, err := utils.RequirePrometheusServiceName(s.client)
+	if err != nil {
+		return nil, err
+	}
+	return utils.GetClusterGpuRange(s.client, prometheusServiceName, tr.Start, tr.End, tr.Step)
+}
+
+func (s *Server) nodes(selector string, names []string, tr *timeRange) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		nodes, err := utils.ListGpuNodes(s.client, selector, names)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) > 0 && len(nodes) == 0 {
+			return nil, &NotFoundError{Kind: "GPU node", Name: names[0]}
+		}
+		if tr == nil {
+			usages, err := utils.GetNodesGpuUsage(s.client, selector, names)
+			if err != nil || len(names) == 0 {
+				return usages, err
+			}
+			if len(usages) == 0 {
+				return nil, &NotFoundError{Kind: "GPU node", Name: names[0]}
+			}
+			return usages[0], nil
+		}
+		nodeNames := []string{}
+		for _, node := range nodes {
+			nodeNames = append(nodeNames, node.Name)
+		}
+		return s.rangeOf(nodeNames, tr, utils.GetNodesGpuRange)
+	}
+}
+
+func (s *Server) namespaces(selector string, names []string, tr *timeRange) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		usages, err := utils.GetNamespacesGpuUsage(s.client, selector, names)
+		if err != nil {
+			return nil, err
+		}
+		if tr == nil {
+			if len(names) == 0 {
+				return usages, nil
+			}
+			if len(usages) == 0 {
+				return utils.NamespaceGpuUsage{Namespace: names[0]}, nil
+			}
+			return usages[0], nil
+		}
+		if selector != "" {
+			// the series of the selected pods only, not of their whole namespaces
+			pods, err := utils.ListRunningGpuPods(s.client, selector, names)
+			if err != nil {
+				return nil, err
+			}
+			return s.podsRange(pods, tr)
+		}
+		namespaces := []string{}
+		for _, usage := range usages {
+			namespaces = append(namespaces, usage.Namespace)
+		}
+		return s.rangeOf(namespaces, tr, utils.GetNamespacesGpuRange)
+	}
+}
+
+func (s *Server) pods(namespace string, selector string, names []string, tr *timeRange) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		if tr != nil {
+			pods, err := utils.ListPods(s.client, namespace, selector, names)
+			if err != nil {
+				return nil, err
+			}
+			if len(names) > 0 && len(pods) == 0 {
+				return nil, &NotFoundError{Kind: "pod", Name: namespace + "/" + names[0]}
+			}
+			return s.podsRange(utils.RunningPods(pods), tr)
+		}
+		usages, err := utils.GetPodsGpuUsage(s.client, namespace, selector, names)
+		if err != nil || len(names) == 0 {
+			return usages, err
+		}
+		if len(usages) == 0 {
+			return nil, &NotFoundError{Kind: "pod", Name: namespace + "/" + names[0]}
+		}
+		return usages[0], nil
+	}
+}
+
+func (s *Server) job(namespace string, name string, selector string, tr *timeRange) func() (interface{}, error) {
+	pods := s.pods(namespace, selector, nil, tr)
+	return func() (interface{}, error) {
+		obj, err := pods()
+		if err != nil {
+			return nil, err
+		}
+		if usages, ok := obj.([]utils.InstanceGpuUsage); ok && len(usages) == 0 {
+			return nil, &NotFoundError{Kind: "job", Name: namespace + "/" + name}
+		}
+		return obj, nil
+	}
+}
+
+func (s *Server) workload(namespace string, kind string, name string, tr *timeRange) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		w, err := workload.NewResolver(s.client).ByOwner(namespace, kind, name)
+		if _, ok := err.(*workload.NoPodsError); ok || errors.IsNotFound(err) {
+			return nil, &NotFoundError{Kind: kind, Name: namespace + "/" + name}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if tr != nil {
+			return s.podsRange(utils.RunningPods(w.AllPods()), tr)
+		}
+		return utils.GetWorkloadGpuUsage(s.client, w)
+	}
+}
+
+// analysisLoader runs an analysis of a workload over the window ending now, the default window of the analysis if zero
+type analysisLoader func(client kubernetes.Interface, w workload.Workload, window time.Duration) (interface{}, error)
+
+// analyses are served under the path of a job or workload, such as /namespaces/default/jobs/mnist/stragglers
+var analyses = map[string]analysisLoader{
+	"stragglers": func(client kubernetes.Interface, w workload.Workload, window time.Duration) (interface{}, error) {
+		o := analysis.DefaultStragglerOptions()
+		if window > 0 {
+			o.Window = window
+		}
+		return analysis.GetWorkloadStragglers(client, w, o)
+	},
+	"hung": func(client kubernetes.Interface, w workload.Workload, window time.Duration) (interface{}, error) {
+		o := analysis.DefaultHungOptions()
+		if window > 0 {
+			o.Window = window
+		}
+		return analysis.GetWorkloadHung(client, w, o)
+	},
+	"memory-trend": func(client kubernetes.Interface, w workload.Workload, window time.Duration) (interface{}, error) {
+		o := analysis.DefaultMemoryTrendOptions()
+		if window > 0 {
+			o.Window = window
+		}
+		return analysis.GetWorkloadMemoryTrends(client, w, o)
+	},
+	"bottlenecks": func(client kubernetes.Interface, w workload.Workload, window time.Duration) (interface{}, error) {
+		o := analysis.DefaultBottleneckOptions()
+		if window > 0 {
+			o.Window = window
+		}
+		return analysis.GetWorkloadBottlenecks(client, w, o)
+	},
+	"right-sizing": func(client kubernetes.Interface, w workload.Workload, window time.Duration) (interface{}, error) {
+		o := analysis.DefaultRightSizingOptions()
+		if window > 0 {
+			o.Window = window
+		}
+		return analysis.GetWorkloadRightSizing(client, w, o)
+	},
+	"energy": func(client kubernetes.Interface, w workload.Workload, window time.Duration) (interface{}, error) {
+		if window > 0 {
+			end := time.Now()
+			return analysis.GetWorkloadEnergyBetween(client, w, end.Add(-window), end, analysis.DefaultEnergyOptions())
+		}
+		return analysis.GetWorkloadEnergy(client, w, analysis.DefaultEnergyOptions())
+	},
+}
+
+// analysis returns the loader of the analysis name of the workload resolved by resolve
+func (s *Server) analysis(name string, kind string, workloadName string, resolve func() (workload.Workload, error), query url.Values) (func() (interface{}, error), error) {
+	load, ok := analyses[name]
+	if !ok {
+		return nil, &NotFoundError{Kind: "analysis", Name: name}
+	}
+	var window time.Duration
+	if value := query.Get("window"); value != "" {
+		d, err := parseStep(value)
+		if err != nil || d <= 0 {
+			return nil, &BadRequestError{Message: fmt.Sprintf("invalid window %q", value)}
+		}
+		window = d
+	}
+	return func() (interface{}, error) {
+		w, err := resolve()
+		if _, ok := err.(*workload.NoPodsError); ok || errors.IsNotFound(err) {
+			return nil, &NotFoundError{Kind: kind, Name: workloadName}
+		}
+		if err != nil {
+			return nil, err
+		}
+		return load(s.client, w, window)
+	}, nil
+}
+
+type rangeQuery func(client kubernetes.Interface, prometheusServiceName string, names []string, start time.Time, end time.Time, step time.Duration) ([]utils.GpuMetricSeries, error)
+
+func (s *Server) rangeOf(names []string, tr *timeRange, query rangeQuery) (interface{}, error) {
+	if len(names) == 0 {
+		return []utils.GpuMetricSeries{}, nil
+	}
+	prometheusServiceName, err := utils.RequirePrometheusServiceName(s.client)
+	if err != nil {
+		return nil, err
+	}
+	return query(s.client, prometheusServiceName, names, tr.Start, tr.End, tr.Step)
+}
+
+// podsRange returns the metric series of pods between the start and end of tr
+func (s *Server) podsRange(pods []v1.Pod, tr *timeRange) (interface{}, error) {
+	if len(pods) == 0 {
+		return []utils.GpuMetricSeries{}, nil
+	}
+	prometheusServiceName, err := utils.RequirePrometheusServiceName(s.client)
+	if err != nil {
+		return nil, err
+	}
+	return utils.GetNamespacedPodsGpuRange(s.client, prometheusServiceName, pods, tr.Start, tr.End, tr.Step)
+}
+
+// parseTimeRange returns nil if start is not set, which means an instant query
+func parseTimeRange(start string, end string, step string, now time.Time) (*timeRange, error) {
+	if start == "" {
+		if end != "" || step != "" {
+			return nil, &BadRequestError{Message: "end and step require start"}
+		}
+		return nil, nil
+	}
+	tr := &timeRange{End: now, Step: DEFAULT_RANGE_STEP}
+	var err error
+	if tr.Start, err = parseTime(start); err != nil {
+		return nil, &BadRequestError{Message: fmt.Sprintf("invalid start %q: %v", start, err)}
+	}
+	if end != "" {
+		if tr.End, err = parseTime(end); err != nil {
+			return nil, &BadRequestError{Message: fmt.Sprintf("invalid end %q: %v", end, err)}
+		}
+	}
+	if step != "" {
+		if tr.Step, err = parseStep(step); err != nil {
+			return nil, &BadRequestError{Message: fmt.Sprintf("invalid step %q: %v", step, err)}
+		}
+	}
+	if !tr.End.After(tr.Start) {
+		return nil, &BadRequestError{Message: "end must be after start"}
+	}
+	if tr.Step <= 0 {
+		return nil, &BadRequestError{Message: "step must be positive"}
+	}
+	if tr.End.Sub(tr.Start)/tr.Step > MAX_RANGE_POINTS {
+		return nil, &BadRequestError{Message: fmt.Sprintf("range exceeds %d points, increase step", MAX_RANGE_POINTS)}
+	}
+	return tr, nil
+}
+
+// parseTime accepts unix seconds or RFC3339
+func parseTime(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(0, int64(seconds*float64(time.Second))), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// parseStep accepts a duration such as 30s or a number of seconds
+func parseStep(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	return time.ParseDuration(value)
+}
+
+// etagMatches implements the If-None-Match comparison
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func statusOf(err error) int {
+	switch err.(type) {
+	case *NotFoundError:
+		return http.StatusNotFound
+	case *BadRequestError:
+		return http.StatusBadRequest
+	case *base.PermissionError:
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseTimeRange(t *testing.T) {
+	now := time.Unix(10000, 0)
+	tr, err := parseTimeRange("", "", "", now)
+	if tr != nil || err != nil {
+		t.Errorf("instant query should not return a range, got %v %v", tr, err)
+	}
+	tr, err = parseTimeRange("6400", "", "30s", now)
+	if err != nil {
+		t.Fatalf("failed to parseTimeRange, %++v", err)
+	}
+	if !tr.End.Equal(now) || tr.Start.Unix() != 6400 || tr.Step != 30*time.Second {
+		t.Errorf("unexpected range %++v", tr)
+	}
+	tr, err = parseTimeRange("1970-01-01T01:00:00Z", "1970-01-01T02:00:00Z", "60", now)
+	if err != nil || tr.Start.Unix() != 3600 || tr.End.Unix() != 7200 || tr.Step != time.Minute {
+		t.Errorf("unexpected range %++v, %v", tr, err)
+	}
+	for _, c := range [][]string{
+		{"", "100", ""},
+		{"9000", "8000", ""},
+		{"0", "", "0"},
+		{"0", "", "500ms"},
+		{"yesterday", "", ""},
+	} {
+		if _, err := parseTimeRange(c[0], c[1], c[2], now); err == nil {
+			t.Errorf("range %v should be rejected", c)
+		} else if _, ok := err.(*BadRequestError); !ok {
+			t.Errorf("range %v should return BadRequestError, got %T", c, err)
+		}
+	}
+}
+
+func TestConditionalRequest(t *testing.T) {
+	s := NewServer(nil, Options{CacheTTL: time.Minute})
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" {
+		t.Fatalf("openapi.json should be served with an ETag, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/openapi.json", nil)
+	req.Header.Set("If-None-Match", `"other", `+etag)
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("matching If-None-Match should return 304, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/openapi.json", nil)
+	req.Header.Set("If-None-Match", `"other"`)
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("mismatched If-None-Match should return 200, got %d", rec.Code)
+	}
+}
+
+func TestRouteErrors(t *testing.T) {
+	s := NewServer(nil, Options{CacheTTL: time.Minute})
+	for path, code := range map[string]int{
+		"/api/v1/unknown":                                                        http.StatusNotFound,
+		"/api/v1/namespaces/default/secrets":                                     http.StatusNotFound,
+		"/api/v1/cluster?start=yesterday":                                        http.StatusBadRequest,
+		"/metrics":                                                               http.StatusNotFound,
+		"/api/v1/namespaces/default/jobs/mnist/unknown":                          http.StatusNotFound,
+		"/api/v1/namespaces/default/jobs/mnist/stragglers?window=soon":           http.StatusBadRequest,
+		"/api/v1/namespaces/default/workloads/tfjob/mnist/stragglers?window=-1m": http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != code {
+			t.Errorf("%s should return %d, got %d", path, code, rec.Code)
+		}
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/cluster", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST should not be allowed, got %d", rec.Code)
+	}
+}
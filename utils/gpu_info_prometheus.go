@@ -2,23 +2,31 @@ package utils
 
 import (
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	"encoding/json"
 	"fmt"
+	"math"
 	log "github.com/sirupsen/logrus"
 	v12 "k8s.io/api/core/v1"
 	"strconv"
 	"time"
 	"strings"
 	"sort"
+	"regexp"
 	"github.com/unisound-ail/atlasctl/cmd"
+	"github.com/xieydd/gpu-metric/base"
+	"github.com/xieydd/gpu-metric/workload"
 )
 
 const PROMETHEUS_INSTALL_DOC_URL = "https://github.com/xieydd/gpu-metric/blob/master/REAMME.md"
 const KUBE_SYSTEM_NAMESPACE = "kube-system"
 const PROMETHEUS_SCHEME = "http"
 const PROMETHEUS_SVC_LABEL = "kubernetes.io/name=Prometheus"
-const POD_METRIC_TMP = `{__name__=~"%s", pod_name=~"%s"}`
+const CLUSTER_METRIC_TMP = `{__name__=~"%s"}`
+const POD_METRIC_TMP = `{__name__=~"%s", pod_name=~%q}`
+const NODE_METRIC_TMP = `{__name__=~"%s", node_name=~%q}`
+const NAMESPACE_METRIC_TMP = `{__name__=~"%s", namespace_name=~%q}`
+// NAMESPACED_POD_METRIC_TMP takes the metric names, then the quoted regexps of the namespaces and of the pod names
+const NAMESPACED_POD_METRIC_TMP = `{__name__=~"%s", namespace_name=~%q, pod_name=~%q}`
 var GPU_METRIC_LIST = []string{"nvidia_gpu_duty_cycle", "nvidia_gpu_memory_used_bytes", "nvidia_gpu_memory_total_bytes" }
 
 type PrometheusMetric struct {
@@ -38,6 +46,21 @@ type PrometheusMetricResult struct {
 
 type PrometheusMetricValue interface{}
 
+type PrometheusRangeMetric struct {
+	Status string `json:"status,inline"`
+	Data PrometheusRangeMetricData `json:"data,omitempty"`
+}
+
+type PrometheusRangeMetricData struct {
+	Result []PrometheusRangeMetricResult `json:"result"`
+	ResultType string `json:"resultType"`
+}
+
+type PrometheusRangeMetricResult struct {
+	Metric map[string]string `json:"metric"`
+	Values [][]PrometheusMetricValue `json:"values"`
+}
+
 type GpuMetricInfo struct {
 	MetricName string
 	Value string
@@ -50,10 +73,33 @@ type GpuMetricInfo struct {
 	Id string
 }
 
+// GpuMetricSeries is the values of one GPU metric over a time range
+type GpuMetricSeries struct {
+	MetricName string `json:"metricName"`
+	PodName string `json:"pod,omitempty"`
+	PodNamespace string `json:"namespace,omitempty"`
+	ContainerName string `json:"container,omitempty"`
+	NodeName string `json:"node,omitempty"`
+	GPUUID string `json:"uuid,omitempty"`
+	Id string `json:"id"`
+	Samples []GpuMetricSample `json:"samples"`
+}
+
+type GpuMetricSample struct {
+	Time float64 `json:"time"`
+	Value float64 `json:"value"`
+}
+
 type JobGpuMetric map[string]PodGpuMetric
 
 type PodGpuMetric map[string]*GpuMetric
 
+// NodeGpuMetric maps node name to the metrics of the GPUs on the node
+type NodeGpuMetric map[string]PodGpuMetric
+
+// NamespaceGpuMetric maps namespace to the GPU metrics of its pods
+type NamespaceGpuMetric map[string]JobGpuMetric
+
 type GpuMetric struct {
 	GpuDutyCycle float64
 	GpuMemoryUsed float64
@@ -61,20 +107,40 @@ type GpuMetric struct {
 }
 
 func (m *JobGpuMetric) SetPodMetric(metric GpuMetricInfo)  {
-	v, err := strconv.ParseFloat(metric.Value, 64)
-	if err != nil {
-		return
-	}
 	metricMap := *m
 	if _, ok := metricMap[metric.PodName]; !ok {
 		metricMap[metric.PodName] = PodGpuMetric{}
 	}
+	metricMap[metric.PodName].SetGpuMetric(metric)
+}
 
-	podMetric := metricMap[metric.PodName]
-	if _, ok := podMetric[metric.Id]; !ok{
-		podMetric[metric.Id] = &GpuMetric{}
+func (m *NodeGpuMetric) SetNodeMetric(metric GpuMetricInfo) {
+	metricMap := *m
+	if _, ok := metricMap[metric.NodeName]; !ok {
+		metricMap[metric.NodeName] = PodGpuMetric{}
 	}
-	podGPUMetric := podMetric[metric.Id]
+	metricMap[metric.NodeName].SetGpuMetric(metric)
+}
+
+func (m *NamespaceGpuMetric) SetNamespaceMetric(metric GpuMetricInfo) {
+	metricMap := *m
+	if _, ok := metricMap[metric.PodNamespace]; !ok {
+		metricMap[metric.PodNamespace] = JobGpuMetric{}
+	}
+	jobMetric := metricMap[metric.PodNamespace]
+	jobMetric.SetPodMetric(metric)
+}
+
+// SetGpuMetric set the metric value to the GPU identified by metric.Id
+func (m PodGpuMetric) SetGpuMetric(metric GpuMetricInfo) {
+	v, err := strconv.ParseFloat(metric.Value, 64)
+	if err != nil {
+		return
+	}
+	if _, ok := m[metric.Id]; !ok {
+		m[metric.Id] = &GpuMetric{}
+	}
+	podGPUMetric := m[metric.Id]
 	switch metric.MetricName {
 	case "nvidia_gpu_duty_cycle":
 		podGPUMetric.GpuDutyCycle = v
@@ -93,7 +159,7 @@ func (m JobGpuMetric) GetPodMetrics(podName string) PodGpuMetric {
 	return nil
 }
 
-func GpuMonitoringInstalled(client *kubernetes.Clientset) bool {
+func GpuMonitoringInstalled(client kubernetes.Interface) bool {
 	prometheusServiceName := GetPrometheusServiceName(client)
 	if (prometheusServiceName == "") {
 		return false
@@ -102,30 +168,48 @@ func GpuMonitoringInstalled(client *kubernetes.Clientset) bool {
 	return len(gpuDeviceMetrics) > 0
 }
 
-func GetJobGpuMetric(client *kubernetes.Clientset, job cmd.TrainingJob) (jobMetric JobGpuMetric, err error) {
-	runningPods := []string{}
-	jobStatus := job.GetStatus()
-	if jobStatus == "RUNNING" {
-		pods := job.AllPods()
+func GetJobGpuMetric(client kubernetes.Interface, job cmd.TrainingJob) (jobMetric JobGpuMetric, err error) {
+	return GetWorkloadGpuMetric(client, workload.FromTrainingJob(job))
+}
+
+// GetWorkloadGpuMetric returns the GPU metrics of the scheduled pods of a running workload, they are
+// empty if no pod is running or the pods have no metrics. Failing to find or query prometheus, such as
+// a PermissionError, is returned.
+func GetWorkloadGpuMetric(client kubernetes.Interface, w workload.Workload) (jobMetric JobGpuMetric, err error) {
+	runningPods := []v12.Pod{}
+	jobStatus := w.GetStatus()
+	if jobStatus == workload.STATUS_RUNNING {
+		pods := w.AllPods()
 		for _, pod := range pods {
 			if pod.Status.Phase == v12.PodPending {
 				continue
 			}
-			runningPods = append(runningPods, pod.Name)
+			runningPods = append(runningPods, pod)
 		}
 	}
-	prometheusServiceName := GetPrometheusServiceName(client)
-	if (prometheusServiceName == "") {
-		return
+	if len(runningPods) == 0 {
+		return JobGpuMetric{}, nil
 	}
-	podsMetrics, err := GetPodsGpuInfo(client, prometheusServiceName, runningPods)
-	return podsMetrics, nil
+	prometheusServiceName, err := RequirePrometheusServiceName(client)
+	if err != nil {
+		return nil, err
+	}
+	namespaceMetric, err := GetNamespacedPodsGpuInfo(client, prometheusServiceName, runningPods)
+	if err != nil {
+		return nil, err
+	}
+	if namespaceMetric[w.Namespace()] == nil {
+		return JobGpuMetric{}, nil
+	}
+	return namespaceMetric[w.Namespace()], nil
 }
 
-func GetPodsGpuInfo(client *kubernetes.Clientset, prometheusServiceName string, podNames []string) (JobGpuMetric, error) {
+// GetPodsGpuInfo returns the GPU metrics of the pods named podNames in any namespace, use
+// GetNamespacedPodsGpuInfo to tell apart the pods with the same name
+func GetPodsGpuInfo(client kubernetes.Interface, prometheusServiceName string, podNames []string) (JobGpuMetric, error) {
 	jobMetric := &JobGpuMetric{}
 
-	gpuMetrics, err := QueryMetricByPrometheus(client, prometheusServiceName, fmt.Sprintf(POD_METRIC_TMP, strings.Join(GPU_METRIC_LIST, "|"), strings.Join(podNames, "|")))
+	gpuMetrics, err := QueryMetricByPrometheus(client, prometheusServiceName, fmt.Sprintf(POD_METRIC_TMP, strings.Join(GPU_METRIC_LIST, "|"), MatchAny(podNames)))
 	if err != nil {
 		return nil, err
 	}
@@ -135,17 +219,117 @@ func GetPodsGpuInfo(client *kubernetes.Clientset, prometheusServiceName string,
 	return *jobMetric, nil
 }
 
-func QueryMetricByPrometheus(client *kubernetes.Clientset, prometheusServiceName string, query string) ([]GpuMetricInfo, error) {
+// GetNamespacedPodsGpuInfo returns the GPU metrics of pods by namespace and pod name, so that the pods with
+// the same name in other namespaces are not mixed with them
+func GetNamespacedPodsGpuInfo(client kubernetes.Interface, prometheusServiceName string, pods []v12.Pod) (NamespaceGpuMetric, error) {
+	namespaceMetric := &NamespaceGpuMetric{}
+	if len(pods) == 0 {
+		return *namespaceMetric, nil
+	}
+	gpuMetrics, err := QueryMetricByPrometheus(client, prometheusServiceName, namespacedPodsQuery(pods))
+	if _, ok := err.(*NoMetricError); ok {
+		// the pods have no GPU metrics yet
+		return *namespaceMetric, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys := podKeys(pods)
+	for _, metric := range gpuMetrics {
+		if keys[metric.PodNamespace+"/"+metric.PodName] {
+			namespaceMetric.SetNamespaceMetric(metric)
+		}
+	}
+	return *namespaceMetric, nil
+}
+
+// namespacedPodsQuery returns the query of the GPU metrics of pods, when they are in several namespaces it
+// may also match a pod with the name of one of them in another one
+func namespacedPodsQuery(pods []v12.Pod) string {
+	namespaces, names := []string{}, []string{}
+	for _, pod := range pods {
+		namespaces = append(namespaces, pod.Namespace)
+		names = append(names, pod.Name)
+	}
+	return fmt.Sprintf(NAMESPACED_POD_METRIC_TMP, strings.Join(GPU_METRIC_LIST, "|"), MatchAny(namespaces), MatchAny(names))
+}
+
+// podKeys returns the namespace/name of pods
+func podKeys(pods []v12.Pod) map[string]bool {
+	keys := map[string]bool{}
+	for _, pod := range pods {
+		keys[pod.Namespace+"/"+pod.Name] = true
+	}
+	return keys
+}
+
+// MatchAny returns the regexp matching exactly one of values
+func MatchAny(values []string) string {
+	seen := map[string]bool{}
+	quoted := []string{}
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			quoted = append(quoted, regexp.QuoteMeta(value))
+		}
+	}
+	return strings.Join(quoted, "|")
+}
+
+func GetNodesGpuInfo(client kubernetes.Interface, prometheusServiceName string, nodeNames []string) (NodeGpuMetric, error) {
+	nodeMetric := &NodeGpuMetric{}
+
+	gpuMetrics, err := QueryMetricByPrometheus(client, prometheusServiceName, fmt.Sprintf(NODE_METRIC_TMP, strings.Join(GPU_METRIC_LIST, "|"), MatchAny(nodeNames)))
+	if err != nil {
+		return nil, err
+	}
+	for _, metric := range gpuMetrics {
+		nodeMetric.SetNodeMetric(metric)
+	}
+	return *nodeMetric, nil
+}
+
+func GetNamespacesGpuInfo(client kubernetes.Interface, prometheusServiceName string, namespaces []string) (NamespaceGpuMetric, error) {
+	namespaceMetric := &NamespaceGpuMetric{}
+
+	gpuMetrics, err := QueryMetricByPrometheus(client, prometheusServiceName, fmt.Sprintf(NAMESPACE_METRIC_TMP, strings.Join(GPU_METRIC_LIST, "|"), MatchAny(namespaces)))
+	if err != nil {
+		return nil, err
+	}
+	for _, metric := range gpuMetrics {
+		// skip the node level series which are not bound to a pod
+		if metric.PodName == "" {
+			continue
+		}
+		namespaceMetric.SetNamespaceMetric(metric)
+	}
+	return *namespaceMetric, nil
+}
+
+// NoMetricError is returned by QueryMetricByPrometheus if the query has no result
+type NoMetricError struct {
+	Query string
+}
+
+func (e *NoMetricError) Error() string {
+	return fmt.Sprintf("gpu metric is not exist in prometheus for query  %s", e.Query)
+}
+
+func QueryMetricByPrometheus(client kubernetes.Interface, prometheusServiceName string, query string) ([]GpuMetricInfo, error) {
 	var gpuMetric []GpuMetricInfo
 
-	svcClient := client.CoreV1()
-	req :=  svcClient.Services(KUBE_SYSTEM_NAMESPACE).ProxyGet(PROMETHEUS_SCHEME, prometheusServiceName, "9090", "api/v1/query", map[string]string{
+	metric, err := prometheusGet(client, prometheusServiceName, "api/v1/query", map[string]string{
 		"query": query,
 		"time": strconv.FormatInt(time.Now().Unix(), 10),
 	})
-	metric, _ := req.DoRaw()
+	if base.IsPermissionError(err) {
+		return gpuMetric, err
+	}
+	if err != nil {
+		return gpuMetric, fmt.Errorf("failed to query prometheus: %v", err)
+	}
 	var metricResponse *PrometheusMetric
-	err := json.Unmarshal(metric, &metricResponse)
+	err = json.Unmarshal(metric, &metricResponse)
 	if err != nil {
 		log.Errorf("failed to unmarshall heapster response: %v", err)
 		return gpuMetric, fmt.Errorf("failed to unmarshall heapster response: %v", err)
@@ -156,7 +340,7 @@ func QueryMetricByPrometheus(client *kubernetes.Clientset, prometheusServiceName
 	}
 	if len(metricResponse.Data.Result) == 0 {
 		log.Errorf("gpu metric is not exist in prometheus for query  %s", query)
-		return gpuMetric, fmt.Errorf("gpu metric is not exist in prometheusfor query  %s", query)
+		return gpuMetric, &NoMetricError{Query: query}
 	}
 	for _, m := range metricResponse.Data.Result {
 		gpuMetric = append(gpuMetric, GpuMetricInfo{
@@ -174,6 +358,110 @@ func QueryMetricByPrometheus(client *kubernetes.Clientset, prometheusServiceName
 	return gpuMetric, nil
 }
 
+// QueryRangeMetricByPrometheus queries the values of query from start to end by step
+func QueryRangeMetricByPrometheus(client kubernetes.Interface, prometheusServiceName string, query string, start time.Time, end time.Time, step time.Duration) ([]GpuMetricSeries, error) {
+	var gpuMetricSeries []GpuMetricSeries
+
+	metric, err := prometheusGet(client, prometheusServiceName, "api/v1/query_range", map[string]string{
+		"query": query,
+		"start": strconv.FormatInt(start.Unix(), 10),
+		"end":   strconv.FormatInt(end.Unix(), 10),
+		"step":  strconv.FormatFloat(step.Seconds(), 'f', -1, 64),
+	})
+	if base.IsPermissionError(err) {
+		return gpuMetricSeries, err
+	}
+	if err != nil {
+		return gpuMetricSeries, fmt.Errorf("failed to query prometheus range: %v", err)
+	}
+	var metricResponse *PrometheusRangeMetric
+	err = json.Unmarshal(metric, &metricResponse)
+	if err != nil {
+		log.Errorf("failed to unmarshall prometheus range response: %v", err)
+		return gpuMetricSeries, fmt.Errorf("failed to unmarshall prometheus range response: %v", err)
+	}
+	if metricResponse.Status != "success" {
+		log.Errorf("failed to query prometheus range, status: %s", metricResponse.Status)
+		return gpuMetricSeries, fmt.Errorf("failed to query prometheus range, status: %s", metricResponse.Status)
+	}
+	return ParseRangeMetricResults(metricResponse.Data.Result), nil
+}
+
+// ParseRangeMetricResults converts the matrix of a prometheus range query to GpuMetricSeries, invalid samples are skipped
+func ParseRangeMetricResults(results []PrometheusRangeMetricResult) []GpuMetricSeries {
+	gpuMetricSeries := []GpuMetricSeries{}
+	for _, m := range results {
+		series := GpuMetricSeries{
+			MetricName: m.Metric["__name__"],
+			PodNamespace: m.Metric["namespace_name"],
+			NodeName: m.Metric["node_name"],
+			PodName: m.Metric["pod_name"],
+			ContainerName: m.Metric["container_name"],
+			GPUUID: m.Metric["uuid"],
+			Id: m.Metric["minor_number"],
+			Samples: []GpuMetricSample{},
+		}
+		for _, value := range m.Values {
+			if len(value) != 2 {
+				continue
+			}
+			t, ok := value[0].(float64)
+			if !ok {
+				continue
+			}
+			s, ok := value[1].(string)
+			if !ok {
+				continue
+			}
+			v, err := strconv.ParseFloat(s, 64)
+			if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			series.Samples = append(series.Samples, GpuMetricSample{Time: t, Value: v})
+		}
+		gpuMetricSeries = append(gpuMetricSeries, series)
+	}
+	return gpuMetricSeries
+}
+
+func GetClusterGpuRange(client kubernetes.Interface, prometheusServiceName string, start time.Time, end time.Time, step time.Duration) ([]GpuMetricSeries, error) {
+	return QueryRangeMetricByPrometheus(client, prometheusServiceName, fmt.Sprintf(CLUSTER_METRIC_TMP, strings.Join(GPU_METRIC_LIST, "|")), start, end, step)
+}
+
+// GetPodsGpuRange returns the GPU metric series of the pods named podNames in any namespace, use
+// GetNamespacedPodsGpuRange to tell apart the pods with the same name
+func GetPodsGpuRange(client kubernetes.Interface, prometheusServiceName string, podNames []string, start time.Time, end time.Time, step time.Duration) ([]GpuMetricSeries, error) {
+	return QueryRangeMetricByPrometheus(client, prometheusServiceName, fmt.Sprintf(POD_METRIC_TMP, strings.Join(GPU_METRIC_LIST, "|"), MatchAny(podNames)), start, end, step)
+}
+
+// GetNamespacedPodsGpuRange returns the GPU metric series of pods, told apart from the pods with the same
+// name in other namespaces
+func GetNamespacedPodsGpuRange(client kubernetes.Interface, prometheusServiceName string, pods []v12.Pod, start time.Time, end time.Time, step time.Duration) ([]GpuMetricSeries, error) {
+	if len(pods) == 0 {
+		return []GpuMetricSeries{}, nil
+	}
+	series, err := QueryRangeMetricByPrometheus(client, prometheusServiceName, namespacedPodsQuery(pods), start, end, step)
+	if err != nil {
+		return nil, err
+	}
+	keys := podKeys(pods)
+	result := []GpuMetricSeries{}
+	for _, s := range series {
+		if keys[s.PodNamespace+"/"+s.PodName] {
+			result = append(result, s)
+		}
+	}
+	return result, nil
+}
+
+func GetNodesGpuRange(client kubernetes.Interface, prometheusServiceName string, nodeNames []string, start time.Time, end time.Time, step time.Duration) ([]GpuMetricSeries, error) {
+	return QueryRangeMetricByPrometheus(client, prometheusServiceName, fmt.Sprintf(NODE_METRIC_TMP, strings.Join(GPU_METRIC_LIST, "|"), MatchAny(nodeNames)), start, end, step)
+}
+
+func GetNamespacesGpuRange(client kubernetes.Interface, prometheusServiceName string, namespaces []string, start time.Time, end time.Time, step time.Duration) ([]GpuMetricSeries, error) {
+	return QueryRangeMetricByPrometheus(client, prometheusServiceName, fmt.Sprintf(NAMESPACE_METRIC_TMP, strings.Join(GPU_METRIC_LIST, "|"), MatchAny(namespaces)), start, end, step)
+}
+
 func getMetricAverage(metrics []GpuMetricInfo) float64 {
 	var result float64
 	result = 0
@@ -188,18 +476,13 @@ func getMetricAverage(metrics []GpuMetricInfo) float64 {
 	return result
 }
 
-func GetPrometheusServiceName(client *kubernetes.Clientset) string {
-	services, err := client.CoreV1().Services(KUBE_SYSTEM_NAMESPACE).List(v1.ListOptions{
-		LabelSelector: PROMETHEUS_SVC_LABEL,
-	})
+func GetPrometheusServiceName(client kubernetes.Interface) string {
+	prometheusServiceName, err := FindPrometheusService(client)
 	if err != nil {
+		log.Warnf("failed to find prometheus service, %v", err)
 		return ""
 	}
-	if len(services.Items) == 0 {
-		return ""
-	}
-	prometheusService := services.Items[0]
-	return prometheusService.Name
+	return prometheusServiceName
 
 }
 
@@ -1,10 +1,18 @@
 package utils
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/xieydd/gpu-metric/base"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
+
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 func TestQueryMetricByPrometheus(t *testing.T) {
@@ -18,3 +26,81 @@ func TestQueryMetricByPrometheus(t *testing.T) {
 		t.Logf("metric name %s, value: %s", m.MetricName, m.Value)
 	}
 }
+
+func TestSetNamespaceMetric(t *testing.T) {
+	namespaceMetric := &NamespaceGpuMetric{}
+	namespaceMetric.SetNamespaceMetric(GpuMetricInfo{MetricName: "nvidia_gpu_duty_cycle", Value: "98", PodName: "worker-0", PodNamespace: "team-a", Id: "0"})
+	namespaceMetric.SetNamespaceMetric(GpuMetricInfo{MetricName: "nvidia_gpu_memory_used_bytes", Value: "1024", PodName: "worker-0", PodNamespace: "team-a", Id: "0"})
+	namespaceMetric.SetNamespaceMetric(GpuMetricInfo{MetricName: "nvidia_gpu_duty_cycle", Value: "10", PodName: "worker-0", PodNamespace: "team-b", Id: "1"})
+
+	podMetric := (*namespaceMetric)["team-a"].GetPodMetrics("worker-0")
+	if podMetric == nil || podMetric["0"].GpuDutyCycle != 98 || podMetric["0"].GpuMemoryUsed != 1024 {
+		t.Errorf("unexpected metric of team-a/worker-0: %++v", podMetric)
+	}
+	if _, ok := (*namespaceMetric)["team-b"].GetPodMetrics("worker-0")["0"]; ok {
+		t.Errorf("metric of team-b should not be mixed with team-a")
+	}
+}
+
+func TestParseRangeMetricResults(t *testing.T) {
+	var response PrometheusRangeMetric
+	data := `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"nvidia_gpu_duty_cycle","pod_name":"worker-0","namespace_name":"default","minor_number":"1"},"values":[[1543202894.919,"98"],[1543202924.919,"NaN"],[1543202954.919,"bad"]]}]}}`
+	if err := json.Unmarshal([]byte(data), &response); err != nil {
+		t.Fatalf("failed to unmarshal, %++v", err)
+	}
+	series := ParseRangeMetricResults(response.Data.Result)
+	if len(series) != 1 {
+		t.Fatalf("expect 1 series, got %d", len(series))
+	}
+	if series[0].PodName != "worker-0" || series[0].Id != "1" || series[0].MetricName != "nvidia_gpu_duty_cycle" {
+		t.Errorf("unexpected series labels %++v", series[0])
+	}
+	if len(series[0].Samples) != 1 || series[0].Samples[0].Value != 98 {
+		t.Errorf("unexpected samples %++v", series[0].Samples)
+	}
+}
+
+func TestGetNamespacedPodsGpuRange(t *testing.T) {
+	query := ""
+	prometheus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("query")
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"matrix","result":[`+
+			`{"metric":{"__name__":"nvidia_gpu_duty_cycle","namespace_name":"team-a","pod_name":"job.worker-0","minor_number":"0"},"values":[[1546300800,"90"]]},`+
+			`{"metric":{"__name__":"nvidia_gpu_duty_cycle","namespace_name":"team-b","pod_name":"job.worker-0","minor_number":"0"},"values":[[1546300800,"10"]]}]}}`)
+	}))
+	defer prometheus.Close()
+	PrometheusEndpoint = prometheus.URL + "/"
+	defer func() { PrometheusEndpoint = "" }()
+
+	pods := []v12.Pod{{ObjectMeta: v1.ObjectMeta{Name: "job.worker-0", Namespace: "team-a"}}}
+	end := time.Unix(1546300800, 0)
+	series, err := GetNamespacedPodsGpuRange(fake.NewSimpleClientset(), "", pods, end.Add(-time.Minute), end, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to GetNamespacedPodsGpuRange, %++v", err)
+	}
+	if len(series) != 1 || series[0].PodNamespace != "team-a" || series[0].Samples[0].Value != 90 {
+		t.Errorf("the pod of team-b should be left out, got %++v", series)
+	}
+	if !strings.Contains(query, `namespace_name=~"team-a", pod_name=~"job\\.worker-0"`) {
+		t.Errorf("the query should match the namespace and the quoted pod name, got %s", query)
+	}
+}
+
+func TestGetNodesGpuInfoQuotesNodeNames(t *testing.T) {
+	query := ""
+	prometheus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("query")
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[`+
+			`{"metric":{"__name__":"nvidia_gpu_duty_cycle","node_name":"192.168.0.98","minor_number":"0"},"value":[1546300800,"90"]}]}}`)
+	}))
+	defer prometheus.Close()
+	PrometheusEndpoint = prometheus.URL + "/"
+	defer func() { PrometheusEndpoint = "" }()
+
+	if _, err := GetNodesGpuInfo(fake.NewSimpleClientset(), "", []string{"192.168.0.98", "gpu-node"}); err != nil {
+		t.Fatalf("failed to GetNodesGpuInfo, %++v", err)
+	}
+	if !strings.Contains(query, `node_name=~"192\\.168\\.0\\.98|gpu-node"`) {
+		t.Errorf("the query should match the quoted node names, got %s", query)
+	}
+}
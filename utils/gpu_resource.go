@@ -0,0 +1,38 @@
+package utils
+
+import (
+	v12 "k8s.io/api/core/v1"
+)
+
+const NVIDIA_GPU_RESOURCE_NAME = "nvidia.com/gpu"
+const DEPRECATED_NVIDIA_GPU_RESOURCE_NAME = "alpha.kubernetes.io/nvidia-gpu"
+
+// The way to get GPU Count of Node: nvidia.com/gpu, fall back to alpha.kubernetes.io/nvidia-gpu
+func GpuInNode(node v12.Node) int64 {
+	if val, ok := node.Status.Capacity[NVIDIA_GPU_RESOURCE_NAME]; ok {
+		return val.Value()
+	}
+	if val, ok := node.Status.Capacity[DEPRECATED_NVIDIA_GPU_RESOURCE_NAME]; ok {
+		return val.Value()
+	}
+	return 0
+}
+
+// GPU count requested by the containers of the pod
+func GpuInPod(pod v12.Pod) int64 {
+	var gpuCount int64
+	for _, container := range pod.Spec.Containers {
+		gpuCount += GpuInContainer(container)
+	}
+	return gpuCount
+}
+
+func GpuInContainer(container v12.Container) int64 {
+	if val, ok := container.Resources.Limits[NVIDIA_GPU_RESOURCE_NAME]; ok {
+		return val.Value()
+	}
+	if val, ok := container.Resources.Limits[DEPRECATED_NVIDIA_GPU_RESOURCE_NAME]; ok {
+		return val.Value()
+	}
+	return 0
+}
@@ -0,0 +1,335 @@
+package utils
+
+import (
+	"fmt"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/xieydd/gpu-metric/base"
+	"github.com/xieydd/gpu-metric/workload"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// JOB_RELEASE_LABEL is the label set by atlasctl/arena on all the pods of a training job
+const JOB_RELEASE_LABEL = base.JOB_RELEASE_LABEL
+
+// GpuUsage is the usage of one GPU device
+type GpuUsage struct {
+	Index       string  `json:"index"`
+	DutyCycle   float64 `json:"dutyCycle"`
+	MemoryUsed  float64 `json:"memoryUsedBytes"`
+	MemoryTotal float64 `json:"memoryTotalBytes"`
+}
+
+// InstanceGpuUsage is the GPU usage of a pod or node, RequestedGPU is the
+// GPU limit of a pod or the GPU capacity of a node
+type InstanceGpuUsage struct {
+	Name         string     `json:"name"`
+	Namespace    string     `json:"namespace,omitempty"`
+	Status       string     `json:"status"`
+	Node         string     `json:"node,omitempty"`
+	RequestedGPU int64      `json:"requestedGPU"`
+	GPUs         []GpuUsage `json:"gpus"`
+}
+
+// NamespaceGpuUsage is the aggregated GPU usage of the pods in a namespace
+type NamespaceGpuUsage struct {
+	Namespace        string  `json:"namespace"`
+	Pods             int     `json:"pods"`
+	GPUs             int     `json:"gpus"`
+	AverageDutyCycle float64 `json:"averageDutyCycle"`
+	MemoryUsed       float64 `json:"memoryUsedBytes"`
+	MemoryTotal      float64 `json:"memoryTotalBytes"`
+}
+
+// ClusterGpuUsage is the aggregated GPU usage of all the GPU nodes
+type ClusterGpuUsage struct {
+	Nodes            int     `json:"nodes"`
+	GPUs             int     `json:"gpus"`
+	AverageDutyCycle float64 `json:"averageDutyCycle"`
+	MemoryUsed       float64 `json:"memoryUsedBytes"`
+	MemoryTotal      float64 `json:"memoryTotalBytes"`
+}
+
+func NewGpuUsages(podMetric PodGpuMetric) []GpuUsage {
+	usages := []GpuUsage{}
+	for _, id := range SortMapKeys(podMetric) {
+		metric := podMetric[id]
+		usages = append(usages, GpuUsage{
+			Index:       id,
+			DutyCycle:   metric.GpuDutyCycle,
+			MemoryUsed:  metric.GpuMemoryUsed,
+			MemoryTotal: metric.GpuMemoryTotal,
+		})
+	}
+	return usages
+}
+
+// RequirePrometheusServiceName returns an error pointing to the install doc if prometheus is not deployed
+func RequirePrometheusServiceName(client kubernetes.Interface) (string, error) {
+	prometheusServiceName, err := FindPrometheusService(client)
+	if err != nil {
+		return "", err
+	}
+	if prometheusServiceName == "" {
+		return "", fmt.Errorf("%s, please install GPU monitoring by %s, or set --prometheus-service or --prometheus-url",
+			PrometheusNotFoundMessage(), PROMETHEUS_INSTALL_DOC_URL)
+	}
+	return prometheusServiceName, nil
+}
+
+// ListPods lists the pods matching selector, and only keeps the ones in names if it is set
+func ListPods(client kubernetes.Interface, namespace string, selector string, names []string) ([]v12.Pod, error) {
+	pods := []v12.Pod{}
+	err := base.EachPod(client, namespace, v1.ListOptions{LabelSelector: selector}, func(pod *v12.Pod) error {
+		if containsString(names, pod.Name) {
+			pods = append(pods, *pod)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pods, nil
+}
+
+// RunningPodNames returns the names of the running pods
+func RunningPodNames(pods []v12.Pod) []string {
+	names := []string{}
+	for _, pod := range pods {
+		if pod.Status.Phase == v12.PodRunning {
+			names = append(names, pod.Name)
+		}
+	}
+	return names
+}
+
+// RunningPods returns the running pods
+func RunningPods(pods []v12.Pod) []v12.Pod {
+	running := []v12.Pod{}
+	for _, pod := range pods {
+		if pod.Status.Phase == v12.PodRunning {
+			running = append(running, pod)
+		}
+	}
+	return running
+}
+
+// GetPodsGpuUsage lists the pods matching selector (and names if set) and gathers their GPU metrics
+func GetPodsGpuUsage(client kubernetes.Interface, namespace string, selector string, names []string) ([]InstanceGpuUsage, error) {
+	prometheusServiceName, err := RequirePrometheusServiceName(client)
+	if err != nil {
+		return nil, err
+	}
+	pods, err := ListPods(client, namespace, selector, names)
+	if err != nil {
+		return nil, err
+	}
+	return getPodsGpuUsage(client, prometheusServiceName, pods)
+}
+
+// GetWorkloadGpuUsage gathers the GPU metrics of the pods of a workload
+func GetWorkloadGpuUsage(client kubernetes.Interface, w workload.Workload) ([]InstanceGpuUsage, error) {
+	prometheusServiceName, err := RequirePrometheusServiceName(client)
+	if err != nil {
+		return nil, err
+	}
+	return getPodsGpuUsage(client, prometheusServiceName, w.AllPods())
+}
+
+func getPodsGpuUsage(client kubernetes.Interface, prometheusServiceName string, pods []v12.Pod) ([]InstanceGpuUsage, error) {
+	namespaceMetric, err := GetNamespacedPodsGpuInfo(client, prometheusServiceName, RunningPods(pods))
+	if err != nil {
+		return nil, err
+	}
+
+	usages := []InstanceGpuUsage{}
+	for _, pod := range pods {
+		usages = append(usages, InstanceGpuUsage{
+			Name:         pod.Name,
+			Namespace:    pod.Namespace,
+			Status:       string(pod.Status.Phase),
+			Node:         pod.Spec.NodeName,
+			RequestedGPU: GpuInPod(pod),
+			GPUs:         NewGpuUsages(namespaceMetric[pod.Namespace].GetPodMetrics(pod.Name)),
+		})
+	}
+	return usages, nil
+}
+
+// ListGpuNodes lists the nodes with GPU capacity matching selector (and names if set)
+func ListGpuNodes(client kubernetes.Interface, selector string, names []string) ([]v12.Node, error) {
+	nodeList, err := client.CoreV1().Nodes().List(v1.ListOptions{
+		LabelSelector: selector,
+	})
+	if err != nil {
+		return nil, base.ToPermissionError(err, "list", "nodes", "")
+	}
+	nodes := []v12.Node{}
+	for _, node := range nodeList.Items {
+		if GpuInNode(node) == 0 || !containsString(names, node.Name) {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// GetNodesGpuUsage gathers the GPU metrics of the GPU nodes matching selector (and names if set)
+func GetNodesGpuUsage(client kubernetes.Interface, selector string, names []string) ([]InstanceGpuUsage, error) {
+	prometheusServiceName, err := RequirePrometheusServiceName(client)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := ListGpuNodes(client, selector, names)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeNames := []string{}
+	for _, node := range nodes {
+		nodeNames = append(nodeNames, node.Name)
+	}
+	nodeMetric := NodeGpuMetric{}
+	if len(nodeNames) > 0 {
+		nodeMetric, err = GetNodesGpuInfo(client, prometheusServiceName, nodeNames)
+		if err != nil {
+			log.Debugf("failed to get gpu metrics of nodes %v: %v", nodeNames, err)
+		}
+	}
+
+	usages := []InstanceGpuUsage{}
+	for _, node := range nodes {
+		usages = append(usages, InstanceGpuUsage{
+			Name:         node.Name,
+			Status:       NodeStatus(node),
+			RequestedGPU: GpuInNode(node),
+			GPUs:         NewGpuUsages(nodeMetric[node.Name]),
+		})
+	}
+	return usages, nil
+}
+
+// ListRunningGpuPods lists the running pods requesting GPUs matching selector in namespaces, or in all the
+// namespaces if none is given
+func ListRunningGpuPods(client kubernetes.Interface, selector string, namespaces []string) ([]v12.Pod, error) {
+	pods := []v12.Pod{}
+	opts := v1.ListOptions{LabelSelector: selector, FieldSelector: base.RUNNING_POD_FIELD_SELECTOR}
+	err := base.EachPod(client, "", opts, func(pod *v12.Pod) error {
+		if pod.Status.Phase == v12.PodRunning && GpuInPod(*pod) > 0 && containsString(namespaces, pod.Namespace) {
+			pods = append(pods, *pod)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pods, nil
+}
+
+// GetNamespacesGpuUsage aggregates the GPU metrics of the running GPU pods matching selector per namespace,
+// the metrics of the other pods of the namespaces are left out
+func GetNamespacesGpuUsage(client kubernetes.Interface, selector string, names []string) ([]NamespaceGpuUsage, error) {
+	prometheusServiceName, err := RequirePrometheusServiceName(client)
+	if err != nil {
+		return nil, err
+	}
+	pods, err := ListRunningGpuPods(client, selector, names)
+	if err != nil {
+		return nil, err
+	}
+	podNames := map[string]map[string]bool{}
+	for _, pod := range pods {
+		if podNames[pod.Namespace] == nil {
+			podNames[pod.Namespace] = map[string]bool{}
+		}
+		podNames[pod.Namespace][pod.Name] = true
+	}
+	namespaces := []string{}
+	for ns := range podNames {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+
+	namespaceMetric := NamespaceGpuMetric{}
+	if len(namespaces) > 0 {
+		namespaceMetric, err = GetNamespacesGpuInfo(client, prometheusServiceName, namespaces)
+		if err != nil {
+			log.Debugf("failed to get gpu metrics of namespaces %v: %v", namespaces, err)
+		}
+	}
+
+	usages := []NamespaceGpuUsage{}
+	for _, ns := range namespaces {
+		usage := NamespaceGpuUsage{
+			Namespace: ns,
+			Pods:      len(podNames[ns]),
+		}
+		for podName, podMetric := range namespaceMetric[ns] {
+			if !podNames[ns][podName] {
+				continue
+			}
+			for _, metric := range podMetric {
+				usage.GPUs++
+				usage.AverageDutyCycle += metric.GpuDutyCycle
+				usage.MemoryUsed += metric.GpuMemoryUsed
+				usage.MemoryTotal += metric.GpuMemoryTotal
+			}
+		}
+		if usage.GPUs > 0 {
+			usage.AverageDutyCycle = usage.AverageDutyCycle / float64(usage.GPUs)
+		}
+		usages = append(usages, usage)
+	}
+	return usages, nil
+}
+
+// GetClusterGpuUsage aggregates the GPU metrics of all the GPU nodes
+func GetClusterGpuUsage(client kubernetes.Interface) (*ClusterGpuUsage, error) {
+	nodes, err := GetNodesGpuUsage(client, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	usage := &ClusterGpuUsage{
+		Nodes: len(nodes),
+	}
+	for _, node := range nodes {
+		for _, gpu := range node.GPUs {
+			usage.GPUs++
+			usage.AverageDutyCycle += gpu.DutyCycle
+			usage.MemoryUsed += gpu.MemoryUsed
+			usage.MemoryTotal += gpu.MemoryTotal
+		}
+	}
+	if usage.GPUs > 0 {
+		usage.AverageDutyCycle = usage.AverageDutyCycle / float64(usage.GPUs)
+	}
+	return usage, nil
+}
+
+func NodeStatus(node v12.Node) string {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v12.NodeReady {
+			if condition.Status == v12.ConditionTrue {
+				return "Ready"
+			}
+			return "NotReady"
+		}
+	}
+	return "Unknown"
+}
+
+// containsString returns true if names is empty or contains name
+func containsString(names []string, name string) bool {
+	if len(names) == 0 {
+		return true
+	}
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newGpuPod(namespace string, name string, labels map[string]string) *v12.Pod {
+	return &v12.Pod{
+		ObjectMeta: v1.ObjectMeta{Name: name, Namespace: namespace, Labels: labels},
+		Spec: v12.PodSpec{Containers: []v12.Container{{Name: "main", Resources: v12.ResourceRequirements{
+			Limits: v12.ResourceList{NVIDIA_GPU_RESOURCE_NAME: resource.MustParse("1")},
+		}}}},
+		Status: v12.PodStatus{Phase: v12.PodRunning},
+	}
+}
+
+// newDutyCyclePrometheus serves the duty cycle of GPU 0 of namespace/pod keys, and records the queries
+func newDutyCyclePrometheus(dutyCycles map[string]float64, queries *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*queries = append(*queries, r.URL.Query().Get("query"))
+		results := []string{}
+		for key, dutyCycle := range dutyCycles {
+			parts := strings.Split(key, "/")
+			results = append(results, fmt.Sprintf(`{"metric":{"__name__":"nvidia_gpu_duty_cycle","namespace_name":"%s","pod_name":"%s","minor_number":"0"},"value":[1546300800,"%v"]}`,
+				parts[0], parts[1], dutyCycle))
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[%s]}}`, strings.Join(results, ","))
+	}))
+}
+
+func TestGetPodsGpuUsageAcrossNamespaces(t *testing.T) {
+	queries := []string{}
+	prometheus := newDutyCyclePrometheus(map[string]float64{"team-a/worker-0": 90, "team-b/worker-0": 10, "team-c/worker-0": 50}, &queries)
+	defer prometheus.Close()
+	PrometheusEndpoint = prometheus.URL + "/"
+	defer func() { PrometheusEndpoint = "" }()
+
+	client := fake.NewSimpleClientset(newGpuPod("team-a", "worker-0", nil), newGpuPod("team-b", "worker-0", nil))
+	usages, err := GetPodsGpuUsage(client, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to GetPodsGpuUsage, %++v", err)
+	}
+	dutyCycles := map[string]float64{}
+	for _, usage := range usages {
+		if len(usage.GPUs) != 1 {
+			t.Fatalf("expect 1 GPU of %s/%s, got %++v", usage.Namespace, usage.Name, usage.GPUs)
+		}
+		dutyCycles[usage.Namespace] = usage.GPUs[0].DutyCycle
+	}
+	if len(usages) != 2 || dutyCycles["team-a"] != 90 || dutyCycles["team-b"] != 10 {
+		t.Errorf("the pods with the same name should not be mixed, got %v", dutyCycles)
+	}
+	if len(queries) != 1 || !strings.Contains(queries[0], `namespace_name=~"team-a|team-b"`) || !strings.Contains(queries[0], `pod_name=~"worker-0"`) {
+		t.Errorf("unexpected queries %v", queries)
+	}
+}
+
+func TestGetNamespacesGpuUsageWithSelector(t *testing.T) {
+	queries := []string{}
+	prometheus := newDutyCyclePrometheus(map[string]float64{"team-a/train-0": 90, "team-a/serve-0": 10}, &queries)
+	defer prometheus.Close()
+	PrometheusEndpoint = prometheus.URL + "/"
+	defer func() { PrometheusEndpoint = "" }()
+
+	client := fake.NewSimpleClientset(newGpuPod("team-a", "train-0", map[string]string{"app": "train"}),
+		newGpuPod("team-a", "serve-0", map[string]string{"app": "serve"}))
+	usages, err := GetNamespacesGpuUsage(client, "app=train", nil)
+	if err != nil {
+		t.Fatalf("failed to GetNamespacesGpuUsage, %++v", err)
+	}
+	if len(usages) != 1 || usages[0].Pods != 1 || usages[0].GPUs != 1 || usages[0].AverageDutyCycle != 90 {
+		t.Errorf("only the selected pods should be aggregated, got %++v", usages)
+	}
+}
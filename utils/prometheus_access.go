@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xieydd/gpu-metric/base"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+)
+
+// PROMETHEUS_URL_ENV configures a prometheus reachable without the API server proxy
+const PROMETHEUS_URL_ENV = "GPU_METRIC_PROMETHEUS_URL"
+const PROMETHEUS_PORT = "9090"
+
+// PrometheusEndpoint is the URL of a prometheus queried directly instead of through the service
+// proxy of the API server, for the users which are not allowed to proxy to services in kube-system
+var PrometheusEndpoint = os.Getenv(PROMETHEUS_URL_ENV)
+
+var prometheusHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// permissionHint suggests the prometheus endpoint to the users without access to kube-system
+var permissionHint = fmt.Sprintf("set --prometheus-url or %s to a prometheus reachable without the API server proxy", PROMETHEUS_URL_ENV)
+
+// FindPrometheusService returns the prometheus service as namespace/name:port, or PrometheusEndpoint if it is set.
+// The service is PrometheusService if it is set, otherwise the one selected by DiscoverPrometheus,
+// a NoPrometheusError is returned if the discovered candidates are all rejected.
+// It returns a PermissionError if the user is not allowed to find or proxy to the service, the access is checked
+// once per PROMETHEUS_DISCOVERY_TTL rather than before every query.
+func FindPrometheusService(client kubernetes.Interface) (string, error) {
+	if PrometheusEndpoint != "" {
+		return PrometheusEndpoint, nil
+	}
+	candidate := &PrometheusCandidate{}
+	if PrometheusService != "" {
+		candidate.Namespace, candidate.Name, candidate.Port = parsePrometheusService(PrometheusService)
+	} else {
+		discovery := CachedDiscoverPrometheus(client)
+		candidate = discovery.SelectedCandidate()
+		if err := discovery.Err(); err != nil {
+			// the candidates may be unhealthy as the user is not allowed to proxy to them
+			for i := range discovery.Candidates {
+				if accessErr := checkPrometheusAccess(client, &discovery.Candidates[i]); base.IsPermissionError(accessErr) {
+					return "", accessErr
+				}
+			}
+			return "", err
+		}
+	}
+	if candidate != nil {
+		if err := checkPrometheusAccess(client, candidate); err != nil {
+			return "", err
+		}
+		return candidate.Ref(), nil
+	}
+	// nothing is found, it may be hidden from the user
+	for _, verb := range []struct{ verb, subresource string }{{"list", ""}, {"get", "proxy"}} {
+		if err := cachedCheckServiceAccess(client, verb.verb, verb.subresource, KUBE_SYSTEM_NAMESPACE); err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// prometheusGet gets path of the prometheus HTTP API, from PrometheusEndpoint if it is set,
+// otherwise through the service proxy of the API server to prometheusServiceName (namespace/name:port)
+func prometheusGet(client kubernetes.Interface, prometheusServiceName string, path string, params map[string]string) ([]byte, error) {
+	if PrometheusEndpoint != "" {
+		query := url.Values{}
+		for k, v := range params {
+			query.Set(k, v)
+		}
+		resp, err := prometheusHTTPClient.Get(strings.TrimSuffix(PrometheusEndpoint, "/") + "/" + path + "?" + query.Encode())
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		return ioutil.ReadAll(resp.Body)
+	}
+	namespace, name, port := parsePrometheusService(prometheusServiceName)
+	req := client.CoreV1().Services(namespace).ProxyGet(PROMETHEUS_SCHEME, name, port, path, params)
+	data, err := req.DoRaw()
+	if errors.IsForbidden(err) {
+		// the access may have been revoked since it was checked
+		forgetServiceAccess(client, "get", "proxy", namespace)
+		return nil, &base.PermissionError{Verb: "get", Resource: "services", Subresource: "proxy", Namespace: namespace, Hint: permissionHint}
+	}
+	return data, err
+}
+
+// QueryPrometheus returns the vector of an instant query, an empty result is not an error
+func QueryPrometheus(client kubernetes.Interface, prometheusServiceName string, query string) ([]PrometheusMetricResult, error) {
+	data, err := prometheusGet(client, prometheusServiceName, "api/v1/query", map[string]string{
+		"query": query,
+		"time":  strconv.FormatInt(time.Now().Unix(), 10),
+	})
+	if base.IsPermissionError(err) {
+		return nil, err
+	}
+	var response PrometheusMetric
+	if jsonErr := json.Unmarshal(data, &response); jsonErr != nil {
+		if err != nil {
+			return nil, fmt.Errorf("failed to query prometheus: %v", err)
+		}
+		return nil, fmt.Errorf("failed to unmarshall prometheus response: %v", jsonErr)
+	}
+	if response.Status != "success" {
+		return nil, fmt.Errorf("failed to query prometheus %q, status: %s", query, response.Status)
+	}
+	return response.Data.Result, nil
+}
+
+// SampleValue returns the value of an instant query result
+func SampleValue(result PrometheusMetricResult) (float64, bool) {
+	if len(result.Value) != 2 {
+		return 0, false
+	}
+	s, ok := result.Value[1].(string)
+	if !ok {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	return v, err == nil
+}
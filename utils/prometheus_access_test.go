@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/xieydd/gpu-metric/base"
+	"github.com/xieydd/gpu-metric/workload"
+	authorization_v1 "k8s.io/api/authorization/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestFindPrometheusServiceWithoutPermission(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorization_v1.SelfSubjectAccessReview)
+		review.Status.Allowed = review.Spec.ResourceAttributes.Subresource != "proxy"
+		return true, review, nil
+	})
+
+	_, err := FindPrometheusService(client)
+	if !base.IsPermissionError(err) {
+		t.Fatalf("expect PermissionError, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "services/proxy") || !strings.Contains(err.Error(), "--prometheus-url") {
+		t.Errorf("permission error should name the permission and the fallback, got %v", err)
+	}
+	if _, err := RequirePrometheusServiceName(client); !base.IsPermissionError(err) {
+		t.Errorf("expect PermissionError instead of not installed, got %v", err)
+	}
+}
+
+func TestQueryPrometheusEndpoint(t *testing.T) {
+	prometheus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/query" || r.URL.Query().Get("query") != "nvidia_gpu_num_devices" {
+			http.Error(w, "unexpected request "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"nvidia_gpu_num_devices","node_name":"gpu-node"},"value":[1546300800,"8"]}]}}`))
+	}))
+	defer prometheus.Close()
+	PrometheusEndpoint = prometheus.URL + "/"
+	defer func() { PrometheusEndpoint = "" }()
+
+	// the endpoint is used without access to kube-system
+	client := fake.NewSimpleClientset()
+	prometheusServiceName, err := RequirePrometheusServiceName(client)
+	if err != nil {
+		t.Fatalf("failed to RequirePrometheusServiceName, %++v", err)
+	}
+	metrics, err := QueryMetricByPrometheus(client, prometheusServiceName, "nvidia_gpu_num_devices")
+	if err != nil {
+		t.Fatalf("failed to QueryMetricByPrometheus, %++v", err)
+	}
+	if len(metrics) != 1 || metrics[0].NodeName != "gpu-node" || metrics[0].Value != "8" {
+		t.Errorf("unexpected metrics %++v", metrics)
+	}
+	if len(client.Actions()) != 0 {
+		t.Errorf("the API server should not be called, got %v", client.Actions())
+	}
+}
+
+func TestFindPrometheusServiceChecksAccessOnce(t *testing.T) {
+	PrometheusService = "monitoring/prometheus:9090"
+	defer func() { PrometheusService = "" }()
+	client := fake.NewSimpleClientset()
+	reviews := 0
+	client.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		reviews++
+		review := action.(k8stesting.CreateAction).GetObject().(*authorization_v1.SelfSubjectAccessReview)
+		review.Status.Allowed = true
+		return true, review, nil
+	})
+
+	for i := 0; i < 3; i++ {
+		prometheusServiceName, err := FindPrometheusService(client)
+		if err != nil || prometheusServiceName != "monitoring/prometheus:9090" {
+			t.Fatalf("unexpected prometheus service %q, %v", prometheusServiceName, err)
+		}
+	}
+	if reviews != 1 {
+		t.Errorf("expect the access to be checked once, got %d reviews", reviews)
+	}
+}
+
+func TestGetWorkloadGpuMetricProxyForbidden(t *testing.T) {
+	PrometheusService = "monitoring/prometheus:9090"
+	defer func() { PrometheusService = "" }()
+	// the access is allowed when checked, and revoked before the query
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorization_v1.SelfSubjectAccessReview)
+		review.Status.Allowed = true
+		return true, review, nil
+	})
+	client.PrependProxyReactor("services", func(action k8stesting.Action) (bool, rest.ResponseWrapper, error) {
+		return true, proxyResponse{err: errors.NewForbidden(schema.GroupResource{Resource: "services"}, "prometheus", nil)}, nil
+	})
+
+	pod := newJobPod("job-worker-0", "worker", "0", 1)
+	pod.Namespace = "default"
+	w := workload.NewWorkload("TFJob", "job", "default", []v12.Pod{pod})
+	if _, err := GetWorkloadGpuMetric(client, w); !base.IsPermissionError(err) {
+		t.Errorf("expect PermissionError, got %v", err)
+	}
+	if _, err := GetWorkloadRoleGpuMetric(client, w); !base.IsPermissionError(err) {
+		t.Errorf("expect PermissionError, got %v", err)
+	}
+	if _, err := GetWorkloadGpuUsage(client, w); !base.IsPermissionError(err) {
+		t.Errorf("expect PermissionError, got %v", err)
+	}
+}
+
+func TestQueryMetricByPrometheusUnreachable(t *testing.T) {
+	prometheus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	PrometheusEndpoint = prometheus.URL + "/"
+	defer func() { PrometheusEndpoint = "" }()
+	prometheus.Close()
+
+	_, err := QueryMetricByPrometheus(fake.NewSimpleClientset(), PrometheusEndpoint, "nvidia_gpu_num_devices")
+	if err == nil || !strings.Contains(err.Error(), "failed to query prometheus") {
+		t.Errorf("expect the query to fail, got %v", err)
+	}
+}
@@ -0,0 +1,423 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xieydd/gpu-metric/base"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// PROMETHEUS_SERVICE_ENV configures the prometheus service as namespace/name:port, skipping the discovery
+const PROMETHEUS_SERVICE_ENV = "GPU_METRIC_PROMETHEUS_SERVICE"
+
+// PrometheusService is the configured prometheus service as namespace/name:port
+var PrometheusService = os.Getenv(PROMETHEUS_SERVICE_ENV)
+
+// the service created by the prometheus operator for the Prometheus objects of a namespace
+const PROMETHEUS_OPERATED_SERVICE = "prometheus-operated"
+const PROMETHEUS_OPERATED_PORT = "web"
+const PROMETHEUS_OPERATOR_PATH = "/apis/monitoring.coreos.com/v1/prometheuses"
+
+// the labels of the prometheus services of the manifests of this repo and the common helm charts
+var PROMETHEUS_SVC_SELECTORS = []string{PROMETHEUS_SVC_LABEL, "app.kubernetes.io/name=prometheus", "app=prometheus"}
+
+// the names of the ports of the prometheus HTTP API, preferred over the other ports of a service
+var PROMETHEUS_PORT_NAMES = []string{"web", "http", "prometheus", "http-web"}
+
+// the query probing a prometheus, it fails if prometheus is down and is empty without GPU metrics
+const PROMETHEUS_PROBE_QUERY = "count(nvidia_gpu_num_devices)"
+
+// how long a discovery and the access checks of the prometheus services are reused
+const PROMETHEUS_DISCOVERY_TTL = 5 * time.Minute
+
+const (
+	PROMETHEUS_SOURCE_OVERRIDE = "override"
+	PROMETHEUS_SOURCE_OPERATOR = "operator"
+	PROMETHEUS_SOURCE_SERVICE  = "service"
+)
+
+// the preference of the sources when the candidates are otherwise equal
+var prometheusSourceRank = map[string]int{PROMETHEUS_SOURCE_OVERRIDE: 0, PROMETHEUS_SOURCE_OPERATOR: 1, PROMETHEUS_SOURCE_SERVICE: 2}
+
+// PrometheusCandidate is a prometheus found by the discovery
+type PrometheusCandidate struct {
+	Source    string `json:"source"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	Port      string `json:"port,omitempty"`
+	// Origin is the object the candidate is found from, such as the Prometheus object of the operator
+	Origin  string `json:"origin,omitempty"`
+	Healthy bool   `json:"healthy"`
+	// GpuNodes is the number of nodes with GPU metrics in the candidate
+	GpuNodes int    `json:"gpuNodes"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Ref returns the service of the candidate as namespace/name:port, the prometheus service name
+// of the query functions, or the URL of an endpoint
+func (c PrometheusCandidate) Ref() string {
+	if c.Namespace == "" {
+		return c.Name
+	}
+	return fmt.Sprintf("%s/%s:%s", c.Namespace, c.Name, c.Port)
+}
+
+// PrometheusDiscovery is the candidates in the order of preference and the explanation of the choice
+type PrometheusDiscovery struct {
+	Candidates []PrometheusCandidate `json:"candidates"`
+	// Selected is the index of the chosen candidate, -1 if there is none
+	Selected    int      `json:"selected"`
+	Explanation []string `json:"explanation"`
+	// PermissionErrors are the sources which could not be searched
+	PermissionErrors []string `json:"permissionErrors,omitempty"`
+}
+
+// PrometheusNotFoundMessage describes the sources searched by DiscoverPrometheus when nothing is found
+func PrometheusNotFoundMessage() string {
+	return fmt.Sprintf("no Prometheus object of the operator or service labeled %s is found", strings.Join(PROMETHEUS_SVC_SELECTORS, " or "))
+}
+
+// NoPrometheusError is returned if prometheus candidates are found but none is healthy with GPU metrics
+type NoPrometheusError struct {
+	Candidates []PrometheusCandidate
+}
+
+func (e *NoPrometheusError) Error() string {
+	rejected := []string{}
+	for _, c := range e.Candidates {
+		rejected = append(rejected, fmt.Sprintf("%s (%s)", c.Ref(), c.status()))
+	}
+	return fmt.Sprintf("none of the %d prometheus candidates is healthy with GPU metrics: %s, set --prometheus-service or --prometheus-url",
+		len(e.Candidates), strings.Join(rejected, ", "))
+}
+
+// Err returns a NoPrometheusError if candidates are found but none is selected
+func (d *PrometheusDiscovery) Err() error {
+	if d.Selected >= 0 || len(d.Candidates) == 0 {
+		return nil
+	}
+	return &NoPrometheusError{Candidates: d.Candidates}
+}
+
+// SelectedCandidate returns the chosen candidate or nil
+func (d *PrometheusDiscovery) SelectedCandidate() *PrometheusCandidate {
+	if d.Selected < 0 {
+		return nil
+	}
+	return &d.Candidates[d.Selected]
+}
+
+type cachedDiscovery struct {
+	discovery *PrometheusDiscovery
+	expires   time.Time
+}
+
+var discoveryCache = struct {
+	sync.Mutex
+	entries map[kubernetes.Interface]cachedDiscovery
+}{entries: map[kubernetes.Interface]cachedDiscovery{}}
+
+type accessKey struct {
+	client      kubernetes.Interface
+	verb        string
+	subresource string
+	namespace   string
+}
+
+type cachedAccess struct {
+	err     error
+	expires time.Time
+}
+
+var accessCache = struct {
+	sync.Mutex
+	entries map[accessKey]cachedAccess
+}{entries: map[accessKey]cachedAccess{}}
+
+// parsePrometheusService splits namespace/name:port, a name only is a service of kube-system
+func parsePrometheusService(ref string) (string, string, string) {
+	namespace, name, port := KUBE_SYSTEM_NAMESPACE, ref, PROMETHEUS_PORT
+	if i := strings.Index(name, "/"); i >= 0 {
+		namespace, name = name[:i], name[i+1:]
+	}
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		name, port = name[:i], name[i+1:]
+	}
+	return namespace, name, port
+}
+
+// CachedDiscoverPrometheus returns the discovery of the last PROMETHEUS_DISCOVERY_TTL if any. Only
+// the discoveries which selected a prometheus are reused, so that a prometheus which is back is found.
+func CachedDiscoverPrometheus(client kubernetes.Interface) *PrometheusDiscovery {
+	discoveryCache.Lock()
+	entry, ok := discoveryCache.entries[client]
+	discoveryCache.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.discovery
+	}
+	discovery := DiscoverPrometheus(client)
+	discoveryCache.Lock()
+	if discovery.Selected >= 0 {
+		discoveryCache.entries[client] = cachedDiscovery{discovery: discovery, expires: time.Now().Add(PROMETHEUS_DISCOVERY_TTL)}
+	} else {
+		delete(discoveryCache.entries, client)
+	}
+	discoveryCache.Unlock()
+	return discovery
+}
+
+// DiscoverPrometheus finds the prometheus candidates from the overrides, the Prometheus objects of
+// the prometheus operator and the prometheus services of all namespaces, probes them and selects
+// the healthy one with GPU metrics of the most nodes. Ties are broken by the source, preferring
+// overrides then the operator, then kube-system, then the namespace and name. An override is always
+// selected, otherwise nothing is if no candidate is healthy with GPU metrics.
+func DiscoverPrometheus(client kubernetes.Interface) *PrometheusDiscovery {
+	d := &PrometheusDiscovery{Selected: -1}
+	candidates := []PrometheusCandidate{}
+	switch {
+	case PrometheusEndpoint != "":
+		candidates = append(candidates, PrometheusCandidate{Source: PROMETHEUS_SOURCE_OVERRIDE, Name: PrometheusEndpoint, Origin: "--prometheus-url"})
+	case PrometheusService != "":
+		namespace, name, port := parsePrometheusService(PrometheusService)
+		candidates = append(candidates, PrometheusCandidate{Source: PROMETHEUS_SOURCE_OVERRIDE, Namespace: namespace, Name: name, Port: port, Origin: "--prometheus-service"})
+	default:
+		candidates = append(candidates, d.operatorCandidates(client)...)
+		candidates = append(candidates, d.serviceCandidates(client)...)
+	}
+
+	seen := map[string]bool{}
+	for _, c := range candidates {
+		if seen[c.Ref()] {
+			continue
+		}
+		seen[c.Ref()] = true
+		result, err := QueryPrometheus(client, c.Ref(), PROMETHEUS_PROBE_QUERY)
+		if err != nil {
+			c.Error = err.Error()
+		} else {
+			c.Healthy = true
+			if len(result) > 0 {
+				v, _ := SampleValue(result[0])
+				c.GpuNodes = int(v)
+			}
+		}
+		d.Candidates = append(d.Candidates, c)
+	}
+
+	sort.SliceStable(d.Candidates, func(i, j int) bool {
+		a, b := d.Candidates[i], d.Candidates[j]
+		if a.Source == PROMETHEUS_SOURCE_OVERRIDE || b.Source == PROMETHEUS_SOURCE_OVERRIDE {
+			return a.Source == PROMETHEUS_SOURCE_OVERRIDE && b.Source != PROMETHEUS_SOURCE_OVERRIDE
+		}
+		if a.Healthy != b.Healthy {
+			return a.Healthy
+		}
+		if a.GpuNodes != b.GpuNodes {
+			return a.GpuNodes > b.GpuNodes
+		}
+		if prometheusSourceRank[a.Source] != prometheusSourceRank[b.Source] {
+			return prometheusSourceRank[a.Source] < prometheusSourceRank[b.Source]
+		}
+		if (a.Namespace == KUBE_SYSTEM_NAMESPACE) != (b.Namespace == KUBE_SYSTEM_NAMESPACE) {
+			return a.Namespace == KUBE_SYSTEM_NAMESPACE
+		}
+		return a.Ref() < b.Ref()
+	})
+	if len(d.Candidates) > 0 && (d.Candidates[0].Source == PROMETHEUS_SOURCE_OVERRIDE || d.Candidates[0].GpuNodes > 0) {
+		d.Selected = 0
+	}
+	d.explain()
+	return d
+}
+
+// operatorCandidates returns the prometheus-operated services of the namespaces with Prometheus objects
+func (d *PrometheusDiscovery) operatorCandidates(client kubernetes.Interface) []PrometheusCandidate {
+	restClient, ok := client.CoreV1().RESTClient().(*rest.RESTClient)
+	if !ok || restClient == nil {
+		return nil
+	}
+	data, err := restClient.Get().AbsPath(PROMETHEUS_OPERATOR_PATH).DoRaw()
+	if errors.IsNotFound(err) {
+		// the prometheus operator is not installed
+		return nil
+	}
+	if errors.IsForbidden(err) {
+		d.PermissionErrors = append(d.PermissionErrors, "list prometheuses.monitoring.coreos.com")
+		return nil
+	}
+	if err != nil {
+		d.Explanation = append(d.Explanation, fmt.Sprintf("failed to list the Prometheus objects of the operator, %v", err))
+		return nil
+	}
+	return operatorCandidatesOf(data)
+}
+
+func operatorCandidatesOf(data []byte) []PrometheusCandidate {
+	var list struct {
+		Items []struct {
+			Metadata v1.ObjectMeta `json:"metadata"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil
+	}
+	candidates := []PrometheusCandidate{}
+	for _, item := range list.Items {
+		candidates = append(candidates, PrometheusCandidate{
+			Source:    PROMETHEUS_SOURCE_OPERATOR,
+			Namespace: item.Metadata.Namespace,
+			Name:      PROMETHEUS_OPERATED_SERVICE,
+			Port:      PROMETHEUS_OPERATED_PORT,
+			Origin:    fmt.Sprintf("Prometheus %s/%s", item.Metadata.Namespace, item.Metadata.Name),
+		})
+	}
+	return candidates
+}
+
+// serviceCandidates returns the prometheus services of all namespaces, or of kube-system
+// if the user can't list the services of all namespaces
+func (d *PrometheusDiscovery) serviceCandidates(client kubernetes.Interface) []PrometheusCandidate {
+	candidates := []PrometheusCandidate{}
+	for _, selector := range PROMETHEUS_SVC_SELECTORS {
+		services, err := client.CoreV1().Services("").List(v1.ListOptions{LabelSelector: selector})
+		if errors.IsForbidden(err) {
+			services, err = client.CoreV1().Services(KUBE_SYSTEM_NAMESPACE).List(v1.ListOptions{LabelSelector: selector})
+		}
+		if errors.IsForbidden(err) {
+			d.PermissionErrors = append(d.PermissionErrors, fmt.Sprintf("list services labeled %s", selector))
+			continue
+		}
+		if err != nil {
+			d.Explanation = append(d.Explanation, fmt.Sprintf("failed to list services labeled %s, %v", selector, err))
+			continue
+		}
+		for _, svc := range services.Items {
+			candidates = append(candidates, PrometheusCandidate{
+				Source:    PROMETHEUS_SOURCE_SERVICE,
+				Namespace: svc.Namespace,
+				Name:      svc.Name,
+				Port:      prometheusPort(svc),
+				Origin:    fmt.Sprintf("Service labeled %s", selector),
+			})
+		}
+	}
+	return candidates
+}
+
+// prometheusPort returns the named HTTP API port of svc, or 9090, or its first port
+func prometheusPort(svc v12.Service) string {
+	for _, name := range PROMETHEUS_PORT_NAMES {
+		for _, port := range svc.Spec.Ports {
+			if port.Name == name {
+				return fmt.Sprintf("%d", port.Port)
+			}
+		}
+	}
+	for _, port := range svc.Spec.Ports {
+		if fmt.Sprintf("%d", port.Port) == PROMETHEUS_PORT {
+			return PROMETHEUS_PORT
+		}
+	}
+	if len(svc.Spec.Ports) > 0 {
+		return fmt.Sprintf("%d", svc.Spec.Ports[0].Port)
+	}
+	return PROMETHEUS_PORT
+}
+
+func (d *PrometheusDiscovery) explain() {
+	if len(d.Candidates) == 0 {
+		d.Explanation = append(d.Explanation, "no prometheus is found")
+	} else if d.Selected < 0 {
+		d.Explanation = append(d.Explanation, "no prometheus is selected, none is healthy with GPU metrics")
+	}
+	for i, c := range d.Candidates {
+		line := fmt.Sprintf("%s (%s from %s): %s", c.Ref(), c.Source, c.Origin, c.status())
+		switch {
+		case i == d.Selected && c.Source == PROMETHEUS_SOURCE_OVERRIDE:
+			line = "selected " + line + ", configured explicitly"
+		case i == d.Selected && len(d.Candidates) == 1:
+			line = "selected " + line + ", the only candidate"
+		case i == d.Selected:
+			line = "selected " + line + ", " + d.reason(c, d.Candidates[1])
+		default:
+			line = "skipped " + line
+		}
+		d.Explanation = append(d.Explanation, line)
+	}
+	for _, source := range d.PermissionErrors {
+		d.Explanation = append(d.Explanation, fmt.Sprintf("not allowed to %s", source))
+	}
+}
+
+// status explains the probe of the candidate
+func (c PrometheusCandidate) status() string {
+	switch {
+	case !c.Healthy:
+		return "unhealthy: " + c.Error
+	case c.GpuNodes == 0:
+		return "healthy, no GPU metrics"
+	}
+	return fmt.Sprintf("healthy, GPU metrics of %d nodes", c.GpuNodes)
+}
+
+// reason explains why selected is preferred over the runner-up
+func (d *PrometheusDiscovery) reason(selected PrometheusCandidate, next PrometheusCandidate) string {
+	switch {
+	case selected.Healthy != next.Healthy:
+		return "the only healthy one"
+	case selected.GpuNodes != next.GpuNodes:
+		return "the most nodes with GPU metrics"
+	case selected.Source != next.Source:
+		return fmt.Sprintf("%s candidates are preferred", selected.Source)
+	case selected.Namespace != next.Namespace && selected.Namespace == KUBE_SYSTEM_NAMESPACE:
+		return "kube-system is preferred"
+	}
+	return "the first by namespace and name"
+}
+
+// checkPrometheusAccess returns a PermissionError if the user can't proxy to the candidate service
+func checkPrometheusAccess(client kubernetes.Interface, c *PrometheusCandidate) error {
+	if c.Namespace == "" {
+		return nil
+	}
+	return cachedCheckServiceAccess(client, "get", "proxy", c.Namespace)
+}
+
+// cachedCheckServiceAccess checks the access to the services of namespace, reusing the answer of the last
+// PROMETHEUS_DISCOVERY_TTL. Only the allowed and the denied answers are reused, not the failed checks.
+func cachedCheckServiceAccess(client kubernetes.Interface, verb string, subresource string, namespace string) error {
+	key := accessKey{client: client, verb: verb, subresource: subresource, namespace: namespace}
+	accessCache.Lock()
+	entry, ok := accessCache.entries[key]
+	accessCache.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.err
+	}
+	err := base.CheckAccess(client, verb, "services", subresource, namespace)
+	if permissionErr, ok := err.(*base.PermissionError); ok {
+		permissionErr.Hint = permissionHint
+	} else if err != nil {
+		return err
+	}
+	accessCache.Lock()
+	accessCache.entries[key] = cachedAccess{err: err, expires: time.Now().Add(PROMETHEUS_DISCOVERY_TTL)}
+	accessCache.Unlock()
+	return err
+}
+
+// forgetServiceAccess drops the cached answer of an access check
+func forgetServiceAccess(client kubernetes.Interface, verb string, subresource string, namespace string) {
+	accessCache.Lock()
+	delete(accessCache.entries, accessKey{client: client, verb: verb, subresource: subresource, namespace: namespace})
+	accessCache.Unlock()
+}
@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	authorization_v1 "k8s.io/api/authorization/v1"
+	v12 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// proxyResponse is the response of a fake service proxy
+type proxyResponse struct {
+	data []byte
+	err  error
+}
+
+func (r proxyResponse) DoRaw() ([]byte, error) {
+	return r.data, r.err
+}
+
+func (r proxyResponse) Stream() (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader(string(r.data))), r.err
+}
+
+var _ rest.ResponseWrapper = proxyResponse{}
+
+func newPrometheusService(namespace string, name string, labels map[string]string, ports ...v12.ServicePort) *v12.Service {
+	return &v12.Service{
+		ObjectMeta: meta_v1.ObjectMeta{Name: name, Namespace: namespace, Labels: labels},
+		Spec:       v12.ServiceSpec{Ports: ports},
+	}
+}
+
+// newDiscoveryClient answers the probe of the services in gpuNodes with the number of GPU nodes,
+// a negative number fails the probe
+func newDiscoveryClient(gpuNodes map[string]int, objects ...runtime.Object) *fake.Clientset {
+	client := fake.NewSimpleClientset(objects...)
+	client.PrependProxyReactor("services", func(action k8stesting.Action) (bool, rest.ResponseWrapper, error) {
+		proxy := action.(k8stesting.ProxyGetAction)
+		ref := fmt.Sprintf("%s/%s:%s", action.GetNamespace(), proxy.GetName(), proxy.GetPort())
+		n, ok := gpuNodes[ref]
+		switch {
+		case !ok || n < 0:
+			return true, proxyResponse{err: fmt.Errorf("connection refused")}, nil
+		case n == 0:
+			return true, proxyResponse{data: []byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`)}, nil
+		}
+		return true, proxyResponse{data: []byte(fmt.Sprintf(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1546300800,"%d"]}]}}`, n))}, nil
+	})
+	client.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorization_v1.SelfSubjectAccessReview)
+		review.Status.Allowed = true
+		return true, review, nil
+	})
+	return client
+}
+
+func TestDiscoverPrometheusPrefersGpuMetrics(t *testing.T) {
+	client := newDiscoveryClient(map[string]int{
+		"kube-system/prometheus-svc:9090":                  0,
+		"monitoring/kube-prometheus-stack-prometheus:9090": 3,
+		"default/prometheus-server:80":                     -1,
+	},
+		newPrometheusService("kube-system", "prometheus-svc", map[string]string{"kubernetes.io/name": "Prometheus"}, v12.ServicePort{Name: "prometheus", Port: 9090}),
+		newPrometheusService("monitoring", "kube-prometheus-stack-prometheus", map[string]string{"app.kubernetes.io/name": "prometheus"},
+			v12.ServicePort{Name: "reloader-web", Port: 8080}, v12.ServicePort{Name: "http-web", Port: 9090}),
+		newPrometheusService("default", "prometheus-server", map[string]string{"app": "prometheus"}, v12.ServicePort{Port: 80}),
+	)
+
+	d := DiscoverPrometheus(client)
+	selected := d.SelectedCandidate()
+	if selected == nil || selected.Ref() != "monitoring/kube-prometheus-stack-prometheus:9090" {
+		t.Fatalf("expect the prometheus with GPU metrics to be selected, got %++v", d)
+	}
+	refs := []string{}
+	for _, c := range d.Candidates {
+		refs = append(refs, c.Ref())
+	}
+	expected := "monitoring/kube-prometheus-stack-prometheus:9090,kube-system/prometheus-svc:9090,default/prometheus-server:80"
+	if strings.Join(refs, ",") != expected {
+		t.Errorf("expect candidates %s, got %s", expected, strings.Join(refs, ","))
+	}
+	if !strings.Contains(d.Explanation[0], "the most nodes with GPU metrics") || !strings.Contains(d.Explanation[2], "unhealthy") {
+		t.Errorf("unexpected explanation %v", d.Explanation)
+	}
+
+	// the discovered service is queried
+	name, err := FindPrometheusService(client)
+	if err != nil || name != "monitoring/kube-prometheus-stack-prometheus:9090" {
+		t.Errorf("expect the discovered service, got %s %v", name, err)
+	}
+}
+
+func TestDiscoverPrometheusTieBreak(t *testing.T) {
+	client := newDiscoveryClient(map[string]int{
+		"kube-system/prometheus-svc:9090": 2,
+		"monitoring/prometheus:9090":      2,
+	},
+		newPrometheusService("monitoring", "prometheus", map[string]string{"kubernetes.io/name": "Prometheus"}, v12.ServicePort{Port: 9090}),
+		newPrometheusService("kube-system", "prometheus-svc", map[string]string{"kubernetes.io/name": "Prometheus"}, v12.ServicePort{Port: 9090}),
+	)
+	for i := 0; i < 3; i++ {
+		d := DiscoverPrometheus(client)
+		if d.SelectedCandidate().Ref() != "kube-system/prometheus-svc:9090" || !strings.Contains(d.Explanation[0], "kube-system is preferred") {
+			t.Fatalf("expect kube-system to win the tie, got %v", d.Explanation)
+		}
+	}
+}
+
+func TestDiscoverPrometheusOverride(t *testing.T) {
+	PrometheusService = "monitoring/prometheus-operated:web"
+	defer func() { PrometheusService = "" }()
+	client := newDiscoveryClient(map[string]int{"monitoring/prometheus-operated:web": 1},
+		newPrometheusService("kube-system", "prometheus-svc", map[string]string{"kubernetes.io/name": "Prometheus"}, v12.ServicePort{Port: 9090}),
+	)
+	d := DiscoverPrometheus(client)
+	if len(d.Candidates) != 1 || !strings.Contains(d.Explanation[0], "configured explicitly") {
+		t.Errorf("expect only the override, got %++v", d)
+	}
+	if name, err := FindPrometheusService(client); err != nil || name != PrometheusService {
+		t.Errorf("expect the override, got %s %v", name, err)
+	}
+}
+
+func TestDiscoverPrometheusWithoutGpuMetrics(t *testing.T) {
+	client := newDiscoveryClient(map[string]int{"kube-system/prometheus-svc:9090": 0},
+		newPrometheusService("kube-system", "prometheus-svc", map[string]string{"kubernetes.io/name": "Prometheus"}, v12.ServicePort{Port: 9090}),
+		newPrometheusService("default", "prometheus-server", map[string]string{"app": "prometheus"}, v12.ServicePort{Port: 80}),
+	)
+	d := DiscoverPrometheus(client)
+	if d.SelectedCandidate() != nil {
+		t.Fatalf("expect no prometheus to be selected, got %++v", d.SelectedCandidate())
+	}
+
+	_, err := FindPrometheusService(client)
+	if _, ok := err.(*NoPrometheusError); !ok {
+		t.Fatalf("expect NoPrometheusError, got %v", err)
+	}
+	for _, expected := range []string{"kube-system/prometheus-svc:9090 (healthy, no GPU metrics)", "default/prometheus-server:80 (unhealthy: "} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expect %q in the error, got %v", expected, err)
+		}
+	}
+}
+
+func TestCachedDiscoverPrometheusRetriesFailures(t *testing.T) {
+	// prometheus is restarting
+	gpuNodes := map[string]int{"kube-system/prometheus-svc:9090": -1}
+	client := newDiscoveryClient(gpuNodes,
+		newPrometheusService("kube-system", "prometheus-svc", map[string]string{"kubernetes.io/name": "Prometheus"}, v12.ServicePort{Port: 9090}),
+	)
+	if _, err := FindPrometheusService(client); err == nil {
+		t.Fatalf("expect no prometheus while it is down")
+	}
+
+	gpuNodes["kube-system/prometheus-svc:9090"] = 2
+	if name, err := FindPrometheusService(client); err != nil || name != "kube-system/prometheus-svc:9090" {
+		t.Errorf("expect the prometheus which is back, got %s %v", name, err)
+	}
+}
+
+func TestOperatorCandidates(t *testing.T) {
+	candidates := operatorCandidatesOf([]byte(`{"apiVersion":"monitoring.coreos.com/v1","kind":"PrometheusList","items":[
+		{"metadata":{"name":"k8s","namespace":"monitoring"},"spec":{"replicas":2}}]}`))
+	if len(candidates) != 1 || candidates[0].Ref() != "monitoring/prometheus-operated:web" || candidates[0].Origin != "Prometheus monitoring/k8s" {
+		t.Errorf("unexpected candidates %++v", candidates)
+	}
+}
+
+func TestParsePrometheusService(t *testing.T) {
+	for ref, expected := range map[string]string{
+		"prometheus-svc":                     "kube-system prometheus-svc 9090",
+		"monitoring/prometheus-operated:web": "monitoring prometheus-operated web",
+		"monitoring/prometheus":              "monitoring prometheus 9090",
+	} {
+		namespace, name, port := parsePrometheusService(ref)
+		if got := strings.Join([]string{namespace, name, port}, " "); got != expected {
+			t.Errorf("expect %s for %s, got %s", expected, ref, got)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/xieydd/gpu-metric/workload"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ReplicaGpuMetric is the GPU usage of one replica (pod) of a distributed job
+type ReplicaGpuMetric struct {
+	Index        string     `json:"index"`
+	PodName      string     `json:"pod"`
+	Status       string     `json:"status"`
+	NodeName     string     `json:"node,omitempty"`
+	RequestedGPU int64      `json:"requestedGPU"`
+	GPUs         []GpuUsage `json:"gpus"`
+}
+
+// RoleGpuMetric aggregates the GPU usage of the replicas of one type, such as the workers of a TFJob
+type RoleGpuMetric struct {
+	Role         string             `json:"role"`
+	RequestedGPU int64              `json:"requestedGPU"`
+	GPUs         int                `json:"gpus"`
+	MeanDuty     float64            `json:"meanDutyCycle"`
+	MinDuty      float64            `json:"minDutyCycle"`
+	MaxDuty      float64            `json:"maxDutyCycle"`
+	MemoryUsed   float64            `json:"memoryUsedBytes"`
+	MemoryTotal  float64            `json:"memoryTotalBytes"`
+	Replicas     []ReplicaGpuMetric `json:"replicas"`
+}
+
+// GroupByReplicaRole groups the metrics of the pods of a job by replica type and index.
+// Pods which are not created by a kubeflow operator are grouped in the role "Pod".
+func GroupByReplicaRole(pods []v12.Pod, jobMetric JobGpuMetric) []RoleGpuMetric {
+	roles := map[string]*RoleGpuMetric{}
+	for _, pod := range pods {
+		role, index := workload.ReplicaOf(pod)
+		if role == "" {
+			role = "Pod"
+		}
+		if _, ok := roles[role]; !ok {
+			roles[role] = &RoleGpuMetric{Role: role, Replicas: []ReplicaGpuMetric{}}
+		}
+		replica := ReplicaGpuMetric{
+			Index:        index,
+			PodName:      pod.Name,
+			Status:       string(pod.Status.Phase),
+			NodeName:     pod.Spec.NodeName,
+			RequestedGPU: GpuInPod(pod),
+			GPUs:         NewGpuUsages(jobMetric.GetPodMetrics(pod.Name)),
+		}
+		roleMetric := roles[role]
+		roleMetric.RequestedGPU += replica.RequestedGPU
+		roleMetric.Replicas = append(roleMetric.Replicas, replica)
+	}
+
+	result := []RoleGpuMetric{}
+	for _, roleMetric := range roles {
+		replicas := roleMetric.Replicas
+		sort.Slice(replicas, func(i, j int) bool {
+			return replicaIndexLess(replicas[i], replicas[j])
+		})
+		for _, replica := range replicas {
+			for _, gpu := range replica.GPUs {
+				if roleMetric.GPUs == 0 || gpu.DutyCycle < roleMetric.MinDuty {
+					roleMetric.MinDuty = gpu.DutyCycle
+				}
+				if roleMetric.GPUs == 0 || gpu.DutyCycle > roleMetric.MaxDuty {
+					roleMetric.MaxDuty = gpu.DutyCycle
+				}
+				roleMetric.GPUs++
+				roleMetric.MeanDuty += gpu.DutyCycle
+				roleMetric.MemoryUsed += gpu.MemoryUsed
+				roleMetric.MemoryTotal += gpu.MemoryTotal
+			}
+		}
+		if roleMetric.GPUs > 0 {
+			roleMetric.MeanDuty = roleMetric.MeanDuty / float64(roleMetric.GPUs)
+		}
+		result = append(result, *roleMetric)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return workload.ReplicaTypeLess(result[i].Role, result[j].Role)
+	})
+	return result
+}
+
+// GetWorkloadRoleGpuMetric returns the GPU metrics of a workload grouped by replica role
+func GetWorkloadRoleGpuMetric(client kubernetes.Interface, w workload.Workload) ([]RoleGpuMetric, error) {
+	jobMetric, err := GetWorkloadGpuMetric(client, w)
+	if err != nil {
+		return nil, err
+	}
+	return GroupByReplicaRole(w.AllPods(), jobMetric), nil
+}
+
+// replicaIndexLess orders the replicas by numeric index, then by pod name
+func replicaIndexLess(a ReplicaGpuMetric, b ReplicaGpuMetric) bool {
+	ai, errA := strconv.Atoi(a.Index)
+	bi, errB := strconv.Atoi(b.Index)
+	if errA == nil && errB == nil && ai != bi {
+		return ai < bi
+	}
+	return a.PodName < b.PodName
+}
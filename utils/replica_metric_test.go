@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"testing"
+
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newJobPod(name string, role string, index string, gpus int64) v12.Pod {
+	pod := v12.Pod{
+		ObjectMeta: v1.ObjectMeta{Name: name, Labels: map[string]string{"tf-replica-type": role, "tf-replica-index": index}},
+		Spec:       v12.PodSpec{Containers: []v12.Container{{Name: "tensorflow"}}},
+		Status:     v12.PodStatus{Phase: v12.PodRunning},
+	}
+	if gpus > 0 {
+		pod.Spec.Containers[0].Resources.Limits = v12.ResourceList{
+			NVIDIA_GPU_RESOURCE_NAME: *resource.NewQuantity(gpus, resource.DecimalSI),
+		}
+	}
+	return pod
+}
+
+func TestGroupByReplicaRole(t *testing.T) {
+	pods := []v12.Pod{
+		newJobPod("mnist-worker-10", "worker", "10", 1),
+		newJobPod("mnist-worker-2", "worker", "2", 2),
+		newJobPod("mnist-ps-0", "ps", "0", 0),
+		newJobPod("mnist-chief-0", "chief", "0", 1),
+	}
+	jobMetric := JobGpuMetric{
+		"mnist-worker-2": PodGpuMetric{
+			"0": &GpuMetric{GpuDutyCycle: 90, GpuMemoryUsed: 100, GpuMemoryTotal: 1000},
+			"1": &GpuMetric{GpuDutyCycle: 30, GpuMemoryUsed: 200, GpuMemoryTotal: 1000},
+		},
+		"mnist-worker-10": PodGpuMetric{
+			"0": &GpuMetric{GpuDutyCycle: 60, GpuMemoryUsed: 300, GpuMemoryTotal: 1000},
+		},
+	}
+	roles := GroupByReplicaRole(pods, jobMetric)
+	if len(roles) != 3 || roles[0].Role != "Chief" || roles[1].Role != "Worker" || roles[2].Role != "PS" {
+		t.Fatalf("unexpected roles %++v", roles)
+	}
+
+	worker := roles[1]
+	if worker.RequestedGPU != 3 || worker.GPUs != 3 {
+		t.Errorf("workers should request and report 3 GPUs, got %d/%d", worker.RequestedGPU, worker.GPUs)
+	}
+	if worker.MeanDuty != 60 || worker.MinDuty != 30 || worker.MaxDuty != 90 || worker.MemoryUsed != 600 || worker.MemoryTotal != 3000 {
+		t.Errorf("unexpected worker aggregates %++v", worker)
+	}
+	if worker.Replicas[0].Index != "2" || worker.Replicas[1].Index != "10" {
+		t.Errorf("replicas should be sorted by numeric index, got %s, %s", worker.Replicas[0].Index, worker.Replicas[1].Index)
+	}
+
+	ps := roles[2]
+	if ps.RequestedGPU != 0 || ps.GPUs != 0 || len(ps.Replicas) != 1 {
+		t.Errorf("ps should be reported without GPU, got %++v", ps)
+	}
+}
@@ -0,0 +1,99 @@
+package workload
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/kubeflow/tf-operator/pkg/apis/tensorflow/v1alpha2"
+	v1 "k8s.io/api/core/v1"
+)
+
+const REPLICA_TYPE_LAUNCHER = "Launcher"
+
+// replicaTypeLabels are the labels set by the kubeflow operators on the pods of a job, in order of preference
+var replicaTypeLabels = []string{
+	"training.kubeflow.org/replica-type",
+	"replica-type",
+	"tf-replica-type",
+	"pytorch-replica-type",
+	"mpi_role_type",
+}
+
+var replicaIndexLabels = []string{
+	"training.kubeflow.org/replica-index",
+	"replica-index",
+	"tf-replica-index",
+	"pytorch-replica-index",
+}
+
+// replicaTypes maps the lower case label values to the replica type
+var replicaTypes = map[string]string{
+	strings.ToLower(string(v1alpha2.TFReplicaTypeChief)):  string(v1alpha2.TFReplicaTypeChief),
+	strings.ToLower(string(v1alpha2.TFReplicaTypeMaster)): string(v1alpha2.TFReplicaTypeMaster),
+	strings.ToLower(string(v1alpha2.TFReplicaTypeWorker)): string(v1alpha2.TFReplicaTypeWorker),
+	strings.ToLower(string(v1alpha2.TFReplicaTypePS)):     string(v1alpha2.TFReplicaTypePS),
+	strings.ToLower(string(v1alpha2.TFReplicaTypeEval)):   string(v1alpha2.TFReplicaTypeEval),
+	"eval":                                 string(v1alpha2.TFReplicaTypeEval),
+	strings.ToLower(REPLICA_TYPE_LAUNCHER): REPLICA_TYPE_LAUNCHER,
+}
+
+// replicaTypeOrder is the display order of the replica types, the unknown ones come last
+var replicaTypeOrder = []string{
+	string(v1alpha2.TFReplicaTypeChief),
+	string(v1alpha2.TFReplicaTypeMaster),
+	REPLICA_TYPE_LAUNCHER,
+	string(v1alpha2.TFReplicaTypeWorker),
+	string(v1alpha2.TFReplicaTypePS),
+	string(v1alpha2.TFReplicaTypeEval),
+}
+
+// ReplicaOf returns the replica type and index of a pod of a TFJob, PyTorchJob or MPIJob.
+// The index falls back to the numeric suffix of the pod name (MPIJob workers have no index label),
+// the type is empty for pods which are not created by a kubeflow operator.
+func ReplicaOf(pod v1.Pod) (string, string) {
+	replicaType := ""
+	for _, label := range replicaTypeLabels {
+		if value, ok := pod.Labels[label]; ok {
+			replicaType = NormalizeReplicaType(value)
+			break
+		}
+	}
+	if replicaType == "" {
+		return "", ""
+	}
+	for _, label := range replicaIndexLabels {
+		if value, ok := pod.Labels[label]; ok {
+			return replicaType, value
+		}
+	}
+	if i := strings.LastIndex(pod.Name, "-"); i >= 0 {
+		if _, err := strconv.Atoi(pod.Name[i+1:]); err == nil {
+			return replicaType, pod.Name[i+1:]
+		}
+	}
+	return replicaType, ""
+}
+
+// NormalizeReplicaType returns the replica type of a label value such as ps, worker or launcher
+func NormalizeReplicaType(value string) string {
+	if replicaType, ok := replicaTypes[strings.ToLower(value)]; ok {
+		return replicaType
+	}
+	return value
+}
+
+// ReplicaTypeLess orders the replica types as chief, master, launcher, worker, ps, evaluator, then by name
+func ReplicaTypeLess(a string, b string) bool {
+	rank := func(replicaType string) int {
+		for i, t := range replicaTypeOrder {
+			if t == replicaType {
+				return i
+			}
+		}
+		return len(replicaTypeOrder)
+	}
+	if rank(a) != rank(b) {
+		return rank(a) < rank(b)
+	}
+	return a < b
+}
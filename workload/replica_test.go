@@ -0,0 +1,38 @@
+package workload
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestReplicaOf(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		labels map[string]string
+		role   string
+		index  string
+	}{
+		{"mnist-worker-1", map[string]string{"tf-replica-type": "worker", "tf-replica-index": "1"}, "Worker", "1"},
+		{"mnist-ps-0", map[string]string{"tf-replica-type": "ps", "tf-replica-index": "0"}, "PS", "0"},
+		{"mnist-evaluator-0", map[string]string{"replica-type": "evaluator", "replica-index": "0"}, "Evaluator", "0"},
+		{"bert-master-0", map[string]string{"pytorch-replica-type": "master", "pytorch-replica-index": "0"}, "Master", "0"},
+		{"horovod-launcher-x7k2p", map[string]string{"mpi_role_type": "launcher"}, "Launcher", ""},
+		{"horovod-worker-3", map[string]string{"mpi_role_type": "worker"}, "Worker", "3"},
+		{"resnet-chief-0", map[string]string{"training.kubeflow.org/replica-type": "chief", "training.kubeflow.org/replica-index": "0"}, "Chief", "0"},
+		{"notebook-0", map[string]string{"app": "notebook"}, "", ""},
+	} {
+		pod := v1.Pod{ObjectMeta: meta_v1.ObjectMeta{Name: c.name, Labels: c.labels}}
+		role, index := ReplicaOf(pod)
+		if role != c.role || index != c.index {
+			t.Errorf("%s should be %s/%s, got %s/%s", c.name, c.role, c.index, role, index)
+		}
+	}
+}
+
+func TestReplicaTypeLess(t *testing.T) {
+	if !ReplicaTypeLess("Chief", "Worker") || !ReplicaTypeLess("Worker", "PS") || !ReplicaTypeLess("Evaluator", "Custom") {
+		t.Errorf("unexpected replica type order")
+	}
+}
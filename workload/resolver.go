@@ -0,0 +1,196 @@
+package workload
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xieydd/gpu-metric/base"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	KIND_POD          = "Pod"
+	KIND_REPLICA_SET  = "ReplicaSet"
+	KIND_DEPLOYMENT   = "Deployment"
+	KIND_STATEFUL_SET = "StatefulSet"
+	KIND_DAEMON_SET   = "DaemonSet"
+	KIND_JOB          = "Job"
+	KIND_CRON_JOB     = "CronJob"
+	KIND_TF_JOB       = "TFJob"
+	KIND_PYTORCH_JOB  = "PyTorchJob"
+	KIND_MPI_JOB      = "MPIJob"
+)
+
+// kindAliases maps the lower case names, plurals and short names accepted on the command line to the kind
+var kindAliases = map[string]string{
+	"pod": KIND_POD, "pods": KIND_POD, "po": KIND_POD,
+	"replicaset": KIND_REPLICA_SET, "replicasets": KIND_REPLICA_SET, "rs": KIND_REPLICA_SET,
+	"deployment": KIND_DEPLOYMENT, "deployments": KIND_DEPLOYMENT, "deploy": KIND_DEPLOYMENT,
+	"statefulset": KIND_STATEFUL_SET, "statefulsets": KIND_STATEFUL_SET, "sts": KIND_STATEFUL_SET,
+	"daemonset": KIND_DAEMON_SET, "daemonsets": KIND_DAEMON_SET, "ds": KIND_DAEMON_SET,
+	"job": KIND_JOB, "jobs": KIND_JOB,
+	"cronjob": KIND_CRON_JOB, "cronjobs": KIND_CRON_JOB, "cj": KIND_CRON_JOB,
+	"tfjob": KIND_TF_JOB, "tfjobs": KIND_TF_JOB,
+	"pytorchjob": KIND_PYTORCH_JOB, "pytorchjobs": KIND_PYTORCH_JOB,
+	"mpijob": KIND_MPI_JOB, "mpijobs": KIND_MPI_JOB,
+}
+
+// NoPodsError is returned when no pods belong to the requested workload
+type NoPodsError struct {
+	Kind      string
+	Name      string
+	Namespace string
+}
+
+func (e *NoPodsError) Error() string {
+	return fmt.Sprintf("no pods found for %s/%s in namespace %s", e.Kind, e.Name, e.Namespace)
+}
+
+// Owner identifies an object in the owner chain of a pod
+type Owner struct {
+	Kind string
+	Name string
+}
+
+// Resolver finds the pods of workloads by label selector or by walking the owner references of pods:
+// Pod -> ReplicaSet -> Deployment, Pod -> Job -> CronJob, Pod -> StatefulSet/DaemonSet/TFJob/PyTorchJob/MPIJob.
+// A Resolver is not safe for concurrent use.
+type Resolver struct {
+	client kubernetes.Interface
+
+	// owners of the ReplicaSets and Jobs fetched during one resolution
+	owners map[Owner]*Owner
+}
+
+func NewResolver(client kubernetes.Interface) *Resolver {
+	return &Resolver{client: client}
+}
+
+// NormalizeKind returns the kind of a kind name or alias such as deploy or tfjobs
+func NormalizeKind(kind string) (string, error) {
+	if k, ok := kindAliases[strings.ToLower(kind)]; ok {
+		return k, nil
+	}
+	return "", fmt.Errorf("unsupported workload kind %s", kind)
+}
+
+// ParseRef parses a kind/name reference such as deployment/web or tfjob/mnist
+func ParseRef(ref string) (string, string, error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid workload %q, must be kind/name", ref)
+	}
+	kind, err := NormalizeKind(parts[0])
+	if err != nil {
+		return "", "", err
+	}
+	return kind, parts[1], nil
+}
+
+// Resolve returns the workload of a kind/name reference in namespace
+func (r *Resolver) Resolve(namespace string, ref string) (Workload, error) {
+	kind, name, err := ParseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	return r.ByOwner(namespace, kind, name)
+}
+
+// BySelector returns the workload made of the pods matching selector
+func (r *Resolver) BySelector(namespace string, selector string) (Workload, error) {
+	pods, err := base.ListAllPods(r.client, namespace, meta_v1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	return NewWorkload("Selector", selector, namespace, pods), nil
+}
+
+// ByOwner returns the workload made of the pods which have kind/name in their owner chain
+func (r *Resolver) ByOwner(namespace string, kind string, name string) (Workload, error) {
+	if kind == KIND_POD {
+		pod, err := r.client.CoreV1().Pods(namespace).Get(name, meta_v1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return NewWorkload(kind, name, namespace, []v1.Pod{*pod}), nil
+	}
+	candidates, err := base.ListAllPods(r.client, namespace, meta_v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	r.owners = map[Owner]*Owner{}
+	target := Owner{Kind: kind, Name: name}
+	pods := []v1.Pod{}
+	for _, pod := range candidates {
+		chain, err := r.OwnerChain(&pod)
+		if err != nil {
+			return nil, err
+		}
+		for _, owner := range chain {
+			if owner == target {
+				pods = append(pods, pod)
+				break
+			}
+		}
+	}
+	if len(pods) == 0 {
+		return nil, &NoPodsError{Kind: kind, Name: name, Namespace: namespace}
+	}
+	return NewWorkload(kind, name, namespace, pods), nil
+}
+
+// OwnerChain returns the controllers of the pod from the nearest to the top level one
+func (r *Resolver) OwnerChain(pod *v1.Pod) ([]Owner, error) {
+	if r.owners == nil {
+		r.owners = map[Owner]*Owner{}
+	}
+	chain := []Owner{}
+	ref := meta_v1.GetControllerOf(pod)
+	for ref != nil {
+		owner := Owner{Kind: ref.Kind, Name: ref.Name}
+		chain = append(chain, owner)
+		next, err := r.ownerOf(pod.Namespace, owner)
+		if err != nil {
+			return nil, err
+		}
+		if next == nil {
+			break
+		}
+		ref = &meta_v1.OwnerReference{Kind: next.Kind, Name: next.Name}
+	}
+	return chain, nil
+}
+
+// ownerOf returns the controller of a ReplicaSet or Job, the other kinds are top level workloads
+func (r *Resolver) ownerOf(namespace string, owner Owner) (*Owner, error) {
+	if next, ok := r.owners[owner]; ok {
+		return next, nil
+	}
+	var obj meta_v1.Object
+	var err error
+	switch owner.Kind {
+	case KIND_REPLICA_SET:
+		obj, err = r.client.AppsV1().ReplicaSets(namespace).Get(owner.Name, meta_v1.GetOptions{})
+	case KIND_JOB:
+		obj, err = r.client.BatchV1().Jobs(namespace).Get(owner.Name, meta_v1.GetOptions{})
+	default:
+		return nil, nil
+	}
+	if errors.IsNotFound(err) {
+		// the owner is being deleted, stop at it
+		r.owners[owner] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var next *Owner
+	if ref := meta_v1.GetControllerOf(obj); ref != nil {
+		next = &Owner{Kind: ref.Kind, Name: ref.Name}
+	}
+	r.owners[owner] = next
+	return next, nil
+}
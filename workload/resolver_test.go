@@ -0,0 +1,101 @@
+package workload
+
+import (
+	"testing"
+
+	apps_v1 "k8s.io/api/apps/v1"
+	batch_v1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func objectMeta(name string, ownerKind string, ownerName string) meta_v1.ObjectMeta {
+	meta := meta_v1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"app": name}}
+	if ownerKind != "" {
+		controller := true
+		meta.OwnerReferences = []meta_v1.OwnerReference{{Kind: ownerKind, Name: ownerName, Controller: &controller}}
+	}
+	return meta
+}
+
+func newPod(name string, ownerKind string, ownerName string, phase v1.PodPhase) *v1.Pod {
+	return &v1.Pod{ObjectMeta: objectMeta(name, ownerKind, ownerName), Status: v1.PodStatus{Phase: phase}}
+}
+
+func newFakeClient() *fake.Clientset {
+	objects := []runtime.Object{
+		&apps_v1.ReplicaSet{ObjectMeta: objectMeta("web-5d8f", KIND_DEPLOYMENT, "web")},
+		&batch_v1.Job{ObjectMeta: objectMeta("report-1543202894", KIND_CRON_JOB, "report")},
+		&batch_v1.Job{ObjectMeta: objectMeta("train", "", "")},
+		newPod("web-5d8f-a", KIND_REPLICA_SET, "web-5d8f", v1.PodRunning),
+		newPod("web-5d8f-b", KIND_REPLICA_SET, "web-5d8f", v1.PodPending),
+		newPod("report-1543202894-x", KIND_JOB, "report-1543202894", v1.PodSucceeded),
+		newPod("train-x", KIND_JOB, "train", v1.PodFailed),
+		newPod("mnist-worker-0", KIND_TF_JOB, "mnist", v1.PodRunning),
+		newPod("mnist-ps-0", KIND_TF_JOB, "mnist", v1.PodRunning),
+		newPod("orphan-rs-pod", KIND_REPLICA_SET, "deleted-rs", v1.PodRunning),
+		newPod("standalone", "", "", v1.PodRunning),
+	}
+	return fake.NewSimpleClientset(objects...)
+}
+
+func TestResolve(t *testing.T) {
+	resolver := NewResolver(newFakeClient())
+	for _, c := range []struct {
+		ref    string
+		pods   int
+		status string
+	}{
+		{"deployment/web", 2, STATUS_RUNNING},
+		{"rs/web-5d8f", 2, STATUS_RUNNING},
+		{"cronjob/report", 1, STATUS_SUCCEEDED},
+		{"job/report-1543202894", 1, STATUS_SUCCEEDED},
+		{"jobs/train", 1, STATUS_FAILED},
+		{"TFJob/mnist", 2, STATUS_RUNNING},
+		{"replicaset/deleted-rs", 1, STATUS_RUNNING},
+		{"pod/standalone", 1, STATUS_RUNNING},
+	} {
+		w, err := resolver.Resolve("default", c.ref)
+		if err != nil {
+			t.Errorf("failed to resolve %s, %++v", c.ref, err)
+			continue
+		}
+		if len(w.AllPods()) != c.pods || w.GetStatus() != c.status {
+			t.Errorf("%s should have %d pods with status %s, got %d pods with status %s", c.ref, c.pods, c.status, len(w.AllPods()), w.GetStatus())
+		}
+	}
+
+	if _, err := resolver.Resolve("default", "deployment/missing"); err == nil {
+		t.Errorf("missing workload should return error")
+	} else if _, ok := err.(*NoPodsError); !ok {
+		t.Errorf("missing workload should return NoPodsError, got %T", err)
+	}
+	for _, ref := range []string{"web", "secret/web", "deployment/"} {
+		if _, err := resolver.Resolve("default", ref); err == nil {
+			t.Errorf("invalid ref %s should return error", ref)
+		}
+	}
+}
+
+func TestOwnerChain(t *testing.T) {
+	resolver := NewResolver(newFakeClient())
+	chain, err := resolver.OwnerChain(newPod("web-5d8f-a", KIND_REPLICA_SET, "web-5d8f", v1.PodRunning))
+	if err != nil {
+		t.Fatalf("failed to get OwnerChain, %++v", err)
+	}
+	if len(chain) != 2 || chain[0] != (Owner{KIND_REPLICA_SET, "web-5d8f"}) || chain[1] != (Owner{KIND_DEPLOYMENT, "web"}) {
+		t.Errorf("unexpected owner chain %v", chain)
+	}
+}
+
+func TestBySelector(t *testing.T) {
+	w, err := NewResolver(newFakeClient()).BySelector("default", "app=mnist-ps-0")
+	if err != nil {
+		t.Fatalf("failed to resolve by selector, %++v", err)
+	}
+	if len(w.AllPods()) != 1 || w.AllPods()[0].Name != "mnist-ps-0" {
+		t.Errorf("unexpected pods %v", w.AllPods())
+	}
+}
@@ -0,0 +1,115 @@
+package workload
+
+import (
+	"github.com/unisound-ail/atlasctl/cmd"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	STATUS_RUNNING   = "RUNNING"
+	STATUS_PENDING   = "PENDING"
+	STATUS_SUCCEEDED = "SUCCEEDED"
+	STATUS_FAILED    = "FAILED"
+	STATUS_UNKNOWN   = "UNKNOWN"
+)
+
+// Workload is a group of pods GPU metrics can be requested for, such as a
+// Deployment, a batch Job or a Kubeflow TFJob. The method names follow
+// atlasctl's TrainingJob so training jobs can be adapted with FromTrainingJob.
+type Workload interface {
+	// Kind of the workload, such as Deployment, Job or TFJob
+	Kind() string
+
+	Name() string
+
+	Namespace() string
+
+	// Get all the pods of the workload
+	AllPods() []v1.Pod
+
+	// Get the Status of the workload: RUNNING, PENDING, SUCCEEDED, FAILED or UNKNOWN
+	GetStatus() string
+}
+
+// podsWorkload is a workload defined by its pods
+type podsWorkload struct {
+	kind      string
+	name      string
+	namespace string
+	pods      []v1.Pod
+}
+
+func NewWorkload(kind string, name string, namespace string, pods []v1.Pod) Workload {
+	return &podsWorkload{
+		kind:      kind,
+		name:      name,
+		namespace: namespace,
+		pods:      pods,
+	}
+}
+
+func (w *podsWorkload) Kind() string {
+	return w.kind
+}
+
+func (w *podsWorkload) Name() string {
+	return w.name
+}
+
+func (w *podsWorkload) Namespace() string {
+	return w.namespace
+}
+
+func (w *podsWorkload) AllPods() []v1.Pod {
+	return w.pods
+}
+
+func (w *podsWorkload) GetStatus() string {
+	return PodsStatus(w.pods)
+}
+
+// PodsStatus derives the status of a workload from its pods: RUNNING if any pod
+// is running, otherwise PENDING if any pod is pending, FAILED if any pod failed
+// and SUCCEEDED if all the pods succeeded
+func PodsStatus(pods []v1.Pod) string {
+	if len(pods) == 0 {
+		return STATUS_UNKNOWN
+	}
+	count := map[v1.PodPhase]int{}
+	for _, pod := range pods {
+		count[pod.Status.Phase]++
+	}
+	switch {
+	case count[v1.PodRunning] > 0:
+		return STATUS_RUNNING
+	case count[v1.PodPending] > 0:
+		return STATUS_PENDING
+	case count[v1.PodFailed] > 0:
+		return STATUS_FAILED
+	case count[v1.PodSucceeded] == len(pods):
+		return STATUS_SUCCEEDED
+	}
+	return STATUS_UNKNOWN
+}
+
+// trainingJobWorkload adapts an atlasctl TrainingJob
+type trainingJobWorkload struct {
+	cmd.TrainingJob
+}
+
+// FromTrainingJob adapts a TrainingJob of atlasctl to a Workload, its kind is the trainer type
+func FromTrainingJob(job cmd.TrainingJob) Workload {
+	return &trainingJobWorkload{job}
+}
+
+func (w *trainingJobWorkload) Kind() string {
+	return w.Trainer()
+}
+
+func (w *trainingJobWorkload) Namespace() string {
+	pods := w.AllPods()
+	if len(pods) == 0 {
+		return ""
+	}
+	return pods[0].Namespace
+}